@@ -1,36 +1,57 @@
 package offthegrid
 
 import (
-	"log"
+	url_package "net/url"
 	"os"
 	"strings"
 
 	"github.com/andybalholm/cascadia"
+	"github.com/sirupsen/logrus"
 	"golang.org/x/net/html"
 )
 
 // Analyzer is a helper for analyzing HTML file contents
 type Analyzer struct {
+	log *logrus.Logger
 }
 
 func NewAnalyzer() *Analyzer {
-	return &Analyzer{}
+	return NewAnalyzerWithLogger(logrus.New())
+}
+
+// NewAnalyzerWithLogger creates an Analyzer which writes to logger
+func NewAnalyzerWithLogger(logger *logrus.Logger) *Analyzer {
+	return &Analyzer{log: logger}
 }
 
 // FindFormFields looks at HTML strings to find form fields
 func (a *Analyzer) FindFormFields(htmlBody string) {
 	doc, err := html.Parse(strings.NewReader(htmlBody))
 	if err != nil {
-		log.Fatal(err)
+		a.log.WithField("error", err).Fatal("Could not parse the HTML")
 	}
 
 	forms := cascadia.MustCompile("form").MatchAll(doc)
 	err = html.Render(os.Stdout, forms[0])
 	if err != nil {
-		log.Fatal(err)
+		a.log.WithField("error", err).Fatal("Could not render the form")
 	}
 	inputs := cascadia.MustCompile("input").MatchAll(doc)
 	// scripts := cascadia.MustCompile("script").MatchAll(doc)
 	// buttons := cascadia.MustCompile("script").MatchAll(doc)
 	html.Render(os.Stdout, inputs[0])
 }
+
+// FormValues returns the fields a browser would submit for the form matching
+// formSelector, such as its hidden inputs and CSRF token, without its files
+func (a *Analyzer) FormValues(htmlBody, formSelector string) (url_package.Values, error) {
+	doc, err := html.Parse(strings.NewReader(htmlBody))
+	if err != nil {
+		return nil, err
+	}
+	form, err := findForm(doc, formSelector)
+	if err != nil {
+		return nil, err
+	}
+	return formValues(form, nil), nil
+}
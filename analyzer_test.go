@@ -1,6 +1,7 @@
 package offthegrid
 
 import (
+	"context"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -9,7 +10,7 @@ import (
 func TestFindFormFields(t *testing.T) {
 	assert := assert.New(t)
 	driver := NewWebDriver()
-	htmlBody, err := driver.GetFullPageHTML("https://google.com")
+	htmlBody, err := driver.GetFullPageHTML(context.Background(), "https://google.com")
 	assert.NoError(err)
 	analyzer := NewAnalyzer()
 	analyzer.FindFormFields(htmlBody)
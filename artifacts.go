@@ -0,0 +1,113 @@
+package offthegrid
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ArtifactMode says when the WebDriver captures a debug bundle
+type ArtifactMode int
+
+const (
+	// CaptureNever never captures a bundle
+	CaptureNever ArtifactMode = iota
+	// CaptureOnError captures a bundle whenever a browser action fails
+	CaptureOnError
+	// CaptureAlways captures a bundle after every browser action
+	CaptureAlways
+)
+
+var artifactFolder = "artifacts"
+
+// artifactCaptureTimeout bounds capturing a bundle, which happens after the
+// caller's context may already have expired
+const artifactCaptureTimeout = 30 * time.Second
+
+// maxRecentDiagnostics is how many console messages and requests a browser keeps
+const maxRecentDiagnostics = 200
+
+// ConsoleMessage is a message written to the browser's console
+type ConsoleMessage struct {
+	Time  time.Time `json:"time"`
+	Level string    `json:"level"`
+	Text  string    `json:"text"`
+	URL   string    `json:"url,omitempty"`
+}
+
+// RequestRecord is a network request made by the browser
+type RequestRecord struct {
+	Time         time.Time `json:"time"`
+	Method       string    `json:"method"`
+	URL          string    `json:"url"`
+	ResourceType string    `json:"resourceType,omitempty"`
+	Status       int64     `json:"status,omitempty"`
+	Error        string    `json:"error,omitempty"`
+}
+
+// Diagnostics holds what the browser has recently logged and requested
+type Diagnostics struct {
+	Console  []ConsoleMessage `json:"console"`
+	Requests []RequestRecord  `json:"requests"`
+}
+
+// captureArtifacts writes a debug bundle for the action into a new
+// timestamped directory under ArtifactDir, depending on the ArtifactMode
+func (wd *WebDriver) captureArtifacts(action string, actionErr error) {
+	if wd.browser == nil || wd.ArtifactMode == CaptureNever || (wd.ArtifactMode == CaptureOnError && actionErr == nil) {
+		return
+	}
+	// The action's context may have expired, which is often why it failed
+	ctx, cancel := context.WithTimeout(context.Background(), artifactCaptureTimeout)
+	defer cancel()
+	dir, err := wd.writeArtifacts(ctx, action, actionErr)
+	if err != nil {
+		wd.log.WithField("error", err).Error("Could not capture the debug bundle")
+		return
+	}
+	wd.log.WithFields(logrus.Fields{
+		"action": action,
+		"dir":    dir,
+	}).Info("Captured a debug bundle")
+}
+
+// writeArtifacts writes the bundle and returns the directory it was written to.
+// Each piece is captured independently so one failure does not lose the rest.
+func (wd *WebDriver) writeArtifacts(ctx context.Context, action string, actionErr error) (string, error) {
+	dir := filepath.Join(wd.ArtifactDir, fmt.Sprintf("%s-%s", time.Now().Format("20060102-150405.000"), action))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+	write := func(name string, contents []byte) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), contents, 0644); err != nil {
+			wd.log.WithField("error", err).Warn("Could not write part of the debug bundle")
+		}
+	}
+	if actionErr != nil {
+		write("error.txt", []byte(actionErr.Error()+"\n"))
+	}
+	if location, err := wd.browser.Location(ctx); err == nil {
+		write("url.txt", []byte(location+"\n"))
+	}
+	if pageHTML, err := wd.browser.OuterHTML(ctx, "html"); err == nil {
+		write("page.html", []byte(pageHTML))
+	}
+	if screenshot, err := wd.browser.Screenshot(ctx); err == nil && len(screenshot) > 0 {
+		write("screenshot.png", screenshot)
+	}
+	if diagnostics, err := wd.browser.Diagnostics(ctx); err == nil {
+		if consoleJSON, err := json.MarshalIndent(diagnostics.Console, "", "  "); err == nil {
+			write("console.json", consoleJSON)
+		}
+		if networkJSON, err := json.MarshalIndent(diagnostics.Requests, "", "  "); err == nil {
+			write("network.json", networkJSON)
+		}
+	}
+	return dir, nil
+}
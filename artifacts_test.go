@@ -0,0 +1,72 @@
+package offthegrid
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestArtifactsCapturedOnError(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	wd := NewWebDriverWithBrowser(NewHTMLBrowser(newFakeSearchSite()))
+	wd.ArtifactDir = t.TempDir()
+	wd.ArtifactMode = CaptureOnError
+
+	assert.NoError(wd.GoToPage(ctx, "https://search.example/"))
+	bundles, err := ioutil.ReadDir(wd.ArtifactDir)
+	assert.NoError(err)
+	assert.Empty(bundles, "a successful action should not be captured")
+
+	assert.Error(wd.ClickButton(ctx, "#missing"))
+	bundles, err = ioutil.ReadDir(wd.ArtifactDir)
+	assert.NoError(err)
+	if !assert.Len(bundles, 1) {
+		return
+	}
+	dir := filepath.Join(wd.ArtifactDir, bundles[0].Name())
+	assert.Contains(bundles[0].Name(), "-click")
+
+	errorText, err := ioutil.ReadFile(filepath.Join(dir, "error.txt"))
+	assert.NoError(err)
+	assert.Contains(string(errorText), "element not found")
+	location, err := ioutil.ReadFile(filepath.Join(dir, "url.txt"))
+	assert.NoError(err)
+	assert.Equal("https://search.example/\n", string(location))
+	pageHTML, err := ioutil.ReadFile(filepath.Join(dir, "page.html"))
+	assert.NoError(err)
+	assert.Contains(string(pageHTML), "<html>")
+
+	networkJSON, err := ioutil.ReadFile(filepath.Join(dir, "network.json"))
+	assert.NoError(err)
+	var requests []RequestRecord
+	assert.NoError(json.Unmarshal(networkJSON, &requests))
+	if assert.Len(requests, 1) {
+		assert.Equal("https://search.example/", requests[0].URL)
+		assert.Equal(int64(200), requests[0].Status)
+	}
+}
+
+func TestArtifactsCaptureModes(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	wd := NewWebDriverWithBrowser(NewHTMLBrowser(newFakeSearchSite()))
+	wd.ArtifactDir = t.TempDir()
+
+	// Nothing is captured by default
+	assert.Error(wd.ClickButton(ctx, "#missing"))
+	bundles, _ := ioutil.ReadDir(wd.ArtifactDir)
+	assert.Empty(bundles)
+
+	wd.ArtifactMode = CaptureAlways
+	assert.NoError(wd.GoToPage(ctx, "https://search.example/"))
+	bundles, _ = ioutil.ReadDir(wd.ArtifactDir)
+	if assert.Len(bundles, 1) {
+		_, err := ioutil.ReadFile(filepath.Join(wd.ArtifactDir, bundles[0].Name(), "error.txt"))
+		assert.Error(err, "a successful action has no error to record")
+	}
+}
@@ -0,0 +1,107 @@
+package offthegrid
+
+import (
+	"context"
+	"strings"
+	"time"
+)
+
+// Browser is the engine a WebDriver drives. Selectors may be CSS selectors or
+// XPath expressions (anything starting with a '/'), or pierced selectors which
+// descend into iframes and open shadow roots; see Pierce.
+type Browser interface {
+	// Navigate loads the URL in the current tab and waits for it to load
+	Navigate(ctx context.Context, url string) error
+	// Reload reloads the current page
+	Reload(ctx context.Context) error
+	// Location returns the URL of the current page
+	Location(ctx context.Context) (string, error)
+	// Nodes returns all nodes currently matching the selector without waiting
+	Nodes(ctx context.Context, selector string) ([]*Node, error)
+	// WaitReady waits until at least one node matches the selector. Backends
+	// whose documents cannot change on their own fail immediately instead.
+	WaitReady(ctx context.Context, selector string) error
+	// InnerHTML returns the inner HTML of the first node matching the selector
+	InnerHTML(ctx context.Context, selector string) (string, error)
+	// OuterHTML returns the outer HTML of the first node matching the selector
+	OuterHTML(ctx context.Context, selector string) (string, error)
+	// Click clicks the first node matching the selector
+	Click(ctx context.Context, selector string) error
+	// SendKeys types the value into the first node matching the selector
+	SendKeys(ctx context.Context, selector, value string) error
+	// WaitVisible waits until the first node matching the selector is visible
+	WaitVisible(ctx context.Context, selector string) error
+	// ScrollIntoView scrolls the window until the first node matching the
+	// selector is in view
+	ScrollIntoView(ctx context.Context, selector string) error
+	// WaitNetworkIdle waits until no requests have been in flight for the
+	// quiet period
+	WaitNetworkIdle(ctx context.Context, quiet time.Duration) error
+	// ExportSession captures the browser's cookies and the web storage of
+	// the current page
+	ExportSession(ctx context.Context) (*SessionState, error)
+	// ImportSession loads cookies into the browser and restores web storage
+	// by loading the page it was captured from
+	ImportSession(ctx context.Context, state *SessionState) error
+	// UserAgent returns the User-Agent header the browser sends
+	UserAgent(ctx context.Context) (string, error)
+	// SetRequestPolicy applies the policy to every request made from now on.
+	// A nil policy allows everything.
+	SetRequestPolicy(ctx context.Context, policy *RequestPolicy) error
+	// Screenshot captures the whole page as a PNG. Backends which do not
+	// render return no image and no error.
+	Screenshot(ctx context.Context) ([]byte, error)
+	// Diagnostics returns the recent console messages and network requests
+	Diagnostics(ctx context.Context) (*Diagnostics, error)
+	// Close releases every resource held by the browser
+	Close() error
+}
+
+// Node is a backend-independent snapshot of an element matched by a Browser.
+type Node struct {
+	// NodeName is the lower case tag name, such as "div"
+	NodeName string
+	// XPath is the absolute XPath of the node, which can be passed back
+	// to the Browser as a selector. Nodes inside an iframe or a shadow root
+	// have a pierced XPath, such as "/html[1]/body[1]/iframe[1] >>> /html[1]/body[1]/button[1]".
+	XPath string
+	// Attributes holds the attributes of the node when it was queried
+	Attributes map[string]string
+}
+
+// AttributeValue returns the named attribute, or an empty string if the node
+// does not have that attribute.
+func (n *Node) AttributeValue(name string) string {
+	return n.Attributes[name]
+}
+
+// isXPath reports whether a selector should be evaluated as XPath rather than CSS
+func isXPath(selector string) bool {
+	return strings.HasPrefix(selector, "/")
+}
+
+// PierceSeparator separates the parts of a pierced selector
+const PierceSeparator = " >>> "
+
+// Pierce joins selectors into a pierced selector. Each part is evaluated
+// inside the iframe document or open shadow root of the elements matched by
+// the part before it, so Pierce("iframe#consent", "button.accept") finds the
+// accept button within the consent iframe. Parts may be CSS or XPath; an
+// XPath inside a shadow root starts at the root, such as /div[1]/button[1].
+func Pierce(parts ...string) string {
+	return strings.Join(parts, PierceSeparator)
+}
+
+// pierceParts splits a pierced selector into its parts
+func pierceParts(selector string) []string {
+	parts := strings.Split(selector, strings.TrimSpace(PierceSeparator))
+	for i := range parts {
+		parts[i] = strings.TrimSpace(parts[i])
+	}
+	return parts
+}
+
+// isPierced reports whether a selector descends into iframes or shadow roots
+func isPierced(selector string) bool {
+	return strings.Contains(selector, strings.TrimSpace(PierceSeparator))
+}
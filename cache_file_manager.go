@@ -3,49 +3,203 @@ package offthegrid
 
 import (
 	"crypto/md5"
+	"crypto/sha256"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
 	url_package "net/url"
 	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
 
 type CacheFileManager struct {
 	log *logrus.Logger
+	// indexLock serialises updates to the index of cached pages
+	indexLock sync.Mutex
+	// downloadsLock serialises updates to the index of downloads
+	downloadsLock sync.Mutex
 	// TODO: Cache disk checksums in memory?
 	// cacheLock *sync.RWMutex
 	// diskShaMap map[string]string
 }
 
 func NewCacheFileManager() *CacheFileManager {
+	return NewCacheFileManagerWithLogger(logrus.New())
+}
+
+// NewCacheFileManagerWithLogger creates a CacheFileManager which writes to
+// logger. Pages cached under the old one-file-per-host scheme are migrated.
+func NewCacheFileManagerWithLogger(logger *logrus.Logger) *CacheFileManager {
 	// Try to make the cache directory - ignore any errors
 	os.Mkdir(scrapeCacheFolder, 0755)
-	return &CacheFileManager{
-		log: logrus.New(),
+	cfm := &CacheFileManager{
+		log: logger,
 	}
+	cfm.migrateHostFiles()
+	return cfm
 }
 
 var scrapeCacheFolder = "scraped_pages"
 
-// GetCachedFilePath converts a URL to a relative file path
-func GetCachedFilePath(url string) string {
+// cacheIndexFile maps the names of the cached pages' files back to their URLs
+const cacheIndexFile = "index.json"
+
+// maxCacheHostLength keeps the host part of a file name well inside the
+// limits of every filesystem
+const maxCacheHostLength = 100
+
+// CacheEntry describes a page in the cache
+type CacheEntry struct {
+	// Key is the normalised URL the page is cached under
+	Key string `json:"key"`
+	// URL is the URL the page was last cached from
+	URL    string    `json:"url"`
+	Cached time.Time `json:"cached"`
+}
+
+// CacheKey normalises a URL so that every way of writing the same page has
+// the same key. The scheme and host are lower cased, and default ports, the
+// order of query parameters, repeated and trailing slashes and the fragment
+// make no difference. A URL which cannot be parsed is its own key.
+func CacheKey(url string) string {
 	parsedURL, err := url_package.Parse(url)
-	if err != nil {
-		// If we weren't able to parse the URL, then just
-		// use the URL as it is
-		return fmt.Sprintf("%s/%s", scrapeCacheFolder, url)
+	if err != nil || parsedURL.Host == "" {
+		return url
+	}
+	scheme := strings.ToLower(parsedURL.Scheme)
+	host := strings.ToLower(parsedURL.Host)
+	if (scheme == "http" && strings.HasSuffix(host, ":80")) || (scheme == "https" && strings.HasSuffix(host, ":443")) {
+		host = host[:strings.LastIndex(host, ":")]
+	}
+	key := &url_package.URL{
+		Scheme:   scheme,
+		Host:     host,
+		Path:     path.Clean("/" + parsedURL.Path),
+		RawQuery: parsedURL.Query().Encode(),
+	}
+	return key.String()
+}
+
+// GetCachedFilePath converts a URL to a relative file path. The file is
+// named after the URL's host and a hash of its CacheKey, so that every page
+// gets its own file however long its URL or whatever characters it holds.
+func GetCachedFilePath(url string) string {
+	host := "page"
+	if parsedURL, err := url_package.Parse(url); err == nil && parsedURL.Host != "" {
+		host = strings.Map(func(r rune) rune {
+			if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '.' || r == '-' {
+				return r
+			}
+			return '_'
+		}, strings.ToLower(parsedURL.Host))
+	}
+	if len(host) > maxCacheHostLength {
+		host = host[:maxCacheHostLength]
 	}
-	// Otherwise use the hostname as the file path
-	return fmt.Sprintf("%s/%s", scrapeCacheFolder, parsedURL.Host)
+	sum := sha256.Sum256([]byte(CacheKey(url)))
+	return filepath.Join(scrapeCacheFolder, fmt.Sprintf("%s-%s.html", host, hex.EncodeToString(sum[:16])))
 }
 
-// CachePageLocally caches a page's content into a local file
+// CachePageLocally caches a page's content into a local file and records
+// the page in the cache's index
 func (cfm *CacheFileManager) CachePageLocally(pageHTML, url string) error {
-	err := ioutil.WriteFile(GetCachedFilePath(url), []byte(pageHTML), 0644)
-	return err
+	if err := os.MkdirAll(scrapeCacheFolder, 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(GetCachedFilePath(url), []byte(pageHTML), 0644); err != nil {
+		return err
+	}
+	return cfm.indexPage(url, time.Now())
+}
+
+// Entries returns the index of cached pages by the names of their files
+func (cfm *CacheFileManager) Entries() (map[string]*CacheEntry, error) {
+	cfm.indexLock.Lock()
+	defer cfm.indexLock.Unlock()
+	return cfm.readIndex()
+}
+
+// indexPage records that the page at url was cached at the given time
+func (cfm *CacheFileManager) indexPage(url string, cached time.Time) error {
+	cfm.indexLock.Lock()
+	defer cfm.indexLock.Unlock()
+	entries, err := cfm.readIndex()
+	if err != nil {
+		return err
+	}
+	entries[filepath.Base(GetCachedFilePath(url))] = &CacheEntry{
+		Key:    CacheKey(url),
+		URL:    url,
+		Cached: cached,
+	}
+	indexJSON, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(scrapeCacheFolder, cacheIndexFile), indexJSON, 0644)
+}
+
+// readIndex reads the index of cached pages. indexLock must be held.
+func (cfm *CacheFileManager) readIndex() (map[string]*CacheEntry, error) {
+	entries := map[string]*CacheEntry{}
+	indexJSON, err := ioutil.ReadFile(filepath.Join(scrapeCacheFolder, cacheIndexFile))
+	if os.IsNotExist(err) {
+		return entries, nil
+	}
+	if err != nil {
+		cfm.log.WithField("error", err).Error("Could not read the index of cached pages")
+		return nil, err
+	}
+	if err = json.Unmarshal(indexJSON, &entries); err != nil {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// migrateHostFiles moves pages cached under the old scheme, which kept one
+// file per host named after the host, to the file of the host's front page.
+// The old scheme did not record which page on the host a file held, so the
+// first comparison after migrating may report a change.
+func (cfm *CacheFileManager) migrateHostFiles() {
+	files, err := ioutil.ReadDir(scrapeCacheFolder)
+	if err != nil {
+		return
+	}
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || strings.HasPrefix(name, ".") || filepath.Ext(name) == ".html" || filepath.Ext(name) == ".json" {
+			continue
+		}
+		if parsedURL, err := url_package.Parse("https://" + name); err != nil || parsedURL.Host != name {
+			continue
+		}
+		url := "https://" + name + "/"
+		oldPath, newPath := filepath.Join(scrapeCacheFolder, name), GetCachedFilePath(url)
+		if _, err := os.Stat(newPath); err == nil {
+			cfm.log.WithField("file", oldPath).Warn("Left an old cache file alone as its page has been cached since")
+			continue
+		}
+		if err := os.Rename(oldPath, newPath); err != nil {
+			cfm.log.WithField("error", err).Error("Could not migrate an old cache file")
+			continue
+		}
+		if err := cfm.indexPage(url, file.ModTime()); err != nil {
+			cfm.log.WithField("error", err).Error("Could not index a migrated cache file")
+			continue
+		}
+		cfm.log.WithFields(logrus.Fields{
+			"file": newPath,
+			"url":  url,
+		}).Info("Migrated a page cached under the old scheme")
+	}
 }
 
 // FetchLocalCachedPage returns the HTML content of a local page.
@@ -113,3 +267,60 @@ func (cfm *CacheFileManager) GetCachedFileSha(url string) string {
 func (cfm *CacheFileManager) PageHasChanged(fileContents, url string) bool {
 	return cfm.GetCachedFileSha(url) != cfm.GetShaFromString(fileContents)
 }
+
+// ExtractCachedPage fills out from the cached copy of a page, as ExtractHTML does
+func (cfm *CacheFileManager) ExtractCachedPage(url, rootSelector string, out interface{}) error {
+	page, err := cfm.FetchLocalCachedPage(url)
+	if err != nil {
+		return err
+	}
+	if page == "" {
+		return fmt.Errorf("%s has not been cached", url)
+	}
+	return ExtractHTML(page, rootSelector, out)
+}
+
+// downloadIndexFile lists the downloads registered with the cache
+const downloadIndexFile = "downloads.json"
+
+// RegisterDownload adds a downloaded file to the cache's index of downloads
+func (cfm *CacheFileManager) RegisterDownload(download *Download) error {
+	cfm.downloadsLock.Lock()
+	defer cfm.downloadsLock.Unlock()
+	downloads, err := cfm.readDownloads()
+	if err != nil {
+		return err
+	}
+	indexJSON, err := json.MarshalIndent(append(downloads, download), "", "  ")
+	if err != nil {
+		return err
+	}
+	if err = os.MkdirAll(scrapeCacheFolder, 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(scrapeCacheFolder, downloadIndexFile), indexJSON, 0644)
+}
+
+// Downloads returns every download registered with the cache, oldest first
+func (cfm *CacheFileManager) Downloads() ([]*Download, error) {
+	cfm.downloadsLock.Lock()
+	defer cfm.downloadsLock.Unlock()
+	return cfm.readDownloads()
+}
+
+// readDownloads reads the index of downloads. downloadsLock must be held.
+func (cfm *CacheFileManager) readDownloads() ([]*Download, error) {
+	indexJSON, err := ioutil.ReadFile(filepath.Join(scrapeCacheFolder, downloadIndexFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		cfm.log.WithField("error", err).Error("Could not read the index of downloads")
+		return nil, err
+	}
+	var downloads []*Download
+	if err = json.Unmarshal(indexJSON, &downloads); err != nil {
+		return nil, err
+	}
+	return downloads, nil
+}
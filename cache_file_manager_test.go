@@ -1,7 +1,12 @@
 package offthegrid
 
 import (
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
 
 	"github.com/sirupsen/logrus"
@@ -75,3 +80,84 @@ func TestPageHasChanged(t *testing.T) {
 	assert.False(cfm.PageHasChanged("Some Fake Content", "https://some.fake.url"))
 	assert.True(cfm.PageHasChanged("This content shouldn't match", "https://some.fake.url"))
 }
+
+func TestCacheKey(t *testing.T) {
+	assert := assert.New(t)
+	for url, key := range map[string]string{
+		"https://www.kingsoopers.com/cl/coupons":           "https://www.kingsoopers.com/cl/coupons",
+		"HTTPS://WWW.KingSoopers.com:443//cl/coupons/#top": "https://www.kingsoopers.com/cl/coupons",
+		"http://example.com:80":                            "http://example.com/",
+		"https://example.com/search?q=b&a=1":               "https://example.com/search?a=1&q=b",
+		"not a url":                                        "not a url",
+	} {
+		assert.Equal(key, CacheKey(url), url)
+	}
+}
+
+func TestCachePagesPerURL(t *testing.T) {
+	defer cleanupTestCache()
+	assert := assert.New(t)
+	cfm := NewCacheFileManager()
+	coupons, myCoupons := "https://www.kingsoopers.com/cl/coupons", "https://www.kingsoopers.com/cl/mycoupons/"
+	assert.NotEqual(GetCachedFilePath(coupons), GetCachedFilePath(myCoupons))
+	assert.Equal(GetCachedFilePath(coupons), GetCachedFilePath(coupons+"/"))
+	assert.NoError(cfm.CachePageLocally("All coupons", coupons))
+	assert.NoError(cfm.CachePageLocally("My coupons", myCoupons))
+	assert.False(cfm.PageHasChanged("All coupons", coupons))
+	assert.False(cfm.PageHasChanged("My coupons", myCoupons))
+
+	// Long URLs and unsafe characters still make a short, plain file name
+	long := "https://broker.example:8443/search?name=" + strings.Repeat("a/../\\:*?", 500)
+	assert.NoError(cfm.CachePageLocally("Results", long))
+	content, err := cfm.FetchLocalCachedPage(long)
+	assert.NoError(err)
+	assert.Equal("Results", content)
+	name := filepath.Base(GetCachedFilePath(long))
+	assert.Less(len(name), 255)
+	assert.True(strings.HasPrefix(name, "broker.example_8443-"), name)
+
+	entries, err := cfm.Entries()
+	assert.NoError(err)
+	assert.Len(entries, 3)
+	if entry := entries[filepath.Base(GetCachedFilePath(myCoupons))]; assert.NotNil(entry) {
+		assert.Equal(myCoupons, entry.URL)
+		assert.Equal("https://www.kingsoopers.com/cl/mycoupons", entry.Key)
+	}
+}
+
+func TestMigrateHostCacheFiles(t *testing.T) {
+	defer cleanupTestCache()
+	assert := assert.New(t)
+	assert.NoError(os.MkdirAll(scrapeCacheFolder, 0755))
+	legacy := filepath.Join(scrapeCacheFolder, "www.kingsoopers.com")
+	assert.NoError(ioutil.WriteFile(legacy, []byte("Old coupons"), 0644))
+	assert.NoError(ioutil.WriteFile(filepath.Join(scrapeCacheFolder, ".gitkeep"), nil, 0644))
+
+	cfm := NewCacheFileManager()
+	assert.NoFileExists(legacy)
+	content, err := cfm.FetchLocalCachedPage("https://www.kingsoopers.com/")
+	assert.NoError(err)
+	assert.Equal("Old coupons", content)
+	entries, err := cfm.Entries()
+	assert.NoError(err)
+	assert.Len(entries, 1)
+	assert.FileExists(filepath.Join(scrapeCacheFolder, ".gitkeep"))
+}
+
+func TestRegisterDownloadConcurrently(t *testing.T) {
+	defer cleanupTestCache()
+	assert := assert.New(t)
+	cfm := NewCacheFileManager()
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assert.NoError(cfm.RegisterDownload(&Download{URL: fmt.Sprintf("https://broker.example/files/%d", i)}))
+		}(i)
+	}
+	wg.Wait()
+	downloads, err := cfm.Downloads()
+	assert.NoError(err)
+	assert.Len(downloads, 20)
+}
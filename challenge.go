@@ -0,0 +1,305 @@
+package offthegrid
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/html"
+)
+
+// The kinds of challenge the default signatures recognise
+const (
+	ChallengeRecaptcha    = "recaptcha"
+	ChallengeHCaptcha     = "hcaptcha"
+	ChallengeInterstitial = "interstitial"
+	ChallengeVerifyHuman  = "verify-human"
+)
+
+// DefaultSolveTimeout is how long a person has to solve a challenge
+const DefaultSolveTimeout = 10 * time.Minute
+
+// defaultSolvePollInterval is how often the page is checked while waiting
+const defaultSolvePollInterval = 2 * time.Second
+
+// ChallengeSignature recognises a kind of captcha or bot check. A page
+// shows the challenge if the selector matches or its visible text contains
+// the text, ignoring case.
+type ChallengeSignature struct {
+	Kind     string
+	Selector string
+	Text     string
+}
+
+// Challenge is a captcha or bot check found on a page
+type Challenge struct {
+	Kind string
+	URL  string
+	// Matched is the selector or text which gave the challenge away
+	Matched string
+}
+
+// DefaultChallengeSignatures recognises reCAPTCHA and hCaptcha widgets, the
+// interstitial pages of the common bot protection services and pages asking
+// the visitor to prove they are human. Invisible captchas, which many
+// ordinary pages carry, are not counted.
+func DefaultChallengeSignatures() []ChallengeSignature {
+	return []ChallengeSignature{
+		{Kind: ChallengeRecaptcha, Selector: `.g-recaptcha:not([data-size="invisible"])`},
+		{Kind: ChallengeRecaptcha, Selector: `iframe[src*="/recaptcha/"][src*="/anchor"]:not([src*="size=invisible"])`},
+		{Kind: ChallengeHCaptcha, Selector: `.h-captcha:not([data-size="invisible"])`},
+		{Kind: ChallengeHCaptcha, Selector: `iframe[src*="hcaptcha.com"][src*="frame=checkbox"]`},
+		// Cloudflare, PerimeterX and DataDome
+		{Kind: ChallengeInterstitial, Selector: `#challenge-form, #challenge-stage, #cf-challenge-running, iframe[src*="challenges.cloudflare.com"]`},
+		{Kind: ChallengeInterstitial, Selector: `#px-captcha, iframe[src*="captcha-delivery.com"]`},
+		{Kind: ChallengeInterstitial, Text: "checking your browser before accessing"},
+		{Kind: ChallengeVerifyHuman, Text: "verify you are human"},
+		{Kind: ChallengeVerifyHuman, Text: "verify you are a human"},
+		{Kind: ChallengeVerifyHuman, Text: "are you a robot"},
+		{Kind: ChallengeVerifyHuman, Text: "press & hold"},
+	}
+}
+
+// ChallengeNotifier lets a person know that a challenge needs solving
+type ChallengeNotifier interface {
+	NotifyChallenge(ctx context.Context, challenge *Challenge) error
+}
+
+// ChallengePolicy says how the web driver deals with challenges found after
+// a navigation
+type ChallengePolicy struct {
+	// Signatures are the challenges to look for. DefaultChallengeSignatures
+	// is used when it is nil.
+	Signatures []ChallengeSignature
+	// Notifier is told about each challenge. Challenges are only logged
+	// when it is nil.
+	Notifier ChallengeNotifier
+	// SolveTimeout bounds the wait for a person to solve the challenge.
+	// DefaultSolveTimeout is used when it is zero.
+	SolveTimeout time.Duration
+	// PollInterval is how often the page is checked while waiting
+	PollInterval time.Duration
+}
+
+// DefaultChallengePolicy looks for the default signatures and rings the
+// terminal's bell when one is found
+func DefaultChallengePolicy() *ChallengePolicy {
+	return &ChallengePolicy{Notifier: TerminalNotifier{}}
+}
+
+// DetectChallenge checks the current page for the policy's signatures, or
+// the default ones if there is no policy. It returns nil if there is no
+// challenge.
+func (wd *WebDriver) DetectChallenge(ctx context.Context) (*Challenge, error) {
+	var location, pageHTML string
+	err := wd.probe(ctx, func(ctx context.Context, browser Browser) (err error) {
+		if location, err = browser.Location(ctx); err != nil {
+			return err
+		}
+		pageHTML, err = browser.OuterHTML(ctx, "html")
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var signatures []ChallengeSignature
+	if wd.ChallengePolicy != nil {
+		signatures = wd.ChallengePolicy.Signatures
+	}
+	challenge, err := DetectChallengeHTML(pageHTML, signatures)
+	if challenge != nil {
+		challenge.URL = location
+	}
+	return challenge, err
+}
+
+// DetectChallengeHTML checks a page for the signatures. Nil signatures
+// means DefaultChallengeSignatures.
+func DetectChallengeHTML(pageHTML string, signatures []ChallengeSignature) (*Challenge, error) {
+	if signatures == nil {
+		signatures = DefaultChallengeSignatures()
+	}
+	doc, err := html.Parse(strings.NewReader(pageHTML))
+	if err != nil {
+		return nil, err
+	}
+	text := strings.ToLower(strings.Join(strings.Fields(visibleText(doc)), " "))
+	for _, signature := range signatures {
+		if signature.Selector != "" {
+			nodes, err := selectNodes(doc, signature.Selector)
+			if err != nil {
+				return nil, fmt.Errorf("the %s signature is not a valid selector: %w", signature.Kind, err)
+			}
+			if len(nodes) > 0 {
+				return &Challenge{Kind: signature.Kind, Matched: signature.Selector}, nil
+			}
+		}
+		if signature.Text != "" && strings.Contains(text, strings.ToLower(signature.Text)) {
+			return &Challenge{Kind: signature.Kind, Matched: signature.Text}, nil
+		}
+	}
+	return nil, nil
+}
+
+// visibleText returns the text a visitor could read, leaving out scripts,
+// styles and templates
+func visibleText(node *html.Node) string {
+	var sb strings.Builder
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		switch {
+		case n.Type == html.TextNode:
+			sb.WriteString(n.Data)
+			sb.WriteString(" ")
+		case n.Type == html.ElementNode && (n.Data == "script" || n.Data == "style" || n.Data == "noscript" || n.Data == "template"):
+			return
+		}
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+	}
+	walk(node)
+	return sb.String()
+}
+
+// handleChallenge pauses the run while a challenge on the current page is
+// solved. The person solving it is notified, and a headless browser is
+// relaunched with a window, carrying the session over, so that they can see
+// the page. The run carries on in that window once the challenge is gone.
+func (wd *WebDriver) handleChallenge(ctx context.Context) error {
+	policy := wd.ChallengePolicy
+	if policy == nil {
+		return nil
+	}
+	challenge, err := wd.DetectChallenge(ctx)
+	if err != nil || challenge == nil {
+		// A page which cannot be read is left to the next action to report
+		return nil
+	}
+	wd.log.WithFields(logrus.Fields{
+		"kind":    challenge.Kind,
+		"url":     challenge.URL,
+		"matched": challenge.Matched,
+	}).Warn("The page is showing a challenge which needs a person to solve it")
+	if policy.Notifier != nil {
+		if err = policy.Notifier.NotifyChallenge(ctx, challenge); err != nil {
+			wd.log.WithField("error", err).Error("Could not send the challenge notification")
+		}
+	}
+	if wd.headless {
+		if err = wd.relaunchWithWindow(ctx, challenge.URL); err != nil {
+			wd.log.WithField("error", err).Error("Could not relaunch the browser with a window")
+			return actionError(ErrChallengeUnsolved, "solve", challenge.URL, err)
+		}
+	}
+	return actionError(ErrChallengeUnsolved, "solve", challenge.URL, wd.waitForSolve(ctx, policy))
+}
+
+// waitForSolve polls until the page no longer shows a challenge
+func (wd *WebDriver) waitForSolve(ctx context.Context, policy *ChallengePolicy) error {
+	timeout, interval := policy.SolveTimeout, policy.PollInterval
+	if timeout <= 0 {
+		timeout = DefaultSolveTimeout
+	}
+	if interval <= 0 {
+		interval = defaultSolvePollInterval
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		challenge, err := wd.DetectChallenge(ctx)
+		if err == nil && challenge == nil {
+			wd.log.Info("The challenge was solved")
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("the challenge was not solved within %s", timeout)
+		case <-ticker.C:
+		}
+	}
+}
+
+// relaunchWithWindow replaces the headless browser with one which has a
+// window, carrying its cookies, request policy and emulated device over, and
+// opens the page in it. The headless browser is only closed once the window
+// shows the page, so if anything goes wrong the run keeps it.
+func (wd *WebDriver) relaunchWithWindow(ctx context.Context, url string) error {
+	var state *SessionState
+	err := wd.probe(ctx, func(ctx context.Context, browser Browser) (err error) {
+		state, err = browser.ExportSession(ctx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	headful, err := wd.startBrowser(false)
+	if err != nil {
+		return err
+	}
+	opCtx, cancel := wd.operationContext(ctx)
+	defer cancel()
+	err = headful.ImportSession(opCtx, state)
+	if err == nil && wd.policy != nil {
+		err = headful.SetRequestPolicy(opCtx, wd.policy)
+	}
+	if emulator, ok := headful.(Emulator); ok && err == nil && wd.device != nil {
+		err = emulator.Emulate(opCtx, wd.device)
+	}
+	if err == nil {
+		err = headful.Navigate(opCtx, url)
+	}
+	if err != nil {
+		headful.Close()
+		return err
+	}
+	if closeErr := wd.browser.Close(); closeErr != nil {
+		wd.log.WithField("error", closeErr).Error("Could not close the headless browser")
+	}
+	wd.browser, wd.headless = headful, false
+	return nil
+}
+
+// TerminalNotifier rings the terminal's bell and describes the challenge
+type TerminalNotifier struct {
+	// Out defaults to os.Stderr
+	Out io.Writer
+}
+
+// NotifyChallenge writes the notification
+func (tn TerminalNotifier) NotifyChallenge(ctx context.Context, challenge *Challenge) error {
+	out := tn.Out
+	if out == nil {
+		out = os.Stderr
+	}
+	_, err := fmt.Fprintf(out, "\a%s is showing a %s challenge. Solve it in the browser window and the run will carry on.\n", challenge.URL, challenge.Kind)
+	return err
+}
+
+// DesktopNotifier raises a desktop notification with notify-send on Linux
+// or osascript on macOS
+type DesktopNotifier struct{}
+
+// NotifyChallenge raises the notification
+func (DesktopNotifier) NotifyChallenge(ctx context.Context, challenge *Challenge) error {
+	title := "OffTheGrid needs a human"
+	message := fmt.Sprintf("%s is showing a %s challenge", challenge.URL, challenge.Kind)
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "linux":
+		cmd = exec.CommandContext(ctx, "notify-send", title, message)
+	case "darwin":
+		cmd = exec.CommandContext(ctx, "osascript", "-e", fmt.Sprintf("display notification %q with title %q", message, title))
+	default:
+		return fmt.Errorf("desktop notifications are not supported on %s", runtime.GOOS)
+	}
+	return cmd.Run()
+}
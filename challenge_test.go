@@ -0,0 +1,188 @@
+package offthegrid
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newFakeChallengeSite shows an hCaptcha on /search until solve is called.
+// The visitor's cookie has to survive solving it.
+func newFakeChallengeSite() (site http.Handler, solve func()) {
+	solved := false
+	mux := http.NewServeMux()
+	mux.HandleFunc("/search", func(w http.ResponseWriter, r *http.Request) {
+		if _, err := r.Cookie("visitor"); err != nil {
+			http.SetCookie(w, &http.Cookie{Name: "visitor", Value: "42"})
+		}
+		if !solved {
+			fmt.Fprint(w, `<html><body><form><div class="h-captcha" data-sitekey="abc"></div></form></body></html>`)
+			return
+		}
+		visitor, _ := r.Cookie("visitor")
+		fmt.Fprintf(w, `<html><body><p id="results">Results for visitor %s</p></body></html>`, visitor.Value)
+	})
+	return mux, func() { solved = true }
+}
+
+// solvingNotifier solves the challenge as soon as it is told about it. If
+// it has a page, it reloads it afterwards as a solved challenge would.
+type solvingNotifier struct {
+	solve      func()
+	page       Browser
+	challenges []*Challenge
+}
+
+func (sn *solvingNotifier) NotifyChallenge(ctx context.Context, challenge *Challenge) error {
+	sn.challenges = append(sn.challenges, challenge)
+	if sn.solve != nil {
+		sn.solve()
+	}
+	if sn.page != nil {
+		return sn.page.Reload(ctx)
+	}
+	return nil
+}
+
+func TestDetectChallengeHTML(t *testing.T) {
+	assert := assert.New(t)
+	for page, kind := range map[string]string{
+		`<div class="g-recaptcha" data-sitekey="abc"></div>`:                                                        ChallengeRecaptcha,
+		`<iframe src="https://www.google.com/recaptcha/api2/anchor?k=abc&size=normal"></iframe>`:                    ChallengeRecaptcha,
+		`<iframe src="https://newassets.hcaptcha.com/captcha/v1/abc/static/hcaptcha.html#frame=checkbox"></iframe>`: ChallengeHCaptcha,
+		`<div id="challenge-stage"></div>`:                                                                          ChallengeInterstitial,
+		`<h1>Checking your browser before accessing example.com</h1>`:                                               ChallengeInterstitial,
+		`<p>Please   VERIFY you are
+		human to continue</p>`: ChallengeVerifyHuman,
+	} {
+		challenge, err := DetectChallengeHTML("<html><body>"+page+"</body></html>", nil)
+		assert.NoError(err)
+		if assert.NotNil(challenge, page) {
+			assert.Equal(kind, challenge.Kind, page)
+		}
+	}
+
+	// Invisible captchas and text which nobody can see are not challenges
+	for _, page := range []string{
+		`<div class="g-recaptcha" data-size="invisible"></div>`,
+		`<iframe src="https://www.google.com/recaptcha/api2/anchor?k=abc&size=invisible"></iframe>`,
+		`<script>var message = "Verify you are human";</script><p>Welcome back</p>`,
+	} {
+		challenge, err := DetectChallengeHTML("<html><body>"+page+"</body></html>", nil)
+		assert.NoError(err)
+		assert.Nil(challenge, page)
+	}
+
+	_, err := DetectChallengeHTML("<html></html>", []ChallengeSignature{{Kind: "bad", Selector: "[["}})
+	assert.Error(err)
+}
+
+func TestChallengeHandoff(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	site, solve := newFakeChallengeSite()
+	notifier := &solvingNotifier{solve: solve}
+	headless := &closeTracker{HTMLBrowser: NewHTMLBrowser(site)}
+	wd := NewWebDriverWithBrowser(headless)
+	wd.headless = true
+	policy := &RequestPolicy{SetHeaders: map[string]string{"DNT": "1"}}
+	assert.NoError(wd.SetRequestPolicy(ctx, policy))
+	assert.NoError(wd.Emulate(ctx, PhoneDevice()))
+	var launched []bool
+	var headful *HTMLBrowser
+	wd.launch = func(headless bool) (Browser, error) {
+		launched = append(launched, headless)
+		headful = NewHTMLBrowser(site)
+		return headful, nil
+	}
+	// The headless browser is only closed once the window shows the page
+	closedAfter := false
+	headless.onClose = func() { closedAfter = headful != nil && headful.CurrentURL() != "" }
+	wd.ChallengePolicy = &ChallengePolicy{Notifier: notifier, PollInterval: time.Millisecond}
+
+	assert.NoError(wd.GoToPage(ctx, "https://people.example/search"))
+	if assert.Len(notifier.challenges, 1) {
+		assert.Equal(ChallengeHCaptcha, notifier.challenges[0].Kind)
+		assert.Equal("https://people.example/search", notifier.challenges[0].URL)
+	}
+	// The run carries on in a window, with the session, request policy and
+	// device it had
+	assert.Equal([]bool{false}, launched)
+	assert.True(closedAfter)
+	assert.False(wd.headless)
+	if assert.NotNil(headful) {
+		assert.Same(policy, headful.policy)
+		assert.Equal(PhoneDevice(), headful.device)
+	}
+	results, err := wd.GetInnerHTMLOfElement(ctx, "#results")
+	assert.NoError(err)
+	assert.Equal("Results for visitor 42", results)
+
+	// Pages without a challenge are left alone
+	assert.NoError(wd.ReloadPage(ctx))
+	assert.Len(notifier.challenges, 1)
+}
+
+func TestChallengeRelaunchFails(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	site, solve := newFakeChallengeSite()
+	headless := NewHTMLBrowser(site)
+	wd := NewWebDriverWithBrowser(headless)
+	wd.headless = true
+	wd.launch = func(headless bool) (Browser, error) {
+		return nil, fmt.Errorf("no display")
+	}
+	wd.ChallengePolicy = &ChallengePolicy{Notifier: &solvingNotifier{solve: solve}, PollInterval: time.Millisecond}
+
+	// A window which cannot be opened leaves the run in the headless browser
+	err := wd.GoToPage(ctx, "https://people.example/search")
+	assert.ErrorIs(err, ErrChallengeUnsolved)
+	assert.Same(headless, wd.browser)
+	assert.True(wd.headless)
+	assert.NoError(wd.ReloadPage(ctx))
+	results, err := wd.GetInnerHTMLOfElement(ctx, "#results")
+	assert.NoError(err)
+	assert.Equal("Results for visitor 42", results)
+}
+
+// closeTracker is an HTMLBrowser which reports being closed
+type closeTracker struct {
+	*HTMLBrowser
+	onClose func()
+}
+
+func (ct *closeTracker) Close() error {
+	if ct.onClose != nil {
+		ct.onClose()
+	}
+	return ct.HTMLBrowser.Close()
+}
+
+func TestChallengeUnsolved(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	site, _ := newFakeChallengeSite()
+	var notified bytes.Buffer
+	wd := NewWebDriverWithBrowser(NewHTMLBrowser(site))
+	wd.ChallengePolicy = &ChallengePolicy{
+		Notifier:     TerminalNotifier{Out: &notified},
+		SolveTimeout: 20 * time.Millisecond,
+		PollInterval: time.Millisecond,
+	}
+	err := wd.GoToPage(ctx, "https://people.example/search")
+	assert.ErrorIs(err, ErrChallengeUnsolved)
+	assert.Contains(notified.String(), "hcaptcha challenge")
+
+	// Without a policy the page is not checked
+	wd.ChallengePolicy = nil
+	assert.NoError(wd.GoToPage(ctx, "https://people.example/search"))
+	challenge, err := wd.DetectChallenge(ctx)
+	assert.NoError(err)
+	assert.NotNil(challenge)
+}
@@ -0,0 +1,1144 @@
+package offthegrid
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	url_package "net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chromedp/cdproto/browser"
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/emulation"
+	"github.com/chromedp/cdproto/fetch"
+	cdplog "github.com/chromedp/cdproto/log"
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/cdproto/page"
+	"github.com/chromedp/cdproto/runtime"
+	"github.com/chromedp/cdproto/storage"
+	"github.com/chromedp/cdproto/target"
+	"github.com/chromedp/chromedp"
+	"github.com/sirupsen/logrus"
+)
+
+// ChromeBrowser is a Browser backed by a Chrome process driven through chromedp
+type ChromeBrowser struct {
+	chromeDpContext context.Context
+	// cancelTab detaches from the tab and closes it. It is only used for
+	// remote browsers; see Close.
+	cancelTab       context.CancelFunc
+	cancelAllocator context.CancelFunc
+	// remote is set when the browser is a Chrome someone else started, which
+	// must outlive the tab
+	remote      bool
+	userDataDir string
+	// keepUserDataDir is set when the profile directory belongs to a BrowserProfile
+	keepUserDataDir bool
+	profile         *BrowserProfile
+	// device is the device the tab emulates, set by Emulate
+	device      *Device
+	network     *networkTracker
+	interceptor *interceptor
+	// downloads is shared by every tab of the browser, whose download
+	// behaviour can only be set for all of them at once
+	downloads *sync.Mutex
+	log       *logrus.Logger
+}
+
+// downloadResetTimeout bounds restoring Chrome's download behaviour, which
+// happens after the caller's context may already have expired
+const downloadResetTimeout = 5 * time.Second
+
+// networkTracker follows the requests made by a tab so that callers can wait
+// for the network to go quiet, and keeps the most recent of them along with
+// the console output for debug bundles
+type networkTracker struct {
+	sync.Mutex
+	inFlight     map[network.RequestID]bool
+	lastActivity time.Time
+	requests     []RequestRecord
+	requestIndex map[network.RequestID]int
+	console      []ConsoleMessage
+}
+
+// handleEvent records the start and end of each request
+func (nt *networkTracker) handleEvent(ev interface{}) {
+	nt.Lock()
+	defer nt.Unlock()
+	switch ev := ev.(type) {
+	case *network.EventRequestWillBeSent:
+		nt.inFlight[ev.RequestID] = true
+		nt.recordRequest(ev.RequestID, RequestRecord{
+			Time:         time.Now(),
+			Method:       ev.Request.Method,
+			URL:          ev.Request.URL,
+			ResourceType: ev.Type.String(),
+		})
+	case *network.EventResponseReceived:
+		if i, ok := nt.requestIndex[ev.RequestID]; ok {
+			nt.requests[i].Status = ev.Response.Status
+		}
+		return
+	case *network.EventLoadingFinished:
+		delete(nt.inFlight, ev.RequestID)
+	case *network.EventLoadingFailed:
+		delete(nt.inFlight, ev.RequestID)
+		if i, ok := nt.requestIndex[ev.RequestID]; ok {
+			nt.requests[i].Error = ev.ErrorText
+		}
+	case *runtime.EventConsoleAPICalled:
+		text := make([]string, 0, len(ev.Args))
+		for _, arg := range ev.Args {
+			if arg.Value != nil {
+				text = append(text, strings.Trim(string(arg.Value), `"`))
+			} else {
+				text = append(text, arg.Description)
+			}
+		}
+		nt.recordConsole(ConsoleMessage{Time: time.Now(), Level: ev.Type.String(), Text: strings.Join(text, " ")})
+		return
+	case *runtime.EventExceptionThrown:
+		text := ev.ExceptionDetails.Text
+		if ev.ExceptionDetails.Exception != nil && ev.ExceptionDetails.Exception.Description != "" {
+			text = ev.ExceptionDetails.Exception.Description
+		}
+		nt.recordConsole(ConsoleMessage{Time: time.Now(), Level: "exception", Text: text, URL: ev.ExceptionDetails.URL})
+		return
+	case *cdplog.EventEntryAdded:
+		nt.recordConsole(ConsoleMessage{Time: time.Now(), Level: ev.Entry.Level.String(), Text: ev.Entry.Text, URL: ev.Entry.URL})
+		return
+	default:
+		return
+	}
+	nt.lastActivity = time.Now()
+}
+
+// recordRequest keeps a request, dropping the oldest once the limit is reached
+func (nt *networkTracker) recordRequest(id network.RequestID, record RequestRecord) {
+	if len(nt.requests) >= maxRecentDiagnostics {
+		nt.requests = append(nt.requests[:0], nt.requests[1:]...)
+		for requestID, i := range nt.requestIndex {
+			if i == 0 {
+				delete(nt.requestIndex, requestID)
+			} else {
+				nt.requestIndex[requestID] = i - 1
+			}
+		}
+	}
+	nt.requestIndex[id] = len(nt.requests)
+	nt.requests = append(nt.requests, record)
+}
+
+// recordConsole keeps a console message, dropping the oldest once the limit is reached
+func (nt *networkTracker) recordConsole(message ConsoleMessage) {
+	if len(nt.console) >= maxRecentDiagnostics {
+		nt.console = append(nt.console[:0], nt.console[1:]...)
+	}
+	nt.console = append(nt.console, message)
+}
+
+// diagnostics copies the recorded requests and console messages
+func (nt *networkTracker) diagnostics() *Diagnostics {
+	nt.Lock()
+	defer nt.Unlock()
+	return &Diagnostics{
+		Console:  append([]ConsoleMessage{}, nt.console...),
+		Requests: append([]RequestRecord{}, nt.requests...),
+	}
+}
+
+// idleFor reports how long the network has been quiet, or zero if requests
+// are still in flight
+func (nt *networkTracker) idleFor() time.Duration {
+	nt.Lock()
+	defer nt.Unlock()
+	if len(nt.inFlight) > 0 {
+		return 0
+	}
+	return time.Since(nt.lastActivity)
+}
+
+// interceptor applies a RequestPolicy to a tab's requests and writes its
+// traffic log
+type interceptor struct {
+	sync.Mutex
+	policy  *RequestPolicy
+	traffic *trafficLog
+	pending map[network.RequestID]*TrafficEntry
+	blocked map[network.RequestID]bool
+}
+
+// handleEvent blocks or rewrites paused requests and logs finished ones.
+// Paused requests are answered from a new goroutine, as chromedp does not
+// allow commands to be run from within a listener.
+func (ic *interceptor) handleEvent(tabCtx context.Context, ev interface{}) {
+	ic.Lock()
+	defer ic.Unlock()
+	switch ev := ev.(type) {
+	case *fetch.EventRequestPaused:
+		var action chromedp.Action
+		if ic.policy.Blocks(ev.ResourceType.String(), ev.Request.URL) {
+			ic.blocked[ev.NetworkID] = true
+			action = fetch.FailRequest(ev.RequestID, network.ErrorReasonBlockedByClient)
+		} else {
+			header := http.Header{}
+			for name, value := range ev.Request.Headers {
+				header.Set(name, fmt.Sprint(value))
+			}
+			ic.policy.rewriteHeaders(header)
+			headers := make([]*fetch.HeaderEntry, 0, len(header))
+			for name := range header {
+				headers = append(headers, &fetch.HeaderEntry{Name: name, Value: header.Get(name)})
+			}
+			action = fetch.ContinueRequest(ev.RequestID).WithHeaders(headers)
+		}
+		go func() {
+			executorCtx := cdp.WithExecutor(tabCtx, chromedp.FromContext(tabCtx).Target)
+			// The request fails on its own if the tab has gone away
+			_ = action.Do(executorCtx)
+		}()
+	case *network.EventRequestWillBeSent:
+		if ic.traffic == nil {
+			return
+		}
+		ic.pending[ev.RequestID] = &TrafficEntry{
+			Time:           time.Now(),
+			Method:         ev.Request.Method,
+			URL:            ev.Request.URL,
+			ResourceType:   ev.Type.String(),
+			RequestHeaders: cdpHeaders(ev.Request.Headers),
+		}
+	case *network.EventResponseReceived:
+		if entry, ok := ic.pending[ev.RequestID]; ok {
+			entry.Status = ev.Response.Status
+			entry.ResponseHeaders = cdpHeaders(ev.Response.Headers)
+		}
+	case *network.EventLoadingFinished:
+		if entry, ok := ic.pending[ev.RequestID]; ok {
+			ic.traffic.write(entry)
+			delete(ic.pending, ev.RequestID)
+		}
+	case *network.EventLoadingFailed:
+		if entry, ok := ic.pending[ev.RequestID]; ok {
+			entry.Error = ev.ErrorText
+			entry.Blocked = ic.blocked[ev.RequestID]
+			ic.traffic.write(entry)
+			delete(ic.pending, ev.RequestID)
+		}
+		delete(ic.blocked, ev.RequestID)
+	}
+}
+
+// setPolicy replaces the policy, dropping any requests which were being logged
+func (ic *interceptor) setPolicy(policy *RequestPolicy) {
+	ic.Lock()
+	defer ic.Unlock()
+	ic.policy = policy
+	ic.traffic = newTrafficLog(policy)
+	ic.pending = map[network.RequestID]*TrafficEntry{}
+	ic.blocked = map[network.RequestID]bool{}
+}
+
+// cdpHeaders converts the headers reported by chrome
+func cdpHeaders(headers network.Headers) map[string]string {
+	flat := make(map[string]string, len(headers))
+	for name, value := range headers {
+		flat[name] = fmt.Sprint(value)
+	}
+	return flat
+}
+
+// chromeExecPath, when set, is the Chrome binary launched instead of the one
+// chromedp finds on its own
+var chromeExecPath = ""
+
+// NewChromeBrowser launches a new Chrome process and opens a tab in it
+func NewChromeBrowser(headless bool, logger *logrus.Logger) (*ChromeBrowser, error) {
+	return NewChromeBrowserWithProfile(headless, nil, logger)
+}
+
+// NewChromeBrowserWithProfile launches a new Chrome process configured by
+// the profile and opens a tab in it. A nil profile uses Chrome's defaults.
+func NewChromeBrowserWithProfile(headless bool, profile *BrowserProfile, logger *logrus.Logger) (cb *ChromeBrowser, err error) {
+	cb = newChromeTab(profile, logger)
+	if profile != nil && profile.UserDataDir != "" {
+		if err = os.MkdirAll(profile.UserDataDir, 0700); err != nil {
+			return nil, err
+		}
+		cb.userDataDir, cb.keepUserDataDir = profile.UserDataDir, true
+	} else {
+		// Chrome's profile lives in a directory we own so that Close can
+		// remove it once the browser has exited.
+		cb.userDataDir, err = ioutil.TempDir("", "offthegrid-chromedp")
+		if err != nil {
+			return nil, err
+		}
+	}
+	opts := []chromedp.ExecAllocatorOption{
+		chromedp.NoFirstRun,
+		chromedp.DisableGPU,
+		chromedp.NoDefaultBrowserCheck,
+		chromedp.UserDataDir(cb.userDataDir),
+		chromedp.Flag("disable-extensions", true),
+		chromedp.Flag("disable-popup-blocking", true),
+		chromedp.Flag("disable-hang-monitor", true),
+		// Cross-origin iframes stay in the page's process so that pierced
+		// selectors can reach into them
+		chromedp.Flag("disable-features", "IsolateOrigins,site-per-process"),
+	} // append( //chromedp.DefaultExecAllocatorOptions[:],
+	if headless {
+		opts = append(opts, chromedp.Headless)
+	}
+	if chromeExecPath != "" {
+		opts = append(opts, chromedp.ExecPath(chromeExecPath))
+	}
+	profileOpts, err := profileAllocatorOptions(profile)
+	if err != nil {
+		cb.Close()
+		return nil, err
+	}
+	opts = append(opts, profileOpts...)
+
+	allocCtx, cancelAllocator := chromedp.NewExecAllocator(context.Background(), opts...)
+	cb.cancelAllocator = cancelAllocator
+
+	// ensure that the browser process is started
+	if err = cb.openTab(allocCtx); err != nil {
+		cb.Close()
+		return nil, err
+	}
+	return cb, nil
+}
+
+// NewRemoteChromeBrowser attaches to a Chrome which is already running with
+// remote debugging turned on and opens a tab of its own in it. The address
+// may be the DevTools websocket URL, the http URL of the debugging port,
+// host:port, or just the port of a Chrome on this machine. Closing the
+// browser closes that tab and disconnects, leaving Chrome running.
+//
+// Only the parts of the profile which can be applied to a tab are used, so
+// a profile with a proxy, a user data directory or WebRTC settings is
+// refused. Pierced selectors can only reach into cross-origin iframes if
+// Chrome was started with site isolation turned off.
+func NewRemoteChromeBrowser(addr string, profile *BrowserProfile, logger *logrus.Logger) (*ChromeBrowser, error) {
+	debuggerURL, err := remoteDebuggerURL(addr)
+	if err != nil {
+		return nil, err
+	}
+	if profile != nil {
+		if err = profile.Validate(); err != nil {
+			return nil, err
+		}
+		if profile.Proxy != "" || profile.UserDataDir != "" || profile.PreventWebRTCLeaks {
+			return nil, fmt.Errorf("profile %s changes how Chrome is started, so it cannot be used with a running Chrome", profile.Name)
+		}
+	}
+	cb := newChromeTab(profile, logger)
+	cb.remote = true
+	allocCtx, cancelAllocator := chromedp.NewRemoteAllocator(context.Background(), debuggerURL)
+	cb.cancelAllocator = cancelAllocator
+	if err = cb.openTab(allocCtx); err != nil {
+		cb.Close()
+		return nil, err
+	}
+	return cb, nil
+}
+
+// remoteDebuggerURL turns the address of a Chrome's debugging port into a
+// URL chromedp can connect to
+func remoteDebuggerURL(addr string) (string, error) {
+	addr = strings.TrimSpace(addr)
+	if addr == "" {
+		return "", fmt.Errorf("no remote debugging address was given")
+	}
+	if _, err := strconv.Atoi(addr); err == nil {
+		addr = "127.0.0.1:" + addr
+	}
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	parsed, err := url_package.Parse(addr)
+	if err != nil {
+		return "", fmt.Errorf("could not parse the remote debugging address %q: %w", addr, err)
+	}
+	switch parsed.Scheme {
+	case "ws", "wss", "http", "https":
+	default:
+		return "", fmt.Errorf("the remote debugging address %q must be a ws or http URL", addr)
+	}
+	if parsed.Host == "" {
+		return "", fmt.Errorf("the remote debugging address %q has no host", addr)
+	}
+	return parsed.String(), nil
+}
+
+// newChromeTab creates the state of a tab which has not been opened yet
+func newChromeTab(profile *BrowserProfile, logger *logrus.Logger) *ChromeBrowser {
+	cb := &ChromeBrowser{
+		profile: profile,
+		network: &networkTracker{
+			inFlight:     map[network.RequestID]bool{},
+			lastActivity: time.Now(),
+			requestIndex: map[network.RequestID]int{},
+		},
+		interceptor: &interceptor{},
+		downloads:   &sync.Mutex{},
+		log:         logger,
+	}
+	cb.interceptor.setPolicy(nil)
+	return cb
+}
+
+// NewTab opens another tab in the same browser. It shares the browser's
+// cookies, request policy and emulated device, and closing it leaves the
+// browser and its other tabs open.
+func (cb *ChromeBrowser) NewTab(ctx context.Context) (Browser, error) {
+	if cb.chromeDpContext == nil {
+		return nil, fmt.Errorf("the browser has been closed")
+	}
+	tab := newChromeTab(cb.profile, cb.log)
+	tab.remote = cb.remote
+	tab.downloads = cb.downloads
+	if err := tab.openTab(cb.chromeDpContext); err != nil {
+		tab.Close()
+		return nil, err
+	}
+	// The tab follows the same request policy and emulates the same device
+	cb.interceptor.Lock()
+	policy := cb.interceptor.policy
+	cb.interceptor.Unlock()
+	if err := tab.SetRequestPolicy(ctx, policy); err != nil {
+		tab.Close()
+		return nil, err
+	}
+	if cb.device != nil {
+		if err := tab.Emulate(ctx, cb.device); err != nil {
+			tab.Close()
+			return nil, err
+		}
+	}
+	return tab, nil
+}
+
+// openTab creates the tab context from parent and starts listening to it
+func (cb *ChromeBrowser) openTab(parent context.Context) error {
+	var opts []chromedp.ContextOption
+	if c := chromedp.FromContext(parent); c == nil || c.Browser == nil {
+		// also set up a custom logger. It belongs to the browser, so only
+		// the browser's first tab can set it.
+		opts = append(opts, chromedp.WithLogf(log.Printf))
+	}
+	taskCtx, cancelTab := chromedp.NewContext(parent, opts...)
+	cb.chromeDpContext, cb.cancelTab = taskCtx, cancelTab
+	chromedp.ListenTarget(taskCtx, cb.network.handleEvent)
+	chromedp.ListenTarget(taskCtx, func(ev interface{}) {
+		cb.interceptor.handleEvent(taskCtx, ev)
+	})
+	// the console and log domains report to the tracker
+	actions := append([]chromedp.Action{runtime.Enable(), cdplog.Enable()}, profileTabActions(cb.profile)...)
+	return chromedp.Run(taskCtx, actions...)
+}
+
+// profileAllocatorOptions returns the command line options which apply the
+// profile to the whole browser
+func profileAllocatorOptions(profile *BrowserProfile) ([]chromedp.ExecAllocatorOption, error) {
+	if profile == nil {
+		return nil, nil
+	}
+	if err := profile.Validate(); err != nil {
+		return nil, err
+	}
+	var opts []chromedp.ExecAllocatorOption
+	if profile.Proxy != "" {
+		proxy, _ := profile.proxyURL()
+		opts = append(opts, chromedp.ProxyServer(profile.Proxy))
+		if proxy.Scheme == "socks5" {
+			// Hostnames are resolved by the proxy, so no lookups leak to
+			// the local resolver
+			opts = append(opts, chromedp.Flag("host-resolver-rules", "MAP * ~NOTFOUND , EXCLUDE "+proxy.Hostname()))
+		}
+	}
+	if profile.UserAgent != "" {
+		opts = append(opts, chromedp.UserAgent(profile.UserAgent))
+	}
+	if profile.Locale != "" {
+		opts = append(opts, chromedp.Flag("lang", profile.Locale), chromedp.Flag("accept-lang", profile.Locale))
+	}
+	if profile.Timezone != "" {
+		opts = append(opts, chromedp.Env("TZ="+profile.Timezone))
+	}
+	if profile.Viewport != nil {
+		opts = append(opts, chromedp.WindowSize(profile.Viewport.Width, profile.Viewport.Height))
+	}
+	if profile.PreventWebRTCLeaks {
+		// Older versions of Chrome only know the forced spelling
+		opts = append(opts,
+			chromedp.Flag("webrtc-ip-handling-policy", "disable_non_proxied_udp"),
+			chromedp.Flag("force-webrtc-ip-handling-policy", "disable_non_proxied_udp"),
+		)
+	}
+	return opts, nil
+}
+
+// profileTabActions returns the emulation each tab needs for the profile,
+// which covers what the command line options cannot reach in every tab
+func profileTabActions(profile *BrowserProfile) (actions []chromedp.Action) {
+	if profile == nil {
+		return nil
+	}
+	if profile.UserAgent != "" {
+		actions = append(actions, userAgentOverride(profile, profile.UserAgent))
+	}
+	if profile.Locale != "" {
+		actions = append(actions, emulation.SetLocaleOverride().WithLocale(strings.ReplaceAll(profile.Locale, "-", "_")))
+	}
+	if profile.Timezone != "" {
+		actions = append(actions, emulation.SetTimezoneOverride(profile.Timezone))
+	}
+	if profile.Viewport != nil {
+		actions = append(actions, chromedp.EmulateViewport(int64(profile.Viewport.Width), int64(profile.Viewport.Height)))
+	}
+	return actions
+}
+
+// userAgentOverride sends userAgent, along with the profile's language. An
+// empty user agent goes back to the browser's own.
+func userAgentOverride(profile *BrowserProfile, userAgent string) *emulation.SetUserAgentOverrideParams {
+	override := emulation.SetUserAgentOverride(userAgent)
+	if profile != nil && profile.Locale != "" {
+		override = override.WithAcceptLanguage(profile.Locale)
+	}
+	return override
+}
+
+// Close closes the browser and cancels the contexts created for it. A
+// browser attached with NewRemoteChromeBrowser only has its tab closed.
+func (cb *ChromeBrowser) Close() (err error) {
+	switch {
+	case cb.chromeDpContext == nil:
+	case cb.remote:
+		// Cancelling the tab's context only detaches from the tab and
+		// closes it; Chrome keeps running
+		cb.cancelTab()
+	default:
+		// Cancel is the only way the tab context is shut down. Its cancel
+		// func waits for a browser to stop, which never happens if Chrome
+		// failed to start, so it must not be called as well.
+		if err = chromedp.Cancel(cb.chromeDpContext); err != nil {
+			cb.log.WithField("error", err).Error("Could not cleanly close the browser")
+		}
+	}
+	if cb.cancelAllocator != nil {
+		cb.cancelAllocator()
+	}
+	if cb.userDataDir != "" && !cb.keepUserDataDir {
+		// The browser has exited by now, so its profile can be removed
+		if rmErr := os.RemoveAll(cb.userDataDir); rmErr != nil {
+			cb.log.WithField("error", rmErr).Error("Could not remove the browser profile directory")
+			if err == nil {
+				err = rmErr
+			}
+		}
+	}
+	cb.chromeDpContext = nil
+	cb.cancelTab = nil
+	cb.cancelAllocator = nil
+	cb.userDataDir = ""
+	cb.keepUserDataDir = false
+	return err
+}
+
+// run executes the actions against the browser tab. The tab context is
+// bounded by ctx's deadline and is cancelled as soon as ctx is done.
+func (cb *ChromeBrowser) run(ctx context.Context, actions ...chromedp.Action) error {
+	return cb.runFunc(ctx, func(opCtx context.Context) error {
+		return chromedp.Run(opCtx, actions...)
+	})
+}
+
+// runFunc calls f with the bounded tab context described by run
+func (cb *ChromeBrowser) runFunc(ctx context.Context, f func(opCtx context.Context) error) error {
+	if cb.chromeDpContext == nil {
+		return fmt.Errorf("the browser has been closed")
+	}
+	var opCtx context.Context
+	var cancel context.CancelFunc
+	if deadline, ok := ctx.Deadline(); ok {
+		opCtx, cancel = context.WithDeadline(cb.chromeDpContext, deadline)
+	} else {
+		opCtx, cancel = context.WithCancel(cb.chromeDpContext)
+	}
+	defer cancel()
+	go func() {
+		select {
+		case <-ctx.Done():
+			cancel()
+		case <-opCtx.Done():
+		}
+	}()
+	if err := f(opCtx); err != nil {
+		if ctx.Err() != nil {
+			// Report why the caller gave up rather than how chromedp noticed
+			return ctx.Err()
+		}
+		return err
+	}
+	return nil
+}
+
+// Navigate loads the URL in the current tab and waits for it to load. A
+// failing status code is returned as a StatusError.
+func (cb *ChromeBrowser) Navigate(ctx context.Context, url string) error {
+	return cb.runFunc(ctx, func(opCtx context.Context) error {
+		resp, err := chromedp.RunResponse(opCtx, chromedp.Navigate(url))
+		if err != nil {
+			return err
+		}
+		if resp != nil && resp.Status >= 400 {
+			return &StatusError{URL: resp.URL, StatusCode: int(resp.Status)}
+		}
+		return nil
+	})
+}
+
+// Reload reloads the current page
+func (cb *ChromeBrowser) Reload(ctx context.Context) error {
+	return cb.run(ctx, chromedp.Reload())
+}
+
+// Location returns the URL of the current page
+func (cb *ChromeBrowser) Location(ctx context.Context) (location string, err error) {
+	err = cb.run(ctx, chromedp.Location(&location))
+	return location, err
+}
+
+// Nodes returns all nodes currently matching the selector
+func (cb *ChromeBrowser) Nodes(ctx context.Context, selector string) ([]*Node, error) {
+	if isPierced(selector) {
+		return cb.piercedNodes(ctx, selector)
+	}
+	var cdpNodes []*cdp.Node
+	if err := cb.run(ctx, chromedp.Nodes(selector, &cdpNodes, chromedp.AtLeast(0))); err != nil {
+		return nil, err
+	}
+	nodes := make([]*Node, 0, len(cdpNodes))
+	for _, cdpNode := range cdpNodes {
+		nodes = append(nodes, nodeFromCDP(cdpNode))
+	}
+	return nodes, nil
+}
+
+// WaitReady waits until at least one node matches the selector
+func (cb *ChromeBrowser) WaitReady(ctx context.Context, selector string) error {
+	if isPierced(selector) {
+		return cb.piercedFirst(ctx, selector, false, func(ctx context.Context, node piercedNode) error {
+			return nil
+		})
+	}
+	return cb.run(ctx, chromedp.WaitReady(selector))
+}
+
+// InnerHTML returns the inner HTML of the first node matching the selector
+func (cb *ChromeBrowser) InnerHTML(ctx context.Context, selector string) (body string, err error) {
+	if isPierced(selector) {
+		return cb.piercedInnerHTML(ctx, selector)
+	}
+	err = cb.run(ctx, chromedp.InnerHTML(selector, &body))
+	return body, err
+}
+
+// OuterHTML returns the outer HTML of the first node matching the selector
+func (cb *ChromeBrowser) OuterHTML(ctx context.Context, selector string) (body string, err error) {
+	if isPierced(selector) {
+		return cb.piercedOuterHTML(ctx, selector)
+	}
+	err = cb.run(ctx, chromedp.OuterHTML(selector, &body))
+	return body, err
+}
+
+// Click clicks the first node matching the selector
+func (cb *ChromeBrowser) Click(ctx context.Context, selector string) error {
+	if isPierced(selector) {
+		return cb.piercedClick(ctx, selector)
+	}
+	return cb.run(ctx, chromedp.Click(selector))
+}
+
+// SendKeys types the value into the first node matching the selector
+func (cb *ChromeBrowser) SendKeys(ctx context.Context, selector, value string) error {
+	if isPierced(selector) {
+		return cb.piercedSendKeys(ctx, selector, value)
+	}
+	return cb.run(ctx, chromedp.SendKeys(selector, value))
+}
+
+// WaitVisible waits until the first node matching the selector is visible
+func (cb *ChromeBrowser) WaitVisible(ctx context.Context, selector string) error {
+	if isPierced(selector) {
+		return cb.piercedFirst(ctx, selector, true, func(ctx context.Context, node piercedNode) error {
+			return nil
+		})
+	}
+	return cb.run(ctx, chromedp.WaitVisible(selector))
+}
+
+// ScrollIntoView scrolls the window until the selected node is in view
+func (cb *ChromeBrowser) ScrollIntoView(ctx context.Context, selector string) error {
+	if isPierced(selector) {
+		return cb.piercedScrollIntoView(ctx, selector)
+	}
+	return cb.run(ctx, chromedp.ScrollIntoView(selector))
+}
+
+// WaitNetworkIdle waits until no requests have been in flight for the quiet period
+func (cb *ChromeBrowser) WaitNetworkIdle(ctx context.Context, quiet time.Duration) error {
+	ticker := time.NewTicker(50 * time.Millisecond)
+	defer ticker.Stop()
+	for cb.network.idleFor() < quiet {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// readStorage returns a script that copies the named storage into an object.
+// Reading storage throws on opaque origins, which have none to copy
+func readStorage(name string) string {
+	return fmt.Sprintf(`(() => { try { return Object.assign({}, window.%s); } catch (e) { return {}; } })()`, name)
+}
+
+// ExportSession captures every cookie in the browser along with the
+// localStorage and sessionStorage of the current page. Pages without storage,
+// such as about:blank or data: URLs, export empty storage
+func (cb *ChromeBrowser) ExportSession(ctx context.Context) (*SessionState, error) {
+	state := &SessionState{
+		LocalStorage:   map[string]string{},
+		SessionStorage: map[string]string{},
+	}
+	var cookies []*network.Cookie
+	err := cb.run(ctx,
+		chromedp.Location(&state.URL),
+		chromedp.ActionFunc(func(ctx context.Context) (err error) {
+			cookies, err = storage.GetCookies().Do(ctx)
+			return err
+		}),
+		chromedp.Evaluate(readStorage("localStorage"), &state.LocalStorage),
+		chromedp.Evaluate(readStorage("sessionStorage"), &state.SessionStorage),
+	)
+	if err != nil {
+		return nil, err
+	}
+	for _, cookie := range cookies {
+		sessionCookie := SessionCookie{
+			Name:     cookie.Name,
+			Value:    cookie.Value,
+			Domain:   cookie.Domain,
+			Path:     cookie.Path,
+			Secure:   cookie.Secure,
+			HTTPOnly: cookie.HTTPOnly,
+			SameSite: cookie.SameSite.String(),
+		}
+		if !cookie.Session {
+			sessionCookie.Expires = time.Unix(int64(cookie.Expires), 0)
+		}
+		state.Cookies = append(state.Cookies, sessionCookie)
+	}
+	return state, nil
+}
+
+// ImportSession sets the session's cookies, then loads the page the session
+// was captured from to restore its web storage
+func (cb *ChromeBrowser) ImportSession(ctx context.Context, state *SessionState) error {
+	cookies := make([]*network.CookieParam, 0, len(state.Cookies))
+	for _, cookie := range state.Cookies {
+		cookieParam := &network.CookieParam{
+			Name:     cookie.Name,
+			Value:    cookie.Value,
+			Domain:   cookie.Domain,
+			Path:     cookie.Path,
+			Secure:   cookie.Secure,
+			HTTPOnly: cookie.HTTPOnly,
+			SameSite: network.CookieSameSite(cookie.SameSite),
+		}
+		if !strings.HasPrefix(cookie.Domain, ".") {
+			// A cookie is only host-only when it is set by URL
+			scheme := "http"
+			if cookie.Secure {
+				scheme = "https"
+			}
+			cookieParam.Domain = ""
+			cookieParam.URL = scheme + "://" + cookie.Domain + cookie.Path
+		}
+		if !cookie.Expires.IsZero() {
+			expires := cdp.TimeSinceEpoch(cookie.Expires)
+			cookieParam.Expires = &expires
+		}
+		cookies = append(cookies, cookieParam)
+	}
+	actions := []chromedp.Action{storage.SetCookies(cookies)}
+	if state.URL != "" && (len(state.LocalStorage) > 0 || len(state.SessionStorage) > 0) {
+		actions = append(actions,
+			chromedp.Navigate(state.URL),
+			chromedp.Evaluate(restoreStorageScript(state), nil),
+			// Reload so the page starts with the restored storage
+			chromedp.Reload(),
+		)
+	}
+	return cb.run(ctx, actions...)
+}
+
+// UserAgent returns the User-Agent the browser sends
+func (cb *ChromeBrowser) UserAgent(ctx context.Context) (userAgent string, err error) {
+	err = cb.run(ctx, chromedp.Evaluate(`navigator.userAgent`, &userAgent))
+	return userAgent, err
+}
+
+// Emulate applies the device's screen, touch input, user agent and motion
+// preference to the tab. A nil device restores the profile's settings.
+func (cb *ChromeBrowser) Emulate(ctx context.Context, device *Device) error {
+	if device == nil {
+		actions := []chromedp.Action{
+			emulation.ClearDeviceMetricsOverride(),
+			emulation.SetTouchEmulationEnabled(false),
+			emulation.SetEmulatedMedia().WithFeatures([]*emulation.MediaFeature{}),
+		}
+		if cb.profile == nil || cb.profile.UserAgent == "" {
+			// An empty override goes back to the browser's own user agent
+			actions = append(actions, emulation.SetUserAgentOverride(""))
+		}
+		if err := cb.run(ctx, append(actions, profileTabActions(cb.profile)...)...); err != nil {
+			return err
+		}
+		cb.device = nil
+		return nil
+	}
+	scale := device.ScaleFactor
+	if scale == 0 {
+		scale = 1
+	}
+	touch := emulation.SetTouchEmulationEnabled(device.Touch)
+	if device.Touch {
+		touch = touch.WithMaxTouchPoints(5)
+	}
+	motion := "no-preference"
+	if device.ReducedMotion {
+		motion = "reduce"
+	}
+	actions := []chromedp.Action{
+		emulation.SetDeviceMetricsOverride(int64(device.Width), int64(device.Height), scale, device.Mobile),
+		touch,
+		emulation.SetEmulatedMedia().WithFeatures([]*emulation.MediaFeature{{Name: "prefers-reduced-motion", Value: motion}}),
+	}
+	// A device without a user agent of its own, such as a desktop, must not
+	// keep the one of the device emulated before it
+	userAgent := device.UserAgent
+	if userAgent == "" && cb.profile != nil {
+		userAgent = cb.profile.UserAgent
+	}
+	actions = append(actions, userAgentOverride(cb.profile, userAgent))
+	if err := cb.run(ctx, actions...); err != nil {
+		return err
+	}
+	cb.device = device
+	return nil
+}
+
+// Evaluate runs the javascript expression in the page and decodes its value
+// into result
+func (cb *ChromeBrowser) Evaluate(ctx context.Context, expression string, result interface{}) error {
+	return cb.run(ctx, chromedp.Evaluate(expression, result))
+}
+
+// SetRequestPolicy applies the policy to the tab. Requests are only paused
+// when the policy blocks or rewrites something.
+func (cb *ChromeBrowser) SetRequestPolicy(ctx context.Context, policy *RequestPolicy) error {
+	cb.interceptor.setPolicy(policy)
+	if !policy.intercepts() {
+		return cb.run(ctx, fetch.Disable())
+	}
+	return cb.run(ctx, fetch.Enable().WithPatterns([]*fetch.RequestPattern{{URLPattern: "*"}}))
+}
+
+// Screenshot captures the whole page as a PNG
+func (cb *ChromeBrowser) Screenshot(ctx context.Context) (screenshot []byte, err error) {
+	err = cb.run(ctx, chromedp.FullScreenshot(&screenshot, 100))
+	return screenshot, err
+}
+
+// Diagnostics returns the recent console messages and network requests
+func (cb *ChromeBrowser) Diagnostics(ctx context.Context) (*Diagnostics, error) {
+	return cb.network.diagnostics(), nil
+}
+
+// StartRecording injects the recording script into every page the tab loads
+// and reports what it sees, along with the tab's navigations
+func (cb *ChromeBrowser) StartRecording(ctx context.Context) (<-chan RecordedEvent, error) {
+	if cb.chromeDpContext == nil {
+		return nil, fmt.Errorf("the browser has been closed")
+	}
+	tabCtx := cb.chromeDpContext
+	listenCtx, stop := context.WithCancel(tabCtx)
+	// Listeners must not block, so events queue up until they are forwarded
+	queue := make(chan RecordedEvent, 256)
+	push := func(event RecordedEvent) {
+		select {
+		case queue <- event:
+		default:
+			cb.log.WithField("event", event).Error("Dropped a recorded event because too many are waiting")
+		}
+	}
+	closed := make(chan struct{})
+	var closeOnce sync.Once
+	targetID := chromedp.FromContext(tabCtx).Target.TargetID
+	navigations := newNavigationTracker(cdp.FrameID(targetID))
+	chromedp.ListenBrowser(listenCtx, func(ev interface{}) {
+		if ev, ok := ev.(*target.EventTargetDestroyed); ok && ev.TargetID == targetID {
+			closeOnce.Do(func() { close(closed) })
+		}
+	})
+	chromedp.ListenTarget(listenCtx, func(ev interface{}) {
+		switch ev := ev.(type) {
+		case *runtime.EventBindingCalled:
+			if ev.Name != recorderBinding {
+				return
+			}
+			event, err := parseRecordedEvent(ev.Payload)
+			if err != nil {
+				cb.log.WithField("error", err).Error("Could not read a recorded event")
+				return
+			}
+			push(event)
+		default:
+			if event, ok := navigations.handleEvent(ev); ok {
+				push(event)
+			}
+		}
+	})
+	err := cb.run(ctx,
+		runtime.AddBinding(recorderBinding),
+		chromedp.ActionFunc(func(ctx context.Context) error {
+			_, err := page.AddScriptToEvaluateOnNewDocument(recorderScript).Do(ctx)
+			return err
+		}),
+		chromedp.Evaluate(recorderScript, nil),
+	)
+	if err != nil {
+		stop()
+		return nil, err
+	}
+
+	events := make(chan RecordedEvent)
+	go func() {
+		defer close(events)
+		defer stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-closed:
+				return
+			case <-tabCtx.Done():
+				return
+			case event := <-queue:
+				select {
+				case events <- event:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return events, nil
+}
+
+// navigationTracker works out how each navigation of a tab's main frame was
+// started, from the events Chrome sends for it. Listeners are called one at
+// a time, so it needs no lock.
+type navigationTracker struct {
+	mainFrame cdp.FrameID
+	// requested is the last navigation the page asked for which has not
+	// started yet
+	requested *page.EventFrameRequestedNavigation
+	// started holds the URL first requested and the initiator of every
+	// document load which has not committed yet
+	started map[cdp.LoaderID]RecordedEvent
+}
+
+// newNavigationTracker creates a navigationTracker for the frame, whose ID is
+// the tab's target ID
+func newNavigationTracker(mainFrame cdp.FrameID) *navigationTracker {
+	return &navigationTracker{
+		mainFrame: mainFrame,
+		started:   map[cdp.LoaderID]RecordedEvent{},
+	}
+}
+
+// handleEvent returns a RecordNavigate event once a navigation commits
+func (nt *navigationTracker) handleEvent(ev interface{}) (RecordedEvent, bool) {
+	switch ev := ev.(type) {
+	case *page.EventFrameRequestedNavigation:
+		// Only navigations started by the page are requested. Those started
+		// by the browser go straight to the request.
+		if ev.FrameID == nt.mainFrame {
+			nt.requested = ev
+		}
+	case *network.EventRequestWillBeSent:
+		if ev.Type != network.ResourceTypeDocument || ev.FrameID != nt.mainFrame || ev.RedirectResponse != nil {
+			return RecordedEvent{}, false
+		}
+		nt.started[ev.LoaderID] = RecordedEvent{Kind: RecordNavigate, URL: ev.Request.URL + ev.Request.URLFragment, Initiator: nt.takeRequested(ev.Request.URL)}
+	case *page.EventFrameNavigated:
+		if ev.Frame.ParentID != "" {
+			return RecordedEvent{}, false
+		}
+		event, ok := nt.started[ev.Frame.LoaderID]
+		if !ok {
+			// Pages such as about:blank are loaded without a request
+			event = RecordedEvent{Kind: RecordNavigate, URL: ev.Frame.URL + ev.Frame.URLFragment, Initiator: nt.takeRequested(ev.Frame.URL)}
+		}
+		// Loads which had not committed were cancelled by this one
+		nt.started = map[cdp.LoaderID]RecordedEvent{}
+		nt.requested = nil
+		event.Time = time.Now()
+		return event, true
+	case *page.EventNavigatedWithinDocument:
+		if ev.FrameID == nt.mainFrame {
+			return RecordedEvent{Kind: RecordNavigate, URL: ev.URL, Initiator: sameDocumentNavigation, Time: time.Now()}, true
+		}
+	}
+	return RecordedEvent{}, false
+}
+
+// takeRequested returns why the page asked to navigate to url, or "" if it
+// did not, and forgets the request
+func (nt *navigationTracker) takeRequested(url string) string {
+	requested := nt.requested
+	nt.requested = nil
+	if requested == nil || stripFragment(requested.URL) != stripFragment(url) {
+		return ""
+	}
+	return string(requested.Reason)
+}
+
+// stripFragment removes the #fragment from a URL
+func stripFragment(url string) string {
+	if i := strings.Index(url, "#"); i >= 0 {
+		return url[:i]
+	}
+	return url
+}
+
+// Download has the browser save downloads into dir, clicks the selector and
+// waits for the first download which starts to finish. Chrome saves the file
+// under the download's GUID, so it is renamed to the name the site suggested.
+func (cb *ChromeBrowser) Download(ctx context.Context, clickSelector, dir string) (*Download, error) {
+	if cb.chromeDpContext == nil {
+		return nil, fmt.Errorf("the browser has been closed")
+	}
+	listenCtx, stop := context.WithCancel(cb.chromeDpContext)
+	defer stop()
+	// Listeners are called one at a time, so the download is claimed by the
+	// first one to begin without any locking
+	var started *browser.EventDownloadWillBegin
+	finished := make(chan *browser.EventDownloadProgress, 1)
+	chromedp.ListenTarget(listenCtx, func(ev interface{}) {
+		switch ev := ev.(type) {
+		case *browser.EventDownloadWillBegin:
+			if started == nil {
+				started = ev
+			}
+		case *browser.EventDownloadProgress:
+			if started == nil || ev.GUID != started.GUID || ev.State == browser.DownloadProgressStateInProgress {
+				return
+			}
+			select {
+			case finished <- ev:
+			default:
+			}
+		}
+	})
+	// The behaviour is set for the tab's browser context, which is the whole
+	// browser unless the tab has one of its own, so tabs take turns and
+	// Chrome's own behaviour is put back afterwards
+	cb.downloads.Lock()
+	defer cb.downloads.Unlock()
+	var contextID cdp.BrowserContextID
+	err := cb.run(ctx, chromedp.ActionFunc(func(ctx context.Context) error {
+		info, err := target.GetTargetInfo().Do(ctx)
+		if err != nil {
+			return err
+		}
+		if info != nil {
+			contextID = info.BrowserContextID
+		}
+		return browser.SetDownloadBehavior(browser.SetDownloadBehaviorBehaviorAllowAndName).
+			WithBrowserContextID(contextID).
+			WithDownloadPath(dir).
+			WithEventsEnabled(true).
+			Do(ctx)
+	}))
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		resetCtx, cancel := context.WithTimeout(context.Background(), downloadResetTimeout)
+		defer cancel()
+		err := cb.run(resetCtx, browser.SetDownloadBehavior(browser.SetDownloadBehaviorBehaviorDefault).
+			WithBrowserContextID(contextID))
+		if err != nil {
+			cb.log.WithField("error", err).Error("Could not restore the browser's download behaviour")
+		}
+	}()
+	if err = cb.Click(ctx, clickSelector); err != nil {
+		return nil, err
+	}
+	var progress *browser.EventDownloadProgress
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case progress = <-finished:
+	}
+	if progress.State != browser.DownloadProgressStateCompleted {
+		return nil, fmt.Errorf("the download of %s was %s", started.URL, progress.State)
+	}
+	filePath := uniqueDownloadPath(dir, started.SuggestedFilename)
+	if err = os.Rename(filepath.Join(dir, started.GUID), filePath); err != nil {
+		return nil, err
+	}
+	return &Download{Path: filePath, URL: started.URL, Time: time.Now()}, nil
+}
+
+// restoreStorageScript builds the javascript which copies a session's web
+// storage into the current page
+func restoreStorageScript(state *SessionState) string {
+	localStorage, _ := json.Marshal(state.LocalStorage)
+	sessionStorage, _ := json.Marshal(state.SessionStorage)
+	return fmt.Sprintf(`(function(local, session) {
+	for (const key in local) { window.localStorage.setItem(key, local[key]); }
+	for (const key in session) { window.sessionStorage.setItem(key, session[key]); }
+})(%s, %s)`, localStorage, sessionStorage)
+}
+
+// nodeFromCDP snapshots a chromedp node
+func nodeFromCDP(cdpNode *cdp.Node) *Node {
+	node := &Node{
+		NodeName:   strings.ToLower(cdpNode.LocalName),
+		XPath:      cdpNode.FullXPath(),
+		Attributes: map[string]string{},
+	}
+	for i := 0; i+1 < len(cdpNode.Attributes); i += 2 {
+		node.Attributes[cdpNode.Attributes[i]] = cdpNode.Attributes[i+1]
+	}
+	return node
+}
@@ -0,0 +1,389 @@
+package offthegrid
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/network"
+	"github.com/chromedp/cdproto/page"
+	"github.com/gobwas/ws"
+	"github.com/gobwas/ws/wsutil"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDevTools is the debugging port of a Chrome which answers every command
+// without doing anything, and remembers the commands each tab was sent
+type fakeDevTools struct {
+	*httptest.Server
+	lock     sync.Mutex
+	targets  int
+	sessions []string
+	commands map[string][]fakeCommand
+}
+
+// fakeCommand is a command sent to a fakeDevTools
+type fakeCommand struct {
+	Method string
+	Params json.RawMessage
+}
+
+// newFakeDevTools starts a fakeDevTools
+func newFakeDevTools() *fakeDevTools {
+	fd := &fakeDevTools{commands: map[string][]fakeCommand{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/json/version", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"Browser":              "Chrome/106.0.0.0",
+			"webSocketDebuggerUrl": "ws://" + r.Host + "/devtools/browser/fake",
+		})
+	})
+	mux.HandleFunc("/devtools/browser/fake", fd.serve)
+	fd.Server = httptest.NewServer(mux)
+	return fd
+}
+
+// serve answers the commands sent over a DevTools connection
+func (fd *fakeDevTools) serve(w http.ResponseWriter, r *http.Request) {
+	conn, _, _, err := ws.UpgradeHTTP(r, w)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	for {
+		msg, err := wsutil.ReadClientText(conn)
+		if err != nil {
+			return
+		}
+		var command struct {
+			ID        int64           `json:"id"`
+			SessionID string          `json:"sessionId,omitempty"`
+			Method    string          `json:"method"`
+			Params    json.RawMessage `json:"params"`
+		}
+		if err = json.Unmarshal(msg, &command); err != nil {
+			return
+		}
+		response := map[string]interface{}{
+			"id":     command.ID,
+			"result": fd.answer(command.SessionID, command.Method, command.Params),
+		}
+		if command.SessionID != "" {
+			response["sessionId"] = command.SessionID
+		}
+		reply, _ := json.Marshal(response)
+		if err = wsutil.WriteServerText(conn, reply); err != nil {
+			return
+		}
+	}
+}
+
+// answer records the command and returns its result
+func (fd *fakeDevTools) answer(sessionID, method string, params json.RawMessage) interface{} {
+	fd.lock.Lock()
+	defer fd.lock.Unlock()
+	fd.commands[sessionID] = append(fd.commands[sessionID], fakeCommand{Method: method, Params: params})
+	switch method {
+	case "Target.createTarget":
+		fd.targets++
+		return map[string]string{"targetId": fmt.Sprintf("target-%d", fd.targets)}
+	case "Target.attachToTarget":
+		var attach struct {
+			TargetID string `json:"targetId"`
+		}
+		json.Unmarshal(params, &attach)
+		fd.sessions = append(fd.sessions, "session-"+attach.TargetID)
+		return map[string]string{"sessionId": "session-" + attach.TargetID}
+	case "Runtime.evaluate":
+		return map[string]interface{}{"result": map[string]string{"type": "object", "className": "Window"}}
+	case "Target.getTargetInfo":
+		return map[string]interface{}{"targetInfo": map[string]string{"targetId": strings.TrimPrefix(sessionID, "session-"), "type": "page", "browserContextId": "context-1"}}
+	}
+	return map[string]string{}
+}
+
+// methods returns the commands sent to the tab with the session ID, or to
+// the browser itself for an empty ID
+func (fd *fakeDevTools) methods(sessionID string) []string {
+	fd.lock.Lock()
+	defer fd.lock.Unlock()
+	methods := make([]string, 0, len(fd.commands[sessionID]))
+	for _, command := range fd.commands[sessionID] {
+		methods = append(methods, command.Method)
+	}
+	return methods
+}
+
+// lastParams decodes the parameters of the last command with the method
+// sent to the tab with the session ID
+func (fd *fakeDevTools) lastParams(sessionID, method string, params interface{}) error {
+	fd.lock.Lock()
+	defer fd.lock.Unlock()
+	commands := fd.commands[sessionID]
+	for i := len(commands) - 1; i >= 0; i-- {
+		if commands[i].Method == method {
+			return json.Unmarshal(commands[i].Params, params)
+		}
+	}
+	return fmt.Errorf("%s was never sent", method)
+}
+
+// lastSession returns the session of the tab opened last
+func (fd *fakeDevTools) lastSession() string {
+	fd.lock.Lock()
+	defer fd.lock.Unlock()
+	if len(fd.sessions) == 0 {
+		return ""
+	}
+	return fd.sessions[len(fd.sessions)-1]
+}
+
+func TestRemoteDebuggerURL(t *testing.T) {
+	assert := assert.New(t)
+	for addr, expected := range map[string]string{
+		"9222":                   "http://127.0.0.1:9222",
+		"chrome.internal:9222":   "http://chrome.internal:9222",
+		"http://127.0.0.1:9222/": "http://127.0.0.1:9222/",
+		"ws://127.0.0.1:9222/devtools/browser/8d2c": "ws://127.0.0.1:9222/devtools/browser/8d2c",
+	} {
+		debuggerURL, err := remoteDebuggerURL(addr)
+		assert.NoError(err, addr)
+		assert.Equal(expected, debuggerURL, addr)
+	}
+	for _, addr := range []string{"", "ftp://127.0.0.1:9222", "http://"} {
+		_, err := remoteDebuggerURL(addr)
+		assert.Error(err, addr)
+	}
+}
+
+func TestNewRemoteChromeBrowserErrors(t *testing.T) {
+	assert := assert.New(t)
+	// Nothing listens on the port
+	_, err := NewRemoteChromeBrowser("127.0.0.1:1", nil, logrus.New())
+	assert.Error(err)
+	// A proxy cannot be added to a Chrome which is already running
+	_, err = NewRemoteChromeBrowser("9222", TorProfile(), logrus.New())
+	assert.Error(err)
+}
+
+func TestNewChromeBrowserFailsToLaunch(t *testing.T) {
+	assert := assert.New(t)
+	chromeExecPath = "/nonexistent/chrome"
+	defer func() { chromeExecPath = "" }()
+
+	// A Chrome which cannot start is an error, and cleaning up after it must
+	// not wait for a browser which never ran
+	done := make(chan error, 1)
+	go func() {
+		_, err := NewChromeBrowser(true, logrus.New())
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		assert.Error(err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("NewChromeBrowser hung after Chrome failed to start")
+	}
+
+	wd := NewWebDriver()
+	go func() { done <- wd.Init(true) }()
+	select {
+	case err := <-done:
+		assert.Error(err)
+		assert.NoError(wd.Teardown())
+	case <-time.After(10 * time.Second):
+		t.Fatal("Init hung after Chrome failed to start")
+	}
+}
+
+func TestChromeNewTabFollowsBrowser(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	devtools := newFakeDevTools()
+	defer devtools.Close()
+	cb, err := NewRemoteChromeBrowser(devtools.URL, nil, logrus.New())
+	require.NoError(t, err)
+	defer cb.Close()
+
+	policy := &RequestPolicy{BlockResourceTypes: []string{"Image"}}
+	assert.NoError(cb.SetRequestPolicy(ctx, policy))
+	assert.NoError(cb.Emulate(ctx, PhoneDevice()))
+
+	tab, err := cb.NewTab(ctx)
+	require.NoError(t, err)
+	defer tab.Close()
+	assert.Same(policy, tab.(*ChromeBrowser).interceptor.policy)
+	methods := devtools.methods(devtools.lastSession())
+	assert.Contains(methods, "Fetch.enable")
+	assert.Contains(methods, "Emulation.setDeviceMetricsOverride")
+	assert.Contains(methods, "Emulation.setUserAgentOverride")
+}
+
+func TestNavigationTracker(t *testing.T) {
+	assert := assert.New(t)
+	tracker := newNavigationTracker("main")
+	document := func(loader cdp.LoaderID, url string, redirected bool) *network.EventRequestWillBeSent {
+		ev := &network.EventRequestWillBeSent{
+			LoaderID: loader,
+			FrameID:  "main",
+			Type:     network.ResourceTypeDocument,
+			Request:  &network.Request{URL: url},
+		}
+		if redirected {
+			ev.RedirectResponse = &network.Response{Status: http.StatusFound}
+		}
+		return ev
+	}
+	committed := func(loader cdp.LoaderID, url string) *page.EventFrameNavigated {
+		return &page.EventFrameNavigated{Frame: &cdp.Frame{ID: "main", LoaderID: loader, URL: url}}
+	}
+	navigate := func(events ...interface{}) (event RecordedEvent, ok bool) {
+		for _, ev := range events {
+			event, ok = tracker.handleEvent(ev)
+		}
+		return event, ok
+	}
+
+	// Typed into the address bar and redirected by the server
+	event, ok := navigate(
+		document("1", "https://people.example/", false),
+		document("1", "https://people.example/home", true),
+		committed("1", "https://people.example/home"),
+	)
+	assert.True(ok)
+	assert.Equal("https://people.example/", event.URL)
+	assert.Empty(event.Initiator)
+
+	// A link on the page
+	event, _ = navigate(
+		&page.EventFrameRequestedNavigation{FrameID: "main", Reason: page.ClientNavigationReasonAnchorClick, URL: "https://people.example/search#top"},
+		document("2", "https://people.example/search", false),
+		committed("2", "https://people.example/search"),
+	)
+	assert.Equal("anchorClick", event.Initiator)
+
+	// A form the page asked for was cancelled, then a URL was typed
+	event, _ = navigate(
+		&page.EventFrameRequestedNavigation{FrameID: "main", Reason: page.ClientNavigationReasonFormSubmissionPost, URL: "https://people.example/opt-out"},
+		document("3", "https://people.example/privacy", false),
+		committed("3", "https://people.example/privacy"),
+	)
+	assert.Equal("https://people.example/privacy", event.URL)
+	assert.Empty(event.Initiator)
+
+	// Frames other than the main one are ignored
+	_, ok = navigate(&page.EventFrameNavigated{Frame: &cdp.Frame{ID: "ad", ParentID: "main", URL: "https://ads.example/"}})
+	assert.False(ok)
+
+	event, ok = navigate(&page.EventNavigatedWithinDocument{FrameID: "main", URL: "https://people.example/privacy#form"})
+	assert.True(ok)
+	assert.Equal(sameDocumentNavigation, event.Initiator)
+}
+
+func TestRemoteChromeSurvivesTeardown(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	devtools := newFakeDevTools()
+	defer devtools.Close()
+
+	wd := NewWebDriver()
+	require.NoError(t, wd.InitRemote(devtools.URL))
+	tab, err := wd.browser.(*ChromeBrowser).NewTab(ctx)
+	require.NoError(t, err)
+	assert.NoError(tab.Close())
+	assert.NoError(wd.Teardown())
+
+	// Only the two tabs were closed, and the browser can be attached to again
+	methods := devtools.methods("")
+	assert.NotContains(methods, "Browser.close")
+	closed := 0
+	for _, method := range methods {
+		if method == "Target.closeTarget" {
+			closed++
+		}
+	}
+	assert.Equal(2, closed)
+	require.NoError(t, wd.InitRemote(devtools.URL))
+	assert.NoError(wd.Teardown())
+	assert.NotContains(devtools.methods(""), "Browser.close")
+}
+
+func TestChromeDownloadRestoresBehaviour(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	devtools := newFakeDevTools()
+	defer devtools.Close()
+
+	wd := NewWebDriver()
+	require.NoError(t, wd.InitRemote(devtools.URL))
+	defer wd.Teardown()
+	cb := wd.browser.(*ChromeBrowser)
+	tab, err := cb.NewTab(ctx)
+	require.NoError(t, err)
+	defer tab.Close()
+	assert.True(cb.downloads == tab.(*ChromeBrowser).downloads, "tabs take turns downloading")
+
+	// Nothing is ever clicked in the fake, so the download gives up
+	timeoutCtx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+	_, err = tab.(Downloader).Download(timeoutCtx, "#report", t.TempDir())
+	assert.Error(err)
+
+	// Downloads were allowed in the tab's browser context and then put back
+	session := devtools.lastSession()
+	set := 0
+	for _, method := range devtools.methods(session) {
+		if method == "Browser.setDownloadBehavior" {
+			set++
+		}
+	}
+	assert.Equal(2, set)
+	var params struct {
+		Behavior         string `json:"behavior"`
+		BrowserContextID string `json:"browserContextId"`
+	}
+	require.NoError(t, devtools.lastParams(session, "Browser.setDownloadBehavior", &params))
+	assert.Equal("default", params.Behavior)
+	assert.Equal("context-1", params.BrowserContextID)
+}
+
+func TestChromeEmulatePhoneThenDesktop(t *testing.T) {
+	ctx := context.Background()
+	for name, test := range map[string]struct {
+		profile   *BrowserProfile
+		userAgent string
+	}{
+		"browser's own user agent": {},
+		"profile's user agent":     {&BrowserProfile{Name: "ua", UserAgent: "ProfileAgent/1.0"}, "ProfileAgent/1.0"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			devtools := newFakeDevTools()
+			defer devtools.Close()
+			cb, err := NewRemoteChromeBrowser(devtools.URL, test.profile, logrus.New())
+			require.NoError(t, err)
+			defer cb.Close()
+
+			override := struct {
+				UserAgent string `json:"userAgent"`
+			}{}
+			assert.NoError(cb.Emulate(ctx, PhoneDevice()))
+			assert.NoError(devtools.lastParams(devtools.lastSession(), "Emulation.setUserAgentOverride", &override))
+			assert.Equal(PhoneDevice().UserAgent, override.UserAgent)
+
+			// The desktop has no user agent, so the phone's must not stay
+			assert.NoError(cb.Emulate(ctx, DesktopDevice()))
+			assert.NoError(devtools.lastParams(devtools.lastSession(), "Emulation.setUserAgentOverride", &override))
+			assert.Equal(test.userAgent, override.UserAgent)
+		})
+	}
+}
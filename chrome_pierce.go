@@ -0,0 +1,286 @@
+package offthegrid
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/chromedp/cdproto/cdp"
+	"github.com/chromedp/cdproto/dom"
+	"github.com/chromedp/cdproto/runtime"
+	"github.com/chromedp/chromedp"
+)
+
+// piercePollInterval is how often waiting on a pierced selector checks again
+const piercePollInterval = 100 * time.Millisecond
+
+// piercedNode is a node found by a pierced selector
+type piercedNode struct {
+	id cdp.NodeID
+	// xpath is the pierced XPath of the node
+	xpath string
+}
+
+// xpathWithinFunction evaluates an XPath within a document or shadow root
+const xpathWithinFunction = `function(path) {
+	const doc = this.ownerDocument || this;
+	const result = doc.evaluate('.' + path, this, null, XPathResult.ORDERED_NODE_SNAPSHOT_TYPE, null);
+	const nodes = [];
+	for (let i = 0; i < result.snapshotLength; i++) {
+		nodes.push(result.snapshotItem(i));
+	}
+	return nodes;
+}`
+
+// relativeXPathFunction returns the XPath of an element within its document
+// or shadow root
+const relativeXPathFunction = `function() {
+	const steps = [];
+	for (let el = this; el && el.nodeType === Node.ELEMENT_NODE; el = el.parentNode) {
+		let position = 1;
+		for (let sibling = el.previousElementSibling; sibling; sibling = sibling.previousElementSibling) {
+			if (sibling.nodeName === el.nodeName) {
+				position++;
+			}
+		}
+		steps.unshift(el.nodeName.toLowerCase() + '[' + position + ']');
+	}
+	return '/' + steps.join('/');
+}`
+
+// visibleFunction reports whether an element takes up space and is not hidden
+const visibleFunction = `function() {
+	const box = this.getBoundingClientRect();
+	const style = (this.ownerDocument.defaultView || window).getComputedStyle(this);
+	return box.width > 0 && box.height > 0 && style.visibility !== 'hidden' && style.display !== 'none';
+}`
+
+// pierce finds the nodes matching a pierced selector. Each part is evaluated
+// within the documents of the iframes, and the open shadow roots, of the
+// elements the part before it matched. Cross-origin iframes can be entered
+// because the browser is started with site isolation turned off.
+func pierce(ctx context.Context, selector string) ([]piercedNode, error) {
+	document, _, err := runtime.Evaluate("document").Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	documentID, err := dom.RequestNode(document.ObjectID).Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	scopes := []piercedNode{{id: documentID}}
+	parts := pierceParts(selector)
+	for i, part := range parts {
+		var matches []piercedNode
+		for _, scope := range scopes {
+			found, err := queryWithin(ctx, scope.id, part)
+			if err != nil {
+				return nil, err
+			}
+			for _, id := range found {
+				xpath, err := callOnNode(ctx, id, relativeXPathFunction)
+				if err != nil {
+					return nil, err
+				}
+				if scope.xpath != "" {
+					xpath = Pierce(scope.xpath, xpath)
+				}
+				matches = append(matches, piercedNode{id: id, xpath: xpath})
+			}
+		}
+		if i == len(parts)-1 {
+			return matches, nil
+		}
+		scopes = scopes[:0]
+		for _, match := range matches {
+			roots, err := enterNode(ctx, match.id)
+			if err != nil {
+				return nil, err
+			}
+			for _, root := range roots {
+				scopes = append(scopes, piercedNode{id: root, xpath: match.xpath})
+			}
+		}
+	}
+	return nil, nil
+}
+
+// queryWithin evaluates a CSS selector or XPath within a document or shadow root
+func queryWithin(ctx context.Context, scope cdp.NodeID, selector string) ([]cdp.NodeID, error) {
+	if !isXPath(selector) {
+		return dom.QuerySelectorAll(scope, selector).Do(ctx)
+	}
+	object, err := dom.ResolveNode().WithNodeID(scope).Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	path, err := json.Marshal(selector)
+	if err != nil {
+		return nil, err
+	}
+	nodes, exception, err := runtime.CallFunctionOn(xpathWithinFunction).
+		WithObjectID(object.ObjectID).
+		WithArguments([]*runtime.CallArgument{{Value: path}}).
+		Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if exception != nil {
+		return nil, exception
+	}
+	properties, _, _, exception, err := runtime.GetProperties(nodes.ObjectID).WithOwnProperties(true).Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if exception != nil {
+		return nil, exception
+	}
+	var ids []cdp.NodeID
+	for _, property := range properties {
+		if property.Value == nil || property.Value.Subtype != runtime.SubtypeNode {
+			continue
+		}
+		id, err := dom.RequestNode(property.Value.ObjectID).Do(ctx)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// enterNode returns the document of an iframe or the open shadow roots of
+// an element
+func enterNode(ctx context.Context, id cdp.NodeID) ([]cdp.NodeID, error) {
+	described, err := dom.DescribeNode().WithNodeID(id).WithPierce(true).Do(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var roots []cdp.BackendNodeID
+	if described.ContentDocument != nil {
+		roots = append(roots, described.ContentDocument.BackendNodeID)
+	}
+	for _, shadowRoot := range described.ShadowRoots {
+		if shadowRoot.ShadowRootType == cdp.ShadowRootTypeOpen {
+			roots = append(roots, shadowRoot.BackendNodeID)
+		}
+	}
+	if len(roots) == 0 {
+		return nil, nil
+	}
+	return dom.PushNodesByBackendIDsToFrontend(roots).Do(ctx)
+}
+
+// callOnNode calls a javascript function with the node as this and returns
+// its result, which must be a string or a bool
+func callOnNode(ctx context.Context, id cdp.NodeID, function string) (string, error) {
+	object, err := dom.ResolveNode().WithNodeID(id).Do(ctx)
+	if err != nil {
+		return "", err
+	}
+	result, exception, err := runtime.CallFunctionOn(function).
+		WithObjectID(object.ObjectID).
+		WithReturnByValue(true).
+		Do(ctx)
+	if err != nil {
+		return "", err
+	}
+	if exception != nil {
+		return "", exception
+	}
+	var value interface{}
+	if err = json.Unmarshal(result.Value, &value); err != nil {
+		return "", err
+	}
+	return fmt.Sprint(value), nil
+}
+
+// piercedFirst waits for a node to match a pierced selector, and to be
+// visible if visible is set, then runs f on it
+func (cb *ChromeBrowser) piercedFirst(ctx context.Context, selector string, visible bool, f func(ctx context.Context, node piercedNode) error) error {
+	return cb.run(ctx, chromedp.ActionFunc(func(ctx context.Context) error {
+		for {
+			nodes, err := pierce(ctx, selector)
+			if err != nil {
+				return err
+			}
+			if len(nodes) > 0 {
+				shown := "true"
+				if visible {
+					if shown, err = callOnNode(ctx, nodes[0].id, visibleFunction); err != nil {
+						return err
+					}
+				}
+				if shown == "true" {
+					return f(ctx, nodes[0])
+				}
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(piercePollInterval):
+			}
+		}
+	}))
+}
+
+// piercedNodes snapshots every node matching a pierced selector
+func (cb *ChromeBrowser) piercedNodes(ctx context.Context, selector string) (nodes []*Node, err error) {
+	err = cb.run(ctx, chromedp.ActionFunc(func(ctx context.Context) error {
+		matches, err := pierce(ctx, selector)
+		if err != nil {
+			return err
+		}
+		for _, match := range matches {
+			described, err := dom.DescribeNode().WithNodeID(match.id).Do(ctx)
+			if err != nil {
+				return err
+			}
+			node := nodeFromCDP(described)
+			node.XPath = match.xpath
+			nodes = append(nodes, node)
+		}
+		return nil
+	}))
+	return nodes, err
+}
+
+// piercedInnerHTML returns the inner HTML of the first node matching a pierced selector
+func (cb *ChromeBrowser) piercedInnerHTML(ctx context.Context, selector string) (body string, err error) {
+	err = cb.piercedFirst(ctx, selector, false, func(ctx context.Context, node piercedNode) error {
+		body, err = callOnNode(ctx, node.id, `function() { return this.innerHTML; }`)
+		return err
+	})
+	return body, err
+}
+
+// piercedOuterHTML returns the outer HTML of the first node matching a pierced selector
+func (cb *ChromeBrowser) piercedOuterHTML(ctx context.Context, selector string) (body string, err error) {
+	err = cb.piercedFirst(ctx, selector, false, func(ctx context.Context, node piercedNode) error {
+		body, err = dom.GetOuterHTML().WithNodeID(node.id).Do(ctx)
+		return err
+	})
+	return body, err
+}
+
+// piercedClick clicks the first visible node matching a pierced selector
+func (cb *ChromeBrowser) piercedClick(ctx context.Context, selector string) error {
+	return cb.piercedFirst(ctx, selector, true, func(ctx context.Context, node piercedNode) error {
+		return chromedp.MouseClickNode(&cdp.Node{NodeID: node.id}).Do(ctx)
+	})
+}
+
+// piercedSendKeys types into the first visible node matching a pierced selector
+func (cb *ChromeBrowser) piercedSendKeys(ctx context.Context, selector, value string) error {
+	return cb.piercedFirst(ctx, selector, true, func(ctx context.Context, node piercedNode) error {
+		return chromedp.KeyEventNode(&cdp.Node{NodeID: node.id}, value).Do(ctx)
+	})
+}
+
+// piercedScrollIntoView scrolls the first node matching a pierced selector into view
+func (cb *ChromeBrowser) piercedScrollIntoView(ctx context.Context, selector string) error {
+	return cb.piercedFirst(ctx, selector, false, func(ctx context.Context, node piercedNode) error {
+		return dom.ScrollIntoViewIfNeeded().WithNodeID(node.id).Do(ctx)
+	})
+}
@@ -0,0 +1,151 @@
+package offthegrid
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// CodeProvider supplies the one-time codes sites ask for after the password
+type CodeProvider interface {
+	Code(ctx context.Context) (string, error)
+}
+
+// TerminalCodeProvider asks for the code on a terminal
+type TerminalCodeProvider struct {
+	// Prompt is written before reading. A default prompt is used when empty.
+	Prompt string
+	// In and Out default to os.Stdin and os.Stdout
+	In  io.Reader
+	Out io.Writer
+}
+
+// Code prompts for a code and reads it from the next line of input
+func (tcp TerminalCodeProvider) Code(ctx context.Context) (string, error) {
+	in, out, prompt := tcp.In, tcp.Out, tcp.Prompt
+	if in == nil {
+		in = os.Stdin
+	}
+	if out == nil {
+		out = os.Stdout
+	}
+	if prompt == "" {
+		prompt = "Enter the one-time code: "
+	}
+	fmt.Fprint(out, prompt)
+	type line struct {
+		text string
+		err  error
+	}
+	read := make(chan line, 1)
+	// The read cannot be interrupted, so it is abandoned if ctx is done first
+	go func() {
+		text, err := bufio.NewReader(in).ReadString('\n')
+		if err == io.EOF && text != "" {
+			err = nil
+		}
+		read <- line{text: strings.TrimSpace(text), err: err}
+	}()
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case result := <-read:
+		return result.text, result.err
+	}
+}
+
+// TOTPCodeProvider generates time-based codes (RFC 6238) from the secret an
+// authenticator app would be set up with
+type TOTPCodeProvider struct {
+	// Secret is the base32 secret, as shown when setting up an authenticator
+	Secret string
+	// Digits defaults to 6 and may be at most 9. Period defaults to 30
+	// seconds and may not be shorter than a second.
+	Digits int
+	Period time.Duration
+	// now returns the current time, so that tests can fix it
+	now func() time.Time
+}
+
+// Code returns the code for the current time period
+func (tcp TOTPCodeProvider) Code(ctx context.Context) (string, error) {
+	now := time.Now
+	if tcp.now != nil {
+		now = tcp.now
+	}
+	digits, period := tcp.Digits, tcp.Period
+	if digits == 0 {
+		digits = 6
+	}
+	if period == 0 {
+		period = 30 * time.Second
+	}
+	// A longer code would not fit in the 31 bits it is taken from
+	if digits < 1 || digits > 9 {
+		return "", fmt.Errorf("a TOTP code must have between 1 and 9 digits, not %d", digits)
+	}
+	if period < time.Second {
+		return "", fmt.Errorf("a TOTP period must be at least a second, not %s", period)
+	}
+	secret := strings.ToUpper(strings.ReplaceAll(tcp.Secret, " ", ""))
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(strings.TrimRight(secret, "="))
+	if err != nil {
+		return "", fmt.Errorf("could not decode the TOTP secret: %w", err)
+	}
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(now().Unix()/int64(period/time.Second)))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	modulus := uint32(1)
+	for i := 0; i < digits; i++ {
+		modulus *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, value%modulus), nil
+}
+
+// FileCodeProvider waits for a code to be written to a file, such as by a
+// script which reads it from a text message. The file is removed once read.
+type FileCodeProvider struct {
+	Path string
+	// PollInterval defaults to a second
+	PollInterval time.Duration
+}
+
+// Code waits until the file exists and holds a code
+func (fcp FileCodeProvider) Code(ctx context.Context) (string, error) {
+	interval := fcp.PollInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		contents, err := ioutil.ReadFile(fcp.Path)
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		if code := strings.TrimSpace(string(contents)); code != "" {
+			if err = os.Remove(fcp.Path); err != nil {
+				return "", err
+			}
+			return code, nil
+		}
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package offthegrid
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTOTPCodeProvider(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	// The SHA1 test vectors from RFC 6238
+	provider := TOTPCodeProvider{
+		Secret: "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ",
+		Digits: 8,
+		now:    func() time.Time { return time.Unix(59, 0) },
+	}
+	code, err := provider.Code(ctx)
+	assert.NoError(err)
+	assert.Equal("94287082", code)
+
+	provider.now = func() time.Time { return time.Unix(1111111109, 0) }
+	code, err = provider.Code(ctx)
+	assert.NoError(err)
+	assert.Equal("07081804", code)
+
+	provider.Digits = 0
+	code, err = provider.Code(ctx)
+	assert.NoError(err)
+	assert.Equal("081804", code)
+
+	// Settings which would divide by zero or overflow are refused
+	for _, bad := range []TOTPCodeProvider{
+		{Secret: provider.Secret, Period: 500 * time.Millisecond},
+		{Secret: provider.Secret, Period: -time.Second},
+		{Secret: provider.Secret, Digits: 10},
+		{Secret: provider.Secret, Digits: -1},
+	} {
+		_, err = bad.Code(ctx)
+		assert.Error(err, "%+v", bad)
+	}
+
+	provider.Secret = "not base32!"
+	_, err = provider.Code(ctx)
+	assert.Error(err)
+}
+
+func TestTerminalCodeProvider(t *testing.T) {
+	assert := assert.New(t)
+	var out bytes.Buffer
+	provider := TerminalCodeProvider{In: strings.NewReader(" 123456 \n"), Out: &out}
+	code, err := provider.Code(context.Background())
+	assert.NoError(err)
+	assert.Equal("123456", code)
+	assert.Equal("Enter the one-time code: ", out.String())
+}
+
+func TestFileCodeProvider(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "code.txt")
+	provider := FileCodeProvider{Path: path, PollInterval: 10 * time.Millisecond}
+
+	go func() {
+		time.Sleep(30 * time.Millisecond)
+		ioutil.WriteFile(path, []byte("654321\n"), 0600)
+	}()
+	code, err := provider.Code(context.Background())
+	assert.NoError(err)
+	assert.Equal("654321", code)
+	_, err = os.Stat(path)
+	assert.True(os.IsNotExist(err), "the code should only be used once")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+	defer cancel()
+	_, err = provider.Code(ctx)
+	assert.Equal(context.DeadlineExceeded, err)
+}
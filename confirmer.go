@@ -0,0 +1,314 @@
+package offthegrid
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Decision is a Confirmer's answer about a single item
+type Decision int
+
+const (
+	// ConfirmAccept acts on the item
+	ConfirmAccept Decision = iota
+	// ConfirmSkip leaves the item alone
+	ConfirmSkip
+	// ConfirmAcceptAll acts on this item and every one after it
+	ConfirmAcceptAll
+	// ConfirmSkipAll leaves this item and every one after it alone
+	ConfirmSkipAll
+	// ConfirmUndo takes back the previous decision and asks about that item again
+	ConfirmUndo
+	// ConfirmQuit stops asking. Items accepted so far are still acted on.
+	ConfirmQuit
+)
+
+// String names the decision
+func (d Decision) String() string {
+	switch d {
+	case ConfirmAccept:
+		return "accept"
+	case ConfirmSkip:
+		return "skip"
+	case ConfirmAcceptAll:
+		return "accept all"
+	case ConfirmSkipAll:
+		return "skip all"
+	case ConfirmUndo:
+		return "undo"
+	case ConfirmQuit:
+		return "quit"
+	}
+	return fmt.Sprintf("Decision(%d)", int(d))
+}
+
+// Confirmer decides whether to act on each item, usually by asking someone
+type Confirmer interface {
+	Confirm(ctx context.Context, item *Item) (Decision, error)
+}
+
+// ActionSummary reports what ConfirmAndActOnItems did
+type ActionSummary struct {
+	// Found is the number of items with an action button
+	Found int
+	// Filtered is the number of items the ItemDecider turned down before
+	// the Confirmer was asked
+	Filtered int
+	Clicked  int
+	// Skipped holds the items the Confirmer turned down
+	Skipped []*Item
+	// Quit is set if the Confirmer stopped the run early
+	Quit bool
+}
+
+// ConfirmAndActOnItems iterates the items described by the spec, asks the
+// confirmer about every item the decider accepts, then clicks the action
+// button of each confirmed item. Nothing is clicked until every question has
+// been answered, so a decision can be undone. A nil decider accepts everything.
+func (wd *WebDriver) ConfirmAndActOnItems(ctx context.Context, spec ItemSpec, decide ItemDecider, confirmer Confirmer) (summary *ActionSummary, err error) {
+	items, err := wd.IterateItems(ctx, spec)
+	if err != nil {
+		return nil, err
+	}
+	summary = &ActionSummary{}
+	var candidates []*Item
+	for _, item := range items {
+		if item.Action == nil {
+			continue
+		}
+		summary.Found++
+		if decide != nil {
+			act, err := decide(ctx, item)
+			if err != nil {
+				return summary, err
+			}
+			if !act {
+				summary.Filtered++
+				continue
+			}
+		}
+		candidates = append(candidates, item)
+	}
+
+	accepted, err := confirmItems(ctx, candidates, confirmer, summary)
+	if err != nil {
+		return summary, err
+	}
+	for _, item := range accepted {
+		if err = wd.click(ctx, item.Action.XPath); err != nil {
+			wd.log.WithFields(logrus.Fields{
+				"error": err,
+				"xpath": item.Action.XPath,
+			}).Error("Could not click the item's action button")
+			return summary, err
+		}
+		summary.Clicked++
+	}
+	return summary, nil
+}
+
+// confirmItems asks the confirmer about each item in turn and returns the
+// accepted ones. Skipped items and quitting are recorded in the summary.
+func confirmItems(ctx context.Context, items []*Item, confirmer Confirmer, summary *ActionSummary) (accepted []*Item, err error) {
+	decisions := make([]Decision, len(items))
+	decided := 0
+	for decided < len(items) {
+		decision, err := confirmer.Confirm(ctx, items[decided])
+		if err != nil {
+			return nil, err
+		}
+		switch decision {
+		case ConfirmAccept, ConfirmSkip:
+			decisions[decided] = decision
+			decided++
+		case ConfirmAcceptAll, ConfirmSkipAll:
+			for ; decided < len(items); decided++ {
+				decisions[decided] = ConfirmAccept
+				if decision == ConfirmSkipAll {
+					decisions[decided] = ConfirmSkip
+				}
+			}
+		case ConfirmUndo:
+			if decided > 0 {
+				decided--
+			}
+		case ConfirmQuit:
+			summary.Quit = true
+			items = items[:decided]
+		default:
+			return nil, fmt.Errorf("unknown decision %s", decision)
+		}
+	}
+	for i, item := range items {
+		if decisions[i] == ConfirmAccept {
+			accepted = append(accepted, item)
+		} else {
+			summary.Skipped = append(summary.Skipped, item)
+		}
+	}
+	return accepted, nil
+}
+
+// AlwaysYes is a Confirmer which accepts every item
+type AlwaysYes struct{}
+
+// Confirm accepts the item
+func (AlwaysYes) Confirm(ctx context.Context, item *Item) (Decision, error) {
+	return ConfirmAccept, nil
+}
+
+// ConfirmRule decides about items whose field contains some text
+type ConfirmRule struct {
+	Field    string
+	Contains string
+	Decision Decision
+}
+
+// RuleConfirmer decides about each item with the first rule matching it,
+// falling back to Default
+type RuleConfirmer struct {
+	Rules   []ConfirmRule
+	Default Decision
+}
+
+// Confirm applies the rules to the item
+func (rc RuleConfirmer) Confirm(ctx context.Context, item *Item) (Decision, error) {
+	for _, rule := range rc.Rules {
+		if strings.Contains(item.Field(rule.Field), rule.Contains) {
+			return rule.Decision, nil
+		}
+	}
+	return rc.Default, nil
+}
+
+// ScriptedConfirmer answers with a fixed list of decisions, which makes
+// conversations with a Confirmer easy to test
+type ScriptedConfirmer struct {
+	Decisions []Decision
+	// Asked records every item the confirmer was asked about
+	Asked []*Item
+}
+
+// Confirm returns the next scripted decision
+func (sc *ScriptedConfirmer) Confirm(ctx context.Context, item *Item) (Decision, error) {
+	if len(sc.Asked) >= len(sc.Decisions) {
+		return ConfirmQuit, fmt.Errorf("the script ran out of decisions after %d items", len(sc.Decisions))
+	}
+	sc.Asked = append(sc.Asked, item)
+	return sc.Decisions[len(sc.Asked)-1], nil
+}
+
+// TerminalConfirmer asks about each item on a terminal. Answers are read a
+// line at a time, so it works over SSH and when input is piped in; the end
+// of the input quits.
+type TerminalConfirmer struct {
+	// In and Out default to os.Stdin and os.Stdout
+	In  io.Reader
+	Out io.Writer
+	// Describe renders an item for the question. By default its fields are listed.
+	Describe func(item *Item) string
+
+	// lines carries the answers read by a single goroutine, which lives as
+	// long as the input. An answer typed while nobody is asking waits for
+	// the next question rather than being lost.
+	start   sync.Once
+	lines   chan string
+	readErr error
+}
+
+// terminalAnswers maps what may be typed to the decision it stands for
+var terminalAnswers = map[string]Decision{
+	"y": ConfirmAccept,
+	"n": ConfirmSkip,
+	"a": ConfirmAcceptAll,
+	"s": ConfirmSkipAll,
+	"u": ConfirmUndo,
+	"q": ConfirmQuit,
+}
+
+// Confirm describes the item and asks until a valid answer is given
+func (tc *TerminalConfirmer) Confirm(ctx context.Context, item *Item) (Decision, error) {
+	tc.start.Do(tc.startReading)
+	out := tc.Out
+	if out == nil {
+		out = os.Stdout
+	}
+	describe := tc.Describe
+	if describe == nil {
+		describe = describeFields
+	}
+	fmt.Fprintf(out, "------------------------\n%s\n------------------------\n", describe(item))
+	for {
+		fmt.Fprint(out, "Would you like to act on this? (y)es, (n)o, (a)ll, (s)kip all, (u)ndo, (q)uit: ")
+		answer, err := tc.readLine(ctx)
+		if err == io.EOF {
+			fmt.Fprintln(out)
+			return ConfirmQuit, nil
+		}
+		if err != nil {
+			return ConfirmQuit, err
+		}
+		if decision, ok := terminalAnswers[strings.ToLower(answer)]; ok {
+			return decision, nil
+		}
+	}
+}
+
+// startReading starts the goroutine which reads the input a line at a time
+func (tc *TerminalConfirmer) startReading() {
+	in := tc.In
+	if in == nil {
+		in = os.Stdin
+	}
+	tc.lines = make(chan string)
+	go func() {
+		defer close(tc.lines)
+		reader := bufio.NewReader(in)
+		for {
+			text, err := reader.ReadString('\n')
+			if text != "" {
+				tc.lines <- strings.TrimSpace(text)
+			}
+			if err != nil {
+				// Set before the channel is closed, so readLine sees it
+				tc.readErr = err
+				return
+			}
+		}
+	}()
+}
+
+// readLine returns the next answer, giving up if ctx is done first
+func (tc *TerminalConfirmer) readLine(ctx context.Context) (string, error) {
+	select {
+	case <-ctx.Done():
+		return "", ctx.Err()
+	case text, ok := <-tc.lines:
+		if !ok {
+			return "", tc.readErr
+		}
+		return text, nil
+	}
+}
+
+// describeFields lists an item's fields in name order
+func describeFields(item *Item) string {
+	names := make([]string, 0, len(item.Fields))
+	for name := range item.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	lines := make([]string, 0, len(names))
+	for _, name := range names {
+		lines = append(lines, fmt.Sprintf("%s: %s", name, item.Fields[name]))
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,115 @@
+package offthegrid
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConfirmItems(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	var items []*Item
+	for i := 0; i < 4; i++ {
+		items = append(items, &Item{Index: i, Fields: map[string]string{"name": fmt.Sprint(i)}})
+	}
+
+	summary := &ActionSummary{}
+	confirmer := &ScriptedConfirmer{Decisions: []Decision{ConfirmAccept, ConfirmUndo, ConfirmSkip, ConfirmAcceptAll}}
+	accepted, err := confirmItems(ctx, items, confirmer, summary)
+	assert.NoError(err)
+	assert.Equal(items[1:], accepted)
+	assert.Equal(items[:1], summary.Skipped)
+	assert.Equal([]*Item{items[0], items[1], items[0], items[1]}, confirmer.Asked)
+
+	// Quitting keeps what was decided and drops the rest
+	summary = &ActionSummary{}
+	confirmer = &ScriptedConfirmer{Decisions: []Decision{ConfirmAccept, ConfirmQuit}}
+	accepted, err = confirmItems(ctx, items, confirmer, summary)
+	assert.NoError(err)
+	assert.Equal(items[:1], accepted)
+	assert.Empty(summary.Skipped)
+	assert.True(summary.Quit)
+
+	// A script which runs out is an error
+	_, err = confirmItems(ctx, items, &ScriptedConfirmer{}, &ActionSummary{})
+	assert.Error(err)
+}
+
+func TestRuleConfirmer(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	confirmer := RuleConfirmer{
+		Rules:   []ConfirmRule{{Field: "category", Contains: "Baby", Decision: ConfirmSkip}},
+		Default: ConfirmAccept,
+	}
+	decision, err := confirmer.Confirm(ctx, &Item{Fields: map[string]string{"category": "Baby,"}})
+	assert.NoError(err)
+	assert.Equal(ConfirmSkip, decision)
+	decision, err = confirmer.Confirm(ctx, &Item{Fields: map[string]string{"category": "Snacks,"}})
+	assert.NoError(err)
+	assert.Equal(ConfirmAccept, decision)
+}
+
+func TestConfirmAndActOnItemsWithTerminal(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	hb := NewHTMLBrowser(newFakeListingSite())
+	wd := NewWebDriverWithBrowser(hb)
+	assert.NoError(wd.GoToPage(ctx, "https://people.example/"))
+
+	// An unknown answer is asked again, and undo goes back to Jane
+	var out bytes.Buffer
+	confirmer := &TerminalConfirmer{In: strings.NewReader("x\nn\nu\ny\ny\n"), Out: &out}
+	summary, err := wd.ConfirmAndActOnItems(ctx, fakeListingSpec, nil, confirmer)
+	assert.NoError(err)
+	assert.Equal(2, summary.Found)
+	assert.Equal(2, summary.Clicked)
+	assert.False(summary.Quit)
+	assert.Len(hb.Clicks(), 2)
+	assert.Contains(out.String(), "name: Jane Doe\nstate: CO")
+
+	// The end of the input quits without clicking anything more
+	confirmer = &TerminalConfirmer{In: strings.NewReader(""), Out: &out}
+	summary, err = wd.ConfirmAndActOnItems(ctx, fakeListingSpec, func(ctx context.Context, item *Item) (bool, error) {
+		return item.Field("age") != "12", nil
+	}, confirmer)
+	assert.NoError(err)
+	assert.True(summary.Quit)
+	assert.Equal(1, summary.Filtered)
+	assert.Equal(0, summary.Clicked)
+	assert.Len(hb.Clicks(), 2)
+}
+
+func TestTerminalConfirmerKeepsAnswersAfterCancel(t *testing.T) {
+	assert := assert.New(t)
+	in, typing := io.Pipe()
+	confirmer := &TerminalConfirmer{In: in, Out: ioutil.Discard}
+	item := &Item{Fields: map[string]string{"name": "Jane Doe"}}
+
+	// Nobody answers in time
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := confirmer.Confirm(ctx, item)
+	assert.True(errors.Is(err, context.DeadlineExceeded))
+
+	// The answer typed afterwards goes to the next question
+	go func() {
+		typing.Write([]byte("n\n"))
+		typing.Close()
+	}()
+	decision, err := confirmer.Confirm(context.Background(), item)
+	assert.NoError(err)
+	assert.Equal(ConfirmSkip, decision)
+	decision, err = confirmer.Confirm(context.Background(), item)
+	assert.NoError(err)
+	assert.Equal(ConfirmQuit, decision)
+}
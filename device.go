@@ -0,0 +1,151 @@
+package offthegrid
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// The names of the device presets
+const (
+	DevicePhone   = "phone"
+	DeviceTablet  = "tablet"
+	DeviceDesktop = "desktop"
+)
+
+// Device describes the screen and input of a device for the browser to
+// pretend to be. Mobile sites are often lighter, with simpler pages.
+type Device struct {
+	Name string `yaml:"name" json:"name"`
+	// Width and Height are the viewport's size in CSS pixels
+	Width  int `yaml:"width" json:"width"`
+	Height int `yaml:"height" json:"height"`
+	// ScaleFactor is the number of device pixels per CSS pixel
+	ScaleFactor float64 `yaml:"scaleFactor,omitempty" json:"scaleFactor,omitempty"`
+	// Mobile lays pages out as a mobile browser would, with a meta viewport
+	Mobile bool `yaml:"mobile,omitempty" json:"mobile,omitempty"`
+	Touch  bool `yaml:"touch,omitempty" json:"touch,omitempty"`
+	// UserAgent replaces the browser's own when it is set
+	UserAgent string `yaml:"userAgent,omitempty" json:"userAgent,omitempty"`
+	// ReducedMotion asks pages to leave out their animations
+	ReducedMotion bool `yaml:"reducedMotion,omitempty" json:"reducedMotion,omitempty"`
+}
+
+// PhoneDevice is an Android phone
+func PhoneDevice() *Device {
+	return &Device{
+		Name:          DevicePhone,
+		Width:         412,
+		Height:        915,
+		ScaleFactor:   2.625,
+		Mobile:        true,
+		Touch:         true,
+		UserAgent:     "Mozilla/5.0 (Linux; Android 13; Pixel 7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/106.0.0.0 Mobile Safari/537.36",
+		ReducedMotion: true,
+	}
+}
+
+// TabletDevice is an Android tablet. Tablets leave "Mobile" out of their
+// user agent, so sites usually serve them the full pages.
+func TabletDevice() *Device {
+	return &Device{
+		Name:          DeviceTablet,
+		Width:         800,
+		Height:        1280,
+		ScaleFactor:   2,
+		Mobile:        true,
+		Touch:         true,
+		UserAgent:     "Mozilla/5.0 (Linux; Android 13; SM-X700) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/106.0.0.0 Safari/537.36",
+		ReducedMotion: true,
+	}
+}
+
+// DesktopDevice is a laptop sized window which keeps the browser's own user agent
+func DesktopDevice() *Device {
+	return &Device{
+		Name:          DeviceDesktop,
+		Width:         1366,
+		Height:        768,
+		ScaleFactor:   1,
+		ReducedMotion: true,
+	}
+}
+
+// LookupDevice returns the preset with the given name
+func LookupDevice(name string) (*Device, error) {
+	switch strings.ToLower(name) {
+	case DevicePhone:
+		return PhoneDevice(), nil
+	case DeviceTablet:
+		return TabletDevice(), nil
+	case DeviceDesktop:
+		return DesktopDevice(), nil
+	}
+	return nil, fmt.Errorf("there is no device preset named %q", name)
+}
+
+// Validate checks that the device can be emulated
+func (d *Device) Validate() error {
+	if d.Width <= 0 || d.Height <= 0 {
+		return fmt.Errorf("device %s: the viewport must have a positive size", d.Name)
+	}
+	if d.ScaleFactor < 0 {
+		return fmt.Errorf("device %s: the scale factor cannot be negative", d.Name)
+	}
+	return nil
+}
+
+// Emulator is a Browser which can pretend to be another device
+type Emulator interface {
+	// Emulate applies the device to the current tab, including the pages
+	// loaded from now on. A nil device goes back to the browser's own.
+	Emulate(ctx context.Context, device *Device) error
+}
+
+// DeviceTarget is a site module whose selectors were written against the
+// pages a particular device is served
+type DeviceTarget interface {
+	TargetDevice() *Device
+}
+
+// Emulate makes the browser pretend to be the device until it is told
+// otherwise. A nil device goes back to the browser's own.
+func (wd *WebDriver) Emulate(ctx context.Context, device *Device) error {
+	if device != nil {
+		if err := device.Validate(); err != nil {
+			return err
+		}
+	}
+	err := wd.do(ctx, "emulate", func(ctx context.Context, browser Browser) error {
+		emulator, ok := browser.(Emulator)
+		if !ok {
+			return fmt.Errorf("the browser cannot emulate devices")
+		}
+		return emulator.Emulate(ctx, device)
+	})
+	if err != nil {
+		wd.log.WithField("error", err).Error("Could not emulate the device")
+		return err
+	}
+	wd.device = device
+	return nil
+}
+
+// Device returns the device being emulated, or nil if there is none
+func (wd *WebDriver) Device() *Device {
+	return wd.device
+}
+
+// EmulateFor emulates the device the site module's selectors were written for
+func (wd *WebDriver) EmulateFor(ctx context.Context, site DeviceTarget) error {
+	return wd.Emulate(ctx, site.TargetDevice())
+}
+
+// GoToPageAs emulates the device, then navigates to the URL. The device
+// stays in place for the navigations after it.
+func (wd *WebDriver) GoToPageAs(ctx context.Context, url string, device *Device) error {
+	if err := wd.Emulate(ctx, device); err != nil {
+		return err
+	}
+	return wd.GoToPage(ctx, url)
+}
@@ -0,0 +1,128 @@
+package offthegrid
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newFakeMobileSite serves a lighter page to phones, as retailers often do
+func newFakeMobileSite() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/deals", func(w http.ResponseWriter, r *http.Request) {
+		if strings.Contains(r.UserAgent(), "Mobile") {
+			fmt.Fprint(w, `<html><body><ul id="m-deals"><li>Eggs</li></ul></body></html>`)
+			return
+		}
+		fmt.Fprint(w, `<html><body><div class="grid"><div class="deal-card">Eggs</div></div></body></html>`)
+	})
+	return mux
+}
+
+// siteForPhones is a site module written against the mobile pages
+type siteForPhones struct{}
+
+func (siteForPhones) TargetDevice() *Device {
+	return PhoneDevice()
+}
+
+func TestLookupDevice(t *testing.T) {
+	assert := assert.New(t)
+	for _, name := range []string{DevicePhone, DeviceTablet, "Desktop"} {
+		device, err := LookupDevice(name)
+		if assert.NoError(err, name) {
+			assert.Equal(strings.ToLower(name), device.Name)
+			assert.NoError(device.Validate())
+			assert.True(device.ReducedMotion)
+		}
+	}
+	phone, _ := LookupDevice(DevicePhone)
+	assert.True(phone.Mobile && phone.Touch)
+	assert.Contains(phone.UserAgent, "Mobile")
+	tablet, _ := LookupDevice(DeviceTablet)
+	assert.NotContains(tablet.UserAgent, "Mobile")
+	desktop, _ := LookupDevice(DeviceDesktop)
+	assert.Empty(desktop.UserAgent)
+
+	_, err := LookupDevice("watch")
+	assert.Error(err)
+	assert.Error((&Device{Name: "custom", Width: 0, Height: 600}).Validate())
+}
+
+func TestEmulateSwitchesPerNavigation(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	browser := NewHTMLBrowser(newFakeMobileSite())
+	wd := NewWebDriverWithBrowser(browser)
+
+	assert.NoError(wd.GoToPageAs(ctx, "https://deals.example/deals", PhoneDevice()))
+	assert.Equal(DevicePhone, wd.Device().Name)
+	assert.NotNil(wd.FetchElement(ctx, "#m-deals"))
+	userAgent, err := browser.UserAgent(ctx)
+	assert.NoError(err)
+	assert.Equal(PhoneDevice().UserAgent, userAgent)
+
+	// The device stays in place until it is changed
+	assert.NoError(wd.ReloadPage(ctx))
+	assert.NotNil(wd.FetchElement(ctx, "#m-deals"))
+
+	custom := &Device{Name: "kiosk", Width: 1080, Height: 1920, Touch: true, UserAgent: "Kiosk/1.0"}
+	assert.NoError(wd.GoToPageAs(ctx, "https://deals.example/deals", custom))
+	assert.NotNil(wd.FetchElement(ctx, ".deal-card"))
+
+	assert.NoError(wd.EmulateFor(ctx, siteForPhones{}))
+	assert.NoError(wd.GoToPage(ctx, "https://deals.example/deals"))
+	assert.NotNil(wd.FetchElement(ctx, "#m-deals"))
+
+	assert.NoError(wd.Emulate(ctx, nil))
+	assert.Nil(wd.Device())
+	assert.NoError(wd.GoToPage(ctx, "https://deals.example/deals"))
+	assert.NotNil(wd.FetchElement(ctx, ".deal-card"))
+
+	assert.Error(wd.Emulate(ctx, &Device{Name: "broken"}))
+	assert.Nil(wd.Device())
+}
+
+func TestEmulateUnsupportedBrowser(t *testing.T) {
+	assert := assert.New(t)
+	wd := NewWebDriverWithBrowser(struct{ Browser }{NewHTMLBrowser(newFakeMobileSite())})
+	assert.Error(wd.Emulate(context.Background(), PhoneDevice()))
+	assert.Nil(wd.Device())
+}
+
+func TestFlowDevice(t *testing.T) {
+	assert := assert.New(t)
+	flow, err := ParseFlow([]byte(`
+name: deals
+device: phone
+steps:
+  - action: navigate
+    url: https://deals.example/deals
+  - action: extract
+    selector: "#m-deals li"
+    into: first
+  - action: navigate
+    url: https://deals.example/deals
+    device: desktop
+  - action: assert
+    condition:
+      present: .deal-card
+`))
+	if !assert.NoError(err) {
+		return
+	}
+	wd := NewWebDriverWithBrowser(NewHTMLBrowser(newFakeMobileSite()))
+	report, err := wd.RunFlow(context.Background(), flow, FlowEnv{})
+	assert.NoError(err)
+	assert.Equal("Eggs", report.Vars["first"])
+	assert.Equal(DeviceDesktop, wd.Device().Name)
+
+	_, err = ParseFlow([]byte("name: bad\ndevice: watch\nsteps:\n  - action: navigate\n    url: https://deals.example/\n"))
+	assert.Error(err)
+	_, err = ParseFlow([]byte("name: bad\nsteps:\n  - action: navigate\n    url: https://deals.example/\n    device: watch\n"))
+	assert.Error(err)
+}
@@ -0,0 +1,135 @@
+package offthegrid
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var downloadFolder = "downloads"
+
+// defaultDownloadName is used when a download does not suggest a file name
+const defaultDownloadName = "download"
+
+// Download is a file saved by the browser into the download directory
+type Download struct {
+	// Path is where the file was saved
+	Path string `json:"path"`
+	// URL is where the file was downloaded from
+	URL      string `json:"url"`
+	MIMEType string `json:"mimeType"`
+	// Checksum is the hex encoded SHA-256 of the file's contents
+	Checksum string    `json:"checksum"`
+	Size     int64     `json:"size"`
+	Time     time.Time `json:"time"`
+}
+
+// Downloader is a Browser which can save the files that clicking on
+// links or buttons downloads
+type Downloader interface {
+	// Download clicks the first node matching the selector and waits for
+	// the download it starts to finish. The file is saved into dir, and the
+	// returned Download has at least its Path and URL set.
+	Download(ctx context.Context, clickSelector, dir string) (*Download, error)
+}
+
+// DownloadFrom clicks the selector and waits for the file it downloads to be
+// saved into DownloadDir. The file's MIME type and checksum are worked out,
+// and it is registered with the cache so it can be found again.
+func (wd *WebDriver) DownloadFrom(ctx context.Context, clickSelector string) (download *Download, err error) {
+	downloader, ok := wd.browser.(Downloader)
+	if wd.browser != nil && !ok {
+		return nil, fmt.Errorf("the browser cannot download files")
+	}
+	dir, err := filepath.Abs(wd.DownloadDir)
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	err = wd.do(ctx, "download", func(ctx context.Context, browser Browser) (err error) {
+		download, err = downloader.Download(ctx, clickSelector, dir)
+		return err
+	})
+	if err != nil {
+		return nil, actionError(ErrDownloadFailed, "download from", clickSelector, err)
+	}
+	if err = describeDownload(download); err != nil {
+		return nil, actionError(ErrDownloadFailed, "download from", clickSelector, err)
+	}
+	if err = wd.cacheManager.RegisterDownload(download); err != nil {
+		wd.log.WithField("error", err).Error("Could not register the download with the cache")
+		return download, err
+	}
+	wd.log.WithFields(logrus.Fields{
+		"path": download.Path,
+		"url":  download.URL,
+	}).Info("Downloaded a file")
+	return download, nil
+}
+
+// describeDownload fills in what can be learned from the saved file itself
+func describeDownload(download *Download) error {
+	f, err := os.Open(download.Path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// The first 512 bytes are all content sniffing looks at
+	head := make([]byte, 512)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	hasher := sha256.New()
+	hasher.Write(head[:n])
+	rest, err := io.Copy(hasher, f)
+	if err != nil {
+		return err
+	}
+	download.Checksum = hex.EncodeToString(hasher.Sum(nil))
+	download.Size = int64(n) + rest
+	if download.Time.IsZero() {
+		download.Time = time.Now()
+	}
+	if download.MIMEType == "" {
+		download.MIMEType = mime.TypeByExtension(filepath.Ext(download.Path))
+	}
+	if download.MIMEType == "" {
+		download.MIMEType = http.DetectContentType(head[:n])
+	}
+	// Drop parameters such as the charset
+	if mediaType, _, err := mime.ParseMediaType(download.MIMEType); err == nil {
+		download.MIMEType = mediaType
+	}
+	return nil
+}
+
+// uniqueDownloadPath returns a path in dir for the suggested file name which
+// does not overwrite an earlier download, numbering it as browsers do
+func uniqueDownloadPath(dir, suggested string) string {
+	name := filepath.Base(filepath.Clean("/" + strings.ReplaceAll(suggested, `\`, "/")))
+	if name == "/" || name == "." {
+		name = defaultDownloadName
+	}
+	path := filepath.Join(dir, name)
+	extension := filepath.Ext(name)
+	stem := strings.TrimSuffix(name, extension)
+	for i := 1; ; i++ {
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return path
+		}
+		path = filepath.Join(dir, fmt.Sprintf("%s (%d)%s", stem, i, extension))
+	}
+}
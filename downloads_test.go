@@ -0,0 +1,102 @@
+package offthegrid
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const fakeReceipt = "%PDF-1.4\nOpt-out request received\n%%EOF\n"
+
+// newFakeReceiptSite serves a confirmation page whose receipt can be
+// downloaded by a link or by submitting a form
+func newFakeReceiptSite() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/confirmation", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<html><body>
+<a id="receipt" href="/files/8812">Download your receipt</a>
+<form action="/export" method="post"><input name="format" value="csv"><button id="export">Export</button></form>
+<a id="home" href="/">Home</a>
+</body></html>`)
+	})
+	mux.HandleFunc("/files/8812", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Disposition", `attachment; filename="receipt.pdf"`)
+		w.Header().Set("Content-Type", "application/pdf")
+		w.Write([]byte(fakeReceipt))
+	})
+	mux.HandleFunc("/export", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "format,%s\n", r.FormValue("format"))
+	})
+	return mux
+}
+
+func TestDownloadFrom(t *testing.T) {
+	defer cleanupTestCache()
+	assert := assert.New(t)
+	ctx := context.Background()
+	hb := NewHTMLBrowser(newFakeReceiptSite())
+	wd := NewWebDriverWithBrowser(hb)
+	wd.DownloadDir = t.TempDir()
+	assert.NoError(wd.GoToPage(ctx, "https://broker.example/confirmation"))
+
+	download, err := wd.DownloadFrom(ctx, "#receipt")
+	if !assert.NoError(err) {
+		return
+	}
+	checksum := sha256.Sum256([]byte(fakeReceipt))
+	assert.Equal(filepath.Join(wd.DownloadDir, "receipt.pdf"), download.Path)
+	assert.Equal("https://broker.example/files/8812", download.URL)
+	assert.Equal("application/pdf", download.MIMEType)
+	assert.Equal(hex.EncodeToString(checksum[:]), download.Checksum)
+	assert.Equal(int64(len(fakeReceipt)), download.Size)
+	contents, err := ioutil.ReadFile(download.Path)
+	assert.NoError(err)
+	assert.Equal(fakeReceipt, string(contents))
+	// Downloading leaves the page where it was
+	assert.Equal("https://broker.example/confirmation", hb.CurrentURL())
+
+	// A second copy does not overwrite the first
+	again, err := wd.DownloadFrom(ctx, "#receipt")
+	assert.NoError(err)
+	assert.Equal(filepath.Join(wd.DownloadDir, "receipt (1).pdf"), again.Path)
+
+	// Forms can download too, and the type is sniffed when it is not given
+	export, err := wd.DownloadFrom(ctx, "#export")
+	assert.NoError(err)
+	assert.Equal(filepath.Join(wd.DownloadDir, "export"), export.Path)
+	assert.Equal("text/plain", export.MIMEType)
+
+	downloads, err := wd.cacheManager.Downloads()
+	assert.NoError(err)
+	if assert.Len(downloads, 3) {
+		assert.Equal(download.Path, downloads[0].Path)
+		assert.Equal(download.Checksum, downloads[0].Checksum)
+		assert.Equal(export.URL, downloads[2].URL)
+	}
+
+	_, err = wd.DownloadFrom(ctx, "#missing")
+	assert.ErrorIs(err, ErrDownloadFailed)
+}
+
+func TestDownloadFromUnsupportedBrowser(t *testing.T) {
+	assert := assert.New(t)
+	// Hide everything but the Browser methods
+	wd := NewWebDriverWithBrowser(struct{ Browser }{NewHTMLBrowser(newFakeReceiptSite())})
+	_, err := wd.DownloadFrom(context.Background(), "#receipt")
+	assert.Error(err)
+}
+
+func TestUniqueDownloadPath(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+	assert.Equal(filepath.Join(dir, "passwd"), uniqueDownloadPath(dir, "../../etc/passwd"))
+	assert.Equal(filepath.Join(dir, "report.pdf"), uniqueDownloadPath(dir, `C:\Users\report.pdf`))
+	assert.Equal(filepath.Join(dir, defaultDownloadName), uniqueDownloadPath(dir, ""))
+}
@@ -5,130 +5,244 @@ import (
 	"context"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
-	"os"
-	"strings"
 	"time"
 
 	"github.com/sirupsen/logrus"
-	"github.com/andybalholm/cascadia"
-	"github.com/chromedp/cdproto/cdp"
-	"github.com/chromedp/chromedp"
-	"github.com/eiannone/keyboard"
-	"golang.org/x/net/html"
 )
 
+// DefaultOperationTimeout bounds a single browser operation whose caller
+// context carries no deadline of its own.
+const DefaultOperationTimeout = time.Minute
+
 // WebDriver is a helper for hanging
 type WebDriver struct {
-	chromeDpContext  context.Context
-	cacheManager     *CacheFileManager
-	log              *logrus.Logger
-	BlacklistCoupons map[string]bool
+	browser      Browser
+	cacheManager *CacheFileManager
+	sessionStore *SessionStore
+	httpClient   *http.Client
+	sharedJar    *sessionJar
+	profile      *BrowserProfile
+	log          *logrus.Logger
+	redactor     *Redactor
+	// device is the device being emulated, set by Emulate
+	device *Device
+	// policy is the request policy set by SetRequestPolicy
+	policy *RequestPolicy
+	// headless is set while the browser started by Init has no window
+	headless bool
+	// launch starts browsers in place of Chrome, so that tests can relaunch
+	launch func(headless bool) (Browser, error)
+	// OperationTimeout is applied to any operation whose context has
+	// no deadline. Zero disables the timeout.
+	OperationTimeout time.Duration
+	// ArtifactMode says when a debug bundle is written to ArtifactDir
+	ArtifactMode ArtifactMode
+	ArtifactDir  string
+	// DownloadDir is where files downloaded by DownloadFrom are saved
+	DownloadDir string
+	// RetryPolicy says how often navigations, clicks and logins are tried
+	RetryPolicy RetryPolicy
+	// ChallengePolicy, when set, checks each page navigated to for captchas
+	// and bot checks, and waits for a person to solve them
+	ChallengePolicy *ChallengePolicy
 }
 
 // NewWebDriver creates the skeleton for a new web driver.
 // It should almost always be followed by Init() unless testing
 func NewWebDriver() *WebDriver {
+	redactor := NewRedactor()
+	logger := logrus.New()
+	logger.AddHook(redactor)
 	return &WebDriver{
-		log:              logrus.New(),
-		cacheManager:     NewCacheFileManager(),
-		BlacklistCoupons: map[string]bool{},
+		log:              logger,
+		redactor:         redactor,
+		cacheManager:     NewCacheFileManagerWithLogger(logger),
+		sessionStore:     NewSessionStore(sessionFolder),
+		OperationTimeout: DefaultOperationTimeout,
+		ArtifactMode:     CaptureNever,
+		ArtifactDir:      artifactFolder,
+		DownloadDir:      downloadFolder,
 	}
 }
 
+// NewWebDriverWithBrowser creates a web driver which drives the given
+// browser. Init() must not be called on it.
+func NewWebDriverWithBrowser(browser Browser) *WebDriver {
+	wd := NewWebDriver()
+	wd.browser = browser
+	return wd
+}
+
 // Init initializes the WebDriver and populates the
 // skeleton.
 func (wd *WebDriver) Init(headless bool) (err error) {
-	// f, err := os.OpenFile("driver.log", os.O_CREATE|os.O_RDWR, 0666)
-	// if err != nil {
-	// 	fmt.Printf("error opening file: %v", err)
-	// }
-	// wd.log.SetOutput(f)
-	wd.log.SetLevel(logrus.DebugLevel)
 	err = wd.CreateChromeDPDriver(headless)
 	if err != nil {
 		wd.log.WithField("error", err).Error("Could not create a new ChromeDP driver")
 		return err
 	}
-	wd.cacheManager = NewCacheFileManager()
+	wd.cacheManager = NewCacheFileManagerWithLogger(wd.log)
 	return nil
 }
 
-// Teardown stops all related tasks related to the driver
-func (wd *WebDriver) Teardown() {
-	err := chromedp.Cancel(wd.chromeDpContext)
+// InitRemote initializes the WebDriver by attaching to a Chrome which is
+// already running with remote debugging turned on, such as a daily browser
+// which is logged in or one in another container. The address is described
+// by NewRemoteChromeBrowser. Teardown detaches, leaving that Chrome running.
+func (wd *WebDriver) InitRemote(addr string) error {
+	browser, err := NewRemoteChromeBrowser(addr, wd.profile, wd.log)
 	if err != nil {
-		// unlinkat /var/folders/jr/l48h_6kj71n4y2q4gqjrld2w0000gn/T/chromedp-runner260946925/Default: directory not empty
-		if strings.HasPrefix(err.Error(), "unlinkat") {
-			// There was an issue cleaning up a tmp folder. Whack it manually.
-			errComponents := strings.SplitAfter(err.Error(), " ")
-			path := errComponents[1]
-			path = path[0 : len(path)-1]
-			if err2 := os.RemoveAll(path); err2 != nil {
-				wd.log.Panicf("Failed to perform fallback cleanup: %v", err2)
-			}
-		} else {
-			wd.log.Panicf("Could not cleanly teardown chromedp: %+v", err)
-		}
+		wd.log.WithField("error", err).Error("Could not attach to the running Chrome")
+		return err
+	}
+	wd.browser, wd.headless = browser, false
+	wd.cacheManager = NewCacheFileManagerWithLogger(wd.log)
+	return nil
+}
+
+// Teardown closes the browser and releases everything created by Init.
+// A browser attached by InitRemote is only detached from.
+// It is safe to call on a WebDriver which was never initialized.
+func (wd *WebDriver) Teardown() (err error) {
+	if wd.browser == nil {
+		return nil
+	}
+	err = wd.browser.Close()
+	wd.browser, wd.headless, wd.device, wd.policy = nil, false, nil, nil
+	return err
+}
+
+// UseProfile applies the profile to the browser started by Init, and to the
+// HTTP helpers straight away. It must be called before Init.
+func (wd *WebDriver) UseProfile(profile *BrowserProfile) error {
+	if err := profile.Validate(); err != nil {
+		return err
+	}
+	if wd.browser != nil {
+		return fmt.Errorf("the profile must be chosen before the browser is started")
 	}
+	wd.profile = profile
+	wd.httpClient = &http.Client{Transport: profile.transport()}
+	return nil
+}
+
+// Profile returns the profile chosen with UseProfile, if any
+func (wd *WebDriver) Profile() *BrowserProfile {
+	return wd.profile
 }
 
 // CreateChromeDPDriver spawns a new window
 func (wd *WebDriver) CreateChromeDPDriver(headless bool) error {
-	opts := []chromedp.ExecAllocatorOption{
-		chromedp.NoFirstRun,
-		chromedp.DisableGPU,
-		chromedp.NoDefaultBrowserCheck,
-		chromedp.Flag("disable-extensions", true),
-		chromedp.Flag("disable-popup-blocking", true),
-		chromedp.Flag("disable-hang-monitor", true),
-		// chromedp.UserAgent()
-	} // append( //chromedp.DefaultExecAllocatorOptions[:],
-	if headless {
-		opts = append(opts, chromedp.Headless)
+	browser, err := wd.startBrowser(headless)
+	if err != nil {
+		return err
+	}
+	wd.browser, wd.headless = browser, headless
+	return nil
+}
+
+// startBrowser launches a new browser with the web driver's profile
+func (wd *WebDriver) startBrowser(headless bool) (Browser, error) {
+	if wd.launch != nil {
+		return wd.launch(headless)
+	}
+	browser, err := NewChromeBrowserWithProfile(headless, wd.profile, wd.log)
+	if err != nil {
+		return nil, err
 	}
+	return browser, nil
+}
 
-	allocCtx, _ := chromedp.NewExecAllocator(context.Background(), opts...)
-	// defer cancel()
+// operationContext bounds ctx by OperationTimeout unless the caller
+// already set a deadline of their own.
+func (wd *WebDriver) operationContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok || wd.OperationTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, wd.OperationTimeout)
+}
 
-	// also set up a custom logger
-	taskCtx, _ := chromedp.NewContext(allocCtx, chromedp.WithLogf(log.Printf))
+// do runs a single browser action, bounded by ctx, and captures a debug
+// bundle for it according to the ArtifactMode
+func (wd *WebDriver) do(ctx context.Context, action string, operation func(ctx context.Context, browser Browser) error) error {
+	err := wd.probe(ctx, operation)
+	wd.captureArtifacts(action, err)
+	return err
+}
 
-	// defer cancel()
-	wd.chromeDpContext = taskCtx
+// probe runs a single browser operation, bounded by ctx. It is used for
+// queries whose failure is an expected answer rather than a broken action.
+func (wd *WebDriver) probe(ctx context.Context, operation func(ctx context.Context, browser Browser) error) error {
+	if wd.browser == nil {
+		return ErrNotInitialized
+	}
+	opCtx, cancel := wd.operationContext(ctx)
+	defer cancel()
+	return operation(opCtx, wd.browser)
+}
 
-	// ensure that the browser process is started
-	if err := chromedp.Run(taskCtx); err != nil {
+// GoToPage navigates to the given URL. Under a ChallengePolicy it then waits
+// for any challenge the page shows to be solved.
+func (wd *WebDriver) GoToPage(ctx context.Context, url string) error {
+	err := wd.retry(ctx, "navigate", func() error {
+		err := wd.do(ctx, "navigate", func(ctx context.Context, browser Browser) error {
+			return browser.Navigate(ctx, url)
+		})
+		return actionError(ErrNavigationFailed, "navigate", url, err)
+	})
+	if err != nil {
 		return err
 	}
-
-	return nil
+	return wd.handleChallenge(ctx)
 }
 
-// GoToPage navigates to the given URL
-func (wd *WebDriver) GoToPage(url string) error {
-	return chromedp.Run(wd.chromeDpContext, chromedp.Navigate(url))
+// CurrentURL returns the URL of the page the browser is showing
+func (wd *WebDriver) CurrentURL(ctx context.Context) (location string, err error) {
+	err = wd.do(ctx, "location", func(ctx context.Context, browser Browser) (err error) {
+		location, err = browser.Location(ctx)
+		return err
+	})
+	return location, err
 }
 
 // GetInnerHTMLOfElement returns the raw HTML of a web element using
-// the chromedp driver. This is useful for forms with javascript
+// the browser. This is useful for forms with javascript
 // rendering and to maintain session.
-func (wd *WebDriver) GetInnerHTMLOfElement(elementName string) (body string, err error) {
-	err = chromedp.Run(wd.chromeDpContext,
-		chromedp.InnerHTML(elementName, &body), //, chromedp.NodeVisible),
-	)
+func (wd *WebDriver) GetInnerHTMLOfElement(ctx context.Context, elementName string) (body string, err error) {
+	err = wd.do(ctx, "inner-html", func(ctx context.Context, browser Browser) (err error) {
+		body, err = browser.InnerHTML(ctx, elementName)
+		return err
+	})
+	err = actionError(ErrElementNotFound, "read", elementName, err)
 	if err != nil {
 		wd.log.WithField("error", err).Error("Could not fetch page")
 	}
 	return body, err
 }
 
+// FindElements waits for the selector to match and returns every node it
+// matches. An error matching ErrElementNotFound is returned if nothing does.
+func (wd *WebDriver) FindElements(ctx context.Context, selector string) (elements []*Node, err error) {
+	err = wd.probe(ctx, func(ctx context.Context, browser Browser) (err error) {
+		if err = browser.WaitReady(ctx, selector); err != nil {
+			return err
+		}
+		elements, err = browser.Nodes(ctx, selector)
+		return err
+	})
+	if err == nil && len(elements) == 0 {
+		err = fmt.Errorf("no node matches %q", selector)
+	}
+	return elements, actionError(ErrElementNotFound, "find", selector, err)
+}
+
 // FetchElements returns a slice of all nodes that match the selector
 // nil is returned in the case that nothing is found.
-func (wd *WebDriver) FetchElements(selector string) (elements []*cdp.Node) {
-	if err := chromedp.Run(wd.chromeDpContext, chromedp.Nodes(selector, &elements)); err != nil {
-		wd.log.WithField("error", err).Debug("Could not find any coupon buttons")
+func (wd *WebDriver) FetchElements(ctx context.Context, selector string) (elements []*Node) {
+	elements, err := wd.FindElements(ctx, selector)
+	if err != nil {
+		wd.log.WithField("error", err).Debug("Could not find any matching elements")
 		return nil
 	}
 	return elements
@@ -136,222 +250,112 @@ func (wd *WebDriver) FetchElements(selector string) (elements []*cdp.Node) {
 
 // FetchElement returns the first node that matches the selector
 // nil is returned in the case that nothing is found.
-func (wd *WebDriver) FetchElement(selector string) (element *cdp.Node) {
-	elements := wd.FetchElements(selector)
+func (wd *WebDriver) FetchElement(ctx context.Context, selector string) (element *Node) {
+	elements := wd.FetchElements(ctx, selector)
 	if elements == nil || len(elements) == 0 {
 		return nil
 	}
 	return elements[0]
 }
 
-// Login logs the user into a site and waits for the element with the 'waitForThis' selector to become
-// visible before returning. If waitForThis is an empty string, no waiting is performed.
-func (wd *WebDriver) Login(loginURL, userFieldName, username, passwordFieldName, password, submitButton, waitForThis, couponButtons string) (err error) {
-	err = chromedp.Run(wd.chromeDpContext,
-		chromedp.Navigate(loginURL),
-		chromedp.SendKeys(userFieldName, username),
-		chromedp.SendKeys(passwordFieldName, password),
-		chromedp.Click(submitButton), // Submit the login page
-	)
-	if err != nil {
-		wd.log.WithField("error", err).Error("Could not fetch page")
-		return err
-	}
-	if waitForThis != "" {
-		// Wait until this element is visible to finish logging on
-		if err = chromedp.Run(wd.chromeDpContext, chromedp.WaitVisible(waitForThis)); err != nil {
-			wd.log.WithField("error", err).Error("Test coupon button never became visible")
-			return err
-		}
-		// Wait for the footer (looking for an arbitrary link to ensure page is built)
-		if err = chromedp.Run(wd.chromeDpContext, chromedp.WaitVisible("footer > nav > section:nth-child(5) > a:nth-child(6)")); err != nil {
-			wd.log.WithField("error", err).Error("Test coupon button never became visible")
-			return err
-		}
-	}
-
-	wd.log.Debug("Login has finished processing")
-
-	return nil
+// waitVisible waits until the selected element is visible
+func (wd *WebDriver) waitVisible(ctx context.Context, selector string) error {
+	err := wd.do(ctx, "wait-visible", func(ctx context.Context, browser Browser) error {
+		return browser.WaitVisible(ctx, selector)
+	})
+	return actionError(ErrElementNotFound, "wait for", selector, err)
 }
 
 // ReloadPage reloads the current webpage
-func (wd *WebDriver) ReloadPage() (err error) {
-	if err = chromedp.Run(wd.chromeDpContext, chromedp.Reload()); err != nil {
+func (wd *WebDriver) ReloadPage(ctx context.Context) (err error) {
+	err = wd.retry(ctx, "reload", func() error {
+		err := wd.do(ctx, "reload", func(ctx context.Context, browser Browser) error {
+			return browser.Reload(ctx)
+		})
+		return actionError(ErrNavigationFailed, "reload", "", err)
+	})
+	if err != nil {
 		return err
 	}
-	return nil
+	return wd.handleChallenge(ctx)
 }
 
 // ClickButton clicks a button given a selector
-func (wd *WebDriver) ClickButton(buttonSelector string) (err error) {
-	couponButtonNode := wd.FetchElement(buttonSelector)
-	if couponButtonNode == nil {
-		err = fmt.Errorf("could not find a button to click")
-		return err
-	}
-	if err = chromedp.Run(wd.chromeDpContext, chromedp.Click(buttonSelector)); err != nil {
-		return err
-	}
-	return nil
-}
-
-// ClickAllButtons clicks all buttons that match the buttonSelector
-// Used by couponpusher to click LoadToCard
-func (wd *WebDriver) ClickAllButtons(buttonSelector string, confirm bool) (err error) {
-	var couponText string
-	// Sleep for a sec while the buttons populate
-	wd.log.Debug("Scrolling 'infinitely'")
-	chromedp.Run(
-		wd.chromeDpContext,
-		chromedp.Sleep(time.Second*5),
-		// Scroll to the footer to account for infinite scroll
-		chromedp.ScrollIntoView("footer > nav > section:nth-child(5) > a:nth-child(6)"),
-		chromedp.Sleep(time.Second*5),
-		chromedp.ScrollIntoView("footer > nav > section:nth-child(5) > a:nth-child(6)"),
-		chromedp.Sleep(time.Second*5),
-		chromedp.ScrollIntoView("footer > nav > section:nth-child(5) > a:nth-child(6)"),
-		chromedp.Sleep(time.Second*5),
-		chromedp.ScrollIntoView("footer > nav > section:nth-child(5) > a:nth-child(6)"),
-		chromedp.Sleep(time.Second*5),
-		chromedp.ScrollIntoView("footer > nav > section:nth-child(5) > a:nth-child(6)"),
-		chromedp.Sleep(time.Second*5),
-	)
-	wd.log.Debug("Done scrolling 'infinitely'")
-
-	// Get all the "couponCard" divs
-	couponDivSelector := "div.Card > div.CouponCard"
-	couponDivNodes := wd.FetchElements(couponDivSelector)
-	couponButtonNodes := wd.FetchElements(buttonSelector)
-	if len(couponDivNodes) == 0 {
-		err = fmt.Errorf("no coupon divs were found")
-		return err
-	}
-	if len(couponDivNodes) != len(couponButtonNodes) {
-		err = fmt.Errorf("a different number of descriptor nodes were found than coupon button nodes")
-		return err
-	}
-
-	wd.log.WithFields(logrus.Fields{
-		"numBlackList":  len(wd.BlacklistCoupons),
-		"numCouponDivs": len(couponDivNodes),
-		"blacklist":     wd.BlacklistCoupons,
-		"couponDivs":    couponDivNodes,
-	}).Debug("We should have something available to load")
-
-	// Activate a keyboard scanner to read from STDIN
-	if err = keyboard.Open(); err != nil {
-		wd.log.Debug("Could not open keyboard")
-		return err
-	}
-
-	defer keyboard.Close()
-	for i, couponDivNode := range couponDivNodes {
-		xpath := couponDivNode.FullXPathByID()
-
-		label := couponButtonNodes[i].AttributeValue("aria-label")
-		// This will be something like "Baby,"
-		dataCategory := couponDivNode.AttributeValue("data-category")
-		if strings.Contains(dataCategory, "Baby") {
-			// Skip anything in the baby category
-			wd.BlacklistCoupons[couponText] = true
-			continue
-		}
-		couponDivNode, err := wd.GetInnerHTMLOfElement(couponDivNode.FullXPath())
-		if err != nil {
-			return err
-		}
-
-		doc, err := html.Parse(strings.NewReader(couponDivNode))
-		if err != nil {
+func (wd *WebDriver) ClickButton(ctx context.Context, buttonSelector string) (err error) {
+	return wd.retry(ctx, "click", func() error {
+		if _, err := wd.FindElements(ctx, buttonSelector); err != nil {
+			wd.captureArtifacts("click", err)
 			return err
 		}
+		return wd.clickOnce(ctx, buttonSelector)
+	})
+}
 
-		couponTextNode := cascadia.MustCompile(".CouponCard-img").MatchFirst(doc)
-		if couponTextNode == nil {
-			err = fmt.Errorf("coupon text node not found")
-			return err
-		}
+// click clicks the first element matching the selector
+func (wd *WebDriver) click(ctx context.Context, selector string) error {
+	return wd.retry(ctx, "click", func() error {
+		return wd.clickOnce(ctx, selector)
+	})
+}
 
-		for _, attr := range couponTextNode.Attr {
-			//Image Save $1.00 on 2 Angie's BOOMCHICKAPOP®\u200b Ready to Eat Popcorn, Click on this image to view more info in coupon modal
-			if attr.Key == "aria-label" {
-				couponText = attr.Val
-				couponText = strings.TrimPrefix(couponText, "Image ")
-				couponText = strings.TrimSuffix(couponText, ", Click on this image to view more info in coupon modal")
-				break
-			}
-		}
-		if _, ok := wd.BlacklistCoupons[couponText]; ok {
-			// If this is part of the blacklist, continue
-			wd.log.WithField("text", couponText).Debug("Found existing blacklist entry")
-			continue
-		}
-		if confirm {
-			if !strings.Contains(label, "Load to Card") {
-				// If this isn't a coupon, or the coupon has already been loaded
-				// then we don't want to click the button
-				continue
-			}
-			fmt.Printf("------------------------\nCategory: %s\nText: %s\n------------------------\n", dataCategory, couponText)
-			fmt.Print("Would you like to load this coupon? (y/n): ")
-
-			answer, key, err := keyboard.GetKey()
-			if err != nil {
-				panic(err)
-			}
-			if key == keyboard.KeyCtrlC || key == keyboard.KeyCtrlD || key == keyboard.KeyCtrlV {
-				panic("CTRL+C or CTRL+D or CTRL+V was pressed")
-			}
-			fmt.Printf("%s\n", string(answer))
-			if answer != 'y' {
-				fmt.Print("\tSkipping and blacklisting\n")
-				wd.BlacklistCoupons[couponText] = true
-				continue
-			}
-
-			// Add a newline
-			fmt.Println("")
-		}
+// clickOnce makes a single attempt at click
+func (wd *WebDriver) clickOnce(ctx context.Context, selector string) error {
+	err := wd.do(ctx, "click", func(ctx context.Context, browser Browser) error {
+		return browser.Click(ctx, selector)
+	})
+	return actionError(ErrElementNotFound, "click", selector, err)
+}
 
-		wd.log.WithFields(logrus.Fields{
-			"xpath": xpath,
-			"label": label,
-		}).Debug("I found a button to click")
-		if err = chromedp.Run(wd.chromeDpContext, chromedp.Click(couponButtonNodes[i].FullXPath())); err != nil {
-			wd.log.WithFields(logrus.Fields{
-				"error": err,
-				"xpath": xpath,
-				"label": label,
-			}).Error("Could not click the coupon button")
-			return err
-		}
-	}
-	return nil
+// Fill types the value into the first element matching the selector. The
+// value is masked in the logs from then on.
+func (wd *WebDriver) Fill(ctx context.Context, selector, value string) error {
+	wd.redactor.AddSecret(value)
+	err := wd.do(ctx, "fill", func(ctx context.Context, browser Browser) error {
+		return browser.SendKeys(ctx, selector, value)
+	})
+	return actionError(ErrElementNotFound, "type into", selector, err)
 }
 
-// GetFullPageHTML fetches the entire HTML for a given URL using the
-// http.Get() request. It does not consume the session/cookies from WebDriver/chromedp.
+// GetFullPageHTML fetches the entire HTML for a given URL with a plain
+// HTTP GET. Unless EnableSessionSharing has been called it does not consume
+// the session/cookies from the browser; once it has, the browser's cookies are
+// sent and any cookies the response sets are copied back into the browser.
 // If the page is a fairly straight-up form, this should work fine.
-func (wd *WebDriver) GetFullPageHTML(url string) (string, error) {
-	resp, err := http.Get(url)
+func (wd *WebDriver) GetFullPageHTML(ctx context.Context, url string) (string, error) {
+	if wd.sharedJar != nil {
+		if err := wd.SyncCookiesFromBrowser(ctx); err != nil {
+			wd.log.WithField("error", err).Error("Could not copy the browser's cookies")
+			return "", err
+		}
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
-		wd.log.WithField("error", err).Error("Could not retrieve the HTML of the web page")
 		return "", err
 	}
+	resp, err := wd.HTTPClient().Do(req)
+	if err != nil {
+		wd.log.WithField("error", err).Error("Could not retrieve the HTML of the web page")
+		return "", actionError(ErrNavigationFailed, "fetch", url, err)
+	}
+	defer resp.Body.Close()
 	if resp.StatusCode > 300 {
 		wd.log.WithFields(logrus.Fields{
 			"statusCode": resp.StatusCode,
 			"body":       resp.Body,
 		}).Error("Could not retrieve the HTML of the web page")
-		return "", fmt.Errorf("bad status code")
+		return "", actionError(ErrNavigationFailed, "fetch", url, &StatusError{URL: url, StatusCode: resp.StatusCode})
 	}
-	defer resp.Body.Close()
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		wd.log.WithField("error", err).Error("Could not read the response payload")
 		return "", err
 	}
+	if wd.sharedJar != nil {
+		if err = wd.SyncCookiesToBrowser(ctx); err != nil {
+			wd.log.WithField("error", err).Error("Could not copy cookies back into the browser")
+			return "", err
+		}
+	}
 	return string(body), nil
 }
 
@@ -359,8 +363,8 @@ func (wd *WebDriver) GetFullPageHTML(url string) (string, error) {
 // differs from the local content. A True value is returned
 // if there was an issue fetching the page as it's possible the site
 // went away.
-func (wd *WebDriver) SiteHasChangedSinceLastPull(url string, saveIfNew bool) bool {
-	body, err := wd.GetFullPageHTML(url)
+func (wd *WebDriver) SiteHasChangedSinceLastPull(ctx context.Context, url string, saveIfNew bool) bool {
+	body, err := wd.GetFullPageHTML(ctx, url)
 	if err != nil {
 		wd.log.WithField("error", err).Error("Could not fetch the requested page's HTML")
 		return true
@@ -381,8 +385,8 @@ func (wd *WebDriver) SiteHasChangedSinceLastPull(url string, saveIfNew bool) boo
 
 // GetAndCacheSite fetches a site and saves it to disk without
 // performing any collision checks. Force overwrite.
-func (wd *WebDriver) GetAndCacheSite(url string) (err error) {
-	pageHTML, err := wd.GetFullPageHTML(url)
+func (wd *WebDriver) GetAndCacheSite(ctx context.Context, url string) (err error) {
+	pageHTML, err := wd.GetFullPageHTML(ctx, url)
 	if err != nil {
 		wd.log.WithField("error", err).Error("Could not fetch the requested page's HTML")
 		return err
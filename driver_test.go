@@ -1,7 +1,10 @@
 package offthegrid
 
 import (
+	"context"
+	"errors"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -21,7 +24,7 @@ func TestGetPageWithChromeDP(t *testing.T) {
 	err := wd.Init(true)
 	assert.NoError(err)
 	// TODO: Navigate to a page
-	body, err := wd.GetInnerHTMLOfElement("body")
+	body, err := wd.GetInnerHTMLOfElement(context.Background(), "body")
 	assert.NoError(err)
 	assert.GreaterOrEqual(len(body), 1000)
 }
@@ -32,7 +35,7 @@ func TestGetPageWithHTTP(t *testing.T) {
 	defer wd.Teardown()
 	err := wd.Init(true)
 	assert.NoError(err)
-	body, err := wd.GetFullPageHTML("https://google.com")
+	body, err := wd.GetFullPageHTML(context.Background(), "https://google.com")
 	assert.NoError(err)
 	assert.GreaterOrEqual(len(body), 1000)
 }
@@ -47,7 +50,21 @@ func TestSiteHasChangedSinceLastPull(t *testing.T) {
 	// The site isn't cached yet, so we should see that the site has
 	// changed.
 	// The true we are passing in says to save it to local cache
-	assert.True(wd.SiteHasChangedSinceLastPull("https://example.com", true))
+	assert.True(wd.SiteHasChangedSinceLastPull(context.Background(), "https://example.com", true))
 	// Which means if we check again, we'll see disk matches remote
-	assert.False(wd.SiteHasChangedSinceLastPull("https://example.com", true))
+	assert.False(wd.SiteHasChangedSinceLastPull(context.Background(), "https://example.com", true))
+}
+
+func TestTeardownWithoutInit(t *testing.T) {
+	assert := assert.New(t)
+	wd := NewWebDriver()
+	assert.NoError(wd.Teardown())
+	// Operations on an uninitialized driver fail fast rather than hanging or
+	// being retried
+	wd.RetryPolicy = RetryPolicy{Attempts: 5, InitialBackoff: time.Second, Retryable: []error{ErrNavigationFailed}}
+	start := time.Now()
+	err := wd.GoToPage(context.Background(), "https://example.com")
+	assert.True(errors.Is(err, ErrNotInitialized), err)
+	assert.False(errors.Is(err, ErrNavigationFailed))
+	assert.Less(int64(time.Since(start)), int64(100*time.Millisecond))
 }
@@ -0,0 +1,101 @@
+package offthegrid
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// The classes of failure a browser action can end in. Match them with
+// errors.Is; the underlying error, such as chromedp's, is still available
+// through errors.Unwrap and errors.As.
+var (
+	// ErrElementNotFound means a selector never matched anything usable
+	ErrElementNotFound = errors.New("element not found")
+	// ErrNavigationFailed means a page could not be loaded
+	ErrNavigationFailed = errors.New("navigation failed")
+	// ErrLoginFailed means logging into a site did not succeed
+	ErrLoginFailed = errors.New("login failed")
+	// ErrRateLimited means the site asked us to slow down
+	ErrRateLimited = errors.New("rate limited")
+	// ErrSessionExpired means there is no saved session which is still logged in
+	ErrSessionExpired = errors.New("session expired")
+	// ErrDownloadFailed means a file could not be downloaded and saved
+	ErrDownloadFailed = errors.New("download failed")
+	// ErrChallengeUnsolved means a captcha or bot check was not solved in time
+	ErrChallengeUnsolved = errors.New("challenge not solved")
+	// ErrConditionNotMet means a WaitFor condition did not hold in time
+	ErrConditionNotMet = errors.New("condition not met")
+	// ErrNotInitialized means the web driver has no browser, either because
+	// Init was never called or because it has been torn down
+	ErrNotInitialized = errors.New("the web driver has not been initialized")
+)
+
+// ActionError is a failed browser action. It matches its Kind with
+// errors.Is and unwraps to the error which caused it.
+type ActionError struct {
+	// Kind is one of the Err* classes above
+	Kind error
+	// Action names what was being done, such as "navigate" or "click"
+	Action string
+	// Target is the URL or selector the action was done to
+	Target string
+	Err    error
+}
+
+// Error describes the action, its class and its cause
+func (ae *ActionError) Error() string {
+	description := ae.Action
+	if ae.Target != "" {
+		description += " " + ae.Target
+	}
+	if ae.Err == nil {
+		return fmt.Sprintf("%s: %s", description, ae.Kind)
+	}
+	return fmt.Sprintf("%s: %s: %s", description, ae.Kind, ae.Err)
+}
+
+// Unwrap returns the underlying error
+func (ae *ActionError) Unwrap() error {
+	return ae.Err
+}
+
+// Is reports whether target is the action's class of failure
+func (ae *ActionError) Is(target error) bool {
+	return target == ae.Kind
+}
+
+// StatusError is an HTTP response with a failing status code
+type StatusError struct {
+	URL        string
+	StatusCode int
+}
+
+// Error describes the response
+func (se *StatusError) Error() string {
+	return fmt.Sprintf("could not load %s: status code %d", se.URL, se.StatusCode)
+}
+
+// actionError wraps err in an ActionError of the given kind. A response
+// telling us to slow down is always classed as ErrRateLimited, and errors
+// which have already been classified, or which mean there is no browser to
+// act with, are left alone.
+func actionError(kind error, action, target string, err error) error {
+	if err == nil || errors.Is(err, ErrNotInitialized) {
+		return err
+	}
+	var classified *ActionError
+	if errors.As(err, &classified) && classified.Kind == kind {
+		return err
+	}
+	var statusErr *StatusError
+	if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusTooManyRequests {
+		kind = ErrRateLimited
+	}
+	return &ActionError{
+		Kind:   kind,
+		Action: action,
+		Target: target,
+		Err:    err,
+	}
+}
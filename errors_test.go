@@ -0,0 +1,74 @@
+package offthegrid
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestActionErrorClasses(t *testing.T) {
+	assert := assert.New(t)
+	cause := fmt.Errorf("chromedp: node not found")
+	err := actionError(ErrElementNotFound, "click", "#go", cause)
+	assert.ErrorIs(err, ErrElementNotFound)
+	assert.ErrorIs(err, cause)
+	assert.NotErrorIs(err, ErrNavigationFailed)
+	assert.Equal("click #go: element not found: chromedp: node not found", err.Error())
+	assert.Nil(actionError(ErrElementNotFound, "click", "#go", nil))
+
+	// Wrapping keeps the inner class visible
+	login := actionError(ErrLoginFailed, "login", "https://example.com/", actionError(ErrNavigationFailed, "navigate", "https://example.com/", cause))
+	assert.ErrorIs(login, ErrLoginFailed)
+	assert.ErrorIs(login, ErrNavigationFailed)
+
+	var statusErr *StatusError
+	rateLimited := actionError(ErrNavigationFailed, "navigate", "https://example.com/", &StatusError{URL: "https://example.com/", StatusCode: 429})
+	assert.ErrorIs(rateLimited, ErrRateLimited)
+	assert.True(errors.As(rateLimited, &statusErr))
+	assert.Equal(429, statusErr.StatusCode)
+}
+
+func TestWebDriverErrorClasses(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	site := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/busy":
+			w.WriteHeader(http.StatusTooManyRequests)
+		case "/gone":
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			fmt.Fprint(w, "<html><body><p>Nothing to click</p></body></html>")
+		}
+	})
+	wd := NewWebDriverWithBrowser(NewHTMLBrowser(site))
+
+	assert.ErrorIs(wd.GoToPage(ctx, "https://example.com/busy"), ErrRateLimited)
+	assert.ErrorIs(wd.GoToPage(ctx, "https://example.com/gone"), ErrNavigationFailed)
+	assert.NoError(wd.GoToPage(ctx, "https://example.com/"))
+	assert.ErrorIs(wd.ClickButton(ctx, "#missing"), ErrElementNotFound)
+	_, err := wd.FindElements(ctx, "#missing")
+	assert.ErrorIs(err, ErrElementNotFound)
+
+	_, err = wd.Login(ctx, LoginSpec{
+		URL:              "https://example.com/",
+		UsernameSelector: "#user",
+		Username:         "jane",
+		SubmitSelector:   "#submit",
+		SuccessSelector:  "#welcome",
+	})
+	assert.ErrorIs(err, ErrLoginFailed)
+	assert.ErrorIs(err, ErrElementNotFound)
+
+	server := httptest.NewServer(site)
+	defer server.Close()
+	_, err = wd.GetFullPageHTML(ctx, server.URL+"/gone")
+	assert.ErrorIs(err, ErrNavigationFailed)
+	_, err = wd.GetFullPageHTML(ctx, server.URL+"/busy")
+	assert.ErrorIs(err, ErrRateLimited)
+}
@@ -0,0 +1,401 @@
+package offthegrid
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andybalholm/cascadia"
+	"golang.org/x/net/html"
+)
+
+// Money is an amount of money in cents. Extract reads it from text such as
+// "$1,234.56" or "Save $1.00".
+type Money int64
+
+// ParseMoney reads the first amount of money in the text, preferring one
+// written with a dollar sign and ignoring thousands separators
+func ParseMoney(text string) (Money, error) {
+	amount := dollarPattern.FindStringSubmatchIndex(text)
+	if amount == nil {
+		amount = numberPattern.FindStringSubmatchIndex(text)
+	}
+	if amount == nil {
+		return 0, fmt.Errorf("%q has no amount of money in it", text)
+	}
+	dollars, err := strconv.ParseFloat(strings.ReplaceAll(text[amount[4]:amount[5]], ",", ""), 64)
+	if err != nil {
+		return 0, err
+	}
+	cents := Money(math.Round(dollars * 100))
+	// A hyphen inside a word, such as SKU-5, is not a minus sign
+	if amount[3] > amount[2] && (amount[2] == 0 || !isWordByte(text[amount[2]-1])) {
+		cents = -cents
+	}
+	return cents, nil
+}
+
+// dollarPattern matches an amount such as -$1,234.56 and numberPattern one
+// without a dollar sign, each capturing its sign and then its digits
+var (
+	dollarPattern = regexp.MustCompile(`(-?)\$\s*(\d[\d,]*(?:\.\d+)?|\.\d+)`)
+	numberPattern = regexp.MustCompile(`(-?)(\d[\d,]*(?:\.\d+)?|\.\d+)`)
+)
+
+// isWordByte reports whether b is an ASCII letter, digit or underscore
+func isWordByte(b byte) bool {
+	return b == '_' || '0' <= b && b <= '9' || 'a' <= b && b <= 'z' || 'A' <= b && b <= 'Z'
+}
+
+// String writes the amount in dollars, such as $12.34
+func (m Money) String() string {
+	sign := ""
+	if m < 0 {
+		sign, m = "-", -m
+	}
+	return fmt.Sprintf("%s$%d.%02d", sign, m/100, m%100)
+}
+
+// dateLayouts are tried in turn for time.Time fields without a layout tag
+var dateLayouts = []string{
+	time.RFC3339,
+	"2006-01-02",
+	"01/02/2006",
+	"1/2/2006",
+	"1/2/06",
+	"Jan 2, 2006",
+	"January 2, 2006",
+	"Mon, Jan 2, 2006",
+	"2 Jan 2006",
+}
+
+var (
+	timeType  = reflect.TypeOf(time.Time{})
+	moneyType = reflect.TypeOf(Money(0))
+)
+
+// extractTag holds the struct tags which say how a field is extracted:
+//
+//	sel        a CSS selector evaluated inside the enclosing element. When
+//	           empty, the enclosing element itself is read.
+//	attr       reads the attribute instead of the text
+//	html       "inner" or "outer" reads the HTML instead of the text
+//	trim       a prefix removed from the value
+//	trimsuffix a suffix removed from the value
+//	re         a regular expression the value must match. Its first capture
+//	           group, or else the whole match, becomes the value.
+//	layout     the time.Parse layout of a time.Time field
+//	required   "true" fails the extraction if the value is missing
+type extractTag struct {
+	sel        string
+	attr       string
+	html       string
+	trim       string
+	trimSuffix string
+	re         *regexp.Regexp
+	layout     string
+	required   bool
+}
+
+// parseExtractTag reads a struct field's tags
+func parseExtractTag(field reflect.StructField) (tag extractTag, tagged bool, err error) {
+	tag = extractTag{
+		sel:        field.Tag.Get("sel"),
+		attr:       field.Tag.Get("attr"),
+		html:       field.Tag.Get("html"),
+		trim:       field.Tag.Get("trim"),
+		trimSuffix: field.Tag.Get("trimsuffix"),
+		layout:     field.Tag.Get("layout"),
+		required:   field.Tag.Get("required") == "true",
+	}
+	if tag.html != "" && tag.html != "inner" && tag.html != "outer" {
+		return tag, false, fmt.Errorf("the html tag must be inner or outer, not %q", tag.html)
+	}
+	if pattern := field.Tag.Get("re"); pattern != "" {
+		if tag.re, err = regexp.Compile(pattern); err != nil {
+			return tag, false, err
+		}
+	}
+	_, hasSel := field.Tag.Lookup("sel")
+	tagged = hasSel || tag.attr != "" || tag.html != "" || tag.re != nil
+	return tag, tagged, nil
+}
+
+// ExtractHTML fills out from the page. rootSelector, a CSS selector or an
+// XPath, selects the elements to read. out points at a slice, which gets an
+// entry for every element, or at a single value, which is read from the
+// first. Struct fields are filled as their sel, attr, html, trim, trimsuffix,
+// re, layout and required tags say; see extractTag. Fields may be strings,
+// numbers, bools, Money, time.Time, pointers, nested structs and slices of
+// any of them. Untagged fields are left alone.
+func ExtractHTML(pageHTML, rootSelector string, out interface{}) error {
+	doc, err := html.Parse(strings.NewReader(pageHTML))
+	if err != nil {
+		return err
+	}
+	return extractNodes(doc, rootSelector, out)
+}
+
+// Extract fills out from the current page, as ExtractHTML does
+func (wd *WebDriver) Extract(ctx context.Context, rootSelector string, out interface{}) error {
+	var page string
+	err := wd.do(ctx, "extract", func(ctx context.Context, browser Browser) (err error) {
+		page, err = browser.OuterHTML(ctx, "html")
+		return err
+	})
+	if err != nil {
+		wd.log.WithField("error", err).Error("Could not read the page to extract from")
+		return err
+	}
+	return ExtractHTML(page, rootSelector, out)
+}
+
+// extractNodes fills out from the elements of doc matching rootSelector
+func extractNodes(doc *html.Node, rootSelector string, out interface{}) error {
+	target := reflect.ValueOf(out)
+	if target.Kind() != reflect.Ptr || target.IsNil() {
+		return fmt.Errorf("extraction needs a pointer to fill, not %T", out)
+	}
+	target = target.Elem()
+	roots := []*html.Node{doc}
+	if rootSelector != "" {
+		var err error
+		if roots, err = selectNodes(doc, rootSelector); err != nil {
+			return err
+		}
+	}
+	if target.Kind() == reflect.Slice && target.Type().Elem().Kind() != reflect.Uint8 {
+		entries := reflect.MakeSlice(target.Type(), 0, len(roots))
+		for i, root := range roots {
+			entry := reflect.New(target.Type().Elem()).Elem()
+			if _, err := extractValue(entry, root, extractTag{}, fmt.Sprintf("[%d]", i)); err != nil {
+				return err
+			}
+			entries = reflect.Append(entries, entry)
+		}
+		target.Set(entries)
+		return nil
+	}
+	if len(roots) == 0 {
+		return actionError(ErrElementNotFound, "extract", rootSelector, fmt.Errorf("nothing matches"))
+	}
+	_, err := extractValue(target, roots[0], extractTag{}, target.Type().Name())
+	return err
+}
+
+// selectNodes evaluates a CSS or XPath selector against the document
+func selectNodes(doc *html.Node, selector string) ([]*html.Node, error) {
+	if isXPath(selector) {
+		return evalXPath(doc, selector)
+	}
+	compiled, err := cascadia.Compile(selector)
+	if err != nil {
+		return nil, err
+	}
+	return compiled.MatchAll(doc), nil
+}
+
+// extractStruct fills each tagged field of a struct from the element
+func extractStruct(value reflect.Value, node *html.Node, path string) error {
+	for i := 0; i < value.NumField(); i++ {
+		field := value.Type().Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		fieldPath := path + "." + field.Name
+		tag, tagged, err := parseExtractTag(field)
+		if err != nil {
+			return fmt.Errorf("%s: %w", fieldPath, err)
+		}
+		if !tagged && !isNestedStruct(field.Type) {
+			continue
+		}
+		matches := []*html.Node{node}
+		if tag.sel != "" {
+			selector, err := cascadia.Compile(tag.sel)
+			if err != nil {
+				return fmt.Errorf("%s: %w", fieldPath, err)
+			}
+			matches = matchAllWithin(selector, node)
+		}
+
+		fieldValue := value.Field(i)
+		if fieldValue.Kind() == reflect.Slice && fieldValue.Type().Elem().Kind() != reflect.Uint8 {
+			entries := reflect.MakeSlice(fieldValue.Type(), 0, len(matches))
+			for j, match := range matches {
+				entry := reflect.New(fieldValue.Type().Elem()).Elem()
+				found, err := extractValue(entry, match, tag, fmt.Sprintf("%s[%d]", fieldPath, j))
+				if err != nil {
+					return err
+				}
+				if found {
+					entries = reflect.Append(entries, entry)
+				}
+			}
+			fieldValue.Set(entries)
+			continue
+		}
+		found := false
+		if len(matches) > 0 {
+			if found, err = extractValue(fieldValue, matches[0], tag, fieldPath); err != nil {
+				return err
+			}
+		}
+		if !found && tag.required {
+			return actionError(ErrElementNotFound, "extract", fieldPath, fmt.Errorf("the required value is missing"))
+		}
+	}
+	return nil
+}
+
+// extractValue fills a single value from the element and reports whether
+// the element had a value to give
+func extractValue(value reflect.Value, node *html.Node, tag extractTag, path string) (found bool, err error) {
+	if value.Kind() == reflect.Ptr {
+		pointed := reflect.New(value.Type().Elem())
+		if found, err = extractValue(pointed.Elem(), node, tag, path); found && err == nil {
+			value.Set(pointed)
+		}
+		return found, err
+	}
+	if isNestedStruct(value.Type()) {
+		return true, extractStruct(value, node, path)
+	}
+	text, found, err := tag.read(node)
+	if err != nil || !found {
+		return found, err
+	}
+	if err = convertText(value, text, tag.layout); err != nil {
+		return false, fmt.Errorf("%s: %w", path, err)
+	}
+	return true, nil
+}
+
+// isNestedStruct reports whether fields of the type are extracted field by
+// field rather than from a single value
+func isNestedStruct(fieldType reflect.Type) bool {
+	for fieldType.Kind() == reflect.Ptr || fieldType.Kind() == reflect.Slice {
+		fieldType = fieldType.Elem()
+	}
+	return fieldType.Kind() == reflect.Struct && fieldType != timeType
+}
+
+// read returns the element's text, attribute or HTML with the tag's trim and
+// regular expression applied
+func (tag extractTag) read(node *html.Node) (value string, found bool, err error) {
+	switch {
+	case tag.attr != "":
+		if !hasAttr(node, tag.attr) {
+			return "", false, nil
+		}
+		value = attrValue(node, tag.attr)
+	case tag.html != "":
+		var sb strings.Builder
+		if tag.html == "outer" {
+			err = html.Render(&sb, node)
+		}
+		for child := node.FirstChild; child != nil && tag.html == "inner" && err == nil; child = child.NextSibling {
+			err = html.Render(&sb, child)
+		}
+		if err != nil {
+			return "", false, err
+		}
+		value = sb.String()
+	default:
+		value = nodeText(node)
+	}
+	value = strings.TrimSpace(value)
+	value = strings.TrimSpace(strings.TrimSuffix(strings.TrimPrefix(value, tag.trim), tag.trimSuffix))
+	if tag.re != nil {
+		match := tag.re.FindStringSubmatch(value)
+		if match == nil {
+			return "", false, nil
+		}
+		value = match[0]
+		if len(match) > 1 {
+			value = match[1]
+		}
+	}
+	return value, true, nil
+}
+
+// convertText parses text into the value's type
+func convertText(value reflect.Value, text, layout string) error {
+	switch value.Type() {
+	case timeType:
+		parsed, err := parseDate(text, layout)
+		if err != nil {
+			return err
+		}
+		value.Set(reflect.ValueOf(parsed))
+		return nil
+	case moneyType:
+		amount, err := ParseMoney(text)
+		if err != nil {
+			return err
+		}
+		value.SetInt(int64(amount))
+		return nil
+	}
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(text)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		number, err := strconv.ParseInt(strings.ReplaceAll(text, ",", ""), 10, value.Type().Bits())
+		if err != nil {
+			return err
+		}
+		value.SetInt(number)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		number, err := strconv.ParseUint(strings.ReplaceAll(text, ",", ""), 10, value.Type().Bits())
+		if err != nil {
+			return err
+		}
+		value.SetUint(number)
+	case reflect.Float32, reflect.Float64:
+		number, err := strconv.ParseFloat(strings.ReplaceAll(strings.TrimPrefix(text, "$"), ",", ""), value.Type().Bits())
+		if err != nil {
+			return err
+		}
+		value.SetFloat(number)
+	case reflect.Bool:
+		truth, err := strconv.ParseBool(text)
+		if err != nil {
+			return err
+		}
+		value.SetBool(truth)
+	default:
+		return fmt.Errorf("values of type %s cannot be extracted", value.Type())
+	}
+	return nil
+}
+
+// parseDate parses text with the layout, or with each of dateLayouts in
+// turn if no layout is given
+func parseDate(text, layout string) (time.Time, error) {
+	if layout != "" {
+		return time.Parse(layout, text)
+	}
+	for _, layout := range dateLayouts {
+		if parsed, err := time.Parse(layout, text); err == nil {
+			return parsed, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q is not a date in a known layout", text)
+}
+
+// matchAllWithin returns the descendants of root matching the selector
+func matchAllWithin(selector cascadia.Selector, root *html.Node) []*html.Node {
+	var matches []*html.Node
+	for _, match := range selector.MatchAll(root) {
+		if match != root {
+			matches = append(matches, match)
+		}
+	}
+	return matches
+}
@@ -0,0 +1,145 @@
+package offthegrid
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const fakeCouponPage = `<html><body><div id="content">
+<div class="Card"><div class="CouponCard" data-category="Baby,">
+	<img class="CouponCard-img" aria-label="Image Save $1.50 on 2 Diapers, Click on this image to view more info in coupon modal">
+	<span class="expires">Expires 10/31/2022</span>
+	<span class="limit">Limit 5</span>
+	<div class="brand"><b>Huggies</b><a href="/brands/huggies">More</a></div>
+	<ul class="tags"><li>baby</li><li>sale</li></ul>
+</div></div>
+<div class="Card"><div class="CouponCard" data-category="Snacks,">
+	<img class="CouponCard-img" aria-label="Image Save $0.75 on Popcorn, Click on this image to view more info in coupon modal">
+	<span class="expires">Expires 11/01/2022</span>
+	<div class="brand"><b>Angie's</b></div>
+</div></div>
+</div></body></html>`
+
+type fakeBrand struct {
+	Name string `sel:"b"`
+	Link string `sel:"a" attr:"href"`
+}
+
+type fakeCoupon struct {
+	Category    string    `attr:"data-category" trimsuffix:","`
+	Description string    `sel:".CouponCard-img" attr:"aria-label" trim:"Image " trimsuffix:", Click on this image to view more info in coupon modal" required:"true"`
+	Savings     Money     `sel:".CouponCard-img" attr:"aria-label"`
+	Expires     time.Time `sel:".expires" trim:"Expires" layout:"01/02/2006"`
+	Limit       *int      `sel:".limit" re:"Limit (\\d+)"`
+	Brand       fakeBrand `sel:".brand"`
+	Tags        []string  `sel:".tags li"`
+	BrandHTML   string    `sel:".brand" html:"inner"`
+	// Untagged fields are left alone
+	Note string
+}
+
+func TestExtractHTML(t *testing.T) {
+	assert := assert.New(t)
+	var coupons []fakeCoupon
+	assert.NoError(ExtractHTML(fakeCouponPage, "div.Card > div.CouponCard", &coupons))
+	if !assert.Len(coupons, 2) {
+		return
+	}
+	first := coupons[0]
+	assert.Equal("Baby", first.Category)
+	assert.Equal("Save $1.50 on 2 Diapers", first.Description)
+	assert.Equal(Money(150), first.Savings)
+	assert.Equal(time.Date(2022, 10, 31, 0, 0, 0, 0, time.UTC), first.Expires)
+	if assert.NotNil(first.Limit) {
+		assert.Equal(5, *first.Limit)
+	}
+	assert.Equal(fakeBrand{Name: "Huggies", Link: "/brands/huggies"}, first.Brand)
+	assert.Equal([]string{"baby", "sale"}, first.Tags)
+	assert.Equal(`<b>Huggies</b><a href="/brands/huggies">More</a>`, first.BrandHTML)
+
+	// Missing optional values are left as they were
+	assert.Nil(coupons[1].Limit)
+	assert.Empty(coupons[1].Tags)
+	assert.Equal(fakeBrand{Name: "Angie's"}, coupons[1].Brand)
+	assert.Equal(Money(75), coupons[1].Savings)
+
+	// A single value is read from the first match, here found by XPath
+	var coupon fakeCoupon
+	assert.NoError(ExtractHTML(fakeCouponPage, `//div[@data-category="Snacks,"]`, &coupon))
+	assert.Equal("Snacks", coupon.Category)
+	var heading struct {
+		Count []int `sel:".limit" re:"\\d+"`
+	}
+	assert.NoError(ExtractHTML(fakeCouponPage, "", &heading))
+	assert.Equal([]int{5}, heading.Count)
+}
+
+func TestExtractHTMLErrors(t *testing.T) {
+	assert := assert.New(t)
+	var coupon fakeCoupon
+	assert.ErrorIs(ExtractHTML(fakeCouponPage, ".missing", &coupon), ErrElementNotFound)
+	assert.Error(ExtractHTML(fakeCouponPage, "div.CouponCard", coupon), "a value which cannot be filled is refused")
+
+	var required []struct {
+		Name string `sel:".missing" required:"true"`
+	}
+	err := ExtractHTML(fakeCouponPage, "div.CouponCard", &required)
+	assert.ErrorIs(err, ErrElementNotFound)
+	assert.Contains(err.Error(), "[0].Name")
+
+	var badNumber []struct {
+		Limit int `sel:".expires"`
+	}
+	err = ExtractHTML(fakeCouponPage, "div.CouponCard", &badNumber)
+	assert.Error(err)
+	assert.Contains(err.Error(), "[0].Limit")
+}
+
+func TestParseMoney(t *testing.T) {
+	assert := assert.New(t)
+	for text, expected := range map[string]Money{
+		"$1,234.56":         123456,
+		"Save $1 on two":    100,
+		"-$0.99":            -99,
+		"12.5":              1250,
+		"Now only $.50!!!":  50,
+		"Buy 2, Save $1.00": 100,
+		"SKU-5":             500,
+		"Save $1 (SKU-5)":   100,
+		"Balance: -12.50":   -1250,
+		"Buy 3 for -$1.50":  -150,
+	} {
+		amount, err := ParseMoney(text)
+		assert.NoError(err, text)
+		assert.Equal(expected, amount, text)
+	}
+	_, err := ParseMoney("free")
+	assert.Error(err)
+	assert.Equal("-$12.05", Money(-1205).String())
+}
+
+func TestExtractLiveAndCached(t *testing.T) {
+	defer cleanupTestCache()
+	assert := assert.New(t)
+	ctx := context.Background()
+	wd := NewWebDriverWithBrowser(NewHTMLBrowser(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, fakeCouponPage)
+	})))
+	assert.NoError(wd.GoToPage(ctx, "https://coupons.example/"))
+	var live []fakeCoupon
+	assert.NoError(wd.Extract(ctx, "div.CouponCard", &live))
+
+	cfm := NewCacheFileManager()
+	assert.NoError(cfm.CachePageLocally(fakeCouponPage, "https://coupons.example/"))
+	var cached []fakeCoupon
+	assert.NoError(cfm.ExtractCachedPage("https://coupons.example/", "div.CouponCard", &cached))
+	assert.Equal(live, cached)
+	assert.Len(cached, 2)
+
+	assert.Error(cfm.ExtractCachedPage("https://uncached.example/", "div.CouponCard", &cached))
+}
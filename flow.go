@@ -0,0 +1,246 @@
+package offthegrid
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// The actions a FlowStep can take
+const (
+	FlowNavigate  = "navigate"
+	FlowFill      = "fill"
+	FlowClick     = "click"
+	FlowWaitFor   = "wait-for"
+	FlowExtract   = "extract"
+	FlowAssert    = "assert"
+	FlowForEach   = "for-each"
+	FlowClickItem = "click-item"
+	FlowIf        = "if"
+)
+
+// Flow is a site automation written as data rather than Go, so that it can
+// be kept in a YAML or JSON file
+type Flow struct {
+	Name string `yaml:"name" json:"name"`
+	// Device names the preset, such as "phone", which the flow's selectors
+	// were written for. It is emulated before the first step.
+	Device string     `yaml:"device,omitempty" json:"device,omitempty"`
+	Steps  []FlowStep `yaml:"steps" json:"steps"`
+}
+
+// FlowStep is a single step of a Flow. Which fields are used depends on the
+// Action. Text fields may refer to values with ${var.name}, ${item.field},
+// ${person.Field} and ${secret.NAME}.
+type FlowStep struct {
+	// Name describes the step in reports. It is optional.
+	Name   string `yaml:"name,omitempty" json:"name,omitempty"`
+	Action string `yaml:"action" json:"action"`
+	// URL is the page to navigate to
+	URL string `yaml:"url,omitempty" json:"url,omitempty"`
+	// Device switches navigate to another device preset, such as "phone",
+	// for this page and the ones after it
+	Device string `yaml:"device,omitempty" json:"device,omitempty"`
+	// Selector is the element to fill, click, wait for or extract from
+	Selector string `yaml:"selector,omitempty" json:"selector,omitempty"`
+	// Value is typed into the element by fill
+	Value string `yaml:"value,omitempty" json:"value,omitempty"`
+	// Attribute is read by extract instead of the element's text
+	Attribute string `yaml:"attribute,omitempty" json:"attribute,omitempty"`
+	// Into names the variable extract stores its value in
+	Into string `yaml:"into,omitempty" json:"into,omitempty"`
+	// Timeout bounds wait-for. The web driver's OperationTimeout is used when it is zero.
+	Timeout time.Duration `yaml:"timeout,omitempty" json:"timeout,omitempty"`
+	// Condition is checked by assert and if
+	Condition *FlowCondition `yaml:"condition,omitempty" json:"condition,omitempty"`
+	// Then and Else are the branches of if
+	Then []FlowStep `yaml:"then,omitempty" json:"then,omitempty"`
+	Else []FlowStep `yaml:"else,omitempty" json:"else,omitempty"`
+	// Items and Steps describe for-each: Steps run once per item
+	Items *FlowItems `yaml:"items,omitempty" json:"items,omitempty"`
+	Steps []FlowStep `yaml:"steps,omitempty" json:"steps,omitempty"`
+}
+
+// FlowCondition is true when every check it sets passes
+type FlowCondition struct {
+	// Present and Absent check whether anything matches a selector
+	Present string `yaml:"present,omitempty" json:"present,omitempty"`
+	Absent  string `yaml:"absent,omitempty" json:"absent,omitempty"`
+	// URLMatches is a regular expression matched against the current URL
+	URLMatches string `yaml:"url-matches,omitempty" json:"url-matches,omitempty"`
+	// Value, such as "${var.total}", is compared with Equals and Contains
+	Value    string `yaml:"value,omitempty" json:"value,omitempty"`
+	Equals   string `yaml:"equals,omitempty" json:"equals,omitempty"`
+	Contains string `yaml:"contains,omitempty" json:"contains,omitempty"`
+}
+
+// FlowItems describes the list a for-each step loops over. It is the
+// file form of an ItemSpec.
+type FlowItems struct {
+	Container string               `yaml:"container" json:"container"`
+	Action    string               `yaml:"action,omitempty" json:"action,omitempty"`
+	Fields    map[string]FieldSpec `yaml:"fields,omitempty" json:"fields,omitempty"`
+	// LazyLoad loads the whole list first, clicking LoadMore if it is set
+	LazyLoad bool   `yaml:"lazy-load,omitempty" json:"lazy-load,omitempty"`
+	LoadMore string `yaml:"load-more,omitempty" json:"load-more,omitempty"`
+}
+
+// itemSpec converts the items to an ItemSpec
+func (fi *FlowItems) itemSpec() ItemSpec {
+	spec := ItemSpec{
+		ContainerSelector: fi.Container,
+		ActionSelector:    fi.Action,
+		Fields:            fi.Fields,
+	}
+	if fi.LazyLoad {
+		lazyLoad := DefaultLazyLoadOptions()
+		lazyLoad.LoadMoreSelector = fi.LoadMore
+		spec.LazyLoad = &lazyLoad
+	}
+	return spec
+}
+
+// ParseFlow reads a flow from YAML. JSON is valid YAML, so JSON flows can be
+// parsed too. The flow is validated before it is returned.
+func ParseFlow(flowBytes []byte) (*Flow, error) {
+	flow := &Flow{}
+	if err := yaml.Unmarshal(flowBytes, flow); err != nil {
+		return nil, fmt.Errorf("could not parse the flow: %w", err)
+	}
+	if err := flow.Validate(); err != nil {
+		return nil, err
+	}
+	return flow, nil
+}
+
+// LoadFlow reads and validates a flow file
+func LoadFlow(path string) (*Flow, error) {
+	flowBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	flow, err := ParseFlow(flowBytes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return flow, nil
+}
+
+// WriteFlow writes the flow as YAML which ParseFlow can read back
+func WriteFlow(w io.Writer, flow *Flow) error {
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(flow); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+// Validate checks that every step has what its action needs, without
+// running anything
+func (flow *Flow) Validate() error {
+	if len(flow.Steps) == 0 {
+		return fmt.Errorf("the flow %q has no steps", flow.Name)
+	}
+	if flow.Device != "" {
+		if _, err := LookupDevice(flow.Device); err != nil {
+			return fmt.Errorf("the flow %q: %w", flow.Name, err)
+		}
+	}
+	return validateSteps(flow.Steps, "", false)
+}
+
+// validateSteps checks a list of steps. inLoop says whether the steps run
+// inside a for-each, where click-item is allowed.
+func validateSteps(steps []FlowStep, parent string, inLoop bool) error {
+	for i, step := range steps {
+		path := stepPath(parent, i)
+		missing := func(field string) error {
+			return fmt.Errorf("step %s (%s) needs %s", path, step.Action, field)
+		}
+		switch step.Action {
+		case FlowNavigate:
+			if step.URL == "" {
+				return missing("a url")
+			}
+			if step.Device != "" {
+				if _, err := LookupDevice(step.Device); err != nil {
+					return fmt.Errorf("step %s (%s): %w", path, step.Action, err)
+				}
+			}
+		case FlowFill, FlowClick, FlowWaitFor:
+			if step.Selector == "" {
+				return missing("a selector")
+			}
+		case FlowExtract:
+			if step.Selector == "" || step.Into == "" {
+				return missing("a selector and a variable to extract into")
+			}
+		case FlowAssert:
+			if step.Condition == nil {
+				return missing("a condition")
+			}
+		case FlowIf:
+			if step.Condition == nil {
+				return missing("a condition")
+			}
+			if err := validateSteps(step.Then, path+".then", inLoop); err != nil {
+				return err
+			}
+			if err := validateSteps(step.Else, path+".else", inLoop); err != nil {
+				return err
+			}
+		case FlowForEach:
+			if step.Items == nil || step.Items.Container == "" {
+				return missing("items with a container")
+			}
+			if len(step.Steps) == 0 {
+				return missing("steps to run for each item")
+			}
+			if err := validateSteps(step.Steps, path, true); err != nil {
+				return err
+			}
+		case FlowClickItem:
+			if !inLoop {
+				return fmt.Errorf("step %s (%s) can only be used inside for-each", path, step.Action)
+			}
+		case "":
+			return fmt.Errorf("step %s has no action", path)
+		default:
+			return fmt.Errorf("step %s has the unknown action %q", path, step.Action)
+		}
+	}
+	return nil
+}
+
+// stepPath numbers a step from 1 within its parent, such as "3.then.2"
+func stepPath(parent string, index int) string {
+	if parent == "" {
+		return fmt.Sprint(index + 1)
+	}
+	return fmt.Sprintf("%s.%d", parent, index+1)
+}
+
+// NewCachedPageHandler serves the pages saved by the cache manager, so that
+// a flow can be tried offline in an HTMLBrowser. Pages which have not been
+// cached are not found.
+func NewCachedPageHandler(cacheManager *CacheFileManager) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, err := cacheManager.FetchLocalCachedPage(r.URL.String())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if strings.TrimSpace(page) == "" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(page))
+	})
+}
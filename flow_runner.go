@@ -0,0 +1,316 @@
+package offthegrid
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// FlowEnv holds the values a flow's steps may refer to
+type FlowEnv struct {
+	// Person is referred to with ${person.Field}
+	Person *Person
+	// Secrets looks up ${secret.NAME}. Environment variables are used when it is nil.
+	Secrets func(name string) (string, error)
+	// Vars are the starting values of ${var.name}
+	Vars map[string]string
+}
+
+// StepResult reports how a single step of a flow went
+type StepResult struct {
+	// Path locates the step, such as "3.then.2", or "4[2].1" for the first
+	// step run for the second item of a for-each
+	Path   string `json:"path"`
+	Name   string `json:"name,omitempty"`
+	Action string `json:"action"`
+	Passed bool   `json:"passed"`
+	Error  string `json:"error,omitempty"`
+	// Value is what the step extracted, or the outcome of its condition
+	Value    string        `json:"value,omitempty"`
+	Duration time.Duration `json:"duration"`
+}
+
+// FlowReport reports every step a flow ran, in the order they started
+type FlowReport struct {
+	Flow  string            `json:"flow"`
+	Steps []StepResult      `json:"steps"`
+	Vars  map[string]string `json:"vars"`
+}
+
+// Failed returns the step which stopped the flow, or nil if it finished
+func (fr *FlowReport) Failed() *StepResult {
+	for i := range fr.Steps {
+		if !fr.Steps[i].Passed {
+			return &fr.Steps[i]
+		}
+	}
+	return nil
+}
+
+// flowReference matches the references which can be used in step fields
+var flowReference = regexp.MustCompile(`\$\{(var|item|person|secret)\.([A-Za-z0-9_-]+)\}`)
+
+// flowRun is the state of one run of a flow
+type flowRun struct {
+	wd     *WebDriver
+	env    FlowEnv
+	report *FlowReport
+}
+
+// RunFlow runs the flow's steps in order and reports on each. It stops at
+// the first failing step, whose error is returned along with the report.
+func (wd *WebDriver) RunFlow(ctx context.Context, flow *Flow, env FlowEnv) (*FlowReport, error) {
+	if err := flow.Validate(); err != nil {
+		return nil, err
+	}
+	wd.redactor.AddPerson(env.Person)
+	run := &flowRun{
+		wd:  wd,
+		env: env,
+		report: &FlowReport{
+			Flow: flow.Name,
+			Vars: map[string]string{},
+		},
+	}
+	for name, value := range env.Vars {
+		run.report.Vars[name] = value
+	}
+	if flow.Device != "" {
+		device, _ := LookupDevice(flow.Device)
+		if err := wd.Emulate(ctx, device); err != nil {
+			return run.report, err
+		}
+	}
+	err := run.steps(ctx, flow.Steps, "", nil)
+	if err != nil {
+		wd.log.WithFields(logrus.Fields{
+			"error": err,
+			"flow":  flow.Name,
+		}).Error("The flow failed")
+	}
+	return run.report, err
+}
+
+// steps runs a list of steps, each with access to the current item
+func (run *flowRun) steps(ctx context.Context, steps []FlowStep, parent string, item *Item) error {
+	for i, step := range steps {
+		path := stepPath(parent, i)
+		// The step's result is filled in once it and any nested steps are done
+		index := len(run.report.Steps)
+		run.report.Steps = append(run.report.Steps, StepResult{})
+		started := time.Now()
+		value, err := run.step(ctx, step, path, item)
+		result := StepResult{
+			Path:     path,
+			Name:     step.Name,
+			Action:   step.Action,
+			Passed:   err == nil,
+			Value:    value,
+			Duration: time.Since(started),
+		}
+		if err != nil {
+			result.Error = err.Error()
+		}
+		run.report.Steps[index] = result
+		if err != nil {
+			return fmt.Errorf("step %s (%s): %w", path, step.Action, err)
+		}
+	}
+	return nil
+}
+
+// step runs a single step and returns the value to report for it
+func (run *flowRun) step(ctx context.Context, step FlowStep, path string, item *Item) (string, error) {
+	wd := run.wd
+	switch step.Action {
+	case FlowNavigate:
+		url, err := run.expand(step.URL, item)
+		if err != nil {
+			return "", err
+		}
+		if step.Device != "" {
+			device, _ := LookupDevice(step.Device)
+			return "", wd.GoToPageAs(ctx, url, device)
+		}
+		return "", wd.GoToPage(ctx, url)
+	case FlowFill:
+		value, err := run.expand(step.Value, item)
+		if err != nil {
+			return "", err
+		}
+		return "", wd.Fill(ctx, step.Selector, value)
+	case FlowClick:
+		return "", wd.ClickButton(ctx, step.Selector)
+	case FlowWaitFor:
+		if step.Timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, step.Timeout)
+			defer cancel()
+		}
+		return "", wd.waitVisible(ctx, step.Selector)
+	case FlowExtract:
+		value, err := run.extract(ctx, step)
+		if err != nil {
+			return "", err
+		}
+		run.report.Vars[step.Into] = value
+		return value, nil
+	case FlowAssert:
+		passed, err := run.check(ctx, step.Condition, item)
+		if err != nil {
+			return "", err
+		}
+		if !passed {
+			return "false", fmt.Errorf("the condition was not met")
+		}
+		return "true", nil
+	case FlowIf:
+		passed, err := run.check(ctx, step.Condition, item)
+		if err != nil {
+			return "", err
+		}
+		if passed {
+			return "true", run.steps(ctx, step.Then, path+".then", item)
+		}
+		return "false", run.steps(ctx, step.Else, path+".else", item)
+	case FlowForEach:
+		items, err := wd.IterateItems(ctx, step.Items.itemSpec())
+		if err != nil {
+			return "", err
+		}
+		for i, loopItem := range items {
+			if err = run.steps(ctx, step.Steps, fmt.Sprintf("%s[%d]", path, i+1), loopItem); err != nil {
+				return "", err
+			}
+		}
+		return fmt.Sprintf("%d items", len(items)), nil
+	case FlowClickItem:
+		if item.Action == nil {
+			return "", fmt.Errorf("item %d has no action button", item.Index)
+		}
+		return "", wd.click(ctx, item.Action.XPath)
+	}
+	return "", fmt.Errorf("unknown action %q", step.Action)
+}
+
+// extract reads the text or attribute of the first element matching the selector
+func (run *flowRun) extract(ctx context.Context, step FlowStep) (string, error) {
+	nodes, err := run.wd.FindElements(ctx, step.Selector)
+	if err != nil {
+		return "", err
+	}
+	if step.Attribute != "" {
+		return nodes[0].AttributeValue(step.Attribute), nil
+	}
+	return run.wd.textOf(ctx, step.Selector)
+}
+
+// check reports whether every check the condition sets passes
+func (run *flowRun) check(ctx context.Context, condition *FlowCondition, item *Item) (bool, error) {
+	wd := run.wd
+	if condition.Present != "" && !wd.present(ctx, condition.Present) {
+		return false, nil
+	}
+	if condition.Absent != "" && wd.present(ctx, condition.Absent) {
+		return false, nil
+	}
+	if condition.URLMatches != "" {
+		pattern, err := regexp.Compile(condition.URLMatches)
+		if err != nil {
+			return false, err
+		}
+		location, err := wd.CurrentURL(ctx)
+		if err != nil {
+			return false, err
+		}
+		if !pattern.MatchString(location) {
+			return false, nil
+		}
+	}
+	if condition.Equals != "" || condition.Contains != "" {
+		value, err := run.expand(condition.Value, item)
+		if err != nil {
+			return false, err
+		}
+		if condition.Equals != "" && value != condition.Equals {
+			return false, nil
+		}
+		if !strings.Contains(value, condition.Contains) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// expand replaces the references in text with their values
+func (run *flowRun) expand(text string, item *Item) (string, error) {
+	var err error
+	expanded := flowReference.ReplaceAllStringFunc(text, func(reference string) string {
+		match := flowReference.FindStringSubmatch(reference)
+		value, lookupErr := run.lookup(match[1], match[2], item)
+		if lookupErr != nil && err == nil {
+			err = fmt.Errorf("could not resolve %s: %w", reference, lookupErr)
+		}
+		return value
+	})
+	return expanded, err
+}
+
+// lookup returns the value of a single reference
+func (run *flowRun) lookup(kind, name string, item *Item) (string, error) {
+	switch kind {
+	case "var":
+		value, ok := run.report.Vars[name]
+		if !ok {
+			return "", fmt.Errorf("no variable has been set")
+		}
+		return value, nil
+	case "item":
+		if item == nil {
+			return "", fmt.Errorf("there is no item outside of for-each")
+		}
+		value, ok := item.Fields[name]
+		if !ok {
+			return "", fmt.Errorf("the item has no such field")
+		}
+		return value, nil
+	case "person":
+		return personField(run.env.Person, name)
+	case "secret":
+		if run.env.Secrets != nil {
+			return run.env.Secrets(name)
+		}
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("the environment variable is not set")
+		}
+		return value, nil
+	}
+	return "", fmt.Errorf("unknown reference")
+}
+
+// personField returns a field of the person, or the result of one of its
+// methods such as FullName
+func personField(person *Person, name string) (string, error) {
+	if person == nil {
+		return "", fmt.Errorf("no person was given")
+	}
+	value := reflect.ValueOf(person)
+	if method := value.MethodByName(name); method.IsValid() {
+		methodType := method.Type()
+		if methodType.NumIn() == 0 && methodType.NumOut() == 1 && methodType.Out(0).Kind() == reflect.String {
+			return method.Call(nil)[0].String(), nil
+		}
+	}
+	field := value.Elem().FieldByName(name)
+	if !field.IsValid() {
+		return "", fmt.Errorf("a person has no field %s", name)
+	}
+	return fmt.Sprint(field.Interface()), nil
+}
@@ -0,0 +1,157 @@
+package offthegrid
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const fakeOptOutFlow = `
+name: people opt out
+steps:
+  - action: navigate
+    url: https://people.example/search
+  - name: search for the person
+    action: fill
+    selector: "#query"
+    value: "${person.FullName}"
+  - action: fill
+    selector: "#token"
+    value: "${secret.API_TOKEN}"
+  - action: click
+    selector: "#search"
+  - action: wait-for
+    selector: li.listing
+    timeout: 1s
+  - action: extract
+    selector: h1
+    into: heading
+  - action: assert
+    condition:
+      url-matches: /results\?
+      value: "${var.heading}"
+      contains: Results
+  - action: for-each
+    items:
+      container: li.listing
+      action: div.actions > button
+      fields:
+        name: {selector: h2, trim-space: true}
+        state: {attribute: data-state}
+    steps:
+      - action: if
+        condition:
+          value: "${item.state}"
+          equals: CO
+        then:
+          - action: click-item
+`
+
+// newFakePeopleSearch serves a search form which lists the fake people
+func newFakePeopleSearch() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/search", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<html><body><form action="/results">
+<input id="query" name="q"><input id="token" name="token">
+<button id="search" type="submit">Search</button>
+</form></body></html>`)
+	})
+	mux.HandleFunc("/results", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<html><body><h1>Results for `+r.FormValue("q")+`</h1><ul>
+<li class="listing" data-state="CO"><h2>Jane Doe</h2><div class="actions"><button>Opt out</button></div></li>
+<li class="listing" data-state="WY"><h2>Jane Doe</h2><div class="actions"><button>Opt out</button></div></li>
+</ul></body></html>`)
+	})
+	return mux
+}
+
+func TestParseFlow(t *testing.T) {
+	assert := assert.New(t)
+	flow, err := ParseFlow([]byte(fakeOptOutFlow))
+	assert.NoError(err)
+	assert.Equal("people opt out", flow.Name)
+	assert.Len(flow.Steps, 8)
+	assert.Equal("1s", flow.Steps[4].Timeout.String())
+	assert.True(flow.Steps[7].Items.Fields["name"].TrimSpace)
+
+	// JSON is accepted too
+	flow, err = ParseFlow([]byte(`{"name": "json", "steps": [{"action": "navigate", "url": "https://people.example/"}]}`))
+	assert.NoError(err)
+	assert.Equal(FlowNavigate, flow.Steps[0].Action)
+
+	_, err = ParseFlow([]byte("steps:\n  - action: click\n"))
+	assert.EqualError(err, "step 1 (click) needs a selector")
+	_, err = ParseFlow([]byte("steps:\n  - action: if\n    condition: {present: h1}\n    then:\n      - action: click-item\n"))
+	assert.EqualError(err, "step 1.then.1 (click-item) can only be used inside for-each")
+	_, err = ParseFlow([]byte("steps:\n  - action: jump\n"))
+	assert.Error(err)
+	_, err = ParseFlow([]byte("name: empty\n"))
+	assert.Error(err)
+}
+
+func TestRunFlow(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	hb := NewHTMLBrowser(newFakePeopleSearch())
+	wd := NewWebDriverWithBrowser(hb)
+	flow, err := ParseFlow([]byte(fakeOptOutFlow))
+	if !assert.NoError(err) {
+		return
+	}
+	env := FlowEnv{
+		Person: &Person{FirstName: "Jane", LastName: "Doe"},
+		Secrets: func(name string) (string, error) {
+			return "hunter2", nil
+		},
+	}
+
+	report, err := wd.RunFlow(ctx, flow, env)
+	assert.NoError(err)
+	assert.Nil(report.Failed())
+	assert.Equal("Results for Jane Doe", report.Vars["heading"])
+	var paths []string
+	for _, step := range report.Steps {
+		paths = append(paths, step.Path)
+	}
+	// Steps are reported in the order they started, nested steps after their parent
+	assert.Equal([]string{"1", "2", "3", "4", "5", "6", "7", "8", "8[1].1", "8[1].1.then.1", "8[2].1"}, paths)
+	assert.Equal("2 items", report.Steps[7].Value)
+	assert.Equal("false", report.Steps[10].Value)
+	// The search button, then Jane's listing in CO but not the one in WY
+	if assert.Len(hb.Clicks(), 2) {
+		assert.Equal("/html[1]/body[1]/ul[1]/li[1]/div[1]/button[1]", hb.Clicks()[1].XPath)
+	}
+
+	// Without a person the flow stops at the first reference to one
+	report, err = wd.RunFlow(ctx, flow, FlowEnv{})
+	assert.Error(err)
+	if failed := report.Failed(); assert.NotNil(failed) {
+		assert.Equal("2", failed.Path)
+		assert.Contains(failed.Error, "${person.FullName}")
+	}
+	assert.Len(report.Steps, 2)
+}
+
+func TestRunFlowOffline(t *testing.T) {
+	defer cleanupTestCache()
+	assert := assert.New(t)
+	ctx := context.Background()
+	cfm := NewCacheFileManager()
+	assert.NoError(cfm.CachePageLocally(`<html><body><h1>Cached</h1></body></html>`, "https://cached.example/"))
+	wd := NewWebDriverWithBrowser(NewHTMLBrowser(NewCachedPageHandler(cfm)))
+
+	flow := &Flow{Name: "offline", Steps: []FlowStep{
+		{Action: FlowNavigate, URL: "https://cached.example/"},
+		{Action: FlowAssert, Condition: &FlowCondition{Present: "h1", Absent: "form"}},
+	}}
+	_, err := wd.RunFlow(ctx, flow, FlowEnv{})
+	assert.NoError(err)
+
+	flow.Steps[0].URL = "https://uncached.example/"
+	report, err := wd.RunFlow(ctx, flow, FlowEnv{})
+	assert.ErrorIs(err, ErrNavigationFailed)
+	assert.Equal("1", report.Failed().Path)
+}
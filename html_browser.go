@@ -0,0 +1,984 @@
+package offthegrid
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	url_package "net/url"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andybalholm/cascadia"
+	"golang.org/x/net/html"
+)
+
+// HTMLBrowser is a pure-Go Browser which parses the pages served by an
+// http.Handler. It does not run javascript; clicking a link follows it and
+// clicking a submit button submits its form. Every request is answered by the
+// handler regardless of the host in the URL, so site modules can be pointed at
+// a fake version of the site they automate. Iframes are loaded from their src
+// or srcdoc when a pierced selector enters them, and declarative shadow roots
+// (<template shadowrootmode="open">) can be pierced.
+type HTMLBrowser struct {
+	client     *http.Client
+	currentURL *url_package.URL
+	doc        *html.Node
+	// frames holds the documents loaded into the current page's iframes
+	frames   map[*html.Node]*htmlFrame
+	clicks   []*Node
+	jar      *sessionJar
+	requests []RequestRecord
+	policy   *RequestPolicy
+	traffic  *trafficLog
+	// device is being emulated; only its user agent reaches the requests
+	device *Device
+}
+
+// NewHTMLBrowser creates an HTMLBrowser which serves every request from handler
+func NewHTMLBrowser(handler http.Handler) *HTMLBrowser {
+	jar := newSessionJar()
+	return &HTMLBrowser{
+		client: &http.Client{
+			Transport: handlerTransport{handler: handler},
+			Jar:       jar,
+		},
+		jar: jar,
+	}
+}
+
+// htmlFrame is a document loaded into an iframe
+type htmlFrame struct {
+	iframe *html.Node
+	doc    *html.Node
+	url    *url_package.URL
+}
+
+// handlerTransport answers HTTP requests by calling an http.Handler in-process
+type handlerTransport struct {
+	handler http.Handler
+}
+
+// RoundTrip serves the request with the wrapped handler
+func (ht handlerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	recorder := httptest.NewRecorder()
+	ht.handler.ServeHTTP(recorder, req)
+	resp := recorder.Result()
+	resp.Request = req
+	return resp, nil
+}
+
+// NewTab returns another HTMLBrowser served by the same handler. The tabs
+// share their cookies, request policy and emulated device.
+func (hb *HTMLBrowser) NewTab(ctx context.Context) (Browser, error) {
+	return &HTMLBrowser{
+		client:  hb.client,
+		jar:     hb.jar,
+		policy:  hb.policy,
+		traffic: hb.traffic,
+		device:  hb.device,
+	}, nil
+}
+
+// Clicks returns every node which has been clicked, in the order they were clicked
+func (hb *HTMLBrowser) Clicks() []*Node {
+	return hb.clicks
+}
+
+// CurrentURL returns the URL of the page which is currently loaded
+func (hb *HTMLBrowser) CurrentURL() string {
+	if hb.currentURL == nil {
+		return ""
+	}
+	return hb.currentURL.String()
+}
+
+// load performs the request and replaces the current document with the response
+func (hb *HTMLBrowser) load(req *http.Request) error {
+	doc, docURL, err := hb.fetch(req)
+	if err != nil {
+		return err
+	}
+	hb.doc = doc
+	hb.currentURL = docURL
+	hb.frames = nil
+	return nil
+}
+
+// fetch performs the request under the request policy and parses the response
+func (hb *HTMLBrowser) fetch(req *http.Request) (*html.Node, *url_package.URL, error) {
+	resp, err := hb.do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	doc, err := html.Parse(resp.Body)
+	if err != nil {
+		return nil, nil, err
+	}
+	return doc, resp.Request.URL, nil
+}
+
+// do performs the request under the request policy and records it. A failing
+// status code is returned as a StatusError; otherwise the caller must close
+// the response body.
+func (hb *HTMLBrowser) do(req *http.Request) (*http.Response, error) {
+	record := RequestRecord{
+		Time:         time.Now(),
+		Method:       req.Method,
+		URL:          req.URL.String(),
+		ResourceType: "Document",
+	}
+	if hb.device != nil && hb.device.UserAgent != "" {
+		req.Header.Set("User-Agent", hb.device.UserAgent)
+	}
+	hb.policy.rewriteHeaders(req.Header)
+	entry := &TrafficEntry{
+		Time:           record.Time,
+		Method:         record.Method,
+		URL:            record.URL,
+		ResourceType:   record.ResourceType,
+		RequestHeaders: flattenHeaders(req.Header),
+	}
+	if hb.policy.Blocks(record.ResourceType, record.URL) {
+		err := fmt.Errorf("could not load %s: blocked by the request policy", req.URL)
+		record.Error, entry.Error, entry.Blocked = err.Error(), err.Error(), true
+		hb.recordRequest(record)
+		hb.traffic.write(entry)
+		return nil, err
+	}
+	resp, err := hb.client.Do(req)
+	if err != nil {
+		record.Error, entry.Error = err.Error(), err.Error()
+		hb.recordRequest(record)
+		hb.traffic.write(entry)
+		return nil, err
+	}
+	record.Status = int64(resp.StatusCode)
+	entry.Status, entry.ResponseHeaders = record.Status, flattenHeaders(resp.Header)
+	hb.recordRequest(record)
+	hb.traffic.write(entry)
+	if resp.StatusCode >= 400 {
+		resp.Body.Close()
+		return nil, &StatusError{URL: req.URL.String(), StatusCode: resp.StatusCode}
+	}
+	return resp, nil
+}
+
+// recordRequest keeps a request, dropping the oldest once the limit is reached
+func (hb *HTMLBrowser) recordRequest(record RequestRecord) {
+	if len(hb.requests) >= maxRecentDiagnostics {
+		hb.requests = append(hb.requests[:0], hb.requests[1:]...)
+	}
+	hb.requests = append(hb.requests, record)
+}
+
+// Navigate loads the URL, relative to the current page if it is not absolute
+func (hb *HTMLBrowser) Navigate(ctx context.Context, url string) error {
+	target, err := hb.resolve(url)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return err
+	}
+	return hb.load(req)
+}
+
+// Reload fetches the current page again
+func (hb *HTMLBrowser) Reload(ctx context.Context) error {
+	if hb.currentURL == nil {
+		return fmt.Errorf("no page has been loaded")
+	}
+	return hb.Navigate(ctx, hb.currentURL.String())
+}
+
+// Location returns the URL of the current page
+func (hb *HTMLBrowser) Location(ctx context.Context) (string, error) {
+	return hb.CurrentURL(), nil
+}
+
+// Nodes returns all nodes matching the selector
+func (hb *HTMLBrowser) Nodes(ctx context.Context, selector string) ([]*Node, error) {
+	matches, err := hb.query(ctx, selector)
+	if err != nil {
+		return nil, err
+	}
+	nodes := make([]*Node, 0, len(matches))
+	for _, match := range matches {
+		nodes = append(nodes, hb.snapshot(match))
+	}
+	return nodes, nil
+}
+
+// WaitReady succeeds if the selector matches a node. The document only
+// changes when the browser is told to act, so this never waits.
+func (hb *HTMLBrowser) WaitReady(ctx context.Context, selector string) error {
+	_, err := hb.first(ctx, selector)
+	return err
+}
+
+// InnerHTML returns the inner HTML of the first node matching the selector
+func (hb *HTMLBrowser) InnerHTML(ctx context.Context, selector string) (string, error) {
+	node, err := hb.first(ctx, selector)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		if err = html.Render(&buf, child); err != nil {
+			return "", err
+		}
+	}
+	return buf.String(), nil
+}
+
+// OuterHTML returns the outer HTML of the first node matching the selector
+func (hb *HTMLBrowser) OuterHTML(ctx context.Context, selector string) (string, error) {
+	node, err := hb.first(ctx, selector)
+	if err != nil {
+		return "", err
+	}
+	var buf bytes.Buffer
+	if err = html.Render(&buf, node); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// Click clicks the first node matching the selector. Links are followed and
+// submit buttons submit their form; anything else is only recorded.
+func (hb *HTMLBrowser) Click(ctx context.Context, selector string) error {
+	node, err := hb.first(ctx, selector)
+	if err != nil {
+		return err
+	}
+	hb.clicks = append(hb.clicks, hb.snapshot(node))
+	switch {
+	case node.Data == "a" && hasAttr(node, "href"):
+		if frame := hb.frameOf(node); frame != nil {
+			return hb.navigateFrame(ctx, frame, attrValue(node, "href"))
+		}
+		return hb.Navigate(ctx, attrValue(node, "href"))
+	case isSubmitButton(node):
+		if form := enclosingForm(node); form != nil {
+			return hb.submitForm(ctx, form, node)
+		}
+	}
+	return nil
+}
+
+// SendKeys appends the value to the input or textarea matching the selector
+func (hb *HTMLBrowser) SendKeys(ctx context.Context, selector, value string) error {
+	node, err := hb.first(ctx, selector)
+	if err != nil {
+		return err
+	}
+	switch node.Data {
+	case "input":
+		setAttr(node, "value", attrValue(node, "value")+value)
+	case "textarea":
+		node.AppendChild(&html.Node{Type: html.TextNode, Data: value})
+	default:
+		return fmt.Errorf("cannot type into a %s element", node.Data)
+	}
+	return nil
+}
+
+// WaitVisible succeeds if the selector matches a node which is not hidden
+func (hb *HTMLBrowser) WaitVisible(ctx context.Context, selector string) error {
+	node, err := hb.first(ctx, selector)
+	if err != nil {
+		return err
+	}
+	for n := node; n != nil; n = n.Parent {
+		if hasAttr(n, "hidden") || (n.Data == "input" && attrValue(n, "type") == "hidden") {
+			return fmt.Errorf("the node matching %q is not visible", selector)
+		}
+	}
+	return nil
+}
+
+// ScrollIntoView succeeds if the selector matches a node; there is no
+// viewport to scroll.
+func (hb *HTMLBrowser) ScrollIntoView(ctx context.Context, selector string) error {
+	_, err := hb.first(ctx, selector)
+	return err
+}
+
+// WaitNetworkIdle returns immediately; every request made by an HTMLBrowser
+// has finished by the time the call that made it returns.
+func (hb *HTMLBrowser) WaitNetworkIdle(ctx context.Context, quiet time.Duration) error {
+	return ctx.Err()
+}
+
+// ExportSession returns the cookies of every site which has been visited.
+// There is no web storage without javascript.
+func (hb *HTMLBrowser) ExportSession(ctx context.Context) (*SessionState, error) {
+	return &SessionState{
+		URL:     hb.CurrentURL(),
+		Cookies: hb.jar.export(),
+	}, nil
+}
+
+// ImportSession adds the session's cookies to the cookie jar
+func (hb *HTMLBrowser) ImportSession(ctx context.Context, state *SessionState) error {
+	hb.jar.load(state.Cookies)
+	return nil
+}
+
+// UserAgent returns the emulated device's user agent, or an empty string;
+// requests are sent without a User-Agent of the browser's own
+func (hb *HTMLBrowser) UserAgent(ctx context.Context) (string, error) {
+	if hb.device == nil {
+		return "", nil
+	}
+	return hb.device.UserAgent, nil
+}
+
+// Emulate sends the device's user agent with the requests made from now on.
+// There is no layout, so the rest of the device makes no difference.
+func (hb *HTMLBrowser) Emulate(ctx context.Context, device *Device) error {
+	hb.device = device
+	return nil
+}
+
+// SetRequestPolicy applies the policy to the pages loaded from now on. Only
+// documents are requested, so the resource type of every request is "Document".
+func (hb *HTMLBrowser) SetRequestPolicy(ctx context.Context, policy *RequestPolicy) error {
+	hb.policy = policy
+	hb.traffic = newTrafficLog(policy)
+	return nil
+}
+
+// Screenshot returns no image; nothing is rendered
+func (hb *HTMLBrowser) Screenshot(ctx context.Context) ([]byte, error) {
+	return nil, nil
+}
+
+// Diagnostics returns the recent requests. There is no console without javascript.
+func (hb *HTMLBrowser) Diagnostics(ctx context.Context) (*Diagnostics, error) {
+	return &Diagnostics{
+		Console:  []ConsoleMessage{},
+		Requests: append([]RequestRecord{}, hb.requests...),
+	}, nil
+}
+
+// Download fetches what the link or submit button matching the selector
+// points at and saves it into dir, without leaving the current page. The
+// file is named from the Content-Disposition header or the URL.
+func (hb *HTMLBrowser) Download(ctx context.Context, clickSelector, dir string) (*Download, error) {
+	node, err := hb.first(ctx, clickSelector)
+	if err != nil {
+		return nil, err
+	}
+	hb.clicks = append(hb.clicks, hb.snapshot(node))
+	var req *http.Request
+	switch {
+	case node.Data == "a" && hasAttr(node, "href"):
+		target, err := resolveFrom(hb.baseURL(node), attrValue(node, "href"))
+		if err != nil {
+			return nil, err
+		}
+		if req, err = http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil); err != nil {
+			return nil, err
+		}
+	case isSubmitButton(node) && enclosingForm(node) != nil:
+		if req, err = hb.formRequest(ctx, enclosingForm(node), node); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("clicking the %s matching %q does not download anything", node.Data, clickSelector)
+	}
+	resp, err := hb.do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	name := path.Base(resp.Request.URL.Path)
+	if hasAttr(node, "download") && attrValue(node, "download") != "" {
+		name = attrValue(node, "download")
+	}
+	if _, params, err := mime.ParseMediaType(resp.Header.Get("Content-Disposition")); err == nil && params["filename"] != "" {
+		name = params["filename"]
+	}
+	filePath := uniqueDownloadPath(dir, name)
+	f, err := os.Create(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if err = f.Close(); err != nil {
+		return nil, err
+	}
+	return &Download{
+		Path:     filePath,
+		URL:      resp.Request.URL.String(),
+		MIMEType: resp.Header.Get("Content-Type"),
+		Time:     time.Now(),
+	}, nil
+}
+
+// Close discards the current document
+func (hb *HTMLBrowser) Close() error {
+	hb.doc = nil
+	hb.currentURL = nil
+	hb.frames = nil
+	return nil
+}
+
+// resolve turns a possibly relative URL into an absolute one
+func (hb *HTMLBrowser) resolve(rawURL string) (*url_package.URL, error) {
+	return resolveFrom(hb.currentURL, rawURL)
+}
+
+// resolveFrom resolves a possibly relative URL against base, which may be nil
+func resolveFrom(base *url_package.URL, rawURL string) (*url_package.URL, error) {
+	parsedURL, err := url_package.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if base != nil {
+		parsedURL = base.ResolveReference(parsedURL)
+	}
+	if !parsedURL.IsAbs() {
+		return nil, fmt.Errorf("cannot navigate to relative URL %q without a current page", rawURL)
+	}
+	return parsedURL, nil
+}
+
+// query evaluates a CSS, XPath or pierced selector against the current document
+func (hb *HTMLBrowser) query(ctx context.Context, selector string) ([]*html.Node, error) {
+	if hb.doc == nil {
+		return nil, fmt.Errorf("no page has been loaded")
+	}
+	scopes := []*html.Node{hb.doc}
+	parts := pierceParts(selector)
+	for i, part := range parts {
+		var matches []*html.Node
+		for _, scope := range scopes {
+			found, err := selectNodes(scope, part)
+			if err != nil {
+				return nil, err
+			}
+			for _, node := range found {
+				// Shadow roots are only entered by a pierced selector, as
+				// Chrome's queries do not reach into them either
+				if !inShadowRoot(node, scope) {
+					matches = append(matches, node)
+				}
+			}
+		}
+		if i == len(parts)-1 {
+			return matches, nil
+		}
+		scopes = scopes[:0]
+		for _, match := range matches {
+			scope, err := hb.enter(ctx, match)
+			if err != nil {
+				return nil, err
+			}
+			if scope != nil {
+				scopes = append(scopes, scope)
+			}
+		}
+	}
+	return nil, nil
+}
+
+// enter returns the document of an iframe, loading it if need be, or the
+// open shadow root of an element. Other elements have nothing to enter.
+func (hb *HTMLBrowser) enter(ctx context.Context, node *html.Node) (*html.Node, error) {
+	if node.Data == "iframe" {
+		frame, err := hb.frame(ctx, node)
+		if err != nil {
+			return nil, err
+		}
+		return frame.doc, nil
+	}
+	for child := node.FirstChild; child != nil; child = child.NextSibling {
+		if isShadowRoot(child) {
+			return child, nil
+		}
+	}
+	return nil, nil
+}
+
+// isShadowRoot reports whether the node is a declarative open shadow root
+func isShadowRoot(node *html.Node) bool {
+	if node.Type != html.ElementNode || node.Data != "template" {
+		return false
+	}
+	return attrValue(node, "shadowrootmode") == "open" || attrValue(node, "shadowroot") == "open"
+}
+
+// inShadowRoot reports whether the node is, or is inside, a declarative
+// shadow root below scope. Chrome turns these templates into shadow roots,
+// so neither they nor their contents are part of the document.
+func inShadowRoot(node, scope *html.Node) bool {
+	for ; node != nil && node != scope; node = node.Parent {
+		if node.Type == html.ElementNode && node.Data == "template" &&
+			(hasAttr(node, "shadowrootmode") || hasAttr(node, "shadowroot")) {
+			return true
+		}
+	}
+	return false
+}
+
+// frame returns the document loaded into an iframe, loading it from the
+// iframe's srcdoc or src the first time
+func (hb *HTMLBrowser) frame(ctx context.Context, iframe *html.Node) (*htmlFrame, error) {
+	if frame, ok := hb.frames[iframe]; ok {
+		return frame, nil
+	}
+	frame := &htmlFrame{iframe: iframe}
+	var err error
+	if src := attrValue(iframe, "src"); hasAttr(iframe, "srcdoc") || src == "" || src == "about:blank" {
+		frame.doc, err = html.Parse(strings.NewReader(attrValue(iframe, "srcdoc")))
+		frame.url = hb.baseURL(iframe)
+	} else {
+		frame.url, err = resolveFrom(hb.baseURL(iframe), src)
+		if err != nil {
+			return nil, err
+		}
+		var req *http.Request
+		if req, err = http.NewRequestWithContext(ctx, http.MethodGet, frame.url.String(), nil); err != nil {
+			return nil, err
+		}
+		frame.doc, frame.url, err = hb.fetch(req)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if hb.frames == nil {
+		hb.frames = map[*html.Node]*htmlFrame{}
+	}
+	hb.frames[iframe] = frame
+	return frame, nil
+}
+
+// navigateFrame loads a URL into a frame, as clicking a link inside it does
+func (hb *HTMLBrowser) navigateFrame(ctx context.Context, frame *htmlFrame, rawURL string) error {
+	target, err := resolveFrom(frame.url, rawURL)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target.String(), nil)
+	if err != nil {
+		return err
+	}
+	return hb.loadFrame(frame, req)
+}
+
+// loadFrame performs the request and replaces the frame's document with the response
+func (hb *HTMLBrowser) loadFrame(frame *htmlFrame, req *http.Request) error {
+	doc, docURL, err := hb.fetch(req)
+	if err != nil {
+		return err
+	}
+	frame.doc, frame.url = doc, docURL
+	return nil
+}
+
+// frameOf returns the frame whose document holds the node, or nil if it is
+// in the page itself
+func (hb *HTMLBrowser) frameOf(node *html.Node) *htmlFrame {
+	root := node
+	for root.Parent != nil {
+		root = root.Parent
+	}
+	for _, frame := range hb.frames {
+		if frame.doc == root {
+			return frame
+		}
+	}
+	return nil
+}
+
+// baseURL returns the URL relative links in the node's document resolve against
+func (hb *HTMLBrowser) baseURL(node *html.Node) *url_package.URL {
+	if frame := hb.frameOf(node); frame != nil {
+		return frame.url
+	}
+	return hb.currentURL
+}
+
+// snapshot is nodeFromHTML with a pierced XPath for nodes inside frames and
+// shadow roots
+func (hb *HTMLBrowser) snapshot(htmlNode *html.Node) *Node {
+	node := nodeFromHTML(htmlNode)
+	node.XPath = hb.xpathOf(htmlNode)
+	return node
+}
+
+// xpathOf returns the XPath of the node, piercing the frames and shadow
+// roots it is inside of
+func (hb *HTMLBrowser) xpathOf(node *html.Node) string {
+	for n := node.Parent; n != nil; n = n.Parent {
+		if isShadowRoot(n) {
+			return Pierce(hb.xpathOf(n.Parent), relativeXPath(n, node))
+		}
+		if n.Parent == nil {
+			if frame := hb.frameOf(n); frame != nil {
+				return Pierce(hb.xpathOf(frame.iframe), xpathOf(node))
+			}
+		}
+	}
+	return xpathOf(node)
+}
+
+// first returns the first node matching the selector
+func (hb *HTMLBrowser) first(ctx context.Context, selector string) (*html.Node, error) {
+	matches, err := hb.query(ctx, selector)
+	if err != nil {
+		return nil, err
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("no node matches %q", selector)
+	}
+	return matches[0], nil
+}
+
+// submitForm sends the form's fields to its action, as if submitter was clicked
+func (hb *HTMLBrowser) submitForm(ctx context.Context, form, submitter *html.Node) error {
+	req, err := hb.formRequest(ctx, form, submitter)
+	if err != nil {
+		return err
+	}
+	// A form inside an iframe only replaces the iframe's document
+	if frame := hb.frameOf(form); frame != nil {
+		return hb.loadFrame(frame, req)
+	}
+	return hb.load(req)
+}
+
+// formRequest builds the request submitting the form, as if submitter was clicked
+func (hb *HTMLBrowser) formRequest(ctx context.Context, form, submitter *html.Node) (*http.Request, error) {
+	return newFormRequest(ctx, hb.baseURL(form), form, submitter, formValues(form, submitter), nil)
+}
+
+// formValues collects the values a browser would submit for the form, apart
+// from its files
+func formValues(form, submitter *html.Node) url_package.Values {
+	values := url_package.Values{}
+	for _, field := range cascadia.MustCompile("input, select, textarea, button").MatchAll(form) {
+		name := attrValue(field, "name")
+		if name == "" || hasAttr(field, "disabled") {
+			continue
+		}
+		switch field.Data {
+		case "input":
+			switch strings.ToLower(attrValue(field, "type")) {
+			case "checkbox", "radio":
+				if !hasAttr(field, "checked") {
+					continue
+				}
+				value := attrValue(field, "value")
+				if !hasAttr(field, "value") {
+					value = "on"
+				}
+				values.Add(name, value)
+			case "submit", "image", "button", "reset":
+				if field == submitter {
+					values.Add(name, attrValue(field, "value"))
+				}
+			case "file":
+				// Files are added by newFormRequest
+			default:
+				values.Add(name, attrValue(field, "value"))
+			}
+		case "button":
+			if field == submitter {
+				values.Add(name, attrValue(field, "value"))
+			}
+		case "select":
+			options := cascadia.MustCompile("option").MatchAll(field)
+			for _, option := range options {
+				if hasAttr(option, "selected") {
+					values.Add(name, optionValue(option))
+				}
+			}
+			if _, ok := values[name]; !ok && len(options) > 0 && !hasAttr(field, "multiple") {
+				values.Add(name, optionValue(options[0]))
+			}
+		case "textarea":
+			values.Add(name, nodeText(field))
+		}
+	}
+	return values
+}
+
+// optionValue returns an option's value, falling back to its text
+func optionValue(option *html.Node) string {
+	if hasAttr(option, "value") {
+		return attrValue(option, "value")
+	}
+	return strings.TrimSpace(nodeText(option))
+}
+
+// isSubmitButton reports whether clicking the node submits its form
+func isSubmitButton(node *html.Node) bool {
+	switch node.Data {
+	case "button":
+		buttonType := strings.ToLower(attrValue(node, "type"))
+		return buttonType == "" || buttonType == "submit"
+	case "input":
+		inputType := strings.ToLower(attrValue(node, "type"))
+		return inputType == "submit" || inputType == "image"
+	}
+	return false
+}
+
+// enclosingForm returns the form which owns the node, if any
+func enclosingForm(node *html.Node) *html.Node {
+	for n := node.Parent; n != nil; n = n.Parent {
+		if n.Type == html.ElementNode && n.Data == "form" {
+			return n
+		}
+	}
+	return nil
+}
+
+// nodeFromHTML snapshots a parsed HTML node
+func nodeFromHTML(htmlNode *html.Node) *Node {
+	node := &Node{
+		NodeName:   htmlNode.Data,
+		XPath:      xpathOf(htmlNode),
+		Attributes: map[string]string{},
+	}
+	for _, attr := range htmlNode.Attr {
+		node.Attributes[attr.Key] = attr.Val
+	}
+	return node
+}
+
+// nodeText returns the concatenated text of the node and its descendants
+func nodeText(node *html.Node) string {
+	var sb strings.Builder
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			sb.WriteString(n.Data)
+		}
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+	}
+	walk(node)
+	return sb.String()
+}
+
+// hasAttr reports whether the node has the attribute
+func hasAttr(node *html.Node, key string) bool {
+	for _, attr := range node.Attr {
+		if attr.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// attrValue returns the value of the attribute, or an empty string
+func attrValue(node *html.Node, key string) string {
+	for _, attr := range node.Attr {
+		if attr.Key == key {
+			return attr.Val
+		}
+	}
+	return ""
+}
+
+// setAttr sets the attribute, adding it if necessary
+func setAttr(node *html.Node, key, value string) {
+	for i, attr := range node.Attr {
+		if attr.Key == key {
+			node.Attr[i].Val = value
+			return
+		}
+	}
+	node.Attr = append(node.Attr, html.Attribute{Key: key, Val: value})
+}
+
+// xpathOf returns the absolute XPath of an element, such as /html[1]/body[1]/div[2]
+func xpathOf(node *html.Node) string {
+	return relativeXPath(nil, node)
+}
+
+// relativeXPath returns the XPath of node relative to its ancestor root,
+// such as /div[4]/div[2]/button[1]. A nil root gives the absolute XPath.
+func relativeXPath(root, node *html.Node) string {
+	var steps []string
+	for n := node; n != nil && n != root && n.Type == html.ElementNode; n = n.Parent {
+		position := 1
+		for sibling := n.PrevSibling; sibling != nil; sibling = sibling.PrevSibling {
+			if sibling.Type == html.ElementNode && sibling.Data == n.Data {
+				position++
+			}
+		}
+		steps = append([]string{n.Data + "[" + strconv.Itoa(position) + "]"}, steps...)
+	}
+	return "/" + strings.Join(steps, "/")
+}
+
+// xpathStep is a single location step of an XPath expression
+type xpathStep struct {
+	descendant bool
+	name       string
+	predicates []string
+}
+
+// evalXPath evaluates the subset of XPath used by site modules: absolute
+// location paths of child and descendant steps, with positional predicates
+// and attribute predicates such as [@id="x"] or [@disabled].
+func evalXPath(doc *html.Node, expr string) ([]*html.Node, error) {
+	steps, err := parseXPath(expr)
+	if err != nil {
+		return nil, err
+	}
+	contextNodes := []*html.Node{doc}
+	for _, step := range steps {
+		if step.descendant {
+			contextNodes = descendantsOrSelf(contextNodes)
+		}
+		var matched []*html.Node
+		seen := map[*html.Node]bool{}
+		for _, contextNode := range contextNodes {
+			var candidates []*html.Node
+			for child := contextNode.FirstChild; child != nil; child = child.NextSibling {
+				if child.Type == html.ElementNode && (step.name == "*" || child.Data == step.name) {
+					candidates = append(candidates, child)
+				}
+			}
+			for _, predicate := range step.predicates {
+				if candidates, err = applyXPathPredicate(candidates, predicate); err != nil {
+					return nil, err
+				}
+			}
+			for _, candidate := range candidates {
+				if !seen[candidate] {
+					seen[candidate] = true
+					matched = append(matched, candidate)
+				}
+			}
+		}
+		contextNodes = matched
+	}
+	return contextNodes, nil
+}
+
+// parseXPath splits an XPath expression into its steps
+func parseXPath(expr string) (steps []xpathStep, err error) {
+	i := 0
+	for i < len(expr) {
+		var step xpathStep
+		switch {
+		case strings.HasPrefix(expr[i:], "//"):
+			step.descendant = true
+			i += 2
+		case expr[i] == '/':
+			i++
+		default:
+			return nil, fmt.Errorf("unsupported XPath %q", expr)
+		}
+		start := i
+		for i < len(expr) && expr[i] != '/' && expr[i] != '[' {
+			i++
+		}
+		step.name = strings.ToLower(expr[start:i])
+		if step.name == "" {
+			return nil, fmt.Errorf("unsupported XPath %q", expr)
+		}
+		for i < len(expr) && expr[i] == '[' {
+			end, err := closingBracket(expr, i)
+			if err != nil {
+				return nil, err
+			}
+			step.predicates = append(step.predicates, expr[i+1:end])
+			i = end + 1
+		}
+		steps = append(steps, step)
+	}
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("empty XPath")
+	}
+	return steps, nil
+}
+
+// closingBracket finds the ']' matching the '[' at open, skipping quoted text
+func closingBracket(expr string, open int) (int, error) {
+	var quote byte
+	for i := open + 1; i < len(expr); i++ {
+		switch {
+		case quote != 0:
+			if expr[i] == quote {
+				quote = 0
+			}
+		case expr[i] == '"' || expr[i] == '\'':
+			quote = expr[i]
+		case expr[i] == ']':
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("unterminated predicate in XPath %q", expr)
+}
+
+// applyXPathPredicate filters the candidates of one step by a predicate
+func applyXPathPredicate(candidates []*html.Node, predicate string) ([]*html.Node, error) {
+	predicate = strings.TrimSpace(predicate)
+	if position, err := strconv.Atoi(predicate); err == nil {
+		if position < 1 || position > len(candidates) {
+			return nil, nil
+		}
+		return candidates[position-1 : position], nil
+	}
+	if !strings.HasPrefix(predicate, "@") {
+		return nil, fmt.Errorf("unsupported XPath predicate [%s]", predicate)
+	}
+	key, value, hasValue := predicate[1:], "", false
+	if eq := strings.Index(predicate, "="); eq >= 0 {
+		key = strings.TrimSpace(predicate[1:eq])
+		value = strings.TrimSpace(predicate[eq+1:])
+		if len(value) < 2 || (value[0] != '"' && value[0] != '\'') || value[len(value)-1] != value[0] {
+			return nil, fmt.Errorf("unsupported XPath predicate [%s]", predicate)
+		}
+		value, hasValue = value[1:len(value)-1], true
+	}
+	var filtered []*html.Node
+	for _, candidate := range candidates {
+		if hasAttr(candidate, key) && (!hasValue || attrValue(candidate, key) == value) {
+			filtered = append(filtered, candidate)
+		}
+	}
+	return filtered, nil
+}
+
+// descendantsOrSelf returns the nodes and all of their descendants in document order
+func descendantsOrSelf(nodes []*html.Node) []*html.Node {
+	var all []*html.Node
+	seen := map[*html.Node]bool{}
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if seen[n] {
+			return
+		}
+		seen[n] = true
+		all = append(all, n)
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+	}
+	for _, node := range nodes {
+		walk(node)
+	}
+	return all
+}
@@ -0,0 +1,227 @@
+package offthegrid
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+const fakeSearchPage = `<html><body>
+<div id="results">
+	<div class="result"><a href="/people/1">Jane Doe</a></div>
+	<div class="result"><a href="/people/2">John Doe</a></div>
+</div>
+<p hidden>Secret</p>
+<form action="/search" method="get">
+	<input type="hidden" name="token" value="abc">
+	<input id="name" name="name">
+	<input type="checkbox" name="exact" checked>
+	<input type="checkbox" name="ignored">
+	<select name="state"><option value="CO">Colorado</option><option value="WY" selected>Wyoming</option></select>
+	<button id="go" name="action" value="search">Search</button>
+</form>
+</body></html>`
+
+func newFakeSearchSite() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, fakeSearchPage)
+	})
+	mux.HandleFunc("/search", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "<html><body><p id=\"query\">%s</p></body></html>", r.URL.RawQuery)
+	})
+	mux.HandleFunc("/people/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "<html><body><h1>%s</h1></body></html>", r.URL.Path)
+	})
+	return mux
+}
+
+func TestHTMLBrowserQueries(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	hb := NewHTMLBrowser(newFakeSearchSite())
+	assert.NoError(hb.Navigate(ctx, "https://people.example/"))
+
+	nodes, err := hb.Nodes(ctx, "div.result > a")
+	assert.NoError(err)
+	assert.Len(nodes, 2)
+	assert.Equal("/people/2", nodes[1].AttributeValue("href"))
+	assert.Equal("/html[1]/body[1]/div[1]/div[2]/a[1]", nodes[1].XPath)
+
+	// XPaths handed back by Nodes select the same node
+	body, err := hb.InnerHTML(ctx, nodes[1].XPath)
+	assert.NoError(err)
+	assert.Equal("John Doe", body)
+
+	nodes, err = hb.Nodes(ctx, `//*[@id="results"]/div[1]/a`)
+	assert.NoError(err)
+	assert.Len(nodes, 1)
+	assert.Equal("/people/1", nodes[0].AttributeValue("href"))
+
+	nodes, err = hb.Nodes(ctx, "//input[@checked]")
+	assert.NoError(err)
+	assert.Len(nodes, 1)
+
+	nodes, err = hb.Nodes(ctx, "div.missing")
+	assert.NoError(err)
+	assert.Len(nodes, 0)
+
+	assert.NoError(hb.WaitVisible(ctx, "#results"))
+	assert.Error(hb.WaitVisible(ctx, "p"))
+	assert.Error(hb.ScrollIntoView(ctx, "div.missing"))
+}
+
+func TestHTMLBrowserClickAndSubmit(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	hb := NewHTMLBrowser(newFakeSearchSite())
+	assert.NoError(hb.Navigate(ctx, "https://people.example/"))
+
+	assert.NoError(hb.SendKeys(ctx, "#name", "Jane"))
+	assert.NoError(hb.SendKeys(ctx, "#name", " Doe"))
+	assert.NoError(hb.Click(ctx, "#go"))
+	query, err := hb.InnerHTML(ctx, "#query")
+	assert.NoError(err)
+	assert.Equal("action=search&amp;exact=on&amp;name=Jane+Doe&amp;state=WY&amp;token=abc", query)
+
+	assert.NoError(hb.Navigate(ctx, "/"))
+	assert.NoError(hb.Click(ctx, "div.result:nth-child(2) > a"))
+	assert.Equal("https://people.example/people/2", hb.CurrentURL())
+	assert.Len(hb.Clicks(), 2)
+	assert.NoError(hb.Reload(ctx))
+	assert.Equal("https://people.example/people/2", hb.CurrentURL())
+}
+
+func TestWebDriverWithHTMLBrowser(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	wd := NewWebDriverWithBrowser(NewHTMLBrowser(newFakeSearchSite()))
+	defer wd.Teardown()
+
+	assert.NoError(wd.GoToPage(ctx, "https://people.example/"))
+	assert.Len(wd.FetchElements(ctx, "div.result"), 2)
+	assert.Nil(wd.FetchElement(ctx, "div.missing"))
+	assert.Error(wd.ClickButton(ctx, "div.missing"))
+	assert.NoError(wd.ClickButton(ctx, "div.result > a"))
+	body, err := wd.GetInnerHTMLOfElement(ctx, "h1")
+	assert.NoError(err)
+	assert.Equal("/people/1", body)
+}
+
+const fakeConsentPage = `<html><body>
+<iframe id="consent" src="https://consent.example/banner"></iframe>
+<iframe id="inline" srcdoc="<p id='note'>Inline</p>"></iframe>
+<opt-out-widget>
+	<template shadowrootmode="open"><div><button class="confirm">Confirm</button></div></template>
+</opt-out-widget>
+</body></html>`
+
+// newFakeConsentSite serves a page with a cross-origin consent iframe and a
+// web component whose button lives in its shadow root
+func newFakeConsentSite() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Host == "consent.example" {
+			fmt.Fprint(w, `<html><body><form action="/accept"><input id="email" name="email"><button id="accept">Accept</button></form></body></html>`)
+			return
+		}
+		fmt.Fprint(w, fakeConsentPage)
+	})
+	mux.HandleFunc("/accept", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `<html><body><p id="accepted">%s</p></body></html>`, r.FormValue("email"))
+	})
+	return mux
+}
+
+func TestHTMLBrowserPierces(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	hb := NewHTMLBrowser(newFakeConsentSite())
+	wd := NewWebDriverWithBrowser(hb)
+	assert.NoError(wd.GoToPage(ctx, "https://people.example/"))
+
+	// The top-level document does not hold the iframe's contents
+	assert.Empty(wd.FetchElements(ctx, "#accept"))
+	accept := wd.FetchElement(ctx, Pierce("iframe#consent", "#accept"))
+	if assert.NotNil(accept) {
+		assert.Equal("/html[1]/body[1]/iframe[1] >>> /html[1]/body[1]/form[1]/button[1]", accept.XPath)
+	}
+	body, err := wd.GetInnerHTMLOfElement(ctx, Pierce("#inline", "#note"))
+	assert.NoError(err)
+	assert.Equal("Inline", body)
+
+	// Submitting a form in the iframe only replaces the iframe
+	assert.NoError(wd.Fill(ctx, Pierce("iframe#consent", "#email"), "jane@example.com"))
+	assert.NoError(wd.ClickButton(ctx, accept.XPath))
+	body, err = wd.GetInnerHTMLOfElement(ctx, Pierce("iframe#consent", "#accepted"))
+	assert.NoError(err)
+	assert.Equal("jane@example.com", body)
+	assert.Equal("https://people.example/", hb.CurrentURL())
+
+	// Open shadow roots are pierced, and the XPaths handed back select the same node
+	confirm := wd.FetchElements(ctx, Pierce("opt-out-widget", "button.confirm"))
+	if assert.Len(confirm, 1) {
+		assert.Equal("/html[1]/body[1]/opt-out-widget[1] >>> /div[1]/button[1]", confirm[0].XPath)
+		assert.NoError(wd.ClickButton(ctx, confirm[0].XPath))
+		clicks := hb.Clicks()
+		assert.Equal(confirm[0].XPath, clicks[len(clicks)-1].XPath)
+	}
+}
+
+// fakeWidgetPage has a button outside and a button inside a shadow root
+const fakeWidgetPage = `<html><body>
+<button class="confirm">Outside</button>
+<opt-out-widget><template shadowrootmode="open"><button class="confirm">Inside</button></template></opt-out-widget>
+</body></html>`
+
+func TestShadowRootsNeedPiercing(t *testing.T) {
+	ctx := context.Background()
+	site := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, fakeWidgetPage)
+	})
+	server := httptest.NewServer(site)
+	defer server.Close()
+	backends := map[string]func() (Browser, error){
+		"html": func() (Browser, error) {
+			return NewHTMLBrowser(site), nil
+		},
+		"chrome": func() (Browser, error) {
+			return NewChromeBrowser(true, logrus.New())
+		},
+	}
+	// Both backends see the same nodes
+	for name, open := range backends {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			browser, err := open()
+			if err != nil {
+				t.Skipf("%s is not available: %s", name, err)
+			}
+			defer browser.Close()
+			assert.NoError(browser.Navigate(ctx, server.URL))
+			for selector, expected := range map[string]int{
+				"button.confirm": 1,
+				"//button":       1,
+				"template":       0,
+				Pierce("opt-out-widget", "button.confirm"): 1,
+			} {
+				nodes, err := browser.Nodes(ctx, selector)
+				assert.NoError(err, selector)
+				assert.Len(nodes, expected, selector)
+			}
+		})
+	}
+}
+
+func TestPierceParts(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal("iframe >>> button", Pierce("iframe", "button"))
+	assert.Equal([]string{"iframe", "button"}, pierceParts("iframe>>>button"))
+	assert.True(isPierced(Pierce("iframe", "button")))
+	assert.False(isPierced("div > button"))
+}
@@ -0,0 +1,307 @@
+package offthegrid
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	url_package "net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/andybalholm/cascadia"
+	"golang.org/x/net/html"
+)
+
+// FormResponse is the page a form submitted over HTTP ended up on
+type FormResponse struct {
+	// URL is the page's address after any redirects
+	URL        string
+	StatusCode int
+	HTML       string
+}
+
+// SubmitFormHTTP submits a form without the browser. It fetches the page at
+// url, finds the form matching formSelector (or the form around the element
+// it matches) and posts the form's own fields, such as hidden inputs and CSRF
+// tokens, with values filled in over them. A value for a file input is the
+// path of the file to upload. Cookies set by the page are sent with the form,
+// and redirects are followed. A failing status code is returned as an error
+// along with the response, so that its page can still be inspected. The
+// values of password inputs and of hidden token inputs are masked in the logs
+// from then on.
+func (wd *WebDriver) SubmitFormHTTP(ctx context.Context, url, formSelector string, values map[string]string) (*FormResponse, error) {
+	client := *wd.HTTPClient()
+	if client.Jar == nil {
+		// The form's session cookie has to survive until it is posted
+		client.Jar = newSessionJar()
+	}
+	if wd.sharedJar != nil {
+		if err := wd.SyncCookiesFromBrowser(ctx); err != nil {
+			wd.log.WithField("error", err).Error("Could not copy the browser's cookies")
+			return nil, err
+		}
+	}
+	page, err := sendHTTP(ctx, &client, http.MethodGet, url)
+	if err != nil {
+		wd.log.WithField("error", err).Error("Could not fetch the form")
+		return page, actionError(ErrNavigationFailed, "fetch", url, err)
+	}
+	req, secrets, err := formSubmission(ctx, page, formSelector, values)
+	wd.redactor.AddSecret(secrets...)
+	if err != nil {
+		wd.log.WithField("error", err).Error("Could not fill in the form")
+		return nil, actionError(ErrElementNotFound, "submit", formSelector, err)
+	}
+	resp, err := sendHTTPRequest(&client, req)
+	if err != nil {
+		wd.log.WithField("error", err).Error("Could not submit the form")
+		return resp, actionError(ErrNavigationFailed, "submit", req.URL.String(), err)
+	}
+	if wd.sharedJar != nil {
+		if err = wd.SyncCookiesToBrowser(ctx); err != nil {
+			wd.log.WithField("error", err).Error("Could not copy cookies back into the browser")
+			return resp, err
+		}
+	}
+	return resp, nil
+}
+
+// sendHTTP sends a request without a body
+func sendHTTP(ctx context.Context, client *http.Client, method, url string) (*FormResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return sendHTTPRequest(client, req)
+}
+
+// sendHTTPRequest sends the request and reads the page it ends up on
+func sendHTTPRequest(client *http.Client, req *http.Request) (*FormResponse, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	page := &FormResponse{
+		URL:        resp.Request.URL.String(),
+		StatusCode: resp.StatusCode,
+		HTML:       string(body),
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		return page, &StatusError{URL: page.URL, StatusCode: resp.StatusCode}
+	}
+	return page, nil
+}
+
+// formSubmission builds the request submitting the form on the page. The
+// form is submitted as pressing enter would, by its first submit button. The
+// secret values it sends are returned along with it.
+func formSubmission(ctx context.Context, page *FormResponse, formSelector string, values map[string]string) (*http.Request, []string, error) {
+	doc, err := html.Parse(strings.NewReader(page.HTML))
+	if err != nil {
+		return nil, nil, err
+	}
+	form, err := findForm(doc, formSelector)
+	if err != nil {
+		return nil, nil, err
+	}
+	var submitter *html.Node
+	for _, button := range cascadia.MustCompile("button, input").MatchAll(form) {
+		if isSubmitButton(button) && !hasAttr(button, "disabled") {
+			submitter = button
+			break
+		}
+	}
+	base, err := url_package.Parse(page.URL)
+	if err != nil {
+		return nil, nil, err
+	}
+	if baseHref := cascadia.MustCompile("base[href]").MatchFirst(doc); baseHref != nil {
+		if base, err = resolveFrom(base, attrValue(baseHref, "href")); err != nil {
+			return nil, nil, err
+		}
+	}
+	fields := formValues(form, submitter)
+	fileInputs := formFileInputs(form)
+	files := map[string]string{}
+	for name, value := range values {
+		if fileInputs[name] {
+			files[name] = value
+			continue
+		}
+		fields.Set(name, value)
+	}
+	secrets := formSecrets(form, fields)
+	req, err := newFormRequest(ctx, base, form, submitter, fields, files)
+	if err != nil {
+		return nil, secrets, err
+	}
+	// Frameworks such as Rails and Laravel expect the page's token in a
+	// header as well as, or instead of, a hidden input
+	if token := cascadia.MustCompile(`meta[name="csrf-token"]`).MatchFirst(doc); token != nil {
+		req.Header.Set("X-CSRF-Token", attrValue(token, "content"))
+		secrets = append(secrets, attrValue(token, "content"))
+	}
+	req.Header.Set("Referer", page.URL)
+	return req, secrets, nil
+}
+
+// findForm returns the form matching the selector, or the form around the
+// element it matches
+func findForm(doc *html.Node, formSelector string) (*html.Node, error) {
+	nodes, err := selectNodes(doc, formSelector)
+	if err != nil {
+		return nil, err
+	}
+	if len(nodes) == 0 {
+		return nil, fmt.Errorf("no node matches %q", formSelector)
+	}
+	if nodes[0].Data == "form" {
+		return nodes[0], nil
+	}
+	if form := enclosingForm(nodes[0]); form != nil {
+		return form, nil
+	}
+	return nil, fmt.Errorf("%q is not in a form", formSelector)
+}
+
+// formFileInputs returns the names of the form's file inputs
+func formFileInputs(form *html.Node) map[string]bool {
+	names := map[string]bool{}
+	for _, input := range cascadia.MustCompile("input[name]").MatchAll(form) {
+		if strings.EqualFold(attrValue(input, "type"), "file") && !hasAttr(input, "disabled") {
+			names[attrValue(input, "name")] = true
+		}
+	}
+	return names
+}
+
+// tokenFieldPattern matches the names hidden inputs carrying a token use
+var tokenFieldPattern = regexp.MustCompile(`(?i)token|csrf|xsrf|nonce|authenticity`)
+
+// formSecrets returns the values of the fields which are the form's
+// password inputs or hidden inputs carrying a token
+func formSecrets(form *html.Node, fields url_package.Values) []string {
+	var secrets []string
+	for _, input := range cascadia.MustCompile("input[name]").MatchAll(form) {
+		name, inputType := attrValue(input, "name"), strings.ToLower(attrValue(input, "type"))
+		if inputType == "password" || (inputType == "hidden" && tokenFieldPattern.MatchString(name)) {
+			secrets = append(secrets, fields[name]...)
+		}
+	}
+	return secrets
+}
+
+// newFormRequest builds the request submitting values to the form's action,
+// resolved against base, as if submitter was clicked. The submitter's
+// formaction, formmethod and formenctype win over the form's own. files maps
+// the names of file inputs to the paths of the files to upload.
+func newFormRequest(ctx context.Context, base *url_package.URL, form, submitter *html.Node, values url_package.Values, files map[string]string) (*http.Request, error) {
+	rawAction, method, enctype := attrValue(form, "action"), attrValue(form, "method"), attrValue(form, "enctype")
+	if submitter != nil {
+		if hasAttr(submitter, "formaction") {
+			rawAction = attrValue(submitter, "formaction")
+		}
+		if hasAttr(submitter, "formmethod") {
+			method = attrValue(submitter, "formmethod")
+		}
+		if hasAttr(submitter, "formenctype") {
+			enctype = attrValue(submitter, "formenctype")
+		}
+	}
+	action, err := resolveFrom(base, rawAction)
+	if err != nil {
+		return nil, err
+	}
+	fileNames := make([]string, 0, len(files))
+	for name := range formFileInputs(form) {
+		fileNames = append(fileNames, name)
+	}
+	sort.Strings(fileNames)
+	if strings.EqualFold(method, http.MethodPost) && strings.EqualFold(enctype, "multipart/form-data") {
+		body, contentType, err := multipartBody(values, fileNames, files)
+		if err != nil {
+			return nil, err
+		}
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, action.String(), body)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", contentType)
+		return req, nil
+	}
+	// Without multipart only the names of the files are sent
+	for _, name := range fileNames {
+		fileName := ""
+		if files[name] != "" {
+			fileName = filepath.Base(files[name])
+		}
+		values.Add(name, fileName)
+	}
+	if strings.EqualFold(method, http.MethodPost) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, action.String(), strings.NewReader(values.Encode()))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return req, nil
+	}
+	action.RawQuery = values.Encode()
+	return http.NewRequestWithContext(ctx, http.MethodGet, action.String(), nil)
+}
+
+// multipartBody encodes the values and files as multipart/form-data. A file
+// input without a file is sent as an empty file, as browsers do.
+func multipartBody(values url_package.Values, fileNames []string, files map[string]string) (io.Reader, string, error) {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range values[name] {
+			if err := writer.WriteField(name, value); err != nil {
+				return nil, "", err
+			}
+		}
+	}
+	for _, name := range fileNames {
+		filePath, fileName := files[name], ""
+		if filePath != "" {
+			fileName = filepath.Base(filePath)
+		}
+		part, err := writer.CreateFormFile(name, fileName)
+		if err != nil {
+			return nil, "", err
+		}
+		if filePath == "" {
+			continue
+		}
+		f, err := os.Open(filePath)
+		if err != nil {
+			return nil, "", err
+		}
+		_, err = io.Copy(part, f)
+		f.Close()
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	if err := writer.Close(); err != nil {
+		return nil, "", err
+	}
+	return body, writer.FormDataContentType(), nil
+}
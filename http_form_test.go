@@ -0,0 +1,138 @@
+package offthegrid
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	url_package "net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/cascadia"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/net/html"
+)
+
+// fakeOptOutForm is a data broker's opt out form. Its token has to match the
+// session cookie set with the page.
+const fakeOptOutForm = `<html><head><meta name="csrf-token" content="meta-%[1]s"></head><body>
+<form id="opt-out" action="/opt-out/submit" method="post" enctype="%[2]s">
+	<input type="hidden" name="csrf" value="%[1]s">
+	<input type="text" name="email">
+	<select name="reason"><option value="privacy">Privacy</option><option value="other">Other</option></select>
+	<input type="checkbox" name="confirm" value="yes" checked>
+	<input type="file" name="proof">
+	<button type="submit" name="action" value="remove">Remove me</button>
+</form></body></html>`
+
+// newFakeOptOutSite serves the opt out form as urlencoded at /opt-out and as
+// multipart at /opt-out/upload, and redirects good submissions to /done
+func newFakeOptOutSite() http.Handler {
+	mux := http.NewServeMux()
+	form := func(enctype string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "tok123", Path: "/"})
+			fmt.Fprintf(w, fakeOptOutForm, "tok123", enctype)
+		}
+	}
+	mux.HandleFunc("/opt-out", form("application/x-www-form-urlencoded"))
+	mux.HandleFunc("/opt-out/upload", form("multipart/form-data"))
+	mux.HandleFunc("/opt-out/submit", func(w http.ResponseWriter, r *http.Request) {
+		session, err := r.Cookie("session")
+		if err != nil || r.Method != http.MethodPost || r.FormValue("csrf") != session.Value ||
+			r.Header.Get("X-CSRF-Token") != "meta-"+session.Value {
+			http.Error(w, "<html><body>Forbidden</body></html>", http.StatusForbidden)
+			return
+		}
+		proof := "none"
+		if file, header, err := r.FormFile("proof"); err == nil {
+			contents, _ := ioutil.ReadAll(file)
+			proof = header.Filename + ":" + string(contents)
+		}
+		done := url_package.Values{}
+		for _, name := range []string{"email", "reason", "confirm", "action"} {
+			done.Set(name, r.FormValue(name))
+		}
+		done.Set("proof", proof)
+		http.Redirect(w, r, "/done?"+done.Encode(), http.StatusSeeOther)
+	})
+	mux.HandleFunc("/done", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "<html><body><p id=\"status\">Removed %s</p></body></html>", r.URL.RawQuery)
+	})
+	return mux
+}
+
+func TestSubmitFormHTTP(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	server := httptest.NewServer(newFakeOptOutSite())
+	defer server.Close()
+	wd := NewWebDriver()
+
+	resp, err := wd.SubmitFormHTTP(ctx, server.URL+"/opt-out", "#opt-out", map[string]string{
+		"email":  "jane@example.com",
+		"reason": "other",
+	})
+	if assert.NoError(err) {
+		assert.Equal(http.StatusOK, resp.StatusCode)
+		assert.Equal(server.URL+"/done?action=remove&confirm=yes&email=jane%40example.com&proof=none&reason=other", resp.URL)
+		assert.Contains(resp.HTML, "Removed")
+	}
+	// Only the form's tokens are masked in the logs, not everything it sent
+	redacted := wd.Redactor().Redact("tok123 meta-tok123 jane@example.com other")
+	assert.NotContains(redacted, "tok123")
+	assert.Contains(redacted, "jane@example.com other")
+
+	// A file is uploaded by path when the form is multipart, and the form can
+	// be found from any element inside it
+	proof := filepath.Join(t.TempDir(), "id.txt")
+	assert.NoError(ioutil.WriteFile(proof, []byte("it is me"), 0600))
+	resp, err = wd.SubmitFormHTTP(ctx, server.URL+"/opt-out/upload", "//button[@name='action']", map[string]string{
+		"email": "jane@example.com",
+		"proof": proof,
+	})
+	if assert.NoError(err) {
+		assert.Contains(resp.URL, "reason=privacy")
+		assert.Contains(resp.URL, "proof=id.txt%3Ait+is+me")
+	}
+
+	// Without the page's token the site refuses the form
+	resp, err = wd.SubmitFormHTTP(ctx, server.URL+"/opt-out", "#opt-out", map[string]string{"csrf": "forged"})
+	assert.True(errors.Is(err, ErrNavigationFailed))
+	if assert.NotNil(resp) {
+		assert.Equal(http.StatusForbidden, resp.StatusCode)
+		assert.Contains(resp.HTML, "Forbidden")
+	}
+
+	_, err = wd.SubmitFormHTTP(ctx, server.URL+"/opt-out", "#missing", nil)
+	assert.True(errors.Is(err, ErrElementNotFound))
+}
+
+func TestFormSecrets(t *testing.T) {
+	assert := assert.New(t)
+	doc, err := html.Parse(strings.NewReader(`<form>
+		<input name="user"><input type="password" name="pass">
+		<input type="hidden" name="authenticity_token" value="tok123"><input type="hidden" name="page" value="2">
+	</form>`))
+	assert.NoError(err)
+	form := cascadia.MustCompile("form").MatchFirst(doc)
+	fields := formValues(form, nil)
+	fields.Set("user", "jane")
+	fields.Set("pass", "hunter2")
+	assert.ElementsMatch([]string{"hunter2", "tok123"}, formSecrets(form, fields))
+}
+
+func TestAnalyzerFormValues(t *testing.T) {
+	assert := assert.New(t)
+	values, err := NewAnalyzer().FormValues(fmt.Sprintf(fakeOptOutForm, "tok123", ""), "form")
+	assert.NoError(err)
+	assert.Equal("tok123", values.Get("csrf"))
+	assert.Equal("privacy", values.Get("reason"))
+	assert.Equal("yes", values.Get("confirm"))
+	assert.NotContains(values, "proof")
+	assert.NotContains(values, "action")
+}
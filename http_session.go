@@ -0,0 +1,309 @@
+package offthegrid
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	url_package "net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sessionJar is a cookie jar which can export every cookie it holds. The
+// standard jar can only be read back one URL at a time and without the
+// cookies' attributes, so every cookie stored is remembered as well.
+type sessionJar struct {
+	jar     *cookiejar.Jar
+	lock    sync.Mutex
+	cookies map[string]SessionCookie
+	// changed holds the cookies set or deleted by responses since they were
+	// last copied into the browser
+	changed map[string]SessionCookie
+}
+
+// newSessionJar creates an empty sessionJar
+func newSessionJar() *sessionJar {
+	// cookiejar.New never returns an error without a public suffix list
+	jar, _ := cookiejar.New(nil)
+	return &sessionJar{
+		jar:     jar,
+		cookies: map[string]SessionCookie{},
+		changed: map[string]SessionCookie{},
+	}
+}
+
+// SetCookies stores cookies set by a response from u
+func (sj *sessionJar) SetCookies(u *url_package.URL, cookies []*http.Cookie) {
+	sj.jar.SetCookies(u, cookies)
+	sj.lock.Lock()
+	defer sj.lock.Unlock()
+	for _, cookie := range cookies {
+		sessionCookie, ok := responseCookie(u, cookie)
+		if !ok {
+			continue
+		}
+		sj.remember(sessionCookie)
+		sj.changed[cookieKey(sessionCookie)] = sessionCookie
+	}
+}
+
+// Cookies returns the cookies to send in a request to u
+func (sj *sessionJar) Cookies(u *url_package.URL) []*http.Cookie {
+	return sj.jar.Cookies(u)
+}
+
+// remember records the cookie, or forgets it if it has expired. The lock
+// must be held.
+func (sj *sessionJar) remember(cookie SessionCookie) {
+	if cookie.expired(time.Now()) {
+		delete(sj.cookies, cookieKey(cookie))
+		return
+	}
+	sj.cookies[cookieKey(cookie)] = cookie
+}
+
+// export returns every cookie in the jar with its attributes. Cookies whose
+// domain starts with a dot are shared with subdomains; the rest are host-only.
+func (sj *sessionJar) export() []SessionCookie {
+	sj.lock.Lock()
+	defer sj.lock.Unlock()
+	now := time.Now()
+	cookies := make([]SessionCookie, 0, len(sj.cookies))
+	for _, cookie := range sj.cookies {
+		if !cookie.expired(now) {
+			cookies = append(cookies, cookie)
+		}
+	}
+	sortCookies(cookies)
+	return cookies
+}
+
+// changes returns the cookies set by responses since the last call to
+// forgetChanges. Deleted cookies are returned already expired, so that
+// importing them deletes them too.
+func (sj *sessionJar) changes() []SessionCookie {
+	sj.lock.Lock()
+	defer sj.lock.Unlock()
+	cookies := make([]SessionCookie, 0, len(sj.changed))
+	for _, cookie := range sj.changed {
+		cookies = append(cookies, cookie)
+	}
+	sortCookies(cookies)
+	return cookies
+}
+
+// forgetChanges marks the cookies as copied, unless a response has changed
+// them again since
+func (sj *sessionJar) forgetChanges(cookies []SessionCookie) {
+	sj.lock.Lock()
+	defer sj.lock.Unlock()
+	for _, cookie := range cookies {
+		if sj.changed[cookieKey(cookie)] == cookie {
+			delete(sj.changed, cookieKey(cookie))
+		}
+	}
+}
+
+// load adds saved cookies to the jar. Cookies whose domain starts with a dot
+// are shared with subdomains; the rest are host-only.
+func (sj *sessionJar) load(cookies []SessionCookie) {
+	for _, cookie := range cookies {
+		origin := &url_package.URL{
+			Scheme: "http",
+			Host:   strings.TrimPrefix(cookie.Domain, "."),
+			Path:   "/",
+		}
+		if cookie.Secure {
+			origin.Scheme = "https"
+		}
+		httpCookie := &http.Cookie{
+			Name:     cookie.Name,
+			Value:    cookie.Value,
+			Path:     cookie.Path,
+			Expires:  cookie.Expires,
+			Secure:   cookie.Secure,
+			HttpOnly: cookie.HTTPOnly,
+		}
+		if strings.HasPrefix(cookie.Domain, ".") {
+			httpCookie.Domain = cookie.Domain
+		}
+		sj.jar.SetCookies(origin, []*http.Cookie{httpCookie})
+		sj.lock.Lock()
+		sj.remember(cookie)
+		sj.lock.Unlock()
+	}
+}
+
+// replace makes the jar hold the browser's cookies. Cookies the browser no
+// longer has, such as after logging out, are dropped, unless a response has
+// set them since the jar was last copied into the browser.
+func (sj *sessionJar) replace(cookies []SessionCookie) {
+	current := map[string]bool{}
+	for _, cookie := range cookies {
+		current[cookieKey(cookie)] = true
+	}
+	var gone []SessionCookie
+	sj.lock.Lock()
+	for key, cookie := range sj.cookies {
+		if _, changed := sj.changed[key]; !current[key] && !changed {
+			cookie.Value, cookie.Expires = "", time.Unix(0, 0)
+			gone = append(gone, cookie)
+		}
+	}
+	sj.lock.Unlock()
+	// Loading an expired cookie deletes it
+	sj.load(append(gone, cookies...))
+}
+
+// responseCookie describes a cookie set by a response from u the way the
+// browser would store it. Cookies for a domain u cannot set are rejected.
+func responseCookie(u *url_package.URL, cookie *http.Cookie) (SessionCookie, bool) {
+	host := strings.ToLower(u.Hostname())
+	sessionCookie := SessionCookie{
+		Name:     cookie.Name,
+		Value:    cookie.Value,
+		Domain:   host,
+		Path:     cookie.Path,
+		Expires:  cookie.Expires,
+		Secure:   cookie.Secure,
+		HTTPOnly: cookie.HttpOnly,
+	}
+	if domain := strings.ToLower(strings.TrimPrefix(cookie.Domain, ".")); domain != "" {
+		if host != domain && !strings.HasSuffix(host, "."+domain) {
+			return sessionCookie, false
+		}
+		sessionCookie.Domain = "." + domain
+	}
+	if !strings.HasPrefix(sessionCookie.Path, "/") {
+		// The default path is the directory of the page which set it
+		sessionCookie.Path = "/"
+		if i := strings.LastIndex(u.Path, "/"); i > 0 {
+			sessionCookie.Path = u.Path[:i]
+		}
+	}
+	switch {
+	case cookie.MaxAge < 0:
+		sessionCookie.Expires = time.Unix(0, 0)
+	case cookie.MaxAge > 0:
+		sessionCookie.Expires = time.Now().Add(time.Duration(cookie.MaxAge) * time.Second)
+	}
+	switch cookie.SameSite {
+	case http.SameSiteLaxMode:
+		sessionCookie.SameSite = "Lax"
+	case http.SameSiteStrictMode:
+		sessionCookie.SameSite = "Strict"
+	case http.SameSiteNoneMode:
+		sessionCookie.SameSite = "None"
+	}
+	return sessionCookie, true
+}
+
+// cookieKey identifies a cookie the way browsers do: by domain, path and name
+func cookieKey(cookie SessionCookie) string {
+	return cookie.Domain + ";" + cookie.Path + ";" + cookie.Name
+}
+
+// sortCookies puts cookies in a stable order
+func sortCookies(cookies []SessionCookie) {
+	sort.Slice(cookies, func(i, j int) bool {
+		return cookieKey(cookies[i]) < cookieKey(cookies[j])
+	})
+}
+
+// userAgentTransport sets the User-Agent header, and the Accept-Language
+// header if a language is given, on every request
+type userAgentTransport struct {
+	userAgent string
+	language  string
+	next      http.RoundTripper
+}
+
+// RoundTrip sends the request with the configured headers
+func (uat userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	if uat.userAgent != "" {
+		req.Header.Set("User-Agent", uat.userAgent)
+	}
+	if uat.language != "" {
+		req.Header.Set("Accept-Language", uat.language)
+	}
+	return uat.next.RoundTrip(req)
+}
+
+// EnableSessionSharing makes the HTTP helpers such as GetFullPageHTML act as
+// the browser: requests carry the browser's cookies and User-Agent, and any
+// cookies set by the responses are copied back into the browser.
+func (wd *WebDriver) EnableSessionSharing(ctx context.Context) error {
+	var userAgent string
+	err := wd.do(ctx, "user-agent", func(ctx context.Context, browser Browser) (err error) {
+		userAgent, err = browser.UserAgent(ctx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	// The profile's proxy carries the shared session too
+	transport := wd.profile.transport()
+	if userAgent != "" {
+		transport = userAgentTransport{userAgent: userAgent, next: transport}
+	}
+	wd.sharedJar = newSessionJar()
+	wd.httpClient = &http.Client{
+		Transport: transport,
+		Jar:       wd.sharedJar,
+	}
+	return wd.SyncCookiesFromBrowser(ctx)
+}
+
+// HTTPClient returns the client used by the HTTP helpers. It goes through
+// the proxy of the web driver's profile, and once session sharing is enabled
+// it carries the browser's session.
+func (wd *WebDriver) HTTPClient() *http.Client {
+	if wd.httpClient == nil {
+		return http.DefaultClient
+	}
+	return wd.httpClient
+}
+
+// SyncCookiesFromBrowser copies the browser's cookies into the shared HTTP
+// client, dropping any the browser has deleted since the last sync
+func (wd *WebDriver) SyncCookiesFromBrowser(ctx context.Context) error {
+	if wd.sharedJar == nil {
+		return fmt.Errorf("session sharing has not been enabled")
+	}
+	var state *SessionState
+	err := wd.do(ctx, "export-cookies", func(ctx context.Context, browser Browser) (err error) {
+		state, err = browser.ExportSession(ctx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	wd.sharedJar.replace(state.Cookies)
+	return nil
+}
+
+// SyncCookiesToBrowser copies the cookies set by the shared HTTP client's
+// responses into the browser, with the attributes the responses gave them.
+// Cookies which came from the browser are left alone.
+func (wd *WebDriver) SyncCookiesToBrowser(ctx context.Context) error {
+	if wd.sharedJar == nil {
+		return fmt.Errorf("session sharing has not been enabled")
+	}
+	changes := wd.sharedJar.changes()
+	if len(changes) == 0 {
+		return nil
+	}
+	state := &SessionState{Cookies: changes}
+	err := wd.do(ctx, "import-cookies", func(ctx context.Context, browser Browser) error {
+		return browser.ImportSession(ctx, state)
+	})
+	if err != nil {
+		return err
+	}
+	wd.sharedJar.forgetChanges(changes)
+	return nil
+}
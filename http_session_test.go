@@ -0,0 +1,119 @@
+package offthegrid
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	url_package "net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionSharing(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	mux := http.NewServeMux()
+	mux.Handle("/", newFakeAccountSite())
+	mux.HandleFunc("/preferences", func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "theme", Value: "dark", MaxAge: 3600, HttpOnly: true, SameSite: http.SameSiteLaxMode})
+		w.Write([]byte("<html><body>Saved</body></html>"))
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	wd := NewWebDriverWithBrowser(NewHTMLBrowser(mux))
+	assert.NoError(wd.GoToPage(ctx, server.URL+"/login-form"))
+	assert.NoError(wd.ClickButton(ctx, "#login"))
+
+	// Without sharing, plain HTTP requests are not logged in
+	body, err := wd.GetFullPageHTML(ctx, server.URL+"/account")
+	assert.NoError(err)
+	assert.Contains(body, "Log in")
+	assert.Error(wd.SyncCookiesToBrowser(ctx))
+
+	assert.NoError(wd.EnableSessionSharing(ctx))
+	body, err = wd.GetFullPageHTML(ctx, server.URL+"/account")
+	assert.NoError(err)
+	assert.Contains(body, "Welcome back")
+
+	// Cookies set over HTTP make it back into the browser
+	_, err = wd.GetFullPageHTML(ctx, server.URL+"/preferences")
+	assert.NoError(err)
+	state, err := wd.browser.ExportSession(ctx)
+	assert.NoError(err)
+	cookies := map[string]SessionCookie{}
+	for _, cookie := range state.Cookies {
+		cookies[cookie.Name] = cookie
+	}
+	assert.Equal("valid", cookies["session"].Value)
+	// The cookie keeps the attributes the response gave it
+	theme := cookies["theme"]
+	assert.Equal("dark", theme.Value)
+	assert.Equal("127.0.0.1", theme.Domain)
+	assert.Equal("/", theme.Path)
+	assert.True(theme.HTTPOnly)
+	assert.Equal("Lax", theme.SameSite)
+	assert.WithinDuration(time.Now().Add(time.Hour), theme.Expires, time.Minute)
+
+	// Logging out in the browser logs the HTTP client out too
+	session := cookies["session"]
+	session.Expires = time.Unix(0, 0)
+	assert.NoError(wd.browser.ImportSession(ctx, &SessionState{Cookies: []SessionCookie{session}}))
+	assert.NoError(wd.SyncCookiesFromBrowser(ctx))
+	body, err = wd.GetFullPageHTML(ctx, server.URL+"/account")
+	assert.NoError(err)
+	assert.Contains(body, "Log in")
+}
+
+func TestSessionJarChanges(t *testing.T) {
+	assert := assert.New(t)
+	jar := newSessionJar()
+	expires := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+	jar.load([]SessionCookie{
+		{Name: "session", Value: "valid", Domain: ".shop.example", Path: "/", Expires: expires, Secure: true, HTTPOnly: true},
+		{Name: "cart", Value: "3", Domain: "www.shop.example", Path: "/"},
+	})
+	assert.Empty(jar.changes())
+
+	page, _ := url_package.Parse("https://www.shop.example/account/settings")
+	jar.SetCookies(page, []*http.Cookie{
+		{Name: "theme", Value: "dark"},
+		{Name: "tracking", Value: "1", Domain: "shop.example", Path: "/", Secure: true},
+		{Name: "cart", Value: "", Path: "/", MaxAge: -1},
+		// Another site's cookie cannot be set
+		{Name: "evil", Value: "1", Domain: "other.example"},
+	})
+	changes := jar.changes()
+	if assert.Len(changes, 3) {
+		assert.Equal(SessionCookie{Name: "tracking", Value: "1", Domain: ".shop.example", Path: "/", Secure: true}, changes[0])
+		assert.Equal("www.shop.example", changes[1].Domain)
+		assert.Equal("cart", changes[1].Name)
+		assert.True(changes[1].expired(time.Now()))
+		assert.Equal(SessionCookie{Name: "theme", Value: "dark", Domain: "www.shop.example", Path: "/account"}, changes[2])
+	}
+	assert.Len(jar.Cookies(page), 3)
+
+	// The browser's own cookies are exported as they were loaded
+	exported := jar.export()
+	if assert.Len(exported, 3) {
+		assert.Equal(SessionCookie{Name: "session", Value: "valid", Domain: ".shop.example", Path: "/", Expires: expires, Secure: true, HTTPOnly: true}, exported[0])
+	}
+
+	// Replacing the browser's cookies drops those it no longer has, but
+	// keeps those set by responses which have not been copied into it yet
+	jar.replace(nil)
+	names := []string{}
+	for _, cookie := range jar.export() {
+		names = append(names, cookie.Name)
+	}
+	assert.Equal([]string{"tracking", "theme"}, names)
+	assert.Len(jar.Cookies(page), 2)
+
+	jar.forgetChanges(changes)
+	assert.Empty(jar.changes())
+	jar.replace(nil)
+	assert.Empty(jar.export())
+	assert.Empty(jar.Cookies(page))
+}
@@ -0,0 +1,223 @@
+package offthegrid
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/andybalholm/cascadia"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// ItemSpec declares how to find the repeated items in a list, such as
+// coupon cards or search results, and what to read from each of them
+type ItemSpec struct {
+	// ContainerSelector selects every item on the page
+	ContainerSelector string
+	// ActionSelector selects the button to click within an item. It is a CSS
+	// selector evaluated inside the container. Items without a match have no action.
+	ActionSelector string
+	// Fields names the values to read from each item
+	Fields map[string]FieldSpec
+	// LazyLoad, if set, loads the whole list before the items are read
+	LazyLoad *LazyLoadOptions
+}
+
+// FieldSpec reads a single value from an item
+type FieldSpec struct {
+	// Selector is a CSS selector evaluated inside the container. When empty
+	// the value is read from the container itself.
+	Selector string `yaml:"selector,omitempty" json:"selector,omitempty"`
+	// Attribute names the attribute to read. When empty the text is read.
+	Attribute string `yaml:"attribute,omitempty" json:"attribute,omitempty"`
+	// TrimPrefix and TrimSuffix are removed from the value when present
+	TrimPrefix string `yaml:"trim-prefix,omitempty" json:"trim-prefix,omitempty"`
+	TrimSuffix string `yaml:"trim-suffix,omitempty" json:"trim-suffix,omitempty"`
+	// TrimSpace removes leading and trailing whitespace, before the
+	// prefix and suffix are trimmed
+	TrimSpace bool `yaml:"trim-space,omitempty" json:"trim-space,omitempty"`
+	// Required fails the iteration if the value cannot be found
+	Required bool `yaml:"required,omitempty" json:"required,omitempty"`
+}
+
+// Item is a single item found by IterateItems
+type Item struct {
+	// Index is the position of the item on the page
+	Index int
+	// Container is the node which holds the item
+	Container *Node
+	// Action is the item's action button, or nil if it has none
+	Action *Node
+	// Fields holds the values read by the spec's FieldSpecs
+	Fields map[string]string
+}
+
+// Field returns the named value, or an empty string if it was not found
+func (item *Item) Field(name string) string {
+	return item.Fields[name]
+}
+
+// ItemDecider decides whether to click an item's action button
+type ItemDecider func(ctx context.Context, item *Item) (act bool, err error)
+
+// IterateItems finds every item described by the spec and reads its fields
+func (wd *WebDriver) IterateItems(ctx context.Context, spec ItemSpec) (items []*Item, err error) {
+	if spec.LazyLoad != nil {
+		if _, err = wd.LoadAllLazyContent(ctx, spec.ContainerSelector, *spec.LazyLoad); err != nil {
+			return nil, err
+		}
+	}
+	var containers []*Node
+	err = wd.do(ctx, "find-items", func(ctx context.Context, browser Browser) (err error) {
+		containers, err = browser.Nodes(ctx, spec.ContainerSelector)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	wd.log.WithFields(logrus.Fields{
+		"selector": spec.ContainerSelector,
+		"numItems": len(containers),
+	}).Debug("Found items to iterate")
+
+	for i, container := range containers {
+		innerHTML, err := wd.GetInnerHTMLOfElement(ctx, container.XPath)
+		if err != nil {
+			return nil, err
+		}
+		item, err := spec.parseItem(i, container, innerHTML)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// ActOnItems iterates the items described by the spec and clicks the action
+// button of every item the decider accepts. It returns the number of clicks.
+func (wd *WebDriver) ActOnItems(ctx context.Context, spec ItemSpec, decide ItemDecider) (clicked int, err error) {
+	items, err := wd.IterateItems(ctx, spec)
+	if err != nil {
+		return 0, err
+	}
+	for _, item := range items {
+		if item.Action == nil {
+			continue
+		}
+		act, err := decide(ctx, item)
+		if err != nil {
+			return clicked, err
+		}
+		if !act {
+			continue
+		}
+		if err = wd.click(ctx, item.Action.XPath); err != nil {
+			wd.log.WithFields(logrus.Fields{
+				"error": err,
+				"xpath": item.Action.XPath,
+			}).Error("Could not click the item's action button")
+			return clicked, err
+		}
+		clicked++
+	}
+	return clicked, nil
+}
+
+// parseItem reads the fields and action of one container from its inner HTML
+func (spec ItemSpec) parseItem(index int, container *Node, innerHTML string) (*Item, error) {
+	root, err := parseContainer(container, innerHTML)
+	if err != nil {
+		return nil, err
+	}
+	item := &Item{
+		Index:     index,
+		Container: container,
+		Fields:    map[string]string{},
+	}
+	if spec.ActionSelector != "" {
+		selector, err := cascadia.Compile(spec.ActionSelector)
+		if err != nil {
+			return nil, err
+		}
+		if action := matchWithin(selector, root); action != nil {
+			item.Action = nodeFromHTML(action)
+			item.Action.XPath = container.XPath + relativeXPath(root, action)
+		}
+	}
+	for name, field := range spec.Fields {
+		value, found, err := field.read(container, root)
+		if err != nil {
+			return nil, fmt.Errorf("could not read field %q: %w", name, err)
+		}
+		if !found && field.Required {
+			return nil, fmt.Errorf("item %d has no value for the required field %q", index, name)
+		}
+		item.Fields[name] = value
+	}
+	return item, nil
+}
+
+// read extracts the field's value from a parsed container
+func (field FieldSpec) read(container *Node, root *html.Node) (value string, found bool, err error) {
+	switch {
+	case field.Selector == "" && field.Attribute != "":
+		value, found = container.Attributes[field.Attribute]
+	case field.Selector == "":
+		value, found = nodeText(root), true
+	default:
+		selector, err := cascadia.Compile(field.Selector)
+		if err != nil {
+			return "", false, err
+		}
+		node := matchWithin(selector, root)
+		if node == nil {
+			return "", false, nil
+		}
+		if field.Attribute == "" {
+			value, found = nodeText(node), true
+		} else {
+			value, found = attrValue(node, field.Attribute), hasAttr(node, field.Attribute)
+		}
+	}
+	return field.trim(value), found, nil
+}
+
+// trim applies the field's trim rules to a value
+func (field FieldSpec) trim(value string) string {
+	if field.TrimSpace {
+		value = strings.TrimSpace(value)
+	}
+	value = strings.TrimPrefix(value, field.TrimPrefix)
+	return strings.TrimSuffix(value, field.TrimSuffix)
+}
+
+// parseContainer rebuilds a container from its inner HTML so that selectors
+// can be evaluated within it
+func parseContainer(container *Node, innerHTML string) (*html.Node, error) {
+	root := &html.Node{
+		Type:     html.ElementNode,
+		Data:     container.NodeName,
+		DataAtom: atom.Lookup([]byte(container.NodeName)),
+	}
+	children, err := html.ParseFragment(strings.NewReader(innerHTML), root)
+	if err != nil {
+		return nil, err
+	}
+	for _, child := range children {
+		root.AppendChild(child)
+	}
+	return root, nil
+}
+
+// matchWithin returns the first descendant of root matching the selector
+func matchWithin(selector cascadia.Selector, root *html.Node) *html.Node {
+	for _, match := range selector.MatchAll(root) {
+		if match != root {
+			return match
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package offthegrid
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const fakeListingPage = `<html><body><ul>
+<li class="listing" data-state="CO">
+	<h2> Jane Doe </h2>
+	<span class="age">Age 42</span>
+	<div class="actions"><button aria-label="Opt out Jane Doe">Opt out</button></div>
+</li>
+<li class="listing" data-state="WY">
+	<h2>John Doe</h2>
+	<span class="age">Age 40</span>
+</li>
+<li class="listing" data-state="CO">
+	<h2>Jim Doe</h2>
+	<span class="age">Age 12</span>
+	<div class="actions"><button aria-label="Opt out Jim Doe">Opt out</button></div>
+</li>
+</ul></body></html>`
+
+var fakeListingSpec = ItemSpec{
+	ContainerSelector: "li.listing",
+	ActionSelector:    "div.actions > button",
+	Fields: map[string]FieldSpec{
+		"name":  {Selector: "h2", TrimSpace: true, Required: true},
+		"age":   {Selector: ".age", TrimPrefix: "Age "},
+		"state": {Attribute: "data-state"},
+	},
+}
+
+func newFakeListingSite() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, fakeListingPage)
+	})
+}
+
+func TestIterateItems(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	wd := NewWebDriverWithBrowser(NewHTMLBrowser(newFakeListingSite()))
+	assert.NoError(wd.GoToPage(ctx, "https://people.example/"))
+
+	items, err := wd.IterateItems(ctx, fakeListingSpec)
+	assert.NoError(err)
+	if !assert.Len(items, 3) {
+		return
+	}
+	assert.Equal("Jane Doe", items[0].Field("name"))
+	assert.Equal("42", items[0].Field("age"))
+	assert.Equal("CO", items[0].Field("state"))
+	assert.Equal("Opt out Jane Doe", items[0].Action.AttributeValue("aria-label"))
+	assert.Equal("/html[1]/body[1]/ul[1]/li[1]/div[1]/button[1]", items[0].Action.XPath)
+	assert.Nil(items[1].Action)
+
+	spec := fakeListingSpec
+	spec.Fields = map[string]FieldSpec{"missing": {Selector: ".missing", Required: true}}
+	_, err = wd.IterateItems(ctx, spec)
+	assert.Error(err)
+}
+
+func TestActOnItems(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	hb := NewHTMLBrowser(newFakeListingSite())
+	wd := NewWebDriverWithBrowser(hb)
+	assert.NoError(wd.GoToPage(ctx, "https://people.example/"))
+
+	var decided []string
+	clicked, err := wd.ActOnItems(ctx, fakeListingSpec, func(ctx context.Context, item *Item) (bool, error) {
+		decided = append(decided, item.Field("name"))
+		return item.Field("age") != "12", nil
+	})
+	assert.NoError(err)
+	assert.Equal(1, clicked)
+	// Items without an action button are never offered to the decider
+	assert.Equal([]string{"Jane Doe", "Jim Doe"}, decided)
+	if assert.Len(hb.Clicks(), 1) {
+		assert.Equal("Opt out Jane Doe", hb.Clicks()[0].AttributeValue("aria-label"))
+	}
+}
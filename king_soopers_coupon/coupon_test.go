@@ -1,8 +1,11 @@
 package couponpusher
 
 import (
+	"context"
+	"net/http"
 	"testing"
 
+	offthegrid "github.com/TopherGopher/OffTheGrid"
 	"github.com/sirupsen/logrus"
 
 	"github.com/stretchr/testify/assert"
@@ -17,7 +20,7 @@ func TestKingSoopersDoIt(t *testing.T) {
 
 	t.Run("Can do it all", func(t *testing.T) {
 		//t.Skip("Skipping the clicking for now.")
-		assert.NoError(ksc.DoIt())
+		assert.NoError(ksc.DoIt(context.Background()))
 	})
 }
 
@@ -28,9 +31,129 @@ func TestRemoveAllCoupons(t *testing.T) {
 	defer ksc.Teardown()
 	var err error
 	t.Run("Can login", func(t *testing.T) {
-		err = ksc.Login()
+		err = ksc.Login(context.Background())
 		assert.NoError(err)
 	})
-	err = ksc.RemoveAllCoupons()
+	err = ksc.RemoveAllCoupons(context.Background())
 	assert.NoError(err)
 }
+
+// newFakeKingSoopers serves just enough of the King Soopers site from
+// testdata to sign in and list coupons
+func newFakeKingSoopers() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/signin", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.ServeFile(w, r, "testdata/signin.html")
+			return
+		}
+		if r.PostFormValue("email") != "topher@develops.guru" || r.PostFormValue("password") != "MyPASSWORD" {
+			http.Redirect(w, r, "/signin", http.StatusSeeOther)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "signed-in", Path: "/"})
+		http.Redirect(w, r, r.PostFormValue("redirectUrl"), http.StatusSeeOther)
+	})
+	mux.HandleFunc("/cl/coupons/", func(w http.ResponseWriter, r *http.Request) {
+		if cookie, err := r.Cookie("session"); err != nil || cookie.Value != "signed-in" {
+			http.Redirect(w, r, "/signin", http.StatusSeeOther)
+			return
+		}
+		http.ServeFile(w, r, "testdata/coupons.html")
+	})
+	return mux
+}
+
+// newFakeKingSoopersCoupon creates a coupon clipper which drives a fake
+// King Soopers site and keeps its sessions in sessionDir
+func newFakeKingSoopersCoupon(sessionDir string) (*KingSoopersCoupon, *offthegrid.HTMLBrowser) {
+	browser := offthegrid.NewHTMLBrowser(newFakeKingSoopers())
+	wd := offthegrid.NewWebDriverWithBrowser(browser)
+	wd.SetSessionStore(offthegrid.NewSessionStore(sessionDir))
+	return NewKingSoopersCouponWithWebDriver(wd), browser
+}
+
+func TestKingSoopersLoginWithFakeSite(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	ksc, browser := newFakeKingSoopersCoupon(t.TempDir())
+	defer ksc.Teardown()
+
+	assert.NoError(ksc.Login(ctx))
+	assert.Equal("https://www.kingsoopers.com/cl/coupons/", browser.CurrentURL())
+	assert.True(ksc.CouponsAreAvailable(ctx))
+}
+
+func TestKingSoopersClickAllCouponsWithFakeSite(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	ksc, browser := newFakeKingSoopersCoupon(t.TempDir())
+	defer ksc.Teardown()
+	assert.NoError(ksc.Login(ctx))
+	clicksAfterLogin := len(browser.Clicks())
+
+	summary, err := ksc.ClickAllCoupons(ctx, false)
+	assert.NoError(err)
+	assert.Equal(1, summary.Clicked)
+	clicks := browser.Clicks()[clicksAfterLogin:]
+	if assert.Len(clicks, 1) {
+		assert.Equal("Load to Card Popcorn", clicks[0].AttributeValue("aria-label"))
+	}
+	// Baby coupons are never loaded
+	assert.True(ksc.BlacklistCoupons["Save $2.00 on Diapers"])
+}
+
+func TestKingSoopersConfirmsCoupons(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	ksc, browser := newFakeKingSoopersCoupon(t.TempDir())
+	defer ksc.Teardown()
+	assert.NoError(ksc.Login(ctx))
+	clicksAfterLogin := len(browser.Clicks())
+
+	// Quitting stops cleanly without loading anything
+	confirmer := &offthegrid.ScriptedConfirmer{Decisions: []offthegrid.Decision{offthegrid.ConfirmQuit}}
+	ksc.Confirmer = confirmer
+	summary, err := ksc.ClickAllCoupons(ctx, true)
+	assert.NoError(err)
+	assert.True(summary.Quit)
+	assert.Equal(0, summary.Clicked)
+	assert.Len(browser.Clicks(), clicksAfterLogin)
+	if assert.Len(confirmer.Asked, 1) {
+		assert.Equal("Save $1.00 on 2 Popcorn", confirmer.Asked[0].Field("text"))
+	}
+
+	// A declined coupon is blacklisted
+	ksc.Confirmer = &offthegrid.ScriptedConfirmer{Decisions: []offthegrid.Decision{offthegrid.ConfirmSkip}}
+	summary, err = ksc.ClickAllCoupons(ctx, true)
+	assert.NoError(err)
+	assert.Len(summary.Skipped, 1)
+	assert.True(ksc.BlacklistCoupons["Save $1.00 on 2 Popcorn"])
+	assert.Len(browser.Clicks(), clicksAfterLogin)
+}
+
+func TestKingSoopersReusesSavedSession(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	sessionDir := t.TempDir()
+
+	first, firstBrowser := newFakeKingSoopersCoupon(sessionDir)
+	defer first.Teardown()
+	assert.NoError(first.Login(ctx))
+	// No session was saved yet, so the sign in form was submitted
+	assert.Len(firstBrowser.Clicks(), 1)
+
+	second, secondBrowser := newFakeKingSoopersCoupon(sessionDir)
+	defer second.Teardown()
+	assert.NoError(second.Login(ctx))
+	assert.Len(secondBrowser.Clicks(), 0)
+	assert.True(second.CouponsAreAvailable(ctx))
+}
+
+func TestWithLogger(t *testing.T) {
+	assert := assert.New(t)
+	logger := logrus.New()
+	wd := newKingSoopersWebDriver()
+	WithLogger(logger)(wd)
+	assert.Same(logger, wd.Logger())
+}
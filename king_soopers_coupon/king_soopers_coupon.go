@@ -1,26 +1,37 @@
 package couponpusher
 
 import (
+	"context"
 	"fmt"
 	"strings"
+	"time"
 
 	offthegrid "github.com/TopherGopher/OffTheGrid"
-	"github.com/chromedp/cdproto/cdp"
 	"github.com/sirupsen/logrus"
 )
 
+// couponSettleTime is how long the number of coupon cards must stay the same
+// before the page counts as loaded
+const couponSettleTime = time.Second
+
 type CouponBase struct {
 	LoginURL             string
 	CouponURL            string
 	couponButtonSelector string
+	couponSpec           offthegrid.ItemSpec
 	AccountCouponURL     string
-	webDriver            *offthegrid.WebDriver
-	formAnalyzer         *offthegrid.Analyzer
-	log                  *logrus.Logger
+	username             string
+	password             string
+	BlacklistCoupons     map[string]bool
+	// Confirmer is asked about each coupon before DoIt loads it
+	Confirmer    offthegrid.Confirmer
+	webDriver    *offthegrid.WebDriver
+	formAnalyzer *offthegrid.Analyzer
+	log          *logrus.Logger
 }
 
 type CouponInterface interface {
-	Login() error
+	Login(ctx context.Context) error
 }
 
 type KingSoopersCoupon struct {
@@ -28,55 +39,163 @@ type KingSoopersCoupon struct {
 }
 
 func NewKingSoopersCoupon() *KingSoopersCoupon {
-	wd := offthegrid.NewWebDriver()
+	wd := newKingSoopersWebDriver()
 	headless := false
+	// Init logs why the browser did not start, and every action of the
+	// clipper then fails with that browser
 	wd.Init(headless)
+	return NewKingSoopersCouponWithWebDriver(wd)
+}
+
+// Option changes how the web driver of a new clipper is set up
+type Option func(wd *offthegrid.WebDriver)
+
+// WithLogger has the clipper log to logger
+func WithLogger(logger *logrus.Logger) Option {
+	return func(wd *offthegrid.WebDriver) {
+		wd.SetLogger(logger)
+	}
+}
+
+// NewKingSoopersCouponWithProfile creates a King Soopers coupon clipper whose
+// browser and HTTP requests use the given profile, which may be nil to use
+// the defaults
+func NewKingSoopersCouponWithProfile(profile *offthegrid.BrowserProfile, opts ...Option) (*KingSoopersCoupon, error) {
+	wd := newKingSoopersWebDriver()
+	for _, opt := range opts {
+		opt(wd)
+	}
+	if profile != nil {
+		if err := wd.UseProfile(profile); err != nil {
+			return nil, err
+		}
+	}
+	headless := false
+	if err := wd.Init(headless); err != nil {
+		return nil, err
+	}
+	return NewKingSoopersCouponWithWebDriver(wd), nil
+}
+
+// newKingSoopersWebDriver creates a web driver which is not yet initialized,
+// set up for the live site
+func newKingSoopersWebDriver() *offthegrid.WebDriver {
+	wd := offthegrid.NewWebDriver()
+	// The live site is flaky enough that every action deserves a second try
+	wd.RetryPolicy = offthegrid.DefaultRetryPolicy()
+	// Bot checks are handed to whoever is running the clipper
+	wd.ChallengePolicy = offthegrid.DefaultChallengePolicy()
+	return wd
+}
+
+// NewKingSoopersCouponWithWebDriver creates a King Soopers coupon clipper
+// which drives an already initialized web driver
+func NewKingSoopersCouponWithWebDriver(wd *offthegrid.WebDriver) *KingSoopersCoupon {
+	lazyLoad := offthegrid.DefaultLazyLoadOptions()
 	return &KingSoopersCoupon{
 		CouponBase: CouponBase{
 			LoginURL:             "https://www.kingsoopers.com/signin?redirectUrl=/cl/coupons/",
 			CouponURL:            "https://www.kingsoopers.com/cl/coupons",
 			AccountCouponURL:     "https://www.kingsoopers.com/cl/mycoupons/",
 			couponButtonSelector: "div.CouponCard-buttonContainer.CouponCard-row.CouponCard-button > button",
-			webDriver:            wd,
-			formAnalyzer:         offthegrid.NewAnalyzer(),
-			log:                  logrus.New(),
+			username:             "topher@develops.guru",
+			password:             "MyPASSWORD",
+			couponSpec: offthegrid.ItemSpec{
+				ContainerSelector: "div.Card > div.CouponCard",
+				ActionSelector:    "div.CouponCard-buttonContainer.CouponCard-row.CouponCard-button > button",
+				Fields: map[string]offthegrid.FieldSpec{
+					// This will be something like "Baby,"
+					"category": {Attribute: "data-category"},
+					// Image Save $1.00 on 2 Angie's BOOMCHICKAPOP®\u200b Ready to Eat Popcorn, Click on this image to view more info in coupon modal
+					"text": {
+						Selector:   ".CouponCard-img",
+						Attribute:  "aria-label",
+						TrimPrefix: "Image ",
+						TrimSuffix: ", Click on this image to view more info in coupon modal",
+						Required:   true,
+					},
+				},
+				LazyLoad: &lazyLoad,
+			},
+			BlacklistCoupons: map[string]bool{},
+			Confirmer: &offthegrid.TerminalConfirmer{
+				Describe: describeCoupon,
+			},
+			webDriver:    wd,
+			formAnalyzer: offthegrid.NewAnalyzerWithLogger(wd.Logger()),
+			log:          wd.Logger(),
 		},
 	}
 }
 
 // Teardown tears down the web driver
-func (cb *CouponBase) Teardown() {
-	cb.webDriver.Teardown()
+func (cb *CouponBase) Teardown() error {
+	return cb.webDriver.Teardown()
+}
+
+// TargetDevice is the desktop; the coupon selectors were written against
+// the desktop pages
+func (cb *CouponBase) TargetDevice() *offthegrid.Device {
+	return offthegrid.DesktopDevice()
 }
 
-// Login to King Soopers site - session persists in webDriver
+// Login to King Soopers site - session persists in webDriver and is saved
+// to disk so that the next run can skip signing in
+func (cb *CouponBase) Login(ctx context.Context) (err error) {
+	if err = cb.webDriver.EmulateFor(ctx, cb); err != nil {
+		return err
+	}
+	sessionKey := offthegrid.SessionKey{Site: "kingsoopers.com", Account: cb.username}
+	return cb.webDriver.LoginWithSession(ctx, sessionKey, cb.isLoggedIn, cb.signIn)
+}
+
+// isLoggedIn loads the coupon page and reports whether King Soopers let us
+// stay on it rather than sending us to sign in
+func (cb *CouponBase) isLoggedIn(ctx context.Context) (bool, error) {
+	if err := cb.webDriver.GoToPage(ctx, cb.CouponURL); err != nil {
+		return false, err
+	}
+	location, err := cb.webDriver.CurrentURL(ctx)
+	if err != nil {
+		return false, err
+	}
+	return !strings.Contains(location, "/signin"), nil
+}
+
+// signIn fills in the King Soopers sign in form. It has worked once the
+// coupon buttons show up.
 //*[@id="content"]/section/div/section[4]/div/div[2]/div/div/div/div[2]/div/div/div/ul/li[1]/div/div/div[4]/div[2]/button
-func (cb *CouponBase) Login() (err error) {
-	return cb.webDriver.Login(
-		cb.LoginURL,
-		"//*[@id=\"SignIn-emailInput\"]", "topher@develops.guru",
-		"//*[@id=\"SignIn-passwordInput\"]", "MyPASSWORD",
-		"//*[@id=\"SignIn-submitButton\"]",
-		"//*[@id=\"content\"]/section/div/section[4]/div/div[2]/div/div/div/div[2]/div/div/div/ul/li[1]/div/div/div[4]/div[2]/button",
-		cb.couponButtonSelector,
-	)
+func (cb *CouponBase) signIn(ctx context.Context) (err error) {
+	result, err := cb.webDriver.Login(ctx, offthegrid.LoginSpec{
+		URL:              cb.LoginURL,
+		UsernameSelector: "//*[@id=\"SignIn-emailInput\"]",
+		Username:         cb.username,
+		PasswordSelector: "//*[@id=\"SignIn-passwordInput\"]",
+		Password:         cb.password,
+		SubmitSelector:   "//*[@id=\"SignIn-submitButton\"]",
+		SuccessSelector:  cb.couponButtonSelector,
+	})
+	if err != nil {
+		return err
+	}
+	return result.Err()
 }
 
 // CouponsAreAvailable returns True if there are coupon buttons available for clicking
-func (cb *CouponBase) CouponsAreAvailable() bool {
+func (cb *CouponBase) CouponsAreAvailable(ctx context.Context) bool {
 	var couponBody string
-	var elems []*cdp.Node
-	if elems = cb.webDriver.FetchElements(cb.couponButtonSelector); len(elems) == 0 {
+	var elems []*offthegrid.Node
+	if elems = cb.webDriver.FetchElements(ctx, cb.couponButtonSelector); len(elems) == 0 {
 		cb.log.Debug("No coupon buttons were found")
 		return false
 	}
 
-	// if len(cb.webDriver.BlacklistCoupons) >= len(elems) {
+	// if len(cb.BlacklistCoupons) >= len(elems) {
 	// 	foundSomethingClickable := false
 	// 	for _, elem := range elems {
 	// 		// TODO: Add this check so we don't loop forever
 	// 		// we need to compute the text here
-	// 		if _, ok := cb.webDriver.BlacklistCoupons[]; !ok {
+	// 		if _, ok := cb.BlacklistCoupons[]; !ok {
 	// 			foundSomethingClickable = true
 	// 			break
 	// 		}
@@ -96,48 +215,106 @@ func (cb *CouponBase) CouponsAreAvailable() bool {
 }
 
 // RemoveAllCoupons removes all coupons from your account
-func (cb *CouponBase) RemoveAllCoupons() (err error) {
-	if err = cb.webDriver.GoToPage(cb.AccountCouponURL); err != nil {
+func (cb *CouponBase) RemoveAllCoupons(ctx context.Context) (err error) {
+	if err = cb.webDriver.GoToPage(ctx, cb.AccountCouponURL); err != nil {
 		return err
 	}
-	if !cb.CouponsAreAvailable() {
+	if !cb.CouponsAreAvailable(ctx) {
 		cb.log.Info("No remove coupon buttons could be found to click.")
-		return fmt.Errorf("no remove coupon buttons available")
+		return fmt.Errorf("no remove coupon buttons available: %w", offthegrid.ErrElementNotFound)
 	}
 	confirm := false
-	for cb.CouponsAreAvailable() {
+	for cb.CouponsAreAvailable(ctx) {
 		// While coupons are available, click everything on screen
 		// then refresh
-		if err = cb.webDriver.ClickAllButtons(cb.couponButtonSelector, confirm); err != nil {
+		if _, err = cb.ClickAllCoupons(ctx, confirm); err != nil {
 			cb.log.WithField("error", err).Error("There was an issue clicking the buttons")
 			return err
 		}
-		if err = cb.webDriver.ReloadPage(); err != nil {
+		if err = cb.webDriver.ReloadPage(ctx); err != nil {
 			cb.log.WithField("error", err).Error("There was an issue reloading the page")
 			return err
 		}
+		// The coupon cards trickle in after the page loads
+		if err = cb.webDriver.WaitFor(ctx, offthegrid.ElementCountStable(cb.couponSpec.ContainerSelector, couponSettleTime)); err != nil {
+			return err
+		}
 	}
 	return nil
 }
 
+// ClickAllCoupons clicks the button on every coupon card which is not
+// blacklisted. When confirm is set the Confirmer is asked about each coupon
+// first, and any coupon it turns down is blacklisted.
+func (cb *CouponBase) ClickAllCoupons(ctx context.Context, confirm bool) (summary *offthegrid.ActionSummary, err error) {
+	var confirmer offthegrid.Confirmer = offthegrid.AlwaysYes{}
+	if confirm {
+		confirmer = cb.Confirmer
+	}
+	summary, err = cb.webDriver.ConfirmAndActOnItems(ctx, cb.couponSpec, func(ctx context.Context, coupon *offthegrid.Item) (bool, error) {
+		couponText := coupon.Field("text")
+		label := coupon.Action.AttributeValue("aria-label")
+		if strings.Contains(coupon.Field("category"), "Baby") {
+			// Skip anything in the baby category
+			cb.BlacklistCoupons[couponText] = true
+			return false, nil
+		}
+		if _, ok := cb.BlacklistCoupons[couponText]; ok {
+			// If this is part of the blacklist, continue
+			cb.log.WithField("text", couponText).Debug("Found existing blacklist entry")
+			return false, nil
+		}
+		if confirm && !strings.Contains(label, "Load to Card") {
+			// If this isn't a coupon, or the coupon has already been loaded
+			// then we don't want to click the button
+			return false, nil
+		}
+		cb.log.WithFields(logrus.Fields{
+			"xpath": coupon.Action.XPath,
+			"label": label,
+		}).Debug("I found a button to click")
+		return true, nil
+	}, confirmer)
+	if summary != nil {
+		for _, coupon := range summary.Skipped {
+			cb.BlacklistCoupons[coupon.Field("text")] = true
+		}
+	}
+	return summary, err
+}
+
+// describeCoupon shows a coupon the way a shopper would recognise it
+func describeCoupon(coupon *offthegrid.Item) string {
+	return fmt.Sprintf("Category: %s\nText: %s", coupon.Field("category"), coupon.Field("text"))
+}
+
 // DoIt calls Login and clicks any relevant coupon buttons
-func (cb *CouponBase) DoIt() (err error) {
-	if err = cb.Login(); err != nil {
+func (cb *CouponBase) DoIt(ctx context.Context) (err error) {
+	if err = cb.Login(ctx); err != nil {
 		cb.log.WithField("error", err).Error("There was an issue logging in")
 		return err
 	}
 	confirm := true
-	for cb.CouponsAreAvailable() {
+	for cb.CouponsAreAvailable(ctx) {
 		// While coupons are available, click everything on screen
 		// then refresh
-		if err = cb.webDriver.ClickAllButtons(cb.couponButtonSelector, confirm); err != nil {
+		summary, err := cb.ClickAllCoupons(ctx, confirm)
+		if err != nil {
 			cb.log.WithField("error", err).Error("There was an issue clicking the buttons")
 			return err
 		}
+		cb.log.WithFields(logrus.Fields{
+			"clicked": summary.Clicked,
+			"skipped": len(summary.Skipped),
+		}).Info("Finished loading coupons")
+		if summary.Quit {
+			cb.log.Info("Stopped loading coupons as asked")
+			return nil
+		}
 		break
 		// TODO: Bring back reload code when CouponsAreAvailable references
 		// proper map key
-		// if err = cb.webDriver.ReloadPage(); err != nil {
+		// if err = cb.webDriver.ReloadPage(ctx); err != nil {
 		// 	cb.log.WithField("error", err).Error("There was an issue reloading the page")
 		// 	return err
 		// }
@@ -0,0 +1,155 @@
+package offthegrid
+
+import (
+	"context"
+	"time"
+)
+
+// LazyLoadOptions controls how LoadAllLazyContent pages through a list
+type LazyLoadOptions struct {
+	// LoadMoreSelector selects a "Load more" button to click on each round.
+	// When empty the last item is scrolled into view instead.
+	LoadMoreSelector string
+	// MaxItems stops loading once this many items are present. Zero means no limit.
+	MaxItems int
+	// Timeout bounds the whole load. When it passes, loading stops with
+	// whatever has loaded so far. Zero means no limit beyond the caller's context.
+	Timeout time.Duration
+	// NetworkIdle is how long the network must be quiet before items are counted
+	NetworkIdle time.Duration
+	// SettleTimeout bounds the wait for the network to go quiet after each round
+	SettleTimeout time.Duration
+	// StableRounds is how many rounds in a row must load nothing new before
+	// the list is considered complete
+	StableRounds int
+}
+
+// DefaultLazyLoadOptions returns options which suit most infinitely
+// scrolling lists
+func DefaultLazyLoadOptions() LazyLoadOptions {
+	return LazyLoadOptions{
+		Timeout:       2 * time.Minute,
+		NetworkIdle:   500 * time.Millisecond,
+		SettleTimeout: 5 * time.Second,
+		StableRounds:  2,
+	}
+}
+
+// LoadAllLazyContent scrolls (or clicks the "Load more" button) until the
+// number of items matching itemSelector stops growing, MaxItems is reached or
+// the Timeout passes. It returns the number of items which were loaded.
+func (wd *WebDriver) LoadAllLazyContent(ctx context.Context, itemSelector string, options LazyLoadOptions) (count int, err error) {
+	loadCtx, cancel := ctx, context.CancelFunc(func() {})
+	if options.Timeout > 0 {
+		loadCtx, cancel = context.WithTimeout(ctx, options.Timeout)
+	}
+	defer cancel()
+
+	wd.waitForFirstItem(loadCtx, itemSelector, options)
+	count, err = wd.countItems(loadCtx, itemSelector)
+	stableRounds := 0
+	for err == nil && loadCtx.Err() == nil {
+		if options.MaxItems > 0 && count >= options.MaxItems {
+			wd.log.WithField("count", count).Debug("Loaded the maximum number of items")
+			return count, nil
+		}
+		if stableRounds >= options.StableRounds {
+			wd.log.WithField("count", count).Debug("No more items are loading")
+			return count, nil
+		}
+
+		var advanced bool
+		if advanced, err = wd.loadMore(loadCtx, itemSelector, options.LoadMoreSelector); err != nil || !advanced {
+			break
+		}
+		wd.waitForNetworkToSettle(loadCtx, options)
+
+		var newCount int
+		if newCount, err = wd.countItems(loadCtx, itemSelector); err != nil {
+			break
+		}
+		if newCount > count {
+			stableRounds = 0
+		} else {
+			stableRounds++
+		}
+		count = newCount
+	}
+	if ctx.Err() != nil {
+		return count, ctx.Err()
+	}
+	if loadCtx.Err() != nil {
+		wd.log.WithField("count", count).Warn("Timed out loading every item; continuing with what has loaded")
+		return count, nil
+	}
+	return count, err
+}
+
+// waitForFirstItem gives a list which renders after the page loads a chance to
+// show its first item. An empty list is not an error.
+func (wd *WebDriver) waitForFirstItem(ctx context.Context, itemSelector string, options LazyLoadOptions) {
+	waitCtx, cancel := ctx, context.CancelFunc(func() {})
+	if options.SettleTimeout > 0 {
+		waitCtx, cancel = context.WithTimeout(ctx, options.SettleTimeout)
+	}
+	defer cancel()
+	err := wd.probe(waitCtx, func(ctx context.Context, browser Browser) error {
+		return browser.WaitReady(ctx, itemSelector)
+	})
+	if err != nil && ctx.Err() == nil {
+		wd.log.WithField("error", err).Debug("No items have appeared yet")
+	}
+}
+
+// countItems returns how many items currently match the selector
+func (wd *WebDriver) countItems(ctx context.Context, itemSelector string) (count int, err error) {
+	err = wd.do(ctx, "count-items", func(ctx context.Context, browser Browser) error {
+		nodes, err := browser.Nodes(ctx, itemSelector)
+		count = len(nodes)
+		return err
+	})
+	return count, err
+}
+
+// loadMore asks the page for another batch of items, either by clicking the
+// "Load more" button or by scrolling the last item into view. It returns false
+// when there is nothing left to click or scroll to.
+func (wd *WebDriver) loadMore(ctx context.Context, itemSelector, loadMoreSelector string) (advanced bool, err error) {
+	err = wd.do(ctx, "load-more", func(ctx context.Context, browser Browser) error {
+		if loadMoreSelector != "" {
+			buttons, err := browser.Nodes(ctx, loadMoreSelector)
+			if err != nil || len(buttons) == 0 {
+				return err
+			}
+			if err = browser.ScrollIntoView(ctx, buttons[0].XPath); err != nil {
+				return err
+			}
+			advanced = true
+			return browser.Click(ctx, buttons[0].XPath)
+		}
+		items, err := browser.Nodes(ctx, itemSelector)
+		if err != nil || len(items) == 0 {
+			return err
+		}
+		advanced = true
+		return browser.ScrollIntoView(ctx, items[len(items)-1].XPath)
+	})
+	return advanced, err
+}
+
+// waitForNetworkToSettle gives the page a chance to fetch and render the
+// next batch. A network which never goes quiet is not an error; items are
+// counted regardless.
+func (wd *WebDriver) waitForNetworkToSettle(ctx context.Context, options LazyLoadOptions) {
+	settleCtx, cancel := ctx, context.CancelFunc(func() {})
+	if options.SettleTimeout > 0 {
+		settleCtx, cancel = context.WithTimeout(ctx, options.SettleTimeout)
+	}
+	defer cancel()
+	err := wd.probe(settleCtx, func(ctx context.Context, browser Browser) error {
+		return browser.WaitNetworkIdle(ctx, options.NetworkIdle)
+	})
+	if err != nil && ctx.Err() == nil {
+		wd.log.WithField("error", err).Debug("The network did not go quiet")
+	}
+}
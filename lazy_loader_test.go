@@ -0,0 +1,80 @@
+package offthegrid
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newFakePagedList serves a list which shows three more items each time
+// "Load more" is followed, up to ten items
+func newFakePagedList() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		if page < 1 {
+			page = 1
+		}
+		shown := page * 3
+		if shown > 10 {
+			shown = 10
+		}
+		fmt.Fprint(w, "<html><body><ul>")
+		for i := 1; i <= shown; i++ {
+			fmt.Fprintf(w, "<li class=\"item\">Item %d</li>", i)
+		}
+		fmt.Fprint(w, "</ul>")
+		if shown < 10 {
+			fmt.Fprintf(w, "<a class=\"more\" href=\"?page=%d\">Load more</a>", page+1)
+		}
+		fmt.Fprint(w, "</body></html>")
+	})
+}
+
+func TestLoadAllLazyContentWithLoadMore(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	wd := NewWebDriverWithBrowser(NewHTMLBrowser(newFakePagedList()))
+	assert.NoError(wd.GoToPage(ctx, "https://list.example/"))
+
+	options := DefaultLazyLoadOptions()
+	options.LoadMoreSelector = "a.more"
+	count, err := wd.LoadAllLazyContent(ctx, "li.item", options)
+	assert.NoError(err)
+	assert.Equal(10, count)
+}
+
+func TestLoadAllLazyContentStopsAtMaxItems(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	wd := NewWebDriverWithBrowser(NewHTMLBrowser(newFakePagedList()))
+	assert.NoError(wd.GoToPage(ctx, "https://list.example/"))
+
+	options := DefaultLazyLoadOptions()
+	options.LoadMoreSelector = "a.more"
+	options.MaxItems = 5
+	count, err := wd.LoadAllLazyContent(ctx, "li.item", options)
+	assert.NoError(err)
+	assert.Equal(6, count)
+}
+
+func TestLoadAllLazyContentStopsWhenStable(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	wd := NewWebDriverWithBrowser(NewHTMLBrowser(newFakePagedList()))
+	assert.NoError(wd.GoToPage(ctx, "https://list.example/"))
+
+	// Scrolling a static page never loads anything new
+	count, err := wd.LoadAllLazyContent(ctx, "li.item", DefaultLazyLoadOptions())
+	assert.NoError(err)
+	assert.Equal(3, count)
+
+	// Cancellation by the caller is reported
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = wd.LoadAllLazyContent(cancelled, "li.item", DefaultLazyLoadOptions())
+	assert.Equal(context.Canceled, err)
+}
@@ -0,0 +1,207 @@
+package offthegrid
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// RedactedText replaces every secret in a log entry
+const RedactedText = "[REDACTED]"
+
+// minRedactLength is the shortest value which is redacted. Shorter values,
+// such as a house number, would mask too much of every entry.
+const minRedactLength = 3
+
+// LogConfig configures the logger shared by a web driver, its cache and the
+// site modules driving it
+type LogConfig struct {
+	// Level is a logrus level such as "debug" or "warn". It defaults to "info".
+	Level string `yaml:"level,omitempty" json:"level,omitempty"`
+	// Format is "text", the default, or "json"
+	Format string `yaml:"format,omitempty" json:"format,omitempty"`
+	// File is appended to. Entries go to stderr when it is empty.
+	File string `yaml:"file,omitempty" json:"file,omitempty"`
+}
+
+// NewLogger creates a logger as the config describes. Any file it opens
+// stays open for the life of the program.
+func NewLogger(config LogConfig) (*logrus.Logger, error) {
+	logger := logrus.New()
+	if config.Level != "" {
+		level, err := logrus.ParseLevel(config.Level)
+		if err != nil {
+			return nil, err
+		}
+		logger.SetLevel(level)
+	}
+	switch strings.ToLower(config.Format) {
+	case "", "text":
+	case "json":
+		logger.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		return nil, fmt.Errorf("unknown log format %q", config.Format)
+	}
+	if config.File != "" {
+		f, err := os.OpenFile(config.File, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		if err != nil {
+			return nil, err
+		}
+		logger.SetOutput(f)
+	}
+	return logger, nil
+}
+
+// Redactor is a logrus hook which masks personal details and credentials in
+// the message and fields of every entry before it is written
+type Redactor struct {
+	lock    sync.RWMutex
+	secrets map[string]bool
+	// pattern matches any secret, ignoring case. It is nil without secrets.
+	pattern *regexp.Regexp
+}
+
+// NewRedactor creates a Redactor which has no secrets yet
+func NewRedactor() *Redactor {
+	return &Redactor{secrets: map[string]bool{}}
+}
+
+// AddSecret masks each of the values from now on. Values shorter than three
+// characters are ignored.
+func (r *Redactor) AddSecret(values ...string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	added := false
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if len(value) < minRedactLength || r.secrets[value] {
+			continue
+		}
+		r.secrets[value] = true
+		added = true
+	}
+	if !added {
+		return
+	}
+	// The longest secrets go first so that a name is masked whole rather
+	// than around a shorter secret within it
+	alternatives := make([]string, 0, len(r.secrets))
+	for secret := range r.secrets {
+		alternatives = append(alternatives, secret)
+	}
+	sort.Slice(alternatives, func(i, j int) bool {
+		if len(alternatives[i]) != len(alternatives[j]) {
+			return len(alternatives[i]) > len(alternatives[j])
+		}
+		return alternatives[i] < alternatives[j]
+	})
+	for i, secret := range alternatives {
+		alternatives[i] = regexp.QuoteMeta(secret)
+	}
+	r.pattern = regexp.MustCompile("(?i)" + strings.Join(alternatives, "|"))
+}
+
+// AddPerson masks the person's name, contact details, address and
+// identity numbers
+func (r *Redactor) AddPerson(person *Person) {
+	if person == nil {
+		return
+	}
+	values := []string{
+		person.FirstName,
+		person.LastName,
+		person.Email,
+		person.PhoneNumber,
+		person.CellNumber,
+		person.StreetName,
+		digitsOnly(person.PhoneNumber),
+		digitsOnly(person.CellNumber),
+	}
+	if person.FirstName != "" && person.LastName != "" {
+		values = append(values, person.FullName())
+	}
+	if person.HouseNumber != 0 && person.StreetName != "" {
+		values = append(values, fmt.Sprintf("%d %s", person.HouseNumber, person.StreetName))
+	}
+	if person.SocialSecurityNumber != 0 {
+		ssn := fmt.Sprintf("%09d", person.SocialSecurityNumber)
+		values = append(values, ssn, ssn[:3]+"-"+ssn[3:5]+"-"+ssn[5:])
+	}
+	if person.DriversLicenseNumber != 0 {
+		values = append(values, strconv.Itoa(person.DriversLicenseNumber))
+	}
+	r.AddSecret(values...)
+}
+
+// Redact masks every secret within the text
+func (r *Redactor) Redact(text string) string {
+	r.lock.RLock()
+	pattern := r.pattern
+	r.lock.RUnlock()
+	if pattern == nil {
+		return text
+	}
+	return pattern.ReplaceAllString(text, RedactedText)
+}
+
+// Levels redacts entries of every level
+func (r *Redactor) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire redacts the entry's message and fields in place. Fields which are
+// not strings are replaced by their redacted text only if they held a secret.
+func (r *Redactor) Fire(entry *logrus.Entry) error {
+	entry.Message = r.Redact(entry.Message)
+	for key, value := range entry.Data {
+		switch value := value.(type) {
+		case string:
+			entry.Data[key] = r.Redact(value)
+		case error:
+			if redacted := r.Redact(value.Error()); redacted != value.Error() {
+				entry.Data[key] = redacted
+			}
+		default:
+			text := fmt.Sprintf("%+v", value)
+			if redacted := r.Redact(text); redacted != text {
+				entry.Data[key] = redacted
+			}
+		}
+	}
+	return nil
+}
+
+// digitsOnly strips everything but the digits from a phone number
+func digitsOnly(text string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, text)
+}
+
+// SetLogger makes the web driver and its cache write to logger, masking
+// secrets with the web driver's Redactor
+func (wd *WebDriver) SetLogger(logger *logrus.Logger) {
+	logger.AddHook(wd.redactor)
+	wd.log = logger
+	wd.cacheManager.log = logger
+}
+
+// Logger returns the web driver's logger, which site modules should share
+func (wd *WebDriver) Logger() *logrus.Logger {
+	return wd.log
+}
+
+// Redactor returns the hook masking secrets in the web driver's logs.
+// Everything typed into a page is added to it, as is the Person of a flow.
+func (wd *WebDriver) Redactor() *Redactor {
+	return wd.redactor
+}
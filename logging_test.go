@@ -0,0 +1,98 @@
+package offthegrid
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedactor(t *testing.T) {
+	assert := assert.New(t)
+	redactor := NewRedactor()
+	redactor.AddPerson(&Person{
+		FirstName:            "Jane",
+		LastName:             "Doe",
+		HouseNumber:          42,
+		StreetName:           "Elm Street",
+		Email:                "jane@example.com",
+		PhoneNumber:          "(303) 555-0100",
+		SocialSecurityNumber: 12345678,
+	})
+	redactor.AddSecret("hunter2", "ab")
+
+	assert.Equal("Opted out [REDACTED] of [REDACTED]", redactor.Redact("Opted out JANE DOE of 42 Elm Street"))
+	assert.Equal("ssn [REDACTED] or [REDACTED]", redactor.Redact("ssn 012-34-5678 or 012345678"))
+	assert.Equal("call [REDACTED] or [REDACTED]", redactor.Redact("call 3035550100 or (303) 555-0100"))
+	// Values too short to be worth masking are left alone
+	assert.Equal("about the lab", redactor.Redact("about the lab"))
+
+	var logged bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&logged)
+	logger.SetFormatter(&logrus.JSONFormatter{})
+	logger.AddHook(redactor)
+	logger.WithFields(logrus.Fields{
+		"email": "jane@example.com",
+		"error": errors.New("password hunter2 was refused"),
+		"count": 3,
+		"item":  struct{ Name string }{"Jane"},
+	}).Info("Signed in as jane@example.com")
+	var entry map[string]interface{}
+	assert.NoError(json.Unmarshal(logged.Bytes(), &entry))
+	assert.Equal("Signed in as [REDACTED]", entry["msg"])
+	assert.Equal(RedactedText, entry["email"])
+	assert.Equal("password [REDACTED] was refused", entry["error"])
+	assert.Equal(float64(3), entry["count"])
+	assert.Equal("{Name:[REDACTED]}", entry["item"])
+}
+
+func TestNewLogger(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "offthegrid.log")
+	logger, err := NewLogger(LogConfig{Level: "warn", Format: "json", File: path})
+	assert.NoError(err)
+	logger.Info("not written")
+	logger.Warn("written")
+	contents, err := ioutil.ReadFile(path)
+	assert.NoError(err)
+	assert.NotContains(string(contents), "not written")
+	assert.Contains(string(contents), `"msg":"written"`)
+
+	_, err = NewLogger(LogConfig{Level: "chatty"})
+	assert.Error(err)
+	_, err = NewLogger(LogConfig{Format: "xml"})
+	assert.Error(err)
+}
+
+func TestWebDriverRedactsTypedValues(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	var logged bytes.Buffer
+	logger := logrus.New()
+	logger.SetOutput(&logged)
+	wd := NewWebDriverWithBrowser(NewHTMLBrowser(newFakePeopleSearch()))
+	wd.SetLogger(logger)
+	assert.Same(logger, wd.Logger())
+
+	_, err := wd.RunFlow(ctx, &Flow{Name: "search", Steps: []FlowStep{
+		{Action: FlowNavigate, URL: "https://people.example/search"},
+		{Action: FlowFill, Selector: "#token", Value: "${secret.TOKEN}"},
+	}}, FlowEnv{
+		Person: &Person{FirstName: "Jane", LastName: "Doe"},
+		Secrets: func(name string) (string, error) {
+			return "s3cret-token", nil
+		},
+	})
+	assert.NoError(err)
+	wd.Logger().WithField("typed", "s3cret-token").Info("Searched for Jane Doe")
+	assert.NotContains(logged.String(), "s3cret-token")
+	assert.NotContains(logged.String(), "Jane")
+	assert.Contains(logged.String(), RedactedText)
+}
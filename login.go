@@ -0,0 +1,287 @@
+package offthegrid
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultLoginTimeout is how long Login waits for the outcome of submitting
+// the form when the LoginSpec does not say
+const DefaultLoginTimeout = 30 * time.Second
+
+// loginPollInterval is how often the page is checked for a login outcome
+const loginPollInterval = 250 * time.Millisecond
+
+// LoginSpec describes a site's login form and how to tell whether logging
+// in worked
+type LoginSpec struct {
+	// URL is the page holding the login form
+	URL string
+	// UsernameSelector and PasswordSelector select the fields to type the
+	// credentials into. A field whose selector is empty is skipped.
+	UsernameSelector string
+	Username         string
+	PasswordSelector string
+	Password         string
+	// SubmitSelector selects the button which submits the form
+	SubmitSelector string
+
+	// SuccessSelector selects an element which only appears once logged in
+	SuccessSelector string
+	// SuccessURLPattern is a regular expression matching the URL of any page
+	// shown once logged in. At least one success indicator is required.
+	SuccessURLPattern string
+	// FailureSelector selects the banner a site shows for a failed login
+	FailureSelector string
+	// FailureText, if set, must appear in the banner for it to count as a
+	// failure, so that other messages shown in the same place are ignored
+	FailureText string
+	// CaptchaSelector selects a captcha challenge
+	CaptchaSelector string
+	// MFA describes the one-time code step, if the site has one
+	MFA *MFAStep
+
+	// Timeout bounds the wait for an outcome after each submission.
+	// DefaultLoginTimeout is used when it is zero.
+	Timeout time.Duration
+}
+
+// MFAStep describes the one-time code form a site shows after the password
+type MFAStep struct {
+	// CodeSelector selects the field the code is typed into. Its appearance
+	// means the site is asking for a code.
+	CodeSelector string
+	// SubmitSelector selects the button which submits the code
+	SubmitSelector string
+	// Codes provides the code. Without one, Login stops at the MFA step.
+	Codes CodeProvider
+}
+
+// LoginOutcome is what happened when a login form was submitted
+type LoginOutcome int
+
+const (
+	// LoginSucceeded means a success indicator appeared
+	LoginSucceeded LoginOutcome = iota
+	// LoginBadCredentials means the site reported a failed login
+	LoginBadCredentials
+	// LoginMFARequired means the site asked for a one-time code which could
+	// not be provided, or did not accept the one which was
+	LoginMFARequired
+	// LoginCaptcha means the site showed a captcha challenge
+	LoginCaptcha
+)
+
+// String names the outcome
+func (lo LoginOutcome) String() string {
+	switch lo {
+	case LoginSucceeded:
+		return "succeeded"
+	case LoginBadCredentials:
+		return "bad credentials"
+	case LoginMFARequired:
+		return "MFA required"
+	case LoginCaptcha:
+		return "captcha"
+	}
+	return fmt.Sprintf("LoginOutcome(%d)", int(lo))
+}
+
+// LoginResult reports the outcome of Login
+type LoginResult struct {
+	Outcome LoginOutcome
+	// Message is the text of the failure banner, if one appeared
+	Message string
+	// URL is the page the browser was on when the outcome was seen
+	URL string
+}
+
+// Err returns nil for a successful login, or an error matching ErrLoginFailed
+func (lr *LoginResult) Err() error {
+	if lr.Outcome == LoginSucceeded {
+		return nil
+	}
+	cause := fmt.Errorf("%s", lr.Outcome)
+	if lr.Message != "" {
+		cause = fmt.Errorf("%s: %s", lr.Outcome, lr.Message)
+	}
+	return &ActionError{Kind: ErrLoginFailed, Action: "login", Target: lr.URL, Err: cause}
+}
+
+// Login fills in and submits the spec's login form, then waits until the
+// page shows an outcome. An error is only returned if the form could not be
+// used or no outcome appeared; a rejected login is reported in the result.
+func (wd *WebDriver) Login(ctx context.Context, spec LoginSpec) (result *LoginResult, err error) {
+	if spec.SuccessSelector == "" && spec.SuccessURLPattern == "" {
+		return nil, fmt.Errorf("the login spec for %s has no success indicator", spec.URL)
+	}
+	var successURL *regexp.Regexp
+	if spec.SuccessURLPattern != "" {
+		if successURL, err = regexp.Compile(spec.SuccessURLPattern); err != nil {
+			return nil, fmt.Errorf("could not parse the success URL pattern: %w", err)
+		}
+	}
+	err = wd.retry(ctx, "login", func() (err error) {
+		result, err = wd.login(ctx, spec, successURL)
+		return err
+	})
+	if err != nil {
+		return nil, actionError(ErrLoginFailed, "login", spec.URL, err)
+	}
+	wd.log.WithFields(logrus.Fields{
+		"outcome": result.Outcome,
+		"url":     result.URL,
+	}).Debug("Login has finished processing")
+	return result, nil
+}
+
+// login makes a single attempt at Login
+func (wd *WebDriver) login(ctx context.Context, spec LoginSpec, successURL *regexp.Regexp) (*LoginResult, error) {
+	wd.redactor.AddSecret(spec.Username, spec.Password)
+	err := wd.do(ctx, "login", func(ctx context.Context, browser Browser) (err error) {
+		if err = browser.Navigate(ctx, spec.URL); err != nil {
+			return actionError(ErrNavigationFailed, "navigate", spec.URL, err)
+		}
+		if spec.UsernameSelector != "" {
+			if err = browser.SendKeys(ctx, spec.UsernameSelector, spec.Username); err != nil {
+				return actionError(ErrElementNotFound, "type into", spec.UsernameSelector, err)
+			}
+		}
+		if spec.PasswordSelector != "" {
+			if err = browser.SendKeys(ctx, spec.PasswordSelector, spec.Password); err != nil {
+				return actionError(ErrElementNotFound, "type into", spec.PasswordSelector, err)
+			}
+		}
+		// Submit the login page
+		return actionError(ErrElementNotFound, "click", spec.SubmitSelector, browser.Click(ctx, spec.SubmitSelector))
+	})
+	if err != nil {
+		wd.log.WithField("error", err).Error("Could not submit the login form")
+		return nil, err
+	}
+	return wd.awaitLoginOutcome(ctx, spec, successURL)
+}
+
+// awaitLoginOutcome polls the page until it shows an outcome, entering a
+// one-time code the first time one is asked for
+func (wd *WebDriver) awaitLoginOutcome(ctx context.Context, spec LoginSpec, successURL *regexp.Regexp) (*LoginResult, error) {
+	timeout := spec.Timeout
+	if timeout <= 0 {
+		timeout = DefaultLoginTimeout
+	}
+	deadline := time.Now().Add(timeout)
+	ticker := time.NewTicker(loginPollInterval)
+	defer ticker.Stop()
+	codeEntered := false
+	var mfaResult *LoginResult
+	for {
+		result := wd.loginOutcome(ctx, spec, successURL)
+		switch {
+		case result == nil:
+		case result.Outcome != LoginMFARequired:
+			return result, nil
+		case !codeEntered && spec.MFA.Codes != nil:
+			if err := wd.enterCode(ctx, spec.MFA); err != nil {
+				return nil, err
+			}
+			codeEntered = true
+			// Typing the code may have taken a while
+			deadline = time.Now().Add(timeout)
+		case !codeEntered:
+			return result, nil
+		default:
+			// The code form may linger while the code is checked
+			mfaResult = result
+		}
+		if time.Now().After(deadline) {
+			if mfaResult != nil {
+				return mfaResult, nil
+			}
+			return nil, fmt.Errorf("neither success nor failure was shown within %s", timeout)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// loginOutcome checks the page for each of the spec's indicators. It
+// returns nil if none of them is showing yet.
+func (wd *WebDriver) loginOutcome(ctx context.Context, spec LoginSpec, successURL *regexp.Regexp) *LoginResult {
+	var location string
+	_ = wd.probe(ctx, func(ctx context.Context, browser Browser) (err error) {
+		location, err = browser.Location(ctx)
+		return err
+	})
+	result := &LoginResult{URL: location}
+	if spec.FailureSelector != "" && wd.present(ctx, spec.FailureSelector) {
+		message, err := wd.textOf(ctx, spec.FailureSelector)
+		if err == nil && message != "" && strings.Contains(message, spec.FailureText) {
+			result.Outcome, result.Message = LoginBadCredentials, message
+			return result
+		}
+	}
+	if spec.CaptchaSelector != "" && wd.present(ctx, spec.CaptchaSelector) {
+		result.Outcome = LoginCaptcha
+		return result
+	}
+	if spec.MFA != nil && wd.present(ctx, spec.MFA.CodeSelector) {
+		result.Outcome = LoginMFARequired
+		return result
+	}
+	if (spec.SuccessSelector != "" && wd.present(ctx, spec.SuccessSelector)) ||
+		(successURL != nil && successURL.MatchString(location)) {
+		result.Outcome = LoginSucceeded
+		return result
+	}
+	return nil
+}
+
+// enterCode asks the MFA step's CodeProvider for a code and submits it
+func (wd *WebDriver) enterCode(ctx context.Context, mfa *MFAStep) error {
+	code, err := mfa.Codes.Code(ctx)
+	if err != nil {
+		return fmt.Errorf("could not get a one-time code: %w", err)
+	}
+	wd.redactor.AddSecret(code)
+	return wd.do(ctx, "mfa", func(ctx context.Context, browser Browser) error {
+		if err := browser.SendKeys(ctx, mfa.CodeSelector, code); err != nil {
+			return actionError(ErrElementNotFound, "type into", mfa.CodeSelector, err)
+		}
+		return actionError(ErrElementNotFound, "click", mfa.SubmitSelector, browser.Click(ctx, mfa.SubmitSelector))
+	})
+}
+
+// present reports whether anything currently matches the selector, without waiting
+func (wd *WebDriver) present(ctx context.Context, selector string) bool {
+	var nodes []*Node
+	err := wd.probe(ctx, func(ctx context.Context, browser Browser) (err error) {
+		nodes, err = browser.Nodes(ctx, selector)
+		return err
+	})
+	return err == nil && len(nodes) > 0
+}
+
+// textOf returns the trimmed text of the first node matching the selector
+func (wd *WebDriver) textOf(ctx context.Context, selector string) (string, error) {
+	var innerHTML string
+	err := wd.probe(ctx, func(ctx context.Context, browser Browser) (err error) {
+		innerHTML, err = browser.InnerHTML(ctx, selector)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	root, err := parseContainer(&Node{NodeName: "div"}, innerHTML)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(nodeText(root)), nil
+}
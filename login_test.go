@@ -0,0 +1,156 @@
+package offthegrid
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const fakeLoginForm = `<html><body>
+<div id="banner" class="error">%s</div>
+<form method="post" action="/login">
+	<input id="user" name="user">
+	<input id="pass" name="pass" type="password">
+	<button id="submit" type="submit">Log in</button>
+</form>
+</body></html>`
+
+const fakeMFAForm = `<html><body>
+<form method="post" action="/mfa">
+	<input id="code" name="code">
+	<button id="verify" type="submit">Verify</button>
+</form>
+</body></html>`
+
+// newFakeLoginSite serves a login form which accepts jane/secret, asks
+// jane/mfa for the code 123456 and shows a captcha to robot
+func newFakeLoginSite() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			fmt.Fprintf(w, fakeLoginForm, "")
+			return
+		}
+		switch {
+		case r.PostFormValue("user") == "robot":
+			fmt.Fprint(w, `<html><body><div class="g-recaptcha"></div></body></html>`)
+		case r.PostFormValue("user") == "jane" && r.PostFormValue("pass") == "secret":
+			http.Redirect(w, r, "/home", http.StatusSeeOther)
+		case r.PostFormValue("user") == "jane" && r.PostFormValue("pass") == "mfa":
+			http.Redirect(w, r, "/mfa", http.StatusSeeOther)
+		default:
+			fmt.Fprintf(w, fakeLoginForm, "Incorrect username or password")
+		}
+	})
+	mux.HandleFunc("/mfa", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && r.PostFormValue("code") == "123456" {
+			http.Redirect(w, r, "/home", http.StatusSeeOther)
+			return
+		}
+		fmt.Fprint(w, fakeMFAForm)
+	})
+	mux.HandleFunc("/home", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `<html><body><p id="welcome">Welcome back</p></body></html>`)
+	})
+	return mux
+}
+
+// fakeLoginSpec logs into the fake login site
+func fakeLoginSpec(username, password string) LoginSpec {
+	return LoginSpec{
+		URL:               "https://login.example/login",
+		UsernameSelector:  "#user",
+		Username:          username,
+		PasswordSelector:  "#pass",
+		Password:          password,
+		SubmitSelector:    "#submit",
+		SuccessURLPattern: `/home$`,
+		FailureSelector:   "#banner",
+		FailureText:       "Incorrect",
+		CaptchaSelector:   ".g-recaptcha",
+		MFA: &MFAStep{
+			CodeSelector:   "#code",
+			SubmitSelector: "#verify",
+		},
+		Timeout: 300 * time.Millisecond,
+	}
+}
+
+// staticCode is a CodeProvider which always returns the same code
+type staticCode string
+
+func (sc staticCode) Code(ctx context.Context) (string, error) {
+	return string(sc), nil
+}
+
+func TestLoginOutcomes(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	wd := NewWebDriverWithBrowser(NewHTMLBrowser(newFakeLoginSite()))
+
+	result, err := wd.Login(ctx, fakeLoginSpec("jane", "secret"))
+	assert.NoError(err)
+	assert.Equal(LoginSucceeded, result.Outcome)
+	assert.Equal("https://login.example/home", result.URL)
+	assert.NoError(result.Err())
+
+	result, err = wd.Login(ctx, fakeLoginSpec("jane", "wrong"))
+	assert.NoError(err)
+	assert.Equal(LoginBadCredentials, result.Outcome)
+	assert.Equal("Incorrect username or password", result.Message)
+	assert.ErrorIs(result.Err(), ErrLoginFailed)
+
+	result, err = wd.Login(ctx, fakeLoginSpec("robot", "secret"))
+	assert.NoError(err)
+	assert.Equal(LoginCaptcha, result.Outcome)
+
+	// Without a CodeProvider, Login stops at the MFA step
+	result, err = wd.Login(ctx, fakeLoginSpec("jane", "mfa"))
+	assert.NoError(err)
+	assert.Equal(LoginMFARequired, result.Outcome)
+}
+
+func TestLoginWithMFA(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	wd := NewWebDriverWithBrowser(NewHTMLBrowser(newFakeLoginSite()))
+
+	spec := fakeLoginSpec("jane", "mfa")
+	spec.MFA.Codes = staticCode("123456")
+	result, err := wd.Login(ctx, spec)
+	assert.NoError(err)
+	assert.Equal(LoginSucceeded, result.Outcome)
+
+	// A rejected code leaves the site asking for one
+	spec.MFA.Codes = staticCode("000000")
+	result, err = wd.Login(ctx, spec)
+	assert.NoError(err)
+	assert.Equal(LoginMFARequired, result.Outcome)
+}
+
+func TestLoginErrors(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	wd := NewWebDriverWithBrowser(NewHTMLBrowser(newFakeLoginSite()))
+
+	spec := fakeLoginSpec("jane", "secret")
+	spec.SuccessURLPattern = ""
+	_, err := wd.Login(ctx, spec)
+	assert.Error(err, "a spec without a success indicator is rejected")
+
+	spec = fakeLoginSpec("jane", "secret")
+	spec.SubmitSelector = "#missing"
+	_, err = wd.Login(ctx, spec)
+	assert.ErrorIs(err, ErrLoginFailed)
+	assert.ErrorIs(err, ErrElementNotFound)
+
+	// Nothing to recognise on the page is reported once the timeout passes
+	spec = fakeLoginSpec("jane", "secret")
+	spec.SuccessURLPattern = "/never$"
+	_, err = wd.Login(ctx, spec)
+	assert.ErrorIs(err, ErrLoginFailed)
+}
@@ -1,15 +1,42 @@
 package main
 
 import (
-	"github.com/sirupsen/logrus"
+	"context"
+	"flag"
+
+	offthegrid "github.com/TopherGopher/OffTheGrid"
 	couponpusher "github.com/TopherGopher/OffTheGrid/king_soopers_coupon"
 )
 
 func main() {
-	logrus.SetLevel(logrus.DebugLevel)
-	ksc := couponpusher.NewKingSoopersCoupon()
+	profileName := flag.String("profile", "", "the browser profile to use, such as tor")
+	profilesFile := flag.String("profiles", "", "a YAML or JSON file of extra browser profiles")
+	var logConfig offthegrid.LogConfig
+	flag.StringVar(&logConfig.Level, "log-level", "info", "the lowest level of log entry to write")
+	flag.StringVar(&logConfig.Format, "log-format", "text", "text or json")
+	flag.StringVar(&logConfig.File, "log-file", "", "a file to append the log to instead of stderr")
+	flag.Parse()
+	logger, err := offthegrid.NewLogger(logConfig)
+	if err != nil {
+		panic(err)
+	}
+	if *profilesFile != "" {
+		if err := offthegrid.LoadProfiles(*profilesFile); err != nil {
+			panic(err)
+		}
+	}
+	var profile *offthegrid.BrowserProfile
+	if *profileName != "" {
+		if profile, err = offthegrid.LookupProfile(*profileName); err != nil {
+			panic(err)
+		}
+	}
+	ksc, err := couponpusher.NewKingSoopersCouponWithProfile(profile, couponpusher.WithLogger(logger))
+	if err != nil {
+		panic(err)
+	}
 	defer ksc.Teardown()
-	if err := ksc.DoIt(); err != nil {
+	if err := ksc.DoIt(context.Background()); err != nil {
 		panic(err)
 	}
 }
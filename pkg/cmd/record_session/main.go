@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+
+	offthegrid "github.com/TopherGopher/OffTheGrid"
+)
+
+// Opens a browser at -url and records what is done in it until the window is
+// closed or ctrl-c is pressed, then writes the session out as a flow
+func main() {
+	startURL := flag.String("url", "", "the page to start recording on")
+	name := flag.String("name", "recorded", "the name of the flow or Go function")
+	goSnippet := flag.Bool("go", false, "write a Go function rather than a YAML flow")
+	personFile := flag.String("person", "", "a JSON file of the person whose details are typed, so they can be parameterized")
+	remote := flag.String("remote", "", "record in an already running Chrome, given its remote debugging port or DevTools URL")
+	var logConfig offthegrid.LogConfig
+	flag.StringVar(&logConfig.Level, "log-level", "debug", "the lowest level of log entry to write")
+	flag.StringVar(&logConfig.Format, "log-format", "text", "text or json")
+	flag.StringVar(&logConfig.File, "log-file", "", "a file to append the log to instead of stderr")
+	flag.Parse()
+	if *startURL == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	logger, err := offthegrid.NewLogger(logConfig)
+	if err != nil {
+		panic(err)
+	}
+	var person *offthegrid.Person
+	if *personFile != "" {
+		personBytes, err := ioutil.ReadFile(*personFile)
+		if err != nil {
+			panic(err)
+		}
+		person = &offthegrid.Person{}
+		if err = json.Unmarshal(personBytes, person); err != nil {
+			panic(err)
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	wd := offthegrid.NewWebDriver()
+	wd.SetLogger(logger)
+	wd.Redactor().AddPerson(person)
+	if *remote != "" {
+		if err := wd.InitRemote(*remote); err != nil {
+			panic(err)
+		}
+	}
+	defer wd.Teardown()
+	recording, err := wd.RecordSession(ctx, *startURL)
+	if err != nil {
+		panic(err)
+	}
+	if *goSnippet {
+		fmt.Print(recording.GoSnippet(*name, person))
+		return
+	}
+	if err = offthegrid.WriteFlow(os.Stdout, recording.Flow(*name, person)); err != nil {
+		panic(err)
+	}
+}
@@ -0,0 +1,184 @@
+package offthegrid
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	url_package "net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// TorProfileName is the name of the built in profile which sends everything
+// through a local Tor daemon
+const TorProfileName = "tor"
+
+// BrowserProfile is a named identity for the browser and the HTTP helpers:
+// where their traffic goes, and what the sites they visit can learn about
+// the machine they run on. Empty fields leave the defaults alone.
+type BrowserProfile struct {
+	Name string `yaml:"name" json:"name"`
+	// Proxy is the proxy every request is sent through, such as
+	// http://proxy.example:3128 or socks5://127.0.0.1:9050
+	Proxy     string `yaml:"proxy,omitempty" json:"proxy,omitempty"`
+	UserAgent string `yaml:"userAgent,omitempty" json:"userAgent,omitempty"`
+	// Locale is a language tag such as "en-US". It sets the Accept-Language
+	// header and the language the browser reports to pages.
+	Locale string `yaml:"locale,omitempty" json:"locale,omitempty"`
+	// Timezone is an IANA time zone such as "America/Denver"
+	Timezone string    `yaml:"timezone,omitempty" json:"timezone,omitempty"`
+	Viewport *Viewport `yaml:"viewport,omitempty" json:"viewport,omitempty"`
+	// PreventWebRTCLeaks stops WebRTC from revealing IP addresses which
+	// do not go through the proxy
+	PreventWebRTCLeaks bool `yaml:"preventWebRTCLeaks,omitempty" json:"preventWebRTCLeaks,omitempty"`
+	// UserDataDir keeps the browser's profile, and so its cookies, in this
+	// directory between runs. When it is empty every browser gets a fresh
+	// directory which is removed when the browser is closed.
+	UserDataDir string `yaml:"userDataDir,omitempty" json:"userDataDir,omitempty"`
+}
+
+// Viewport is the size of the browser window's content area in CSS pixels
+type Viewport struct {
+	Width  int `yaml:"width" json:"width"`
+	Height int `yaml:"height" json:"height"`
+}
+
+// TorProfile sends traffic through the SOCKS port of a Tor daemon running on
+// this machine, and looks like Tor Browser as far as its headers go
+func TorProfile() *BrowserProfile {
+	return &BrowserProfile{
+		Name:               TorProfileName,
+		Proxy:              "socks5://127.0.0.1:9050",
+		UserAgent:          "Mozilla/5.0 (Windows NT 10.0; rv:102.0) Gecko/20100101 Firefox/102.0",
+		Locale:             "en-US",
+		Timezone:           "UTC",
+		Viewport:           &Viewport{Width: 1000, Height: 900},
+		PreventWebRTCLeaks: true,
+	}
+}
+
+var (
+	profilesLock sync.RWMutex
+	profiles     = map[string]*BrowserProfile{TorProfileName: TorProfile()}
+)
+
+// RegisterProfile makes a profile available to LookupProfile by its name,
+// replacing any profile which already has that name
+func RegisterProfile(profile *BrowserProfile) error {
+	if err := profile.Validate(); err != nil {
+		return err
+	}
+	profilesLock.Lock()
+	defer profilesLock.Unlock()
+	profiles[profile.Name] = profile
+	return nil
+}
+
+// LookupProfile returns the registered profile with the given name
+func LookupProfile(name string) (*BrowserProfile, error) {
+	profilesLock.RLock()
+	defer profilesLock.RUnlock()
+	profile, ok := profiles[name]
+	if !ok {
+		return nil, fmt.Errorf("there is no browser profile named %q", name)
+	}
+	return profile, nil
+}
+
+// ProfileNames returns the names of every registered profile in order
+func ProfileNames() []string {
+	profilesLock.RLock()
+	defer profilesLock.RUnlock()
+	names := make([]string, 0, len(profiles))
+	for name := range profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LoadProfiles registers every profile listed in a YAML or JSON file
+func LoadProfiles(path string) error {
+	profilesYAML, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var loaded []*BrowserProfile
+	if err = yaml.Unmarshal(profilesYAML, &loaded); err != nil {
+		return fmt.Errorf("could not read the browser profiles in %s: %w", path, err)
+	}
+	for i, profile := range loaded {
+		if profile == nil {
+			return fmt.Errorf("%s: profile %d is empty", path, i+1)
+		}
+		if err = RegisterProfile(profile); err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+	}
+	return nil
+}
+
+// Validate checks that the profile can be applied
+func (bp *BrowserProfile) Validate() error {
+	if bp == nil {
+		return fmt.Errorf("no browser profile was given")
+	}
+	if bp.Name == "" {
+		return fmt.Errorf("a browser profile needs a name")
+	}
+	if bp.Proxy != "" {
+		if _, err := bp.proxyURL(); err != nil {
+			return fmt.Errorf("profile %s: %w", bp.Name, err)
+		}
+	}
+	if bp.Timezone != "" {
+		if _, err := time.LoadLocation(bp.Timezone); err != nil {
+			return fmt.Errorf("profile %s: unknown timezone %q", bp.Name, bp.Timezone)
+		}
+	}
+	if bp.Viewport != nil && (bp.Viewport.Width <= 0 || bp.Viewport.Height <= 0) {
+		return fmt.Errorf("profile %s: the viewport must have a positive size", bp.Name)
+	}
+	return nil
+}
+
+// proxyURL parses the proxy, which must be an HTTP, HTTPS or SOCKS5 proxy
+func (bp *BrowserProfile) proxyURL() (*url_package.URL, error) {
+	proxy, err := url_package.Parse(bp.Proxy)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse the proxy %q: %w", bp.Proxy, err)
+	}
+	switch proxy.Scheme {
+	case "http", "https", "socks5":
+	default:
+		return nil, fmt.Errorf("the proxy %q must be an http, https or socks5 URL", bp.Proxy)
+	}
+	if proxy.Host == "" {
+		return nil, fmt.Errorf("the proxy %q has no host", bp.Proxy)
+	}
+	return proxy, nil
+}
+
+// transport returns the transport the HTTP helpers use under the profile. A
+// nil profile uses the default transport.
+func (bp *BrowserProfile) transport() http.RoundTripper {
+	if bp == nil {
+		return http.DefaultTransport
+	}
+	var transport http.RoundTripper = http.DefaultTransport
+	if bp.Proxy != "" {
+		proxied := http.DefaultTransport.(*http.Transport).Clone()
+		proxied.Proxy = func(*http.Request) (*url_package.URL, error) {
+			// Never fall back to a direct connection if the proxy is unusable
+			return bp.proxyURL()
+		}
+		transport = proxied
+	}
+	if bp.UserAgent != "" || bp.Locale != "" {
+		transport = userAgentTransport{userAgent: bp.UserAgent, language: bp.Locale, next: transport}
+	}
+	return transport
+}
@@ -0,0 +1,97 @@
+package offthegrid
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBrowserProfileValidate(t *testing.T) {
+	assert := assert.New(t)
+	assert.NoError(TorProfile().Validate())
+	for _, profile := range []*BrowserProfile{
+		{},
+		{Name: "ftp", Proxy: "ftp://proxy.example:21"},
+		{Name: "hostless", Proxy: "socks5://"},
+		{Name: "nowhere", Timezone: "Mars/Olympus_Mons"},
+		{Name: "tiny", Viewport: &Viewport{Width: 0, Height: 600}},
+	} {
+		assert.Error(profile.Validate(), profile.Name)
+	}
+}
+
+func TestLoadProfiles(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "profiles.yaml")
+	assert.NoError(ioutil.WriteFile(path, []byte(`
+- name: denver-residential
+  proxy: http://proxy.example:3128
+  userAgent: Mozilla/5.0 (X11; Linux x86_64)
+  locale: en-US
+  timezone: America/Denver
+  viewport: {width: 1280, height: 800}
+  preventWebRTCLeaks: true
+`), 0644))
+	assert.NoError(LoadProfiles(path))
+	profile, err := LookupProfile("denver-residential")
+	assert.NoError(err)
+	assert.Equal(&Viewport{Width: 1280, Height: 800}, profile.Viewport)
+	assert.True(profile.PreventWebRTCLeaks)
+	assert.Contains(ProfileNames(), TorProfileName)
+
+	_, err = LookupProfile("missing")
+	assert.Error(err)
+	assert.NoError(ioutil.WriteFile(path, []byte(`- name: broken
+  timezone: Nowhere/Special`), 0644))
+	assert.Error(LoadProfiles(path))
+	// A null entry is refused rather than registered
+	assert.NoError(ioutil.WriteFile(path, []byte("- name: fine\n- null\n"), 0644))
+	assert.Error(LoadProfiles(path))
+}
+
+func TestNilProfile(t *testing.T) {
+	assert := assert.New(t)
+	assert.Error(RegisterProfile(nil))
+	wd := NewWebDriver()
+	assert.Error(wd.UseProfile(nil))
+	assert.Nil(wd.Profile())
+}
+
+func TestProfileHTTPClient(t *testing.T) {
+	assert := assert.New(t)
+	// The proxy answers every request itself, recording what it was asked for
+	var proxied *http.Request
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxied = r
+		fmt.Fprint(w, "<html><body>proxied</body></html>")
+	}))
+	defer proxy.Close()
+
+	wd := NewWebDriver()
+	assert.NoError(wd.UseProfile(&BrowserProfile{
+		Name:      "test",
+		Proxy:     proxy.URL,
+		UserAgent: "OffTheGridTest/1.0",
+		Locale:    "de-DE",
+	}))
+	body, err := wd.GetFullPageHTML(context.Background(), "http://broker.example/search")
+	assert.NoError(err)
+	assert.Contains(body, "proxied")
+	if assert.NotNil(proxied) {
+		assert.Equal("broker.example", proxied.URL.Host)
+		assert.Equal("OffTheGridTest/1.0", proxied.UserAgent())
+		assert.Equal("de-DE", proxied.Header.Get("Accept-Language"))
+	}
+	assert.Equal("test", wd.Profile().Name)
+
+	// A profile cannot change a browser which is already running
+	wd = NewWebDriverWithBrowser(NewHTMLBrowser(http.NotFoundHandler()))
+	assert.Error(wd.UseProfile(TorProfile()))
+	assert.Error(NewWebDriver().UseProfile(&BrowserProfile{Name: "bad", Proxy: "gopher://proxy"}))
+}
@@ -0,0 +1,326 @@
+package offthegrid
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The kinds of RecordedEvent
+const (
+	RecordNavigate = "navigate"
+	RecordClick    = "click"
+	RecordInput    = "input"
+)
+
+// sameDocumentNavigation is the Initiator of a navigation within the page,
+// such as to an anchor or by the history API
+const sameDocumentNavigation = "sameDocument"
+
+// RecordedEvent is something done by hand in a recorded browser
+type RecordedEvent struct {
+	Kind string `json:"kind"`
+	// Selector is the element clicked or typed into
+	Selector string `json:"selector,omitempty"`
+	// Value is what was typed. It is never recorded for password fields.
+	Value string `json:"value,omitempty"`
+	// Secret names the secret a password field is filled from on replay
+	Secret string `json:"secret,omitempty"`
+	// URL is the page navigated to, before any redirects
+	URL string `json:"url,omitempty"`
+	// Initiator is how the page started a navigation, such as "anchorClick",
+	// "formSubmissionPost", "scriptInitiated" or "metaTagRefresh", or
+	// "sameDocument" for a navigation within the page. It is empty when the
+	// browser started it, such as from the address bar.
+	Initiator string    `json:"initiator,omitempty"`
+	Time      time.Time `json:"time"`
+}
+
+// EventRecorder is a Browser which can report what is done in it by hand
+type EventRecorder interface {
+	// StartRecording reports events on the returned channel, which is
+	// closed once ctx is done or the tab is closed
+	StartRecording(ctx context.Context) (<-chan RecordedEvent, error)
+}
+
+// Recording is a session recorded by RecordSession
+type Recording struct {
+	Events []RecordedEvent `json:"events"`
+}
+
+// RecordSession opens startURL and records the clicks, typing and
+// navigations done in the browser until ctx is done or the window is closed.
+// A visible Chrome is started if the web driver has no browser yet.
+func (wd *WebDriver) RecordSession(ctx context.Context, startURL string) (*Recording, error) {
+	if wd.browser == nil {
+		if err := wd.CreateChromeDPDriver(false); err != nil {
+			wd.log.WithField("error", err).Error("Could not start a browser to record in")
+			return nil, err
+		}
+	}
+	recorder, ok := wd.browser.(EventRecorder)
+	if !ok {
+		return nil, fmt.Errorf("the browser cannot record sessions")
+	}
+	events, err := recorder.StartRecording(ctx)
+	if err != nil {
+		wd.log.WithField("error", err).Error("Could not start recording")
+		return nil, err
+	}
+	if err = wd.GoToPage(ctx, startURL); err != nil {
+		return nil, err
+	}
+	recording := &Recording{}
+	for event := range events {
+		wd.log.WithField("event", event).Debug("Recorded an event")
+		recording.Events = append(recording.Events, event)
+	}
+	return recording, nil
+}
+
+// Flow turns the recording into a flow which replays it. Typed values which
+// match one of the person's fields are replaced with a reference to it, so
+// the flow can be replayed for someone else. person may be nil.
+func (rec *Recording) Flow(name string, person *Person) *Flow {
+	flow := &Flow{Name: name}
+	for _, event := range rec.Events {
+		var previous *FlowStep
+		if len(flow.Steps) > 0 {
+			previous = &flow.Steps[len(flow.Steps)-1]
+		}
+		switch event.Kind {
+		case RecordNavigate:
+			// Navigations started by the page, such as by a link, a form or
+			// a script, happen again when the steps before them are replayed
+			if event.Initiator != "" {
+				continue
+			}
+			flow.Steps = append(flow.Steps, FlowStep{Action: FlowNavigate, URL: event.URL})
+		case RecordInput:
+			value := event.Value
+			if event.Secret != "" {
+				value = fmt.Sprintf("${secret.%s}", event.Secret)
+			} else if reference, ok := personReference(person, value); ok {
+				value = reference
+			}
+			// Only the final value of a field matters
+			if previous != nil && previous.Action == FlowFill && previous.Selector == event.Selector {
+				previous.Value = value
+				continue
+			}
+			flow.Steps = append(flow.Steps, FlowStep{Action: FlowFill, Selector: event.Selector, Value: value})
+		case RecordClick:
+			flow.Steps = append(flow.Steps, FlowStep{Action: FlowClick, Selector: event.Selector})
+		}
+	}
+	return flow
+}
+
+// GoSnippet writes the recording as a Go function which replays it
+func (rec *Recording) GoSnippet(funcName string, person *Person) string {
+	var snippet strings.Builder
+	fmt.Fprintf(&snippet, "func %s(ctx context.Context, wd *offthegrid.WebDriver, person *offthegrid.Person) error {\n", funcName)
+	for _, step := range rec.Flow(funcName, person).Steps {
+		var call string
+		switch step.Action {
+		case FlowNavigate:
+			call = fmt.Sprintf("wd.GoToPage(ctx, %s)", goValue(step.URL))
+		case FlowFill:
+			call = fmt.Sprintf("wd.Fill(ctx, %s, %s)", strconv.Quote(step.Selector), goValue(step.Value))
+		case FlowClick:
+			call = fmt.Sprintf("wd.ClickButton(ctx, %s)", strconv.Quote(step.Selector))
+		}
+		fmt.Fprintf(&snippet, "\tif err := %s; err != nil {\n\t\treturn err\n\t}\n", call)
+	}
+	snippet.WriteString("\treturn nil\n}\n")
+	return snippet.String()
+}
+
+// wholeReference matches a value which is nothing but a single reference
+var wholeReference = regexp.MustCompile(`^\$\{(person|secret)\.([A-Za-z0-9_-]+)\}$`)
+
+// goValue writes a flow value as a Go expression
+func goValue(value string) string {
+	match := wholeReference.FindStringSubmatch(value)
+	switch {
+	case match == nil:
+		return strconv.Quote(value)
+	case match[1] == "secret":
+		return fmt.Sprintf("os.Getenv(%s)", strconv.Quote(match[2]))
+	case reflect.ValueOf(&Person{}).MethodByName(match[2]).IsValid():
+		return fmt.Sprintf("person.%s()", match[2])
+	}
+	if field, ok := reflect.TypeOf(Person{}).FieldByName(match[2]); ok && field.Type.Kind() != reflect.String {
+		return fmt.Sprintf("fmt.Sprint(person.%s)", match[2])
+	}
+	return fmt.Sprintf("person.%s", match[2])
+}
+
+// personReference returns the ${person.…} reference whose value is exactly
+// value. FullName is preferred to the fields it is made of.
+func personReference(person *Person, value string) (string, bool) {
+	if person == nil || strings.TrimSpace(value) == "" {
+		return "", false
+	}
+	names := []string{"FullName"}
+	fields := reflect.ValueOf(*person)
+	for i := 0; i < fields.NumField(); i++ {
+		// Unset fields would match values such as "0"
+		if !fields.Field(i).IsZero() {
+			names = append(names, fields.Type().Field(i).Name)
+		}
+	}
+	for _, name := range names {
+		if fieldValue, err := personField(person, name); err == nil && fieldValue == value {
+			return fmt.Sprintf("${person.%s}", name), true
+		}
+	}
+	return "", false
+}
+
+// selectorCandidate is a selector the recording script found for an
+// element, along with how many elements on the page it matches
+type selectorCandidate struct {
+	Selector string `json:"selector"`
+	Matches  int    `json:"matches"`
+}
+
+// recordedPayload is what the recording script reports about each event
+type recordedPayload struct {
+	Kind string `json:"kind"`
+	// Candidates are listed from the most to the least robust
+	Candidates []selectorCandidate `json:"candidates"`
+	XPath      string              `json:"xpath"`
+	Value      string              `json:"value"`
+	// Password and Name describe password fields, whose value is not sent
+	Password bool   `json:"password"`
+	Name     string `json:"name"`
+}
+
+// secretNameCleaner replaces what may not appear in a secret's name
+var secretNameCleaner = regexp.MustCompile(`[^A-Z0-9]+`)
+
+// parseRecordedEvent turns a payload from the recording script into an event
+func parseRecordedEvent(payload string) (RecordedEvent, error) {
+	recorded := recordedPayload{}
+	if err := json.Unmarshal([]byte(payload), &recorded); err != nil {
+		return RecordedEvent{}, err
+	}
+	event := RecordedEvent{
+		Kind:     recorded.Kind,
+		Selector: chooseSelector(recorded.Candidates, recorded.XPath),
+		Value:    recorded.Value,
+		Time:     time.Now(),
+	}
+	if recorded.Password {
+		event.Value = ""
+		event.Secret = strings.Trim(secretNameCleaner.ReplaceAllString(strings.ToUpper(recorded.Name), "_"), "_")
+		if event.Secret == "" {
+			event.Secret = "PASSWORD"
+		}
+	}
+	return event, nil
+}
+
+// chooseSelector picks the first candidate which matches only the element,
+// falling back to its absolute XPath
+func chooseSelector(candidates []selectorCandidate, xpath string) string {
+	for _, candidate := range candidates {
+		if candidate.Matches == 1 {
+			return candidate.Selector
+		}
+	}
+	return xpath
+}
+
+// recorderBinding is the function the recording script reports events with
+const recorderBinding = "offTheGridRecord"
+
+// recorderScript listens for clicks, typing and form submissions in a page
+// and reports them through recorderBinding. Selectors built from an id,
+// name, aria-label or data-* attribute are preferred to the element's XPath.
+const recorderScript = `(() => {
+	if (window.__offTheGridRecorder) {
+		return;
+	}
+	window.__offTheGridRecorder = true;
+	const count = (selector) => {
+		try {
+			return document.querySelectorAll(selector).length;
+		} catch (e) {
+			return 0;
+		}
+	};
+	const xpath = (el) => {
+		const parts = [];
+		for (; el && el.nodeType === Node.ELEMENT_NODE; el = el.parentNode) {
+			let index = 1;
+			for (let sibling = el.previousElementSibling; sibling; sibling = sibling.previousElementSibling) {
+				if (sibling.nodeName === el.nodeName) {
+					index++;
+				}
+			}
+			parts.unshift(el.nodeName.toLowerCase() + '[' + index + ']');
+		}
+		return '/' + parts.join('/');
+	};
+	const describe = (kind, el) => {
+		const tag = el.nodeName.toLowerCase();
+		const selectors = [];
+		if (el.id) {
+			selectors.push('#' + CSS.escape(el.id));
+		}
+		const attributes = ['name', 'aria-label', 'data-testid', 'data-test', 'data-qa'];
+		for (const attribute of el.getAttributeNames()) {
+			if (attribute.startsWith('data-') && !attributes.includes(attribute)) {
+				attributes.push(attribute);
+			}
+		}
+		for (const attribute of attributes) {
+			const value = el.getAttribute(attribute);
+			if (value) {
+				selectors.push(tag + '[' + attribute + '="' + value.replace(/["\\]/g, '\\$&') + '"]');
+			}
+		}
+		const password = el.type === 'password';
+		return {
+			kind: kind,
+			candidates: selectors.map((selector) => ({selector: selector, matches: count(selector)})),
+			xpath: xpath(el),
+			value: password ? '' : (el.value || ''),
+			password: password,
+			name: el.name || el.id || '',
+		};
+	};
+	const send = (event) => window.` + recorderBinding + `(JSON.stringify(event));
+	const clickable = 'a, button, input, select, textarea, label, summary, [role=button], [onclick]';
+	let lastClicked = null;
+	document.addEventListener('click', (event) => {
+		const el = event.target.closest(clickable) || event.target;
+		const tag = el.nodeName.toLowerCase();
+		if ((tag === 'input' && !['button', 'submit', 'checkbox', 'radio', 'reset', 'image'].includes(el.type)) || tag === 'textarea' || tag === 'select') {
+			// Typing into a field is recorded when it changes
+			return;
+		}
+		lastClicked = el;
+		send(describe('click', el));
+	}, true);
+	document.addEventListener('change', (event) => {
+		const el = event.target;
+		if (el.type === 'checkbox' || el.type === 'radio') {
+			return;
+		}
+		send(describe('input', el));
+	}, true);
+	document.addEventListener('submit', (event) => {
+		// Forms submitted with the enter key are replayed by clicking the button
+		if (event.submitter && event.submitter !== lastClicked) {
+			send(describe('click', event.submitter));
+		}
+	}, true);
+})();`
@@ -0,0 +1,162 @@
+package offthegrid
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeRecorderBrowser is an HTMLBrowser which "records" a scripted session
+type fakeRecorderBrowser struct {
+	*HTMLBrowser
+	events []RecordedEvent
+}
+
+func (frb *fakeRecorderBrowser) StartRecording(ctx context.Context) (<-chan RecordedEvent, error) {
+	events := make(chan RecordedEvent, len(frb.events))
+	for _, event := range frb.events {
+		events <- event
+	}
+	close(events)
+	return events, nil
+}
+
+// fakeRecordedSession is a search of the fake people search site
+func fakeRecordedSession() []RecordedEvent {
+	started := time.Now()
+	at := func(seconds int) time.Time {
+		return started.Add(time.Duration(seconds) * time.Second)
+	}
+	return []RecordedEvent{
+		{Kind: RecordNavigate, URL: "https://people.example/search", Time: at(0)},
+		// A script on the page sent it somewhere else straight away
+		{Kind: RecordNavigate, URL: "https://people.example/search?welcome", Initiator: "scriptInitiated", Time: at(1)},
+		{Kind: RecordInput, Selector: "#query", Value: "Jane", Time: at(10)},
+		{Kind: RecordInput, Selector: "#query", Value: "Jane Doe", Time: at(12)},
+		{Kind: RecordInput, Selector: "#token", Secret: "TOKEN", Time: at(14)},
+		{Kind: RecordClick, Selector: "#search", Time: at(15)},
+		{Kind: RecordNavigate, URL: "https://people.example/results?q=Jane+Doe", Initiator: "formSubmissionGet", Time: at(16)},
+		{Kind: RecordNavigate, URL: "https://people.example/results?q=Jane+Doe#page-2", Initiator: "sameDocument", Time: at(17)},
+	}
+}
+
+func TestRecordingFlow(t *testing.T) {
+	assert := assert.New(t)
+	recording := &Recording{Events: fakeRecordedSession()}
+	person := &Person{FirstName: "Jane", LastName: "Doe"}
+
+	flow := recording.Flow("search", person)
+	assert.Equal([]FlowStep{
+		{Action: FlowNavigate, URL: "https://people.example/search"},
+		{Action: FlowFill, Selector: "#query", Value: "${person.FullName}"},
+		{Action: FlowFill, Selector: "#token", Value: "${secret.TOKEN}"},
+		{Action: FlowClick, Selector: "#search"},
+	}, flow.Steps)
+	// Without a person, what was typed is kept as it is
+	assert.Equal("Jane Doe", recording.Flow("search", nil).Steps[1].Value)
+
+	// The written flow reads back the same
+	var written bytes.Buffer
+	assert.NoError(WriteFlow(&written, flow))
+	parsed, err := ParseFlow(written.Bytes())
+	assert.NoError(err)
+	assert.Equal(flow, parsed)
+
+	// Replaying the flow searches for the person again
+	ctx := context.Background()
+	hb := NewHTMLBrowser(newFakePeopleSearch())
+	wd := NewWebDriverWithBrowser(hb)
+	_, err = wd.RunFlow(ctx, flow, FlowEnv{
+		Person: &Person{FirstName: "John", LastName: "Smith"},
+		Secrets: func(name string) (string, error) {
+			return "hunter2", nil
+		},
+	})
+	assert.NoError(err)
+	location, err := wd.CurrentURL(ctx)
+	assert.NoError(err)
+	assert.Contains(location, "q=John+Smith")
+	assert.Contains(location, "token=hunter2")
+}
+
+func TestRecordingFlowKeepsTypedNavigations(t *testing.T) {
+	assert := assert.New(t)
+	// Going somewhere by hand straight after a click is replayed, however
+	// soon it happens
+	now := time.Now()
+	recording := &Recording{Events: []RecordedEvent{
+		{Kind: RecordClick, Selector: "#opt-out", Time: now},
+		{Kind: RecordNavigate, URL: "https://people.example/privacy", Time: now.Add(time.Second)},
+	}}
+	assert.Equal([]FlowStep{
+		{Action: FlowClick, Selector: "#opt-out"},
+		{Action: FlowNavigate, URL: "https://people.example/privacy"},
+	}, recording.Flow("opt out", nil).Steps)
+}
+
+func TestRecordingGoSnippet(t *testing.T) {
+	assert := assert.New(t)
+	recording := &Recording{Events: fakeRecordedSession()}
+	recording.Events = append(recording.Events, RecordedEvent{Kind: RecordInput, Selector: `input[name="email"]`, Value: "jane@example.com", Time: time.Now().Add(time.Minute)})
+	snippet := recording.GoSnippet("searchPeople", &Person{FirstName: "Jane", LastName: "Doe", Email: "jane@example.com"})
+	assert.Equal(`func searchPeople(ctx context.Context, wd *offthegrid.WebDriver, person *offthegrid.Person) error {
+	if err := wd.GoToPage(ctx, "https://people.example/search"); err != nil {
+		return err
+	}
+	if err := wd.Fill(ctx, "#query", person.FullName()); err != nil {
+		return err
+	}
+	if err := wd.Fill(ctx, "#token", os.Getenv("TOKEN")); err != nil {
+		return err
+	}
+	if err := wd.ClickButton(ctx, "#search"); err != nil {
+		return err
+	}
+	if err := wd.Fill(ctx, "input[name=\"email\"]", person.Email); err != nil {
+		return err
+	}
+	return nil
+}
+`, snippet)
+}
+
+func TestParseRecordedEvent(t *testing.T) {
+	assert := assert.New(t)
+	// The aria-label is shared, so the data attribute is used
+	event, err := parseRecordedEvent(`{"kind": "click", "xpath": "/html[1]/body[1]/button[2]", "candidates": [
+		{"selector": "button[aria-label=\"Opt out\"]", "matches": 3},
+		{"selector": "button[data-person=\"42\"]", "matches": 1}
+	]}`)
+	assert.NoError(err)
+	assert.Equal(RecordClick, event.Kind)
+	assert.Equal(`button[data-person="42"]`, event.Selector)
+
+	// Without a unique candidate the XPath is used, and passwords are never kept
+	event, err = parseRecordedEvent(`{"kind": "input", "xpath": "/html[1]/body[1]/input[1]", "value": "hunter2", "password": true, "name": "login-password"}`)
+	assert.NoError(err)
+	assert.Equal("/html[1]/body[1]/input[1]", event.Selector)
+	assert.Empty(event.Value)
+	assert.Equal("LOGIN_PASSWORD", event.Secret)
+
+	_, err = parseRecordedEvent(`not json`)
+	assert.Error(err)
+}
+
+func TestRecordSession(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	browser := &fakeRecorderBrowser{HTMLBrowser: NewHTMLBrowser(newFakePeopleSearch()), events: fakeRecordedSession()}
+	wd := NewWebDriverWithBrowser(browser)
+	recording, err := wd.RecordSession(ctx, "https://people.example/search")
+	assert.NoError(err)
+	assert.Equal(fakeRecordedSession()[0].URL, recording.Events[0].URL)
+	assert.Len(recording.Events, len(fakeRecordedSession()))
+
+	// Browsers which cannot record are turned away
+	wd = NewWebDriverWithBrowser(NewHTMLBrowser(newFakePeopleSearch()))
+	_, err = wd.RecordSession(ctx, "https://people.example/search")
+	assert.Error(err)
+}
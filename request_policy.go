@@ -0,0 +1,166 @@
+package offthegrid
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	url_package "net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HeavyResourceTypes are the resource types which are slow to load and are
+// rarely needed to automate a site
+var HeavyResourceTypes = []string{"Image", "Font", "Media"}
+
+// RequestPolicy decides which of the browser's requests are allowed and
+// how they are sent
+type RequestPolicy struct {
+	// BlockResourceTypes names the resource types to block, such as "Image",
+	// "Font", "Media" or "Stylesheet". Names are matched case-insensitively.
+	BlockResourceTypes []string
+	// BlockHosts lists hosts whose requests are blocked, along with their
+	// subdomains
+	BlockHosts []string
+	// SetHeaders are added to every request, replacing any existing value
+	SetHeaders map[string]string
+	// RemoveHeaders are stripped from every request
+	RemoveHeaders []string
+	// TrafficLog, if set, receives a JSON TrafficEntry for every request
+	TrafficLog io.Writer
+}
+
+// TrafficEntry is a request and its response as written to a traffic log
+type TrafficEntry struct {
+	Time            time.Time         `json:"time"`
+	Method          string            `json:"method"`
+	URL             string            `json:"url"`
+	ResourceType    string            `json:"resourceType,omitempty"`
+	RequestHeaders  map[string]string `json:"requestHeaders,omitempty"`
+	Status          int64             `json:"status,omitempty"`
+	ResponseHeaders map[string]string `json:"responseHeaders,omitempty"`
+	Blocked         bool              `json:"blocked,omitempty"`
+	Error           string            `json:"error,omitempty"`
+}
+
+// LoadHostList reads a list of hosts to block. Each line holds a host, or
+// uses the hosts file format of an address followed by hosts. Blank lines
+// and anything after a '#' are ignored.
+func LoadHostList(path string) (hosts []string, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if comment := strings.Index(line, "#"); comment >= 0 {
+			line = line[:comment]
+		}
+		fields := strings.Fields(line)
+		if len(fields) > 1 && net.ParseIP(fields[0]) != nil {
+			fields = fields[1:]
+		}
+		for _, host := range fields {
+			hosts = append(hosts, strings.ToLower(host))
+		}
+	}
+	return hosts, scanner.Err()
+}
+
+// Blocks reports whether a request for the URL, loading the given resource
+// type, is blocked by the policy
+func (rp *RequestPolicy) Blocks(resourceType, rawURL string) bool {
+	if rp == nil {
+		return false
+	}
+	for _, blocked := range rp.BlockResourceTypes {
+		if strings.EqualFold(blocked, resourceType) {
+			return true
+		}
+	}
+	parsedURL, err := url_package.Parse(rawURL)
+	if err != nil {
+		return false
+	}
+	host := strings.ToLower(parsedURL.Hostname())
+	for _, blocked := range rp.BlockHosts {
+		if host == blocked || strings.HasSuffix(host, "."+blocked) {
+			return true
+		}
+	}
+	return false
+}
+
+// intercepts reports whether requests must be paused to apply the policy
+func (rp *RequestPolicy) intercepts() bool {
+	return rp != nil && (len(rp.BlockResourceTypes) > 0 || len(rp.BlockHosts) > 0 ||
+		len(rp.SetHeaders) > 0 || len(rp.RemoveHeaders) > 0)
+}
+
+// rewriteHeaders applies the policy's header changes
+func (rp *RequestPolicy) rewriteHeaders(header http.Header) {
+	if rp == nil {
+		return
+	}
+	for _, name := range rp.RemoveHeaders {
+		header.Del(name)
+	}
+	for name, value := range rp.SetHeaders {
+		header.Set(name, value)
+	}
+}
+
+// trafficLog writes TrafficEntries to a writer, one JSON object per line
+type trafficLog struct {
+	lock    sync.Mutex
+	encoder *json.Encoder
+}
+
+// newTrafficLog returns a trafficLog for the policy, or nil if it has no log
+func newTrafficLog(policy *RequestPolicy) *trafficLog {
+	if policy == nil || policy.TrafficLog == nil {
+		return nil
+	}
+	return &trafficLog{encoder: json.NewEncoder(policy.TrafficLog)}
+}
+
+// write records an entry. A nil trafficLog discards it.
+func (tl *trafficLog) write(entry *TrafficEntry) {
+	if tl == nil {
+		return
+	}
+	tl.lock.Lock()
+	defer tl.lock.Unlock()
+	// A failing log must not break browsing
+	_ = tl.encoder.Encode(entry)
+}
+
+// flattenHeaders turns http.Header into a single value per name
+func flattenHeaders(header http.Header) map[string]string {
+	flat := make(map[string]string, len(header))
+	for name, values := range header {
+		flat[name] = strings.Join(values, ", ")
+	}
+	return flat
+}
+
+// SetRequestPolicy applies the policy to every request the browser makes
+// from now on. A nil policy allows everything and stops the traffic log.
+func (wd *WebDriver) SetRequestPolicy(ctx context.Context, policy *RequestPolicy) error {
+	err := wd.do(ctx, "request-policy", func(ctx context.Context, browser Browser) error {
+		return browser.SetRequestPolicy(ctx, policy)
+	})
+	if err != nil {
+		return fmt.Errorf("could not apply the request policy: %w", err)
+	}
+	wd.policy = policy
+	return nil
+}
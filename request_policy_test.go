@@ -0,0 +1,85 @@
+package offthegrid
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadHostList(t *testing.T) {
+	assert := assert.New(t)
+	path := filepath.Join(t.TempDir(), "hosts.txt")
+	contents := "# trackers\ntracker.example\n\n0.0.0.0 ads.example  pixel.example # hosts file format\n"
+	assert.NoError(ioutil.WriteFile(path, []byte(contents), 0644))
+
+	hosts, err := LoadHostList(path)
+	assert.NoError(err)
+	assert.Equal([]string{"tracker.example", "ads.example", "pixel.example"}, hosts)
+
+	_, err = LoadHostList(filepath.Join(t.TempDir(), "missing.txt"))
+	assert.Error(err)
+}
+
+func TestRequestPolicyBlocks(t *testing.T) {
+	assert := assert.New(t)
+	policy := &RequestPolicy{
+		BlockResourceTypes: HeavyResourceTypes,
+		BlockHosts:         []string{"tracker.example"},
+	}
+	assert.True(policy.Blocks("image", "https://shop.example/logo.png"))
+	assert.True(policy.Blocks("Script", "https://cdn.tracker.example/t.js"))
+	assert.True(policy.Blocks("Script", "https://tracker.example/t.js"))
+	assert.False(policy.Blocks("Script", "https://nottracker.example/t.js"))
+	assert.False(policy.Blocks("Document", "https://shop.example/"))
+
+	var nilPolicy *RequestPolicy
+	assert.False(nilPolicy.Blocks("Image", "https://shop.example/logo.png"))
+}
+
+func TestWebDriverRequestPolicy(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	site := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "<html><body><p id=\"dnt\">%s</p><p id=\"referer\">%s</p></body></html>",
+			r.Header.Get("DNT"), r.Header.Get("Referer"))
+	})
+	wd := NewWebDriverWithBrowser(NewHTMLBrowser(site))
+	var traffic bytes.Buffer
+	assert.NoError(wd.SetRequestPolicy(ctx, &RequestPolicy{
+		BlockHosts:    []string{"tracker.example"},
+		SetHeaders:    map[string]string{"DNT": "1"},
+		RemoveHeaders: []string{"Referer"},
+		TrafficLog:    &traffic,
+	}))
+
+	assert.NoError(wd.GoToPage(ctx, "https://shop.example/"))
+	dnt, err := wd.GetInnerHTMLOfElement(ctx, "#dnt")
+	assert.NoError(err)
+	assert.Equal("1", dnt)
+	assert.Error(wd.GoToPage(ctx, "https://tracker.example/pixel"))
+
+	lines := strings.Split(strings.TrimSpace(traffic.String()), "\n")
+	if assert.Len(lines, 2) {
+		var allowed, blocked TrafficEntry
+		assert.NoError(json.Unmarshal([]byte(lines[0]), &allowed))
+		assert.NoError(json.Unmarshal([]byte(lines[1]), &blocked))
+		assert.Equal("https://shop.example/", allowed.URL)
+		assert.Equal(int64(200), allowed.Status)
+		assert.Equal("1", allowed.RequestHeaders["Dnt"])
+		assert.False(allowed.Blocked)
+		assert.Equal("https://tracker.example/pixel", blocked.URL)
+		assert.True(blocked.Blocked)
+	}
+
+	// Clearing the policy allows everything again
+	assert.NoError(wd.SetRequestPolicy(ctx, nil))
+	assert.NoError(wd.GoToPage(ctx, "https://tracker.example/pixel"))
+}
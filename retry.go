@@ -0,0 +1,93 @@
+package offthegrid
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// RetryPolicy decides how often a failed navigation, click or login is
+// tried again. The zero value tries everything once.
+type RetryPolicy struct {
+	// Attempts is the total number of tries. Values below 2 disable retries.
+	Attempts int
+	// InitialBackoff is the wait before the first retry. Each later wait is
+	// Multiplier times longer, up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	// Jitter randomly lengthens or shortens each wait by up to this
+	// fraction of it, so that parallel runs do not retry in lockstep
+	Jitter float64
+	// Retryable lists the classes of error, matched with errors.Is, which
+	// are worth trying again
+	Retryable []error
+}
+
+// DefaultRetryPolicy retries flaky failures twice, starting after half a second
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		Attempts:       3,
+		InitialBackoff: 500 * time.Millisecond,
+		MaxBackoff:     10 * time.Second,
+		Multiplier:     2,
+		Jitter:         0.2,
+		Retryable:      []error{ErrNavigationFailed, ErrElementNotFound, ErrRateLimited},
+	}
+}
+
+// IsRetryable reports whether the policy would try err again
+func (rp RetryPolicy) IsRetryable(err error) bool {
+	for _, retryable := range rp.Retryable {
+		if errors.Is(err, retryable) {
+			return true
+		}
+	}
+	return false
+}
+
+// Backoff returns how long to wait after the given failed attempt, counting from 1
+func (rp RetryPolicy) Backoff(attempt int) time.Duration {
+	multiplier := rp.Multiplier
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	backoff := float64(rp.InitialBackoff) * math.Pow(multiplier, float64(attempt-1))
+	if rp.MaxBackoff > 0 && backoff > float64(rp.MaxBackoff) {
+		backoff = float64(rp.MaxBackoff)
+	}
+	if rp.Jitter > 0 {
+		backoff *= 1 + rp.Jitter*(2*rand.Float64()-1)
+	}
+	return time.Duration(backoff)
+}
+
+// retry calls attempt until it succeeds, fails with an error the
+// RetryPolicy does not retry, runs out of attempts or ctx is done. Without a
+// browser no attempt can succeed, so ErrNotInitialized is never retried.
+func (wd *WebDriver) retry(ctx context.Context, action string, attempt func() error) (err error) {
+	for i := 1; ; i++ {
+		err = attempt()
+		if err == nil || errors.Is(err, ErrNotInitialized) || i >= wd.RetryPolicy.Attempts || !wd.RetryPolicy.IsRetryable(err) || ctx.Err() != nil {
+			return err
+		}
+		backoff := wd.RetryPolicy.Backoff(i)
+		wd.log.WithFields(logrus.Fields{
+			"action":  action,
+			"attempt": i,
+			"backoff": backoff,
+			"error":   err,
+		}).Warn("Retrying a failed action")
+		timer := time.NewTimer(backoff)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
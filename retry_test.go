@@ -0,0 +1,63 @@
+package offthegrid
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetryPolicyBackoff(t *testing.T) {
+	assert := assert.New(t)
+	policy := RetryPolicy{
+		InitialBackoff: 100 * time.Millisecond,
+		MaxBackoff:     time.Second,
+		Multiplier:     2,
+	}
+	assert.Equal(100*time.Millisecond, policy.Backoff(1))
+	assert.Equal(400*time.Millisecond, policy.Backoff(3))
+	assert.Equal(time.Second, policy.Backoff(10))
+
+	policy.Jitter = 0.5
+	for i := 0; i < 20; i++ {
+		backoff := policy.Backoff(2)
+		assert.GreaterOrEqual(int64(backoff), int64(100*time.Millisecond))
+		assert.LessOrEqual(int64(backoff), int64(300*time.Millisecond))
+	}
+
+	assert.True(DefaultRetryPolicy().IsRetryable(actionError(ErrRateLimited, "navigate", "", fmt.Errorf("slow down"))))
+	assert.False(DefaultRetryPolicy().IsRetryable(actionError(ErrLoginFailed, "login", "", fmt.Errorf("wrong password"))))
+}
+
+func TestWebDriverRetries(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	requests := 0
+	site := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if requests < 3 {
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		fmt.Fprint(w, "<html><body><p>Finally</p></body></html>")
+	})
+	wd := NewWebDriverWithBrowser(NewHTMLBrowser(site))
+
+	// Without a policy every action is tried once
+	assert.ErrorIs(wd.GoToPage(ctx, "https://example.com/"), ErrRateLimited)
+	assert.Equal(1, requests)
+
+	wd.RetryPolicy = DefaultRetryPolicy()
+	wd.RetryPolicy.InitialBackoff = time.Millisecond
+	assert.NoError(wd.GoToPage(ctx, "https://example.com/"))
+	assert.Equal(3, requests)
+
+	// Errors which are not retryable fail straight away
+	wd.RetryPolicy.Retryable = []error{ErrNavigationFailed}
+	before := requests
+	assert.ErrorIs(wd.ClickButton(ctx, "#missing"), ErrElementNotFound)
+	assert.Equal(before, requests)
+}
@@ -0,0 +1,208 @@
+package offthegrid
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// SessionKey identifies a saved session by the site and the account which
+// was logged into it
+type SessionKey struct {
+	Site    string
+	Account string
+}
+
+// SessionCookie is a browser cookie as it is saved to disk
+type SessionCookie struct {
+	Name     string    `json:"name"`
+	Value    string    `json:"value"`
+	Domain   string    `json:"domain"`
+	Path     string    `json:"path"`
+	Expires  time.Time `json:"expires,omitempty"`
+	Secure   bool      `json:"secure,omitempty"`
+	HTTPOnly bool      `json:"httpOnly,omitempty"`
+	SameSite string    `json:"sameSite,omitempty"`
+}
+
+// expired reports whether the cookie has expired by now. Session cookies,
+// which have no expiry, never do.
+func (sc SessionCookie) expired(now time.Time) bool {
+	return !sc.Expires.IsZero() && !sc.Expires.After(now)
+}
+
+// SessionState is everything a site may use to remember a login: the
+// browser's cookies plus the web storage of the page it was captured from
+type SessionState struct {
+	// URL is the page the storage was captured from. Storage is restored
+	// by loading this page again.
+	URL            string            `json:"url"`
+	Cookies        []SessionCookie   `json:"cookies"`
+	LocalStorage   map[string]string `json:"localStorage,omitempty"`
+	SessionStorage map[string]string `json:"sessionStorage,omitempty"`
+	SavedAt        time.Time         `json:"savedAt"`
+}
+
+// SessionStore saves browser sessions to disk, one file per site and account
+type SessionStore struct {
+	dir string
+}
+
+var sessionFolder = "sessions"
+
+// NewSessionStore creates a store which keeps its files in dir
+func NewSessionStore(dir string) *SessionStore {
+	return &SessionStore{
+		dir: dir,
+	}
+}
+
+var unsafeFileCharacters = regexp.MustCompile(`[^A-Za-z0-9.-]+`)
+
+// Path returns the file a session is kept in. The account is hashed so that
+// usernames and email addresses are not written into file names.
+func (ss *SessionStore) Path(key SessionKey) string {
+	site := unsafeFileCharacters.ReplaceAllString(strings.ToLower(key.Site), "_")
+	account := sha256.Sum256([]byte(key.Account))
+	return filepath.Join(ss.dir, site, hex.EncodeToString(account[:8])+".json")
+}
+
+// Save writes the session to disk, readable only by the current user
+func (ss *SessionStore) Save(key SessionKey, state *SessionState) error {
+	path := ss.Path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	stateBytes, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, stateBytes, 0600)
+}
+
+// Load reads a saved session. If none has been saved, nil is returned
+// without an error.
+func (ss *SessionStore) Load(key SessionKey) (*SessionState, error) {
+	stateBytes, err := ioutil.ReadFile(ss.Path(key))
+	if err != nil && os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	state := &SessionState{}
+	if err = json.Unmarshal(stateBytes, state); err != nil {
+		return nil, fmt.Errorf("could not parse the saved session: %w", err)
+	}
+	return state, nil
+}
+
+// Delete removes a saved session, if there is one
+func (ss *SessionStore) Delete(key SessionKey) error {
+	err := os.Remove(ss.Path(key))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// SessionCheck reports whether the browser is logged in to a site
+type SessionCheck func(ctx context.Context) (bool, error)
+
+// SetSessionStore replaces the store sessions are saved to and restored from
+func (wd *WebDriver) SetSessionStore(store *SessionStore) {
+	wd.sessionStore = store
+}
+
+// SaveSession captures the browser's cookies and the current page's storage
+// and saves them under the key
+func (wd *WebDriver) SaveSession(ctx context.Context, key SessionKey) error {
+	var state *SessionState
+	err := wd.do(ctx, "save-session", func(ctx context.Context, browser Browser) (err error) {
+		state, err = browser.ExportSession(ctx)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	state.SavedAt = time.Now()
+	return wd.sessionStore.Save(key, state)
+}
+
+// RestoreSession loads the session saved under the key into the browser. It
+// returns false if no session has been saved.
+func (wd *WebDriver) RestoreSession(ctx context.Context, key SessionKey) (restored bool, err error) {
+	state, err := wd.sessionStore.Load(key)
+	if err != nil || state == nil {
+		return false, err
+	}
+	err = wd.do(ctx, "restore-session", func(ctx context.Context, browser Browser) error {
+		return browser.ImportSession(ctx, state)
+	})
+	if err != nil {
+		return false, err
+	}
+	wd.log.WithFields(logrus.Fields{
+		"site":    key.Site,
+		"savedAt": state.SavedAt,
+	}).Debug("Restored a saved session")
+	return true, nil
+}
+
+// RequireSession restores the saved session for the key and uses check to
+// see whether it is still logged in. An error matching ErrSessionExpired is
+// returned if there is no saved session or it is no longer logged in.
+func (wd *WebDriver) RequireSession(ctx context.Context, key SessionKey, check SessionCheck) error {
+	restored, err := wd.RestoreSession(ctx, key)
+	if err != nil {
+		return &ActionError{Kind: ErrSessionExpired, Action: "restore session", Target: key.Site, Err: err}
+	}
+	if !restored {
+		return &ActionError{Kind: ErrSessionExpired, Action: "restore session", Target: key.Site, Err: fmt.Errorf("no session has been saved")}
+	}
+	loggedIn, err := check(ctx)
+	if err != nil {
+		return err
+	}
+	if !loggedIn {
+		return &ActionError{Kind: ErrSessionExpired, Action: "restore session", Target: key.Site}
+	}
+	return nil
+}
+
+// LoginWithSession restores the saved session for the key and uses check to
+// see whether it is still logged in. If it is not, login is called and the
+// new session is saved for next time.
+func (wd *WebDriver) LoginWithSession(ctx context.Context, key SessionKey, check SessionCheck, login func(ctx context.Context) error) error {
+	err := wd.RequireSession(ctx, key, check)
+	if err == nil {
+		wd.log.WithField("site", key.Site).Debug("The saved session is still logged in")
+		return nil
+	}
+	if !errors.Is(err, ErrSessionExpired) {
+		return err
+	}
+	// A missing, broken or expired session only costs us a fresh login
+	wd.log.WithFields(logrus.Fields{
+		"error": err,
+		"site":  key.Site,
+	}).Debug("Could not reuse the saved session")
+	if err = login(ctx); err != nil {
+		return err
+	}
+	if err = wd.SaveSession(ctx, key); err != nil {
+		wd.log.WithField("error", err).Warn("Could not save the session")
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package offthegrid
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newFakeAccountSite serves a page which is only visible with a session cookie
+func newFakeAccountSite() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "valid", Path: "/"})
+		http.Redirect(w, r, "/account", http.StatusSeeOther)
+	})
+	mux.HandleFunc("/account", func(w http.ResponseWriter, r *http.Request) {
+		if cookie, err := r.Cookie("session"); err != nil || cookie.Value != "valid" {
+			http.Redirect(w, r, "/login-form", http.StatusSeeOther)
+			return
+		}
+		w.Write([]byte("<html><body><p id=\"welcome\">Welcome back</p></body></html>"))
+	})
+	mux.HandleFunc("/login-form", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<html><body><a id=\"login\" href=\"/login\">Log in</a></body></html>"))
+	})
+	return mux
+}
+
+func TestSessionStorePaths(t *testing.T) {
+	assert := assert.New(t)
+	store := NewSessionStore(t.TempDir())
+	key := SessionKey{Site: "King Soopers/CO", Account: "someone@example.com"}
+	path := store.Path(key)
+	assert.NotContains(path, "someone")
+	assert.Equal("king_soopers_co", filepath.Base(filepath.Dir(path)))
+	assert.NotEqual(path, store.Path(SessionKey{Site: key.Site, Account: "someone.else@example.com"}))
+
+	state, err := store.Load(key)
+	assert.NoError(err)
+	assert.Nil(state)
+	assert.NoError(store.Save(key, &SessionState{URL: "https://example.com/"}))
+	info, err := os.Stat(path)
+	assert.NoError(err)
+	assert.Equal(os.FileMode(0600), info.Mode().Perm())
+	state, err = store.Load(key)
+	assert.NoError(err)
+	assert.Equal("https://example.com/", state.URL)
+	assert.NoError(store.Delete(key))
+	assert.NoError(store.Delete(key))
+}
+
+func TestLoginWithSession(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	store := NewSessionStore(t.TempDir())
+	key := SessionKey{Site: "account.example", Account: "jane"}
+
+	logins := 0
+	loginWith := func(wd *WebDriver) func(ctx context.Context) error {
+		return func(ctx context.Context) error {
+			logins++
+			if err := wd.GoToPage(ctx, "https://account.example/login-form"); err != nil {
+				return err
+			}
+			return wd.ClickButton(ctx, "#login")
+		}
+	}
+	checkWith := func(wd *WebDriver) SessionCheck {
+		return func(ctx context.Context) (bool, error) {
+			if err := wd.GoToPage(ctx, "https://account.example/account"); err != nil {
+				return false, err
+			}
+			location, err := wd.CurrentURL(ctx)
+			return strings.HasSuffix(location, "/account"), err
+		}
+	}
+
+	for run := 0; run < 2; run++ {
+		wd := NewWebDriverWithBrowser(NewHTMLBrowser(newFakeAccountSite()))
+		wd.SetSessionStore(store)
+		assert.NoError(wd.LoginWithSession(ctx, key, checkWith(wd), loginWith(wd)))
+		loggedIn, err := checkWith(wd)(ctx)
+		assert.NoError(err)
+		assert.True(loggedIn)
+	}
+	// The second run reused the session saved by the first
+	assert.Equal(1, logins)
+
+	// An expired session falls back to logging in
+	state, err := store.Load(key)
+	assert.NoError(err)
+	state.Cookies[0].Value = "expired"
+	assert.NoError(store.Save(key, state))
+	wd := NewWebDriverWithBrowser(NewHTMLBrowser(newFakeAccountSite()))
+	wd.SetSessionStore(store)
+	assert.ErrorIs(wd.RequireSession(ctx, key, checkWith(wd)), ErrSessionExpired)
+	assert.ErrorIs(wd.RequireSession(ctx, SessionKey{Site: "other.example"}, checkWith(wd)), ErrSessionExpired)
+	assert.NoError(wd.LoginWithSession(ctx, key, checkWith(wd), loginWith(wd)))
+	assert.Equal(2, logins)
+}
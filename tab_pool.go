@@ -0,0 +1,237 @@
+package offthegrid
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// tabHealthTimeout bounds the check of whether a tab survived a failed job
+const tabHealthTimeout = 5 * time.Second
+
+// ErrTabPoolClosed is returned for jobs submitted to a pool which is closing
+var ErrTabPoolClosed = errors.New("the tab pool is closed")
+
+// TabOpener is a Browser which can open more tabs sharing its cookies
+type TabOpener interface {
+	NewTab(ctx context.Context) (Browser, error)
+}
+
+// TabJob is work done in one of a TabPool's tabs. The WebDriver it is given
+// drives that tab alone.
+type TabJob func(ctx context.Context, wd *WebDriver) error
+
+// TabPool runs jobs concurrently in a fixed number of tabs of one browser
+type TabPool struct {
+	wd     *WebDriver
+	opener TabOpener
+	jobs   chan *tabTask
+	// ctx is cancelled when the pool stops waiting for its jobs
+	ctx        context.Context
+	cancel     context.CancelFunc
+	workers    sync.WaitGroup
+	submitting sync.WaitGroup
+
+	lock         sync.Mutex
+	closed       bool
+	tabsReplaced int
+}
+
+// tabTask is a submitted job along with where to send its result
+type tabTask struct {
+	ctx    context.Context
+	job    TabJob
+	result chan error
+}
+
+// NewTabPool opens size tabs in the web driver's browser and starts a
+// worker for each. The web driver's own tab is left alone.
+func NewTabPool(ctx context.Context, wd *WebDriver, size int) (*TabPool, error) {
+	opener, ok := wd.browser.(TabOpener)
+	if !ok {
+		return nil, fmt.Errorf("the browser cannot open tabs")
+	}
+	if size < 1 {
+		return nil, fmt.Errorf("a tab pool needs at least one tab, not %d", size)
+	}
+	tabs := make([]Browser, 0, size)
+	for i := 0; i < size; i++ {
+		tab, err := opener.NewTab(ctx)
+		if err != nil {
+			for _, tab := range tabs {
+				tab.Close()
+			}
+			return nil, fmt.Errorf("could not open tab %d: %w", i, err)
+		}
+		tabs = append(tabs, tab)
+	}
+	poolCtx, cancel := context.WithCancel(context.Background())
+	tp := &TabPool{
+		wd:     wd,
+		opener: opener,
+		jobs:   make(chan *tabTask),
+		ctx:    poolCtx,
+		cancel: cancel,
+	}
+	for i, tab := range tabs {
+		tp.workers.Add(1)
+		go tp.work(i, tab)
+	}
+	return tp, nil
+}
+
+// Submit queues a job, waiting for a free tab if they are all busy. The
+// job's error is sent on the returned channel once it has run.
+func (tp *TabPool) Submit(ctx context.Context, job TabJob) (<-chan error, error) {
+	tp.lock.Lock()
+	if tp.closed {
+		tp.lock.Unlock()
+		return nil, ErrTabPoolClosed
+	}
+	tp.submitting.Add(1)
+	tp.lock.Unlock()
+	defer tp.submitting.Done()
+
+	task := &tabTask{
+		ctx:    ctx,
+		job:    job,
+		result: make(chan error, 1),
+	}
+	select {
+	case tp.jobs <- task:
+		return task.result, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// TabsReplaced returns how many tabs have been replaced after crashing
+func (tp *TabPool) TabsReplaced() int {
+	tp.lock.Lock()
+	defer tp.lock.Unlock()
+	return tp.tabsReplaced
+}
+
+// Close stops accepting jobs, waits for the submitted ones to finish and
+// closes the tabs. If ctx is done first, the running jobs are cancelled,
+// the rest fail with ErrTabPoolClosed and ctx's error is returned.
+func (tp *TabPool) Close(ctx context.Context) error {
+	tp.lock.Lock()
+	if tp.closed {
+		tp.lock.Unlock()
+		return nil
+	}
+	tp.closed = true
+	tp.lock.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		tp.submitting.Wait()
+		close(tp.jobs)
+		tp.workers.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		tp.cancel()
+		return nil
+	case <-ctx.Done():
+		tp.cancel()
+		<-drained
+		return ctx.Err()
+	}
+}
+
+// work runs jobs in one tab until the pool is closed, replacing the tab
+// whenever a failed job leaves it unresponsive
+func (tp *TabPool) work(id int, tab Browser) {
+	defer tp.workers.Done()
+	var err error
+	for task := range tp.jobs {
+		if tp.ctx.Err() != nil {
+			task.result <- ErrTabPoolClosed
+			continue
+		}
+		if tab == nil {
+			if tab, err = tp.opener.NewTab(tp.ctx); err != nil {
+				task.result <- fmt.Errorf("could not reopen tab %d: %w", id, err)
+				tab = nil
+				continue
+			}
+		}
+		err = tp.run(task, tab)
+		if err != nil && !tp.healthy(tab) {
+			tp.wd.log.WithFields(logrus.Fields{
+				"error": err,
+				"tab":   id,
+			}).Warn("Replacing a tab which stopped responding")
+			tab = tp.replace(id, tab)
+		}
+		task.result <- err
+	}
+	if tab != nil {
+		tab.Close()
+	}
+}
+
+// run runs a single job in the tab. The job is cancelled if either its own
+// context or the pool's is done, and a panic is reported as its error.
+func (tp *TabPool) run(task *tabTask, tab Browser) (err error) {
+	jobCtx, cancel := context.WithCancel(task.ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-tp.ctx.Done():
+			cancel()
+		case <-jobCtx.Done():
+		}
+	}()
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("the job panicked: %v", r)
+		}
+	}()
+	return task.job(jobCtx, tp.wd.forTab(tab))
+}
+
+// healthy reports whether the tab still answers
+func (tp *TabPool) healthy(tab Browser) bool {
+	ctx, cancel := context.WithTimeout(tp.ctx, tabHealthTimeout)
+	defer cancel()
+	_, err := tab.Location(ctx)
+	return err == nil
+}
+
+// replace closes a crashed tab and opens a new one in its place. If that
+// fails, nil is returned and the worker tries again with its next job.
+func (tp *TabPool) replace(id int, tab Browser) Browser {
+	if err := tab.Close(); err != nil {
+		tp.wd.log.WithField("error", err).Debug("Could not close the crashed tab")
+	}
+	tp.lock.Lock()
+	tp.tabsReplaced++
+	tp.lock.Unlock()
+	replacement, err := tp.opener.NewTab(tp.ctx)
+	if err != nil {
+		tp.wd.log.WithFields(logrus.Fields{
+			"error": err,
+			"tab":   id,
+		}).Error("Could not open a replacement tab")
+		return nil
+	}
+	return replacement
+}
+
+// forTab returns a web driver with the same settings which drives the tab.
+// A tab cannot be relaunched with a window on its own, so a challenge in it
+// is only announced and waited for.
+func (wd *WebDriver) forTab(tab Browser) *WebDriver {
+	tabDriver := *wd
+	tabDriver.browser = tab
+	tabDriver.headless = false
+	return &tabDriver
+}
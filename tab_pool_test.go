@@ -0,0 +1,162 @@
+package offthegrid
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// crashableTab is an HTMLBrowser tab which can be made to stop responding
+type crashableTab struct {
+	*HTMLBrowser
+	crashed bool
+}
+
+func (ct *crashableTab) Location(ctx context.Context) (string, error) {
+	if ct.crashed {
+		return "", fmt.Errorf("the tab has crashed")
+	}
+	return ct.HTMLBrowser.Location(ctx)
+}
+
+func (ct *crashableTab) NewTab(ctx context.Context) (Browser, error) {
+	tab, err := ct.HTMLBrowser.NewTab(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &crashableTab{HTMLBrowser: tab.(*HTMLBrowser)}, nil
+}
+
+func TestTabPoolRunsJobs(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	wd := NewWebDriverWithBrowser(NewHTMLBrowser(newFakeSearchSite()))
+	pool, err := NewTabPool(ctx, wd, 3)
+	if !assert.NoError(err) {
+		return
+	}
+
+	var lock sync.Mutex
+	headings := map[string]bool{}
+	tabs := map[Browser]bool{}
+	var results []<-chan error
+	for i := 0; i < 10; i++ {
+		url := fmt.Sprintf("https://search.example/people/%d", i)
+		result, err := pool.Submit(ctx, func(ctx context.Context, wd *WebDriver) error {
+			if err := wd.GoToPage(ctx, url); err != nil {
+				return err
+			}
+			heading, err := wd.GetInnerHTMLOfElement(ctx, "h1")
+			lock.Lock()
+			defer lock.Unlock()
+			headings[heading] = true
+			tabs[wd.browser] = true
+			return err
+		})
+		assert.NoError(err)
+		results = append(results, result)
+	}
+	for _, result := range results {
+		assert.NoError(<-result)
+	}
+	assert.NoError(pool.Close(ctx))
+	assert.Len(headings, 10)
+	assert.LessOrEqual(len(tabs), 3)
+	assert.NotContains(tabs, wd.browser, "the pool should not use the driver's own tab")
+
+	_, err = pool.Submit(ctx, func(ctx context.Context, wd *WebDriver) error { return nil })
+	assert.Equal(ErrTabPoolClosed, err)
+}
+
+func TestTabPoolReplacesCrashedTabs(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	wd := NewWebDriverWithBrowser(&crashableTab{HTMLBrowser: NewHTMLBrowser(newFakeSearchSite())})
+	pool, err := NewTabPool(ctx, wd, 1)
+	if !assert.NoError(err) {
+		return
+	}
+
+	result, err := pool.Submit(ctx, func(ctx context.Context, wd *WebDriver) error {
+		wd.browser.(*crashableTab).crashed = true
+		panic("the page killed the renderer")
+	})
+	assert.NoError(err)
+	assert.EqualError(<-result, "the job panicked: the page killed the renderer")
+
+	// A job which fails in a healthy tab keeps it
+	result, _ = pool.Submit(ctx, func(ctx context.Context, wd *WebDriver) error {
+		assert.False(wd.browser.(*crashableTab).crashed)
+		return fmt.Errorf("no results")
+	})
+	assert.Error(<-result)
+	assert.NoError(pool.Close(ctx))
+	assert.Equal(1, pool.TabsReplaced())
+}
+
+func TestTabPoolChallenge(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	site, solve := newFakeChallengeSite()
+	notifier := &solvingNotifier{solve: solve}
+	open := 1
+	browser := &closeTracker{HTMLBrowser: NewHTMLBrowser(site), onClose: func() { open-- }}
+	wd := NewWebDriverWithBrowser(browser)
+	wd.headless = true
+	wd.launch = func(headless bool) (Browser, error) {
+		open++
+		return NewHTMLBrowser(site), nil
+	}
+	wd.ChallengePolicy = &ChallengePolicy{Notifier: notifier, PollInterval: time.Millisecond}
+	pool, err := NewTabPool(ctx, wd, 1)
+	if !assert.NoError(err) {
+		return
+	}
+
+	// The challenge is solved in the pool's tab, which stays in use, rather
+	// than in a second browser
+	result, err := pool.Submit(ctx, func(ctx context.Context, wd *WebDriver) error {
+		notifier.page = wd.browser
+		if err := wd.GoToPage(ctx, "https://people.example/search"); err != nil {
+			return err
+		}
+		results, err := wd.GetInnerHTMLOfElement(ctx, "#results")
+		assert.Equal("Results for visitor 42", results)
+		return err
+	})
+	assert.NoError(err)
+	assert.NoError(<-result)
+	assert.NoError(pool.Close(ctx))
+	assert.Len(notifier.challenges, 1)
+	assert.Equal(1, open)
+	assert.True(wd.headless)
+	assert.NoError(wd.Teardown())
+	assert.Equal(0, open)
+}
+
+func TestTabPoolCloseCancelsJobs(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	wd := NewWebDriverWithBrowser(NewHTMLBrowser(newFakeSearchSite()))
+	pool, err := NewTabPool(ctx, wd, 1)
+	if !assert.NoError(err) {
+		return
+	}
+	started := make(chan struct{})
+	result, err := pool.Submit(ctx, func(ctx context.Context, wd *WebDriver) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	assert.NoError(err)
+	<-started
+
+	expired, cancel := context.WithCancel(ctx)
+	cancel()
+	assert.Equal(context.Canceled, pool.Close(expired))
+	assert.Equal(context.Canceled, <-result)
+}
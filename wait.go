@@ -0,0 +1,234 @@
+package offthegrid
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+// waitPollInterval is how often a condition is checked while waiting for it
+const waitPollInterval = 100 * time.Millisecond
+
+// WaitCondition is something WaitFor can wait for
+type WaitCondition interface {
+	// String describes the condition in errors
+	String() string
+	// Wait blocks until the condition holds or ctx is done
+	Wait(ctx context.Context, browser Browser) error
+}
+
+// ScriptRunner is a Browser which can run javascript in the page
+type ScriptRunner interface {
+	// Evaluate runs the expression and decodes its value into result
+	Evaluate(ctx context.Context, expression string, result interface{}) error
+}
+
+// WaitFor waits for each condition in turn, all within the operation
+// timeout. The error names the condition which was not met, and matches
+// ErrConditionNotMet.
+func (wd *WebDriver) WaitFor(ctx context.Context, conditions ...WaitCondition) error {
+	descriptions := make([]string, len(conditions))
+	for i, condition := range conditions {
+		descriptions[i] = condition.String()
+	}
+	err := wd.do(ctx, "wait", func(ctx context.Context, browser Browser) error {
+		for i, condition := range conditions {
+			if err := condition.Wait(ctx, browser); err != nil {
+				return fmt.Errorf("%s was not met (%d of %d conditions held): %w", condition, i, len(conditions), err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		wd.log.WithField("error", err).Error("Gave up waiting")
+	}
+	return actionError(ErrConditionNotMet, "wait for", strings.Join(descriptions, ", "), err)
+}
+
+// Predicate is a condition which holds once check returns true. Errors from
+// check are taken to mean "not yet"; the last one is reported if the wait
+// times out.
+func Predicate(description string, check func(ctx context.Context, browser Browser) (bool, error)) WaitCondition {
+	return &predicate{description: description, check: check}
+}
+
+// predicate polls its check until it holds
+type predicate struct {
+	description string
+	check       func(ctx context.Context, browser Browser) (bool, error)
+}
+
+func (p *predicate) String() string {
+	return p.description
+}
+
+// Wait polls the check every waitPollInterval
+func (p *predicate) Wait(ctx context.Context, browser Browser) error {
+	ticker := time.NewTicker(waitPollInterval)
+	defer ticker.Stop()
+	var lastErr error
+	for {
+		held, err := p.check(ctx, browser)
+		if err == nil && held {
+			return nil
+		}
+		if err != nil {
+			lastErr = err
+		}
+		select {
+		case <-ctx.Done():
+			if lastErr != nil {
+				return fmt.Errorf("%w (last error: %s)", ctx.Err(), lastErr)
+			}
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// NetworkIdle holds once no requests have been in flight for the quiet period
+func NetworkIdle(quiet time.Duration) WaitCondition {
+	return networkIdle(quiet)
+}
+
+type networkIdle time.Duration
+
+func (ni networkIdle) String() string {
+	return fmt.Sprintf("network idle for %s", time.Duration(ni))
+}
+
+func (ni networkIdle) Wait(ctx context.Context, browser Browser) error {
+	return browser.WaitNetworkIdle(ctx, time.Duration(ni))
+}
+
+// TextAppears holds once the page's text contains text. Runs of whitespace
+// are treated as a single space.
+func TextAppears(text string) WaitCondition {
+	return Predicate(fmt.Sprintf("text %q appears", text), func(ctx context.Context, browser Browser) (bool, error) {
+		return pageContains(ctx, browser, text)
+	})
+}
+
+// TextDisappears holds once the page's text no longer contains text
+func TextDisappears(text string) WaitCondition {
+	return Predicate(fmt.Sprintf("text %q disappears", text), func(ctx context.Context, browser Browser) (bool, error) {
+		found, err := pageContains(ctx, browser, text)
+		return !found && err == nil, err
+	})
+}
+
+// pageContains reports whether the text a visitor could read contains text
+func pageContains(ctx context.Context, browser Browser, text string) (bool, error) {
+	pageHTML, err := browser.OuterHTML(ctx, "html")
+	if err != nil {
+		return false, err
+	}
+	doc, err := html.Parse(strings.NewReader(pageHTML))
+	if err != nil {
+		return false, err
+	}
+	pageText := strings.Join(strings.Fields(visibleText(doc)), " ")
+	return strings.Contains(pageText, strings.Join(strings.Fields(text), " ")), nil
+}
+
+// URLMatches holds once the current URL matches the regular expression. An
+// invalid expression fails the wait straight away.
+func URLMatches(pattern string) WaitCondition {
+	description := fmt.Sprintf("URL matches %q", pattern)
+	urlPattern, err := regexp.Compile(pattern)
+	if err != nil {
+		return failedCondition{description: description, err: err}
+	}
+	return Predicate(description, func(ctx context.Context, browser Browser) (bool, error) {
+		location, err := browser.Location(ctx)
+		return err == nil && urlPattern.MatchString(location), err
+	})
+}
+
+// ElementEnabled holds once the first node matching the selector exists and
+// is neither disabled nor aria-disabled
+func ElementEnabled(selector string) WaitCondition {
+	return Predicate(fmt.Sprintf("%s is enabled", selector), func(ctx context.Context, browser Browser) (bool, error) {
+		nodes, err := browser.Nodes(ctx, selector)
+		if err != nil || len(nodes) == 0 {
+			return false, err
+		}
+		_, disabled := nodes[0].Attributes["disabled"]
+		return !disabled && nodes[0].AttributeValue("aria-disabled") != "true", nil
+	})
+}
+
+// ElementCountStable holds once the number of nodes matching the selector
+// has not changed for the period, such as when a list has finished loading
+func ElementCountStable(selector string, period time.Duration) WaitCondition {
+	return &countStable{selector: selector, period: period}
+}
+
+type countStable struct {
+	selector string
+	period   time.Duration
+}
+
+func (cs *countStable) String() string {
+	return fmt.Sprintf("the number of %s is stable for %s", cs.selector, cs.period)
+}
+
+// Wait counts the nodes every waitPollInterval, starting the period over
+// whenever the count changes
+func (cs *countStable) Wait(ctx context.Context, browser Browser) error {
+	count, since := -1, time.Now()
+	return Predicate(cs.String(), func(ctx context.Context, browser Browser) (bool, error) {
+		nodes, err := browser.Nodes(ctx, cs.selector)
+		if err != nil {
+			return false, err
+		}
+		if len(nodes) != count {
+			count, since = len(nodes), time.Now()
+			return false, nil
+		}
+		return time.Since(since) >= cs.period, nil
+	}).Wait(ctx, browser)
+}
+
+// JSPredicate holds once the javascript expression is truthy in the page.
+// It needs a browser which is a ScriptRunner.
+func JSPredicate(expression string) WaitCondition {
+	return &jsPredicate{expression: expression}
+}
+
+type jsPredicate struct {
+	expression string
+}
+
+func (jp *jsPredicate) String() string {
+	return fmt.Sprintf("javascript %q is true", jp.expression)
+}
+
+func (jp *jsPredicate) Wait(ctx context.Context, browser Browser) error {
+	runner, ok := browser.(ScriptRunner)
+	if !ok {
+		return fmt.Errorf("the browser cannot run javascript")
+	}
+	return Predicate(jp.String(), func(ctx context.Context, browser Browser) (held bool, err error) {
+		err = runner.Evaluate(ctx, "!!("+jp.expression+")", &held)
+		return held, err
+	}).Wait(ctx, browser)
+}
+
+// failedCondition is a condition which could not be built
+type failedCondition struct {
+	description string
+	err         error
+}
+
+func (fc failedCondition) String() string {
+	return fc.description
+}
+
+func (fc failedCondition) Wait(ctx context.Context, browser Browser) error {
+	return fc.err
+}
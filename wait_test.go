@@ -0,0 +1,106 @@
+package offthegrid
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newFakeLoadingSite serves a results page which finishes loading on the
+// third request: the spinner goes, the button is enabled and the results
+// stop growing
+func newFakeLoadingSite() http.Handler {
+	requests := 0
+	mux := http.NewServeMux()
+	mux.HandleFunc("/results", func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		loaded := requests >= 3
+		var sb strings.Builder
+		sb.WriteString(`<html><body>`)
+		if loaded {
+			sb.WriteString(`<button id="next">Next</button><p>All   results loaded</p>`)
+		} else {
+			sb.WriteString(`<button id="next" disabled>Next</button><p>Loading…</p>`)
+		}
+		for i := 0; i < requests && i < 3; i++ {
+			fmt.Fprintf(&sb, `<div class="result">%d</div>`, i)
+		}
+		sb.WriteString(`</body></html>`)
+		w.Write([]byte(sb.String()))
+	})
+	return mux
+}
+
+// livePage reloads its page before every query, so that the page changes
+// while a condition is being waited for the way it does in a real browser
+type livePage struct {
+	*HTMLBrowser
+}
+
+func (lp livePage) Nodes(ctx context.Context, selector string) ([]*Node, error) {
+	if err := lp.HTMLBrowser.Reload(ctx); err != nil {
+		return nil, err
+	}
+	return lp.HTMLBrowser.Nodes(ctx, selector)
+}
+
+func (lp livePage) OuterHTML(ctx context.Context, selector string) (string, error) {
+	if err := lp.HTMLBrowser.Reload(ctx); err != nil {
+		return "", err
+	}
+	return lp.HTMLBrowser.OuterHTML(ctx, selector)
+}
+
+func TestWaitFor(t *testing.T) {
+	for name, condition := range map[string]WaitCondition{
+		"text appears":    TextAppears("All results loaded"),
+		"text disappears": TextDisappears("Loading…"),
+		"enabled":         ElementEnabled("#next"),
+		"count stable":    ElementCountStable(".result", 300*time.Millisecond),
+		"predicate": Predicate("three results", func(ctx context.Context, browser Browser) (bool, error) {
+			nodes, err := browser.Nodes(ctx, ".result")
+			return len(nodes) == 3, err
+		}),
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert := assert.New(t)
+			ctx := context.Background()
+			browser := NewHTMLBrowser(newFakeLoadingSite())
+			assert.NoError(browser.Navigate(ctx, "https://results.example/results"))
+			wd := NewWebDriverWithBrowser(livePage{browser})
+			wd.OperationTimeout = 5 * time.Second
+			assert.NoError(wd.WaitFor(ctx, condition, NetworkIdle(time.Millisecond), URLMatches(`/results$`)))
+			nodes, err := browser.Nodes(ctx, ".result")
+			assert.NoError(err)
+			assert.Len(nodes, 3)
+		})
+	}
+}
+
+func TestWaitForTimesOut(t *testing.T) {
+	assert := assert.New(t)
+	ctx := context.Background()
+	wd := NewWebDriverWithBrowser(NewHTMLBrowser(newFakeLoadingSite()))
+	wd.OperationTimeout = 300 * time.Millisecond
+	assert.NoError(wd.GoToPage(ctx, "https://results.example/results"))
+
+	err := wd.WaitFor(ctx, URLMatches("results"), TextAppears("All results loaded"))
+	assert.True(errors.Is(err, ErrConditionNotMet))
+	assert.True(errors.Is(err, context.DeadlineExceeded))
+	assert.Contains(err.Error(), `text "All results loaded" appears was not met (1 of 2 conditions held)`)
+
+	// Conditions which can never hold fail without waiting
+	started := time.Now()
+	err = wd.WaitFor(ctx, URLMatches("(unclosed"))
+	assert.True(errors.Is(err, ErrConditionNotMet))
+	err = wd.WaitFor(ctx, JSPredicate("document.readyState === 'complete'"))
+	assert.True(errors.Is(err, ErrConditionNotMet))
+	assert.Contains(err.Error(), "cannot run javascript")
+	assert.Less(int64(time.Since(started)), int64(wd.OperationTimeout))
+}